@@ -0,0 +1,362 @@
+// Package acme is a client for the acme text editor's file server.
+//
+// A program manipulates an acme window through a Win, which wraps the files
+// of the window's directory in acme(4): ctl, addr, data, body, event and
+// so on. A program that takes over the events of a window reads them with
+// ReadEvent or EventChan and writes back those it does not handle with
+// WriteEvent, so that acme acts on them in the usual way:
+//
+//	w, err := acme.New()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	w.Name("/tmp/+hello")
+//	w.Fprintf("body", "hello, world\n")
+//	for e := range w.EventChan() {
+//		if e.C2 == 'x' && string(e.Text) == "Hi" {
+//			w.Fprintf("body", "hi\n")
+//			continue
+//		}
+//		w.WriteEvent(e)
+//	}
+//
+// Programs that follow all windows, such as formatters run on Put, read
+// acme's log with a LogReader.
+//
+// The package connects to the acme service posted in the name space
+// directory; see client.Namespace.
+package acme
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+)
+
+var (
+	fsysMu sync.Mutex
+	fsys   *client.Fsys
+
+	// mountService connects to a posted service; tests replace it.
+	mountService = client.MountService
+)
+
+// mount returns the connection to acme, making it if need be.
+func mount() (*client.Fsys, error) {
+	fsysMu.Lock()
+	defer fsysMu.Unlock()
+	if fsys == nil {
+		f, err := mountService("acme")
+		if err != nil {
+			return nil, err
+		}
+		fsys = f
+	}
+	return fsys, nil
+}
+
+// remount replaces the connection old, which has failed, with a new one,
+// unless another caller has done so already.
+func remount(old *client.Fsys) (*client.Fsys, error) {
+	fsysMu.Lock()
+	if fsys == old {
+		fsys = nil
+	}
+	fsysMu.Unlock()
+	return mount()
+}
+
+// A Win is an acme window. Its methods, other than those reading events,
+// are not safe for concurrent use.
+type Win struct {
+	id   int
+	fsys *client.Fsys
+
+	ctl   *client.Fid
+	addr  *client.Fid
+	body  *client.Fid
+	data  *client.Fid
+	event *client.Fid
+	tag   *client.Fid
+	xdata *client.Fid
+	ebuf  *bufio.Reader
+	c     chan *Event
+}
+
+// New creates a new window.
+func New() (*Win, error) {
+	fsys, err := mount()
+	if err != nil {
+		return nil, err
+	}
+	ctl, err := fsys.Open("new/ctl", plan9.ORDWR)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 100)
+	n, err := ctl.Read(buf)
+	if err != nil {
+		ctl.Close()
+		return nil, err
+	}
+	f := strings.Fields(string(buf[:n]))
+	if len(f) == 0 {
+		ctl.Close()
+		return nil, errors.New("acme: short read from new/ctl")
+	}
+	id, err := strconv.Atoi(f[0])
+	if err != nil {
+		ctl.Close()
+		return nil, fmt.Errorf("acme: unexpected window id %q in new/ctl", f[0])
+	}
+	return &Win{id: id, fsys: fsys, ctl: ctl}, nil
+}
+
+// Open connects to the existing window with the given id.
+func Open(id int) (*Win, error) {
+	fsys, err := mount()
+	if err != nil {
+		return nil, err
+	}
+	ctl, err := fsys.Open(fmt.Sprintf("%d/ctl", id), plan9.ORDWR)
+	if err != nil {
+		return nil, err
+	}
+	return &Win{id: id, fsys: fsys, ctl: ctl}, nil
+}
+
+// ID returns the window's id, the name of its directory.
+func (w *Win) ID() int {
+	return w.id
+}
+
+// fid returns the window's open file called name, opening it if need be.
+func (w *Win) fid(name string) (*client.Fid, error) {
+	var f **client.Fid
+	switch name {
+	case "addr":
+		f = &w.addr
+	case "body":
+		f = &w.body
+	case "ctl":
+		f = &w.ctl
+	case "data":
+		f = &w.data
+	case "event":
+		f = &w.event
+	case "tag":
+		f = &w.tag
+	case "xdata":
+		f = &w.xdata
+	default:
+		return nil, fmt.Errorf("acme: unknown window file %q", name)
+	}
+	if *f == nil {
+		fid, err := w.fsys.Open(fmt.Sprintf("%d/%s", w.id, name), plan9.ORDWR)
+		if err != nil {
+			return nil, err
+		}
+		*f = fid
+	}
+	return *f, nil
+}
+
+// CloseFiles closes the window's files. The window stays on the screen.
+func (w *Win) CloseFiles() {
+	for _, f := range []**client.Fid{&w.ctl, &w.addr, &w.body, &w.data, &w.event, &w.tag, &w.xdata} {
+		if *f != nil {
+			(*f).Close()
+			*f = nil
+		}
+	}
+	w.ebuf = nil
+}
+
+// Write writes b to the window's file called name.
+func (w *Win) Write(name string, b []byte) (int, error) {
+	f, err := w.fid(name)
+	if err != nil {
+		return 0, err
+	}
+	return f.Write(b)
+}
+
+// Fprintf formats according to format and writes the result to the
+// window's file called name.
+func (w *Win) Fprintf(name, format string, args ...interface{}) error {
+	_, err := w.Write(name, []byte(fmt.Sprintf(format, args...)))
+	return err
+}
+
+// Read reads from the window's file called name, continuing where the
+// last read left off.
+func (w *Win) Read(name string, b []byte) (int, error) {
+	f, err := w.fid(name)
+	if err != nil {
+		return 0, err
+	}
+	return f.Read(b)
+}
+
+// ReadAll reads the whole of the window's file called name.
+func (w *Win) ReadAll(name string) ([]byte, error) {
+	f, err := w.fid(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+// ReadBody returns the text in the window's body.
+func (w *Win) ReadBody() ([]byte, error) {
+	return w.ReadAll("body")
+}
+
+// Ctl writes a control message, such as "clean" or "dot=addr", to the
+// window. See acme(4).
+func (w *Win) Ctl(format string, args ...interface{}) error {
+	return w.Fprintf("ctl", format+"\n", args...)
+}
+
+// Name sets the window's file name.
+func (w *Win) Name(format string, args ...interface{}) error {
+	return w.Ctl("name "+format, args...)
+}
+
+// Addr sets the window's address, used by the data and xdata files, by
+// writing an address such as "#0,#5" or "/regexp/" to its addr file.
+func (w *Win) Addr(format string, args ...interface{}) error {
+	return w.Fprintf("addr", format, args...)
+}
+
+// ReadAddr returns the window's address as character offsets.
+func (w *Win) ReadAddr() (q0, q1 int, err error) {
+	f, err := w.fid("addr")
+	if err != nil {
+		return 0, 0, err
+	}
+	buf := make([]byte, 40)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	a := strings.Fields(string(buf[:n]))
+	if len(a) < 2 {
+		return 0, 0, errors.New("acme: short read from addr")
+	}
+	q0, err0 := strconv.Atoi(a[0])
+	q1, err1 := strconv.Atoi(a[1])
+	if err0 != nil || err1 != nil {
+		return 0, 0, fmt.Errorf("acme: malformed addr %q", buf[:n])
+	}
+	return q0, q1, nil
+}
+
+// Replace replaces the text at the address addr in the window's body
+// with text.
+func (w *Win) Replace(addr, text string) error {
+	if err := w.Addr("%s", addr); err != nil {
+		return err
+	}
+	_, err := w.Write("data", []byte(text))
+	return err
+}
+
+// Clear deletes the text in the window's body.
+func (w *Win) Clear() error {
+	return w.Replace(",", "")
+}
+
+// Del deletes the window. Unless sure is set, a window with unsaved
+// changes is not deleted, and Del returns an error.
+func (w *Win) Del(sure bool) error {
+	cmd := "del"
+	if sure {
+		cmd = "delete"
+	}
+	err := w.Ctl("%s", cmd)
+	if err == nil {
+		w.CloseFiles()
+	}
+	return err
+}
+
+// A WinInfo describes a window, as listed in acme's index file.
+type WinInfo struct {
+	ID      int
+	TagLen  int // in characters
+	BodyLen int // in characters
+	IsDir   bool
+	Dirty   bool
+	Name    string // the first word of the tag
+	Tag     string // the first line of the tag
+}
+
+// Windows returns the windows open in acme.
+func Windows() ([]WinInfo, error) {
+	fsys, err := mount()
+	if err != nil {
+		return nil, err
+	}
+	fid, err := fsys.Open("index", plan9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	var buf bytes.Buffer
+	if _, err := fid.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return parseIndex(buf.String())
+}
+
+// ctlWidth is the width of the numbers at the start of a line of the
+// index, or of a ctl file: five of them, each of 11 digits and a space.
+const ctlWidth = 5 * 12
+
+// parseIndex parses the contents of acme's index file.
+func parseIndex(s string) ([]WinInfo, error) {
+	var info []WinInfo
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line == "" {
+			continue
+		}
+		if len(line) < ctlWidth || line[len(line)-1] != '\n' {
+			return nil, fmt.Errorf("acme: malformed index line %q", line)
+		}
+		var n [5]int
+		for i, f := range strings.Fields(line[:ctlWidth]) {
+			v, err := strconv.Atoi(f)
+			if err != nil || i >= len(n) {
+				return nil, fmt.Errorf("acme: malformed index line %q", line)
+			}
+			n[i] = v
+		}
+		wi := WinInfo{
+			ID:      n[0],
+			TagLen:  n[1],
+			BodyLen: n[2],
+			IsDir:   n[3] != 0,
+			Dirty:   n[4] != 0,
+			Tag:     line[ctlWidth : len(line)-1],
+		}
+		if f := strings.Fields(wi.Tag); len(f) > 0 {
+			wi.Name = f[0]
+		}
+		info = append(info, wi)
+	}
+	return info, nil
+}
@@ -0,0 +1,229 @@
+package acme
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/plan9test"
+)
+
+// serve makes the package use a test server holding files in place of
+// acme.
+func serve(t *testing.T, files map[string]string) *plan9test.Server {
+	s := plan9test.NewServer(plan9test.NewTree(files))
+	t.Cleanup(s.Close)
+	mountService = func(string) (*client.Fsys, error) {
+		conn, err := s.Dial()
+		if err != nil {
+			return nil, err
+		}
+		return conn.Attach(nil, plan9test.User, "")
+	}
+	fsys = s.Mount(t)
+	return s
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	fid, err := fsys.Open(name, plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+	b, err := io.ReadAll(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWin(t *testing.T) {
+	serve(t, map[string]string{
+		"new/ctl": fmt.Sprintf("%11d %11d %11d %11d %11d ", 3, 0, 0, 0, 0),
+		"3/addr":  "0 5",
+		"3/body":  "hello, world\n",
+		"3/data":  "",
+	})
+	w, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.CloseFiles()
+	if w.ID() != 3 {
+		t.Errorf("ID = %d, want 3", w.ID())
+	}
+	if b, err := w.ReadBody(); err != nil || string(b) != "hello, world\n" {
+		t.Errorf("ReadBody = %q, %v", b, err)
+	}
+	if q0, q1, err := w.ReadAddr(); q0 != 0 || q1 != 5 || err != nil {
+		t.Errorf("ReadAddr = %d, %d, %v; want 0, 5", q0, q1, err)
+	}
+	if err := w.Name("/tmp/+%s", "Errors"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Ctl("clean"); err != nil {
+		t.Fatal(err)
+	}
+	// The window's ctl file is the new/ctl New opened, and the
+	// messages follow what New read.
+	if s := readFile(t, "new/ctl"); !strings.HasSuffix(s, " name /tmp/+Errors\nclean\n") {
+		t.Errorf("ctl got %q", s)
+	}
+	if err := w.Replace("#0,#5", "HELLO"); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, "3/addr"); s != "#0,#5" {
+		t.Errorf("addr got %q", s)
+	}
+	if s := readFile(t, "3/data"); s != "HELLO" {
+		t.Errorf("data got %q", s)
+	}
+	if err := w.Fprintf("index", "x"); err == nil {
+		t.Errorf("write to unknown window file succeeded")
+	}
+}
+
+func TestReadEvent(t *testing.T) {
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'a'
+	}
+	serve(t, map[string]string{
+		"1/ctl":   "",
+		"1/addr":  "",
+		"1/xdata": string(long),
+		"1/event": "MI0 5 0 5 héllo\n" +
+			// A click expanded to a word.
+			"Mx7 7 2 0 \n" +
+			"Mx6 9 0 3 Del\n" +
+			// A selection, which keeps its text.
+			"ML10 14 2 4 abcd\n" +
+			"ML8 16 0 8 abcdefgh\n" +
+			// A chorded execute.
+			"Mx20 23 8 3 Get\n" +
+			"Mx0 0 0 4 file\n" +
+			"Mx0 0 0 12 /tmp/x:#3,#5\n" +
+			// Text too long to send.
+			"MX0 300 0 0 \n" +
+			"KI300 301 0 0 \n",
+	})
+	w, err := Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.CloseFiles()
+	want := []Event{
+		{C1: 'M', C2: 'I', Q0: 0, Q1: 5, OrigQ0: 0, OrigQ1: 5, Nr: 5, Text: []byte("héllo")},
+		{C1: 'M', C2: 'x', Q0: 6, Q1: 9, OrigQ0: 7, OrigQ1: 7, Flag: 2, Nr: 3, Text: []byte("Del")},
+		{C1: 'M', C2: 'L', Q0: 10, Q1: 14, OrigQ0: 10, OrigQ1: 14, Flag: 2, Nr: 4, Text: []byte("abcd")},
+		{C1: 'M', C2: 'x', Q0: 20, Q1: 23, OrigQ0: 20, OrigQ1: 23, Flag: 8, Nr: 3, Text: []byte("Get"), Arg: []byte("file"), Loc: []byte("/tmp/x:#3,#5")},
+		{C1: 'M', C2: 'X', Q0: 0, Q1: 300, OrigQ0: 0, OrigQ1: 300, Nr: 300, Text: long},
+		{C1: 'K', C2: 'I', Q0: 300, Q1: 301, OrigQ0: 300, OrigQ1: 301},
+	}
+	for _, we := range want {
+		e, err := w.ReadEvent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%+q", *e) != fmt.Sprintf("%+q", we) {
+			t.Errorf("ReadEvent = %+q, want %+q", *e, we)
+		}
+	}
+	if s := readFile(t, "1/addr"); s != "#0,#300" {
+		t.Errorf("addr got %q, want #0,#300", s)
+	}
+	if e, err := w.ReadEvent(); err != io.EOF {
+		t.Errorf("ReadEvent at end = %v, %v; want EOF", e, err)
+	}
+}
+
+func TestReadEventErrors(t *testing.T) {
+	for _, ev := range []string{
+		"M",
+		"Mx1 2",
+		"Mx1 2 0 3 ab",
+		"Mx1 a 0 0 \n",
+		"Mx1  2 0 0 \n",
+		"Mx1 2 0 0 x\n",
+		"Mx1 2 0 999 \n",
+		"Mx1 1 2 0 \n",
+		"Mx1 2 8 1 a\nMx0 0 0 1 b\n",
+	} {
+		serve(t, map[string]string{"1/ctl": "", "1/event": ev})
+		w, err := Open(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := w.ReadEvent(); err == nil || err == io.EOF {
+			t.Errorf("ReadEvent of %q = %+q, %v; want error", ev, e, err)
+		}
+		w.CloseFiles()
+	}
+}
+
+func TestEventChan(t *testing.T) {
+	serve(t, map[string]string{
+		"1/ctl":   "",
+		"1/event": "Mx7 7 2 0 \nMx6 9 0 3 Del\nMl1 4 0 3 foo\n",
+	})
+	w, err := Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.CloseFiles()
+	var got []string
+	for e := range w.EventChan() {
+		got = append(got, string(e.Text))
+	}
+	if fmt.Sprint(got) != "[Del foo]" {
+		t.Errorf("EventChan sent %q", got)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	serve(t, map[string]string{"1/ctl": "", "1/event": ""})
+	w, err := Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.CloseFiles()
+	e := &Event{C1: 'M', C2: 'x', Q0: 6, Q1: 9, OrigQ0: 7, OrigQ1: 7, Flag: 2, Text: []byte("Del")}
+	if err := w.WriteEvent(e); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, "1/event"); s != "Mx7 7 \n" {
+		t.Errorf("event got %q", s)
+	}
+}
+
+func TestWindows(t *testing.T) {
+	serve(t, map[string]string{
+		"index": fmt.Sprintf("%11d %11d %11d %11d %11d %s\n", 1, 40, 120, 0, 1, "/tmp/x.go Del Snarf | Look Put") +
+			fmt.Sprintf("%11d %11d %11d %11d %11d %s\n", 2, 30, 0, 1, 0, "/usr/glenda/ Del Snarf Get |"),
+	})
+	ws, err := Windows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WinInfo{
+		{ID: 1, TagLen: 40, BodyLen: 120, Dirty: true, Name: "/tmp/x.go", Tag: "/tmp/x.go Del Snarf | Look Put"},
+		{ID: 2, TagLen: 30, IsDir: true, Name: "/usr/glenda/", Tag: "/usr/glenda/ Del Snarf Get |"},
+	}
+	if fmt.Sprint(ws) != fmt.Sprint(want) {
+		t.Errorf("Windows = %+v, want %+v", ws, want)
+	}
+
+	for _, s := range []string{
+		"1 2 3 4 5 x\n",
+		fmt.Sprintf("%11d %11d %11d %11d %11s x\n", 1, 2, 3, 4, "y"),
+		fmt.Sprintf("%11d %11d %11d %11d %11d x", 1, 2, 3, 4, 5),
+	} {
+		if _, err := parseIndex(s); err == nil {
+			t.Errorf("parseIndex(%q) succeeded", s)
+		}
+	}
+}
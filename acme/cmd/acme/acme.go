@@ -25,6 +25,7 @@ import (
 	"bwsd.dev/plan9/acme/internal/wind"
 
 	"bwsd.dev/plan9/draw"
+	"bwsd.dev/plan9/plumb"
 )
 
 var (
@@ -49,6 +50,7 @@ func main() {
 	ncol := -1
 	loadfile := ""
 	winsize := ""
+	headless := false
 
 	flag.Bool("D", false, "") // ignored
 	flag.BoolVar(&wind.GlobalAutoindent, "a", wind.GlobalAutoindent, "autoindent")
@@ -56,6 +58,7 @@ func main() {
 	flag.IntVar(&ncol, "c", ncol, "set number of `columns`")
 	flag.StringVar(&adraw.FontNames[0], "f", adraw.FontNames[0], "font")
 	flag.StringVar(&adraw.FontNames[1], "F", adraw.FontNames[1], "font")
+	flag.BoolVar(&headless, "headless", headless, "run without a display, drawing in memory")
 	flag.StringVar(&loadfile, "l", loadfile, "loadfile")
 	flag.StringVar(&mtpt, "m", mtpt, "mtpt")
 	flag.BoolVar(&swapscrollbuttons, "r", swapscrollbuttons, "swapscrollbuttons")
@@ -110,7 +113,13 @@ func main() {
 		}
 	*/
 	ch := make(chan error)
-	d, err := draw.Init(ch, adraw.FontNames[0], "acme", winsize)
+	var d *draw.Display
+	var err error
+	if headless {
+		d, err = initHeadless(ch, winsize)
+	} else {
+		d, err = draw.Init(ch, adraw.FontNames[0], "acme", winsize)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -444,10 +453,10 @@ func mousethread() {
 		case pm := <-cplumb:
 			bigLock()
 			if pm.Type == "text" {
-				act := pm.LookupAttr("action")
-				if act == "" || act == "showfile" {
+				act := pm.Action()
+				if act == "" || act == plumb.ActionShowFile {
 					plumblook(pm)
-				} else if act == "showdata" {
+				} else if act == plumb.ActionShowData {
 					plumbshow(pm)
 				}
 			}
@@ -7,6 +7,7 @@ import (
 	"bwsd.dev/plan9"
 	"bwsd.dev/plan9/draw"
 	"bwsd.dev/plan9/plumb"
+	"bwsd.dev/plan9/srv"
 )
 
 const (
@@ -50,12 +51,10 @@ type Dirtab struct {
 
 type Fid struct {
 	fid    int
-	busy   bool
 	open   bool
 	qid    plan9.Qid
 	w      *wind.Window
 	dir    []Dirtab
-	next   *Fid
 	mntdir *base.Mntdir
 	rpart  []byte
 	logoff int64
@@ -63,6 +62,7 @@ type Fid struct {
 
 type Xfid struct {
 	arg   interface{}
+	req   *srv.Req
 	fcall *plan9.Fcall
 	next  *Xfid
 	c     chan func(*Xfid)
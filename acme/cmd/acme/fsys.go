@@ -5,7 +5,6 @@ import (
 	"os"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -15,38 +14,16 @@ import (
 	"bwsd.dev/plan9/acme/internal/wind"
 
 	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/srv"
 )
 
 func QID(w, q int) uint64  { return uint64(w<<8 | q) }
 func WIN(q plan9.Qid) int  { return int(q.Path>>8) & 0xFFFFFF }
 func FILE(q plan9.Qid) int { return int(q.Path & 0xFF) }
 
-var (
-	sfdR, sfdW *os.File
-	fids       [Nhash]*Fid
-	fcall      [plan9.Tmax]func(*Xfid, *Fid) *Xfid
-)
+var sfd *fsyspipe
 
-const (
-	Nhash = 16
-	DEBUG = 0
-)
-
-func initfcall() {
-	fcall[plan9.Tflush] = fsysflush
-	fcall[plan9.Tversion] = fsysversion
-	fcall[plan9.Tauth] = fsysauth
-	fcall[plan9.Tattach] = fsysattach
-	fcall[plan9.Twalk] = fsyswalk
-	fcall[plan9.Topen] = fsysopen
-	fcall[plan9.Tcreate] = fsyscreate
-	fcall[plan9.Tread] = fsysread
-	fcall[plan9.Twrite] = fsyswrite
-	fcall[plan9.Tclunk] = fsysclunk
-	fcall[plan9.Tremove] = fsysremove
-	fcall[plan9.Tstat] = fsysstat
-	fcall[plan9.Twstat] = fsyswstat
-}
+const DEBUG = 0
 
 var (
 	Eperm   string = "permission denied"
@@ -91,13 +68,24 @@ type Mnt struct {
 var mnt Mnt
 
 var (
-	user        string = "Wile E. Coyote"
-	closing     bool
-	messagesize int = 8192 + plan9.IOHDRSZ // good start
+	user    string = "Wile E. Coyote"
+	closing bool
 )
 
+// fsyspipe is acme's end of the pipe to the posted service.
+type fsyspipe struct {
+	r, w *os.File
+}
+
+func (p *fsyspipe) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *fsyspipe) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+func (p *fsyspipe) Close() error {
+	p.w.Close()
+	return p.r.Close()
+}
+
 func fsysinit() {
-	initfcall()
 	r1, w1, err := os.Pipe()
 	if err != nil {
 		util.Fatal("can't create pipe")
@@ -106,60 +94,65 @@ func fsysinit() {
 	if err != nil {
 		util.Fatal("can't create pipe")
 	}
-	sfdR, sfdW = r1, w2
-	if err := post9pservice(r2, w1, "acme", mtpt); err != nil {
-		util.Fatal("can't post service")
-	}
+	sfd = &fsyspipe{r1, w2}
 	u := os.Getenv("USER")
 	if u != "" {
 		user = u
 	}
+	// The server must be running for post9pservice
+	// to negotiate the protocol version with it.
 	go fsysproc()
+	if err := post9pservice(r2, w1, "acme", mtpt); err != nil {
+		util.Fatal("can't post service: " + err.Error())
+	}
 }
 
 func fsysproc() {
-	var x *Xfid
-	for {
-		if x == nil {
-			cxfidalloc <- nil
-			x = <-cxfidalloc
-		}
-		fc, err := plan9.ReadFcall(sfdR)
-		if err != nil {
-			if closing {
-				break
-			}
-			util.Fatal("i/o error on server channel")
-		}
-		if DEBUG != 0 {
-			fmt.Fprintf(os.Stderr, "-> %v\n", fc)
-		}
-		x.fcall = fc
-		if int(x.fcall.Type) >= len(fcall) || fcall[x.fcall.Type] == nil {
-			var t plan9.Fcall
-			x = respond(x, &t, "bad fcall type")
-		} else {
-			var f *Fid
-			var t plan9.Fcall
-			switch x.fcall.Type {
-			case plan9.Tversion, plan9.Tauth, plan9.Tflush:
-				f = nil
-			case plan9.Tattach:
-				f = newfid(int(x.fcall.Fid))
-			default:
-				f = newfid(int(x.fcall.Fid))
-				if !f.busy {
-					x.f = f
-					x = respond(x, &t, "fid not in use")
-					continue
-				}
-			}
-			x.f = f
-			x = fcall[x.fcall.Type](x, f)
-		}
+	s := &srv.Srv{
+		Handler: new(fsys),
+		Chatty:  DEBUG != 0,
+	}
+	s.Serve(sfd)
+	if !closing {
+		util.Fatal("i/o error on server channel")
+	}
+}
+
+// fsys is the srv.Handler for acme's file system.
+// It hands each request to an Xfid, much as the
+// dispatch loop in fsysproc used to.
+type fsys struct {
+	x *Xfid // next Xfid to use
+}
+
+func (fs *fsys) run(r *srv.Req, fn func(*Xfid, *Fid) *Xfid) {
+	if fs.x == nil {
+		cxfidalloc <- nil
+		fs.x = <-cxfidalloc
+	}
+	x := fs.x
+	x.req = r
+	x.fcall = &r.Ifcall
+	x.f = nil
+	if r.Fid != nil {
+		x.f, _ = r.Fid.Aux.(*Fid)
 	}
+	fs.x = fn(x, x.f)
 }
 
+func (fs *fsys) Auth(r *srv.Req)   { fs.run(r, fsysauth) }
+func (fs *fsys) Flush(r *srv.Req)  { fs.run(r, fsysflush) }
+func (fs *fsys) Attach(r *srv.Req) { fs.run(r, fsysattach) }
+func (fs *fsys) Walk(r *srv.Req)   { fs.run(r, fsyswalk) }
+func (fs *fsys) Open(r *srv.Req)   { fs.run(r, fsysopen) }
+func (fs *fsys) Create(r *srv.Req) { fs.run(r, fsyscreate) }
+func (fs *fsys) Read(r *srv.Req)   { fs.run(r, fsysread) }
+func (fs *fsys) Write(r *srv.Req)  { fs.run(r, fsyswrite) }
+func (fs *fsys) Clunk(r *srv.Req)  { fs.run(r, fsysclunk) }
+func (fs *fsys) Remove(r *srv.Req) { fs.run(r, fsysremove) }
+func (fs *fsys) Stat(r *srv.Req)   { fs.run(r, fsysstat) }
+func (fs *fsys) Wstat(r *srv.Req)  { fs.run(r, fsyswstat) }
+
 func fsysaddid(dir []rune, incl [][]rune) *base.Mntdir {
 	mnt.lk.Lock()
 	defer mnt.lk.Unlock()
@@ -229,37 +222,15 @@ func fsysclose() {
 }
 
 func respond(x *Xfid, t *plan9.Fcall, err string) *Xfid {
+	x.req.Ofcall = *t
 	if err != "" {
-		t.Type = plan9.Rerror
-		t.Ename = err
+		x.req.Respond(srv.Error(err))
 	} else {
-		t.Type = x.fcall.Type + 1
-	}
-	t.Fid = x.fcall.Fid
-	t.Tag = x.fcall.Tag
-	if DEBUG != 0 {
-		fmt.Fprintf(os.Stderr, "<- %v\n", t)
-	}
-	if err := plan9.WriteFcall(sfdW, t); err != nil {
-		util.Fatal("write error in respond")
+		x.req.Respond(nil)
 	}
 	return x
 }
 
-func fsysversion(x *Xfid, f *Fid) *Xfid {
-	var t plan9.Fcall
-	if x.fcall.Msize < 256 {
-		return respond(x, &t, "version: message size too small")
-	}
-	messagesize = int(x.fcall.Msize)
-	t.Msize = uint32(messagesize)
-	if !strings.HasPrefix(x.fcall.Version, "9P2000") {
-		return respond(x, &t, "unrecognized 9P version")
-	}
-	t.Version = "9P2000"
-	return respond(x, &t, "")
-}
-
 func fsysauth(x *Xfid, f *Fid) *Xfid {
 	var t plan9.Fcall
 	return respond(x, &t, "acme: authentication not required")
@@ -275,8 +246,10 @@ func fsysattach(x *Xfid, f *Fid) *Xfid {
 	if x.fcall.Uname != user {
 		return respond(x, &t, Eperm)
 	}
-	f.busy = true
-	f.open = false
+	f = new(Fid)
+	f.fid = int(x.fcall.Fid)
+	x.req.Fid.Aux = f
+	x.f = f
 	f.qid.Path = Qdir
 	f.qid.Type = plan9.QTDIR
 	f.qid.Vers = 0
@@ -309,13 +282,9 @@ func fsyswalk(x *Xfid, f *Fid) *Xfid {
 	if f.open {
 		return respond(x, &t, "walk of open file")
 	}
-	if x.fcall.Fid != x.fcall.Newfid {
-		nf = newfid(int(x.fcall.Newfid))
-		if nf.busy {
-			return respond(x, &t, "newfid already in use")
-		}
-		nf.busy = true
-		nf.open = false
+	if x.req.Newfid != x.req.Fid {
+		nf = new(Fid)
+		nf.fid = int(x.fcall.Newfid)
 		nf.mntdir = f.mntdir
 		if f.mntdir != nil {
 			f.mntdir.Ref++
@@ -435,10 +404,12 @@ func fsyswalk(x *Xfid, f *Fid) *Xfid {
 
 	if err != "" || len(t.Wqid) < len(x.fcall.Wname) {
 		if nf != nil {
-			nf.busy = false
 			fsysdelid(nf.mntdir)
 		}
 	} else if len(t.Wqid) == len(x.fcall.Wname) {
+		if nf != nil {
+			x.req.Newfid.Aux = nf
+		}
 		if w != nil {
 			f.w = w
 			w = nil // don't drop the reference
@@ -502,12 +473,8 @@ func fsysread(x *Xfid, f *Fid) *Xfid {
 			respond(x, &t, "")
 			return x
 		}
-		o := int64(x.fcall.Offset)
-		e := int64(x.fcall.Offset) + int64(x.fcall.Count)
 		clock := getclock()
-		b := make([]byte, messagesize)
 		id := WIN(f.qid)
-		n := 0
 		var d []Dirtab
 		if id > 0 {
 			d = dirtabw[:]
@@ -515,65 +482,39 @@ func fsysread(x *Xfid, f *Fid) *Xfid {
 			d = dirtab[:]
 		}
 		d = d[1:] // first entry is '.'
-		var w int
-		var i int
-		for i = 0; len(d) > 0 && int64(i) < e; i += w {
-			buf, err := dostat(WIN(x.f.qid), &d[0], clock)
-			if err != nil {
-				break
-			}
-			if n+len(buf) > int(x.fcall.Count) {
-				break
-			}
-			copy(b[n:], buf)
-			w = len(buf)
-			if w <= 2 {
-				break
-			}
-			if int64(i) >= o {
-				n += w
-			}
-			d = d[1:]
-		}
+		var ids []int
 		if id == 0 {
 			wind.TheRow.Lk.Lock()
-			nids := 0
-			var ids []int
-			var j int
-			var k int
-			for j = 0; j < len(wind.TheRow.Col); j++ {
-				c := wind.TheRow.Col[j]
-				for k = 0; k < len(c.W); k++ {
-					ids = append(ids, c.W[k].ID)
+			for _, c := range wind.TheRow.Col {
+				for _, w := range c.W {
+					ids = append(ids, w.ID)
 				}
 			}
 			wind.TheRow.Lk.Unlock()
 			sort.Ints(ids)
-			j = 0
-			var dt Dirtab
-			var nn int
-			for ; j < nids && int64(i) < e; i += nn {
-				k = ids[j]
-				dt.name = fmt.Sprintf("%d", k)
-				dt.qid = int(QID(k, Qdir)) // TODO(rsc)
-				dt.typ = plan9.QTDIR
-				dt.perm = plan9.DMDIR | 0o700
-				buf, err := dostat(k, &dt, clock)
-				if err != nil || len(b) > int(x.fcall.Count)-n {
-					break
-				}
-				copy(b[n:], buf)
-				nn = len(buf)
-				if int64(i) >= o {
-					n += nn
-				}
-				j++
+		}
+		err := srv.DirRead(x.req, func(i int) (*plan9.Dir, bool) {
+			if i < len(d) {
+				return dirstat(id, &d[i], clock), true
 			}
+			i -= len(d)
+			if i >= len(ids) {
+				return nil, false
+			}
+			k := ids[i]
+			dt := Dirtab{
+				name: fmt.Sprintf("%d", k),
+				qid:  Qdir,
+				typ:  plan9.QTDIR,
+				perm: plan9.DMDIR | 0o700,
+			}
+			return dirstat(k, &dt, clock), true
+		})
+		if err != nil {
+			return respond(x, &t, err.Error())
 		}
-		t.Data = b[:n]
-		t.Count = uint32(n)
-		respond(x, &t, "")
-		return x
+		t.Data = x.req.Ofcall.Data
+		return respond(x, &t, "")
 	}
 	x.c <- xfidread
 	return nil
@@ -591,8 +532,10 @@ func fsysclunk(x *Xfid, f *Fid) *Xfid {
 }
 
 func fsysremove(x *Xfid, f *Fid) *Xfid {
-	var t plan9.Fcall
-	return respond(x, &t, Eperm)
+	// The fid is clunked even though the remove fails.
+	fsysdelid(f.mntdir)
+	x.c <- xfidremove
+	return nil
 }
 
 func fsysstat(x *Xfid, f *Fid) *Xfid {
@@ -602,9 +545,6 @@ func fsysstat(x *Xfid, f *Fid) *Xfid {
 	if err != nil {
 		return respond(x, &t, err.Error())
 	}
-	if len(t.Stat) > messagesize-plan9.IOHDRSZ {
-		return respond(x, &t, "stat too long")
-	}
 	return respond(x, &t, "")
 }
 
@@ -613,33 +553,11 @@ func fsyswstat(x *Xfid, f *Fid) *Xfid {
 	return respond(x, &t, Eperm)
 }
 
-func newfid(fid int) *Fid {
-	var ff *Fid
-	fh := &fids[fid&(Nhash-1)]
-	var f *Fid
-	for f = *fh; f != nil; f = f.next {
-		if f.fid == fid {
-			return f
-		} else if ff == nil && !f.busy {
-			ff = f
-		}
-	}
-	if ff != nil {
-		ff.fid = fid
-		return ff
-	}
-	f = new(Fid)
-	f.fid = fid
-	f.next = *fh
-	*fh = f
-	return f
-}
-
 func getclock() int {
 	return int(time.Now().Unix())
 }
 
-func dostat(id int, dir *Dirtab, clock int) ([]byte, error) {
+func dirstat(id int, dir *Dirtab, clock int) *plan9.Dir {
 	var d plan9.Dir
 	d.Qid.Path = QID(id, dir.qid)
 	d.Qid.Vers = 0
@@ -652,5 +570,9 @@ func dostat(id int, dir *Dirtab, clock int) ([]byte, error) {
 	d.Muid = user
 	d.Atime = uint32(clock)
 	d.Mtime = uint32(clock)
-	return d.Bytes()
+	return &d
+}
+
+func dostat(id int, dir *Dirtab, clock int) ([]byte, error) {
+	return dirstat(id, dir, clock).Bytes()
 }
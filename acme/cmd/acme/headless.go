@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"bwsd.dev/plan9/acme/internal/adraw"
+	"bwsd.dev/plan9/draw"
+	"bwsd.dev/plan9/draw/devdraw"
+)
+
+// initHeadless connects to a draw server running inside acme, which keeps
+// the window in memory, so that acme runs without a display: its files,
+// Edit commands, Get, Put and the log all work as usual. If the font cannot
+// be found, as where plan9port is not installed, the built-in font is used.
+func initHeadless(ch chan error, winsize string) (*draw.Display, error) {
+	font := adraw.FontNames[0]
+	if _, err := (*draw.Display)(nil).OpenFont(font); err != nil {
+		log.Printf("%v; using built-in font", err)
+		font = ""
+		os.Unsetenv("font")
+	}
+	d, err := draw.InitConn(devdraw.New().Dial(), ch, font, "acme", winsize)
+	if err != nil {
+		return nil, err
+	}
+	if font == "" {
+		adraw.FontNames[0] = d.Font.Name
+	}
+	return d, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"bwsd.dev/plan9/acme"
+)
+
+// startHeadless builds acme and runs it with -headless, posting its
+// service in a name space directory of the test's own.
+func startHeadless(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs acme")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "acme")
+	if out, err := exec.Command(gobin, "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building acme: %v\n%s", err, out)
+	}
+
+	ns := filepath.Join(dir, "ns")
+	t.Setenv("NAMESPACE", ns)
+	if os.Getenv("USER") == "" {
+		t.Setenv("USER", "test")
+	}
+	cmd := exec.Command(bin, "-headless")
+	cmd.Dir = dir
+	if testing.Verbose() {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	waitFor(t, "acme to post its service", func() bool {
+		_, err := os.Stat(filepath.Join(ns, "acme"))
+		return err == nil
+	})
+}
+
+// waitFor calls cond until it reports true, failing the test if that
+// takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestHeadless(t *testing.T) {
+	startHeadless(t)
+
+	file := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(file, []byte("hello\nworld\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w, err := acme.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.CloseFiles()
+	if err := w.Name(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Ctl("get"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := w.ReadBody(); err != nil || string(b) != "hello\nworld\n" {
+		t.Fatalf("body after get = %q, %v", b, err)
+	}
+
+	// Type an Edit command in the tag and execute it.
+	tag, err := w.ReadAll("tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := "Edit ,s/world/there/"
+	if _, err := w.Write("tag", []byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	q0 := utf8.RuneCount(tag)
+	e := &acme.Event{C1: 'M', C2: 'x', OrigQ0: q0, OrigQ1: q0 + len(cmd)}
+	if err := w.WriteEvent(e); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "Edit to change the body", func() bool {
+		b, err := w.ReadBody()
+		return err == nil && string(b) == "hello\nthere\n"
+	})
+
+	if err := w.Ctl("put"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "hello\nthere\n" {
+		t.Errorf("file after put = %q, %v", b, err)
+	}
+	if err := w.Del(true); err != nil {
+		t.Error(err)
+	}
+}
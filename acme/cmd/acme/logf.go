@@ -11,6 +11,11 @@ import (
 	"bwsd.dev/plan9"
 )
 
+// maxLog is the most entries the log holds for readers that have not read
+// them. When a reader falls further behind, its oldest unread entries are
+// dropped, and its next read returns "0 missed n", saying how many.
+const maxLog = 4096
+
 type Log struct {
 	lk    sync.Mutex
 	r     sync.Cond
@@ -81,9 +86,15 @@ func xfidlogread(x *Xfid) {
 		return
 	}
 
-	i = int(x.f.logoff - eventlog.start)
-	p := eventlog.ev[i]
-	x.f.logoff++
+	var p string
+	if x.f.logoff < eventlog.start {
+		p = fmt.Sprintf("0 missed %d\n", eventlog.start-x.f.logoff)
+		x.f.logoff = eventlog.start
+	} else {
+		i = int(x.f.logoff - eventlog.start)
+		p = eventlog.ev[i]
+		x.f.logoff++
+	}
 	eventlog.lk.Unlock()
 
 	var fc plan9.Fcall
@@ -126,6 +137,9 @@ func xfidlogflush(x *Xfid) {
  *
  * op == "del" for deleted window
  *	- called from winclose
+ *
+ * op == "focus" for window given the keyboard focus
+ *	- called from mousethread
  */
 func xfidlog(w *wind.Window, op string) {
 	bigUnlock()
@@ -146,7 +160,14 @@ func xfidlog(w *wind.Window, op string) {
 			eventlog.start += int64(n)
 		}
 
-		// Otherwise grow (in append below).
+		// Otherwise grow (in append below),
+		// unless a reader has fallen too far behind.
+		if len(eventlog.ev) >= maxLog {
+			n := len(eventlog.ev) - maxLog + 1
+			copy(eventlog.ev, eventlog.ev[n:])
+			eventlog.ev = eventlog.ev[:len(eventlog.ev)-n]
+			eventlog.start += int64(n)
+		}
 	}
 
 	f := w.Body.File
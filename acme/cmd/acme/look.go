@@ -1,9 +1,8 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"time"
 
 	"bwsd.dev/plan9/acme/internal/adraw"
 	"bwsd.dev/plan9/acme/internal/alog"
@@ -12,65 +11,18 @@ import (
 	"bwsd.dev/plan9/acme/internal/ui"
 	"bwsd.dev/plan9/acme/internal/wind"
 
-	"bwsd.dev/plan9"
-	"bwsd.dev/plan9/client"
 	"bwsd.dev/plan9/plumb"
 )
 
-var plumbeditfid *client.Fid
-
 var nuntitled int
 
 func plumbthread() {
 	/*
-	 * Loop so that if plumber is restarted, acme need not be.
+	 * Listen reconnects if the plumber is restarted,
+	 * so acme need not be.
 	 */
-	for {
-		/*
-		 * Connect to plumber.
-		 */
-		// TODO(rsc): plumbunmount()
-		var fid *client.Fid
-		for {
-			var err error
-			fid, err = plumb.Open("edit", plan9.OREAD|plan9.OCEXEC)
-			if err == nil {
-				break
-			}
-			time.Sleep(2 * time.Second)
-		}
-		big.Lock() // TODO still racy
-		plumbeditfid = fid
-		ui.Plumbsendfid, _ = plumb.Open("send", plan9.OWRITE|plan9.OCEXEC)
-		big.Unlock()
-
-		/*
-		 * Relay messages.
-		 */
-		bedit := bufio.NewReader(fid)
-		for {
-			m := new(plumb.Message)
-			err := m.Recv(bedit)
-			if err != nil {
-				break
-			}
-			cplumb <- m
-		}
-
-		/*
-		 * Lost connection.
-		 */
-		big.Lock() // TODO still racy
-		fid = ui.Plumbsendfid
-		ui.Plumbsendfid = nil
-		big.Unlock()
-		fid.Close()
-
-		big.Lock() // TODO still racy
-		fid = plumbeditfid
-		plumbeditfid = nil
-		big.Unlock()
-		fid.Close()
+	for m := range plumb.Listen(context.Background(), "edit") {
+		cplumb <- m
 	}
 }
 
@@ -103,7 +55,7 @@ func plumblook(m *plumb.Message) {
 	e.Jump = true
 	e.A0 = 0
 	e.A1 = 0
-	addr := m.LookupAttr("addr")
+	addr := m.Addr()
 	if addr != "" {
 		r := []rune(addr)
 		e.A1 = len(r)
@@ -2,47 +2,52 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"net"
 	"os"
-	"os/exec"
-	"strings"
 
 	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/srv"
 )
 
 var chattyfuse int
 
+// post9pservice serves the 9P conversation on rfd and wfd to clients of the
+// service name, which is a network address or the name of a socket in the
+// name space directory, as 9pserve(4) would.
 func post9pservice(rfd, wfd *os.File, name, mtpt string) error {
 	if name == "" && mtpt == "" {
 		rfd.Close()
 		wfd.Close()
 		return fmt.Errorf("nothing to do")
 	}
+	if mtpt != "" {
+		// Mounting needs FUSE, which this port does not have.
+		rfd.Close()
+		wfd.Close()
+		return fmt.Errorf("cannot mount on %s: mounting not supported", mtpt)
+	}
 
-	if name != "" {
-		var addr string
-		if strings.Contains(addr, "!") { // assume is already network address
-			addr = name
-		} else {
-			addr = "unix!" + client.Namespace() + "/" + name
-		}
-		cmd := exec.Command("9pserve", "-u", addr)
-		cmd.Stdin = rfd
-		cmd.Stdout = wfd
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		if err != nil {
-			return err
-		}
-		if mtpt != "" {
-			// reopen
-			// TODO: implement this
-			log.Fatalf("post9pservice mount not implemented")
-		}
+	// Without a default network, only a full address or a path name
+	// parses; anything else names a service.
+	var l net.Listener
+	var err error
+	if _, perr := client.ParseDialString(name, "", ""); perr == nil {
+		l, err = client.Announce(name)
+	} else {
+		l, err = client.ListenService(name)
 	}
-	if mtpt != "" {
-		// TODO: implement this
-		log.Fatalf("post9pservice mount not implemented")
+	if err != nil {
+		rfd.Close()
+		wfd.Close()
+		return err
+	}
+	p := &fsyspipe{rfd, wfd}
+	m, err := srv.NewMux(p)
+	if err != nil {
+		p.Close()
+		l.Close()
+		return err
 	}
+	go m.Serve(l)
 	return nil
 }
@@ -193,21 +193,31 @@ func xfidopen(x *Xfid) {
 		}
 	}
 	fc.Qid = x.f.qid
-	fc.Iounit = uint32(messagesize - plan9.IOHDRSZ)
+	fc.Iounit = x.req.Msize() - plan9.IOHDRSZ
 	x.f.open = true
 	respond(x, &fc, "")
 }
 
 func xfidclose(x *Xfid) {
+	xfidclunk(x)
+	var fc plan9.Fcall
+	respond(x, &fc, "")
+}
+
+func xfidremove(x *Xfid) {
+	xfidclunk(x)
+	var fc plan9.Fcall
+	respond(x, &fc, Eperm)
+}
+
+// xfidclunk releases the resources held by x.f.
+func xfidclunk(x *Xfid) {
 	w := x.f.w
-	x.f.busy = false
 	x.f.w = nil
-	var fc plan9.Fcall
 	if !x.f.open {
 		if w != nil {
 			wind.Winclose(w)
 		}
-		respond(x, &fc, "")
 		return
 	}
 
@@ -264,7 +274,6 @@ func xfidclose(x *Xfid) {
 			editpkg.Editoutlk.Unlock()
 		}
 	}
-	respond(x, &fc, "")
 }
 
 func xfidread(x *Xfid) {
@@ -0,0 +1,204 @@
+package acme
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// An Event is a user action in a window, as reported by its event file.
+// See acme(4).
+type Event struct {
+	// C1 says where the action came from: E for a write to the body
+	// or tag file, F for other file actions, K for the keyboard and M
+	// for the mouse. C2 says what it was: D or d for text deleted from
+	// the body or tag, I or i for text inserted, L or l for a button 3
+	// click (look) and X or x for a button 2 click (execute). Upper
+	// case is for the body, lower case for the tag.
+	C1, C2 rune
+
+	// Q0 and Q1 are the character offsets of the text acted on. If the
+	// user clicked in an empty selection, acme expands it to the word
+	// or file name around the click; Q0 and Q1 are then those of the
+	// expansion, while OrigQ0 and OrigQ1 keep those of the click.
+	Q0, Q1         int
+	OrigQ0, OrigQ1 int
+
+	// Flag holds the flag bits of the event: for an execute, 1 if the
+	// command is built in, 2 if the click was expanded and 8 if it has
+	// a chorded argument; for a look, 1 if acme can interpret the text
+	// itself, 2 if expanded and 4 if it is a file or window name.
+	Flag int
+
+	// Nr is the number of characters in Text as sent by acme. Acme
+	// leaves out long text, which ReadEvent then reads from the
+	// window's xdata file.
+	Nr   int
+	Text []byte
+
+	// Arg and Loc are the chorded argument of an execute, if Flag has
+	// the 8 bit, and the file and address it came from.
+	Arg []byte
+	Loc []byte
+}
+
+// eventSize is the most characters of text acme includes in an event.
+const eventSize = 256
+
+// ReadEvent reads the next event from the window. Once a program opens
+// the event file, acme passes it the clicks in the window instead of
+// acting on them itself, and the program must write back with
+// WriteEvent those it wants acme to handle.
+func (w *Win) ReadEvent() (*Event, error) {
+	if w.ebuf == nil {
+		f, err := w.fid("event")
+		if err != nil {
+			return nil, err
+		}
+		w.ebuf = bufio.NewReader(f)
+	}
+	e, err := readEvent(w.ebuf)
+	if err != nil {
+		return nil, err
+	}
+	e.OrigQ0, e.OrigQ1 = e.Q0, e.Q1
+
+	// An expansion follows; use it if the click was in an empty
+	// selection.
+	if e.Flag&2 != 0 {
+		e2, err := readEvent(w.ebuf)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if e.Q0 == e.Q1 {
+			e.Q0, e.Q1 = e2.Q0, e2.Q1
+			e.Nr, e.Text = e2.Nr, e2.Text
+		}
+	}
+
+	// A chorded argument follows, then its location.
+	if e.Flag&8 != 0 {
+		arg, err := readEvent(w.ebuf)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		loc, err := readEvent(w.ebuf)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		e.Arg, e.Loc = arg.Text, loc.Text
+	}
+
+	// The text was too long to send.
+	if e.Nr == 0 && e.Q0 < e.Q1 && isClick(e.C2) {
+		if err := w.Addr("#%d,#%d", e.Q0, e.Q1); err != nil {
+			return nil, err
+		}
+		text, err := w.ReadAll("xdata")
+		if err != nil {
+			return nil, err
+		}
+		e.Text = text
+		e.Nr = utf8.RuneCount(text)
+	}
+	return e, nil
+}
+
+// isClick reports whether c is the type of an execute or look event.
+func isClick(c rune) bool {
+	switch c {
+	case 'x', 'X', 'l', 'L':
+		return true
+	}
+	return false
+}
+
+// EventChan returns a channel on which the window's events are sent, as
+// read by ReadEvent. The channel is closed when reading fails, as when
+// the window is deleted.
+func (w *Win) EventChan() <-chan *Event {
+	if w.c == nil {
+		w.c = make(chan *Event)
+		go func() {
+			defer close(w.c)
+			for {
+				e, err := w.ReadEvent()
+				if err != nil {
+					return
+				}
+				w.c <- e
+			}
+		}()
+	}
+	return w.c
+}
+
+// WriteEvent hands e back to acme, which acts on it as it would have had
+// the program not been reading the window's events. Only execute and look
+// events can be written back.
+func (w *Win) WriteEvent(e *Event) error {
+	return w.Fprintf("event", "%c%c%d %d \n", e.C1, e.C2, e.OrigQ0, e.OrigQ1)
+}
+
+// readEvent reads a single event message: the two characters C1 and C2,
+// the numbers Q0, Q1, Flag and Nr each followed by a space, Nr characters
+// of text and a newline.
+func readEvent(r *bufio.Reader) (*Event, error) {
+	e := new(Event)
+	var err error
+	if e.C1, _, err = r.ReadRune(); err != nil {
+		return nil, err
+	}
+	if e.C2, _, err = r.ReadRune(); err != nil {
+		return nil, unexpected(err)
+	}
+	for _, p := range []*int{&e.Q0, &e.Q1, &e.Flag, &e.Nr} {
+		if *p, err = readNum(r); err != nil {
+			return nil, err
+		}
+	}
+	if e.Nr > eventSize {
+		return nil, fmt.Errorf("acme: event text of %d characters", e.Nr)
+	}
+	for i := 0; i < e.Nr; i++ {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		e.Text = utf8.AppendRune(e.Text, c)
+	}
+	if c, err := r.ReadByte(); err != nil {
+		return nil, unexpected(err)
+	} else if c != '\n' {
+		return nil, fmt.Errorf("acme: malformed event: %q after text", c)
+	}
+	return e, nil
+}
+
+// readNum reads a decimal number followed by a space.
+func readNum(r *bufio.Reader) (int, error) {
+	n, digits := 0, 0
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, unexpected(err)
+		}
+		if c == ' ' && digits > 0 {
+			return n, nil
+		}
+		if c < '0' || '9' < c || digits > 10 {
+			return 0, fmt.Errorf("acme: malformed event: %q in number", c)
+		}
+		n = n*10 + int(c-'0')
+		digits++
+	}
+}
+
+// unexpected turns io.EOF within an event into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -13,7 +13,6 @@ import (
 	"bwsd.dev/plan9/acme/internal/util"
 	"bwsd.dev/plan9/acme/internal/wind"
 
-	"bwsd.dev/plan9/client"
 	"bwsd.dev/plan9/draw"
 	"bwsd.dev/plan9/plumb"
 )
@@ -87,46 +86,44 @@ func Look3(t *wind.Text, q0, q1 int, external bool) {
 		}
 		return
 	}
-	if Plumbsendfid != nil {
-		// send whitespace-delimited word to plumber
-		m := new(plumb.Message)
-		m.Src = "acme"
-		dir := wind.Dirname(t, nil)
-		if len(dir) == 1 && dir[0] == '.' { // sigh
-			dir = nil
-		}
-		if len(dir) == 0 {
-			m.Dir = Wdir
+	// send whitespace-delimited word to plumber, if it is running
+	m := new(plumb.Message)
+	m.Src = "acme"
+	dir := wind.Dirname(t, nil)
+	if len(dir) == 1 && dir[0] == '.' { // sigh
+		dir = nil
+	}
+	if len(dir) == 0 {
+		m.Dir = Wdir
+	} else {
+		m.Dir = string(dir)
+	}
+	m.Type = "text"
+	if q1 == q0 {
+		if t.Q1 > t.Q0 && t.Q0 <= q0 && q0 <= t.Q1 {
+			q0 = t.Q0
+			q1 = t.Q1
 		} else {
-			m.Dir = string(dir)
-		}
-		m.Type = "text"
-		if q1 == q0 {
-			if t.Q1 > t.Q0 && t.Q0 <= q0 && q0 <= t.Q1 {
-				q0 = t.Q0
-				q1 = t.Q1
-			} else {
-				p := q0
-				for q0 > 0 && func() bool { c = tgetc(t, q0-1); return c != ' ' }() && c != '\t' && c != '\n' {
-					q0--
-				}
-				for q1 < t.Len() && func() bool { c = tgetc(t, q1); return c != ' ' }() && c != '\t' && c != '\n' {
-					q1++
-				}
-				if q1 == q0 {
-					return
-				}
-				m.Attr = &plumb.Attribute{Name: "click", Value: fmt.Sprint(p - q0)}
+			p := q0
+			for q0 > 0 && func() bool { c = tgetc(t, q0-1); return c != ' ' }() && c != '\t' && c != '\n' {
+				q0--
 			}
+			for q1 < t.Len() && func() bool { c = tgetc(t, q1); return c != ' ' }() && c != '\t' && c != '\n' {
+				q1++
+			}
+			if q1 == q0 {
+				return
+			}
+			m.SetClick(p - q0)
 		}
-		r = make([]rune, q1-q0)
-		t.File.Read(q0, r)
-		m.Data = []byte(string(r))
-		if len(m.Data) < 7*1024 && m.Send(Plumbsendfid) == nil {
-			return
-		}
-		// plumber failed to match; fall through
 	}
+	r = make([]rune, q1-q0)
+	t.File.Read(q0, r)
+	m.Data = []byte(string(r))
+	if len(m.Data) < 7*1024 && plumb.Send(m) == nil {
+		return
+	}
+	// plumber failed to match or is not running; fall through
 
 	// interpret alphanumeric string ourselves
 	if !expanded {
@@ -526,8 +523,6 @@ func tgetc(a interface{}, n int) rune {
 
 var Ismtpt func(string) bool
 
-var Plumbsendfid *client.Fid
-
 var Wdir = "."
 
 var Objtype string
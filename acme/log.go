@@ -0,0 +1,133 @@
+package acme
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+)
+
+// A LogEvent is an entry in acme's log file, which records what happens
+// to windows as a whole.
+type LogEvent struct {
+	ID   int    // the window's id
+	Op   string // "new", "zerox", "get", "put", "del", "focus" or "missed"
+	Name string // the window's file name
+
+	// Missed is, for an Op of "missed", the number of entries the
+	// reader lost, or -1 if the number is not known. Acme drops
+	// entries for a reader that falls too far behind, and any made
+	// while a LogReader is reconnecting are lost.
+	Missed int
+}
+
+// A LogReader reads acme's log, reconnecting to acme if the connection
+// fails, as when acme is restarted.
+type LogReader struct {
+	fsys *client.Fsys
+	f    *client.Fid
+	r    *bufio.Reader
+}
+
+// reconnectTimeout is how long a LogReader tries to reconnect.
+var reconnectTimeout = time.Minute
+
+// Log opens acme's log.
+func Log() (*LogReader, error) {
+	fsys, err := mount()
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.Open("log", plan9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	return &LogReader{fsys: fsys, f: f, r: bufio.NewReader(f)}, nil
+}
+
+// Read returns the next entry in the log, waiting for one if need be. If
+// reading fails, Read reconnects and returns an entry with Op "missed"
+// standing for those made meanwhile. It returns an error only if it
+// cannot reconnect, after trying for a minute, or if an entry is
+// malformed.
+func (r *LogReader) Read() (LogEvent, error) {
+	if r.f == nil {
+		return LogEvent{}, errors.New("acme: read of closed log")
+	}
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		if err := r.reconnect(); err != nil {
+			return LogEvent{}, err
+		}
+		return LogEvent{Op: "missed", Missed: -1}, nil
+	}
+	return parseLog(line)
+}
+
+// reconnect reopens the log, connecting to acme anew if need be.
+func (r *LogReader) reconnect() error {
+	r.f.Close()
+	r.f = nil
+	delay := 10 * time.Millisecond
+	deadline := time.Now().Add(reconnectTimeout)
+	for {
+		f, err := r.fsys.Open("log", plan9.OREAD)
+		if err != nil {
+			var fsys *client.Fsys
+			if fsys, err = remount(r.fsys); err == nil {
+				r.fsys = fsys
+				f, err = fsys.Open("log", plan9.OREAD)
+			}
+		}
+		if err == nil {
+			r.f, r.r = f, bufio.NewReader(f)
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("acme: reconnecting to log: %v", err)
+		}
+		time.Sleep(delay)
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// Close closes the log. It must not be called during a Read.
+func (r *LogReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// parseLog parses a line of the log: the window id, the operation and the
+// window's name, which may contain spaces.
+func parseLog(line string) (LogEvent, error) {
+	f := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+	if len(f) < 2 {
+		return LogEvent{}, fmt.Errorf("acme: malformed log entry %q", line)
+	}
+	id, err := strconv.Atoi(f[0])
+	if err != nil {
+		return LogEvent{}, fmt.Errorf("acme: malformed log entry %q", line)
+	}
+	e := LogEvent{ID: id, Op: f[1]}
+	if len(f) == 3 {
+		e.Name = f[2]
+	}
+	if e.Op == "missed" {
+		if e.Missed, err = strconv.Atoi(e.Name); err != nil {
+			return LogEvent{}, fmt.Errorf("acme: malformed log entry %q", line)
+		}
+		e.Name = ""
+	}
+	return e, nil
+}
@@ -0,0 +1,73 @@
+package acme
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9/client"
+)
+
+func TestLogReader(t *testing.T) {
+	s := serve(t, map[string]string{
+		"log": "1 new /tmp/x.go\n2 put /usr/glenda/My Documents/a\n0 missed 12\n",
+	})
+	r, err := Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, want := range []LogEvent{
+		{ID: 1, Op: "new", Name: "/tmp/x.go"},
+		{ID: 2, Op: "put", Name: "/usr/glenda/My Documents/a"},
+		{Op: "missed", Missed: 12},
+	} {
+		if e, err := r.Read(); e != want || err != nil {
+			t.Errorf("Read = %+v, %v; want %+v", e, err, want)
+		}
+	}
+
+	// Acme goes away and comes back.
+	s.Close()
+	serve(t, map[string]string{"log": "3 del \n"})
+	for _, want := range []LogEvent{
+		{Op: "missed", Missed: -1},
+		{ID: 3, Op: "del"},
+	} {
+		if e, err := r.Read(); e != want || err != nil {
+			t.Errorf("Read after restart = %+v, %v; want %+v", e, err, want)
+		}
+	}
+}
+
+func TestLogReaderTimeout(t *testing.T) {
+	s := serve(t, map[string]string{"log": ""})
+	r, err := Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer func(d time.Duration) { reconnectTimeout = d }(reconnectTimeout)
+	reconnectTimeout = 50 * time.Millisecond
+	s.Close()
+	mountService = func(string) (*client.Fsys, error) {
+		return nil, errors.New("no acme")
+	}
+	if e, err := r.Read(); err == nil {
+		t.Errorf("Read with acme gone = %+v, want error", e)
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"1\n",
+		"x new /tmp/x\n",
+		"0 missed\n",
+		"0 missed many\n",
+	} {
+		if e, err := parseLog(line); err == nil {
+			t.Errorf("parseLog(%q) = %+v, want error", line, e)
+		}
+	}
+}
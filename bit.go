@@ -8,19 +8,6 @@ sequences in little-endian byte order.
 // FIXME(bwsd): bounds checking elimination is not performed.
 // See: golang.org/issue/14808
 
-// gbit8 decodes a uint8 from b and returns that value and the remaining slice
-// of b.
-func gbit8(b []byte) (uint8, []byte) {
-	return uint8(b[0]), b[1:]
-}
-
-// gbit16 decodes a uint16 from b and returns that value and the remaining slice
-// of b.
-func gbit16(b []byte) (uint16, []byte) {
-	// _ = b[1] compiler BCE hint; see: golang.org/issue/14808
-	return uint16(b[0]) | uint16(b[1])<<8, b[2:]
-}
-
 // gbit32 decodes a uint32 from from b and returns that value and the remaining
 // slice of b.
 func gbit32(b []byte) (uint32, []byte) {
@@ -28,21 +15,6 @@ func gbit32(b []byte) (uint32, []byte) {
 	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24, b[4:]
 }
 
-// gbit64 decodes a uint64 from b and returns that value and and the remaining
-// slice of b.
-func gbit64(b []byte) (uint64, []byte) {
-	lo, b := gbit32(b)
-	hi, b := gbit32(b)
-	return uint64(hi)<<32 | uint64(lo), b
-}
-
-// gstring reads a string from b, prefixed with a 16-bit length. It returns the
-// string and the remaining slice of b.
-func gstring(b []byte) (string, []byte) {
-	n, b := gbit16(b)
-	return string(b[0:n]), b[n:]
-}
-
 // pbit8 encodes a uint8 x into b and returns the remaining slice of b.
 func pbit8(b []byte, x uint8) []byte {
 	n := len(b)
@@ -102,6 +74,94 @@ func pstring(b []byte, s string) []byte {
 		panic(ProtocolError("string too long"))
 	}
 	b = pbit16(b, uint16(len(s)))
-	b = append(b, []byte(s)...)
+	b = append(b, s...)
 	return b
 }
+
+// An unpacker decodes the fields of a message in order, checking each
+// against the end of the buffer instead of relying on the run-time bounds
+// checks. Once a field does not fit, the unpacker is bad and every later
+// field decodes as zero, so that a decoder need check only at the end.
+type unpacker struct {
+	b    []byte
+	off  int // offset of the next field
+	bad  bool
+	fail int // offset of the field that did not fit
+}
+
+// next returns the next n bytes of u.b, or nil if there are not n bytes.
+func (u *unpacker) next(n int) []byte {
+	if u.bad || n < 0 || len(u.b)-u.off < n {
+		u.setBad()
+		return nil
+	}
+	p := u.b[u.off : u.off+n : u.off+n]
+	u.off += n
+	return p
+}
+
+// setBad marks u bad, recording the offset of the first field to fail.
+func (u *unpacker) setBad() {
+	if !u.bad {
+		u.bad = true
+		u.fail = u.off
+	}
+}
+
+// check returns nil if u decoded all of u.b, or else why it did not and
+// the offset at which it went wrong.
+func (u *unpacker) check() (off int, err error) {
+	switch {
+	case u.bad:
+		return u.fail, errTruncated
+	case !u.empty():
+		return u.off, errTrailing
+	}
+	return 0, nil
+}
+
+// empty reports whether u has no more bytes to decode.
+func (u *unpacker) empty() bool {
+	return u.off == len(u.b)
+}
+
+func (u *unpacker) bit8() uint8 {
+	if p := u.next(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+func (u *unpacker) bit16() uint16 {
+	if p := u.next(2); p != nil {
+		return uint16(p[0]) | uint16(p[1])<<8
+	}
+	return 0
+}
+
+func (u *unpacker) bit32() uint32 {
+	if p := u.next(4); p != nil {
+		return uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16 | uint32(p[3])<<24
+	}
+	return 0
+}
+
+func (u *unpacker) bit64() uint64 {
+	lo := u.bit32()
+	hi := u.bit32()
+	return uint64(hi)<<32 | uint64(lo)
+}
+
+// string decodes a string prefixed with a 16-bit length.
+func (u *unpacker) string() string {
+	return string(u.next(int(u.bit16())))
+}
+
+// data returns the next n bytes, which are not copied.
+func (u *unpacker) data(n uint32) []byte {
+	if uint64(n) > uint64(len(u.b)-u.off) {
+		u.setBad()
+		return nil
+	}
+	return u.next(int(n))
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// An Authenticator runs the client side of an authentication protocol
+// over an auth fid, proving the user's identity to the server before
+// Attach. See attach(5).
+type Authenticator interface {
+	// Proto returns the protocol's name, as offered in p9any negotiation.
+	Proto() string
+
+	// Authenticate runs the protocol on rw, the auth fid, for user.
+	Authenticate(rw io.ReadWriter, user string) error
+}
+
+// DefaultAuthenticator, if not nil, is used by Mount, MountService and
+// MountServiceAname to authenticate to servers that require it.
+var DefaultAuthenticator Authenticator
+
+// AttachAuth is like Attach but first uses a to authenticate user to the
+// server. If a is nil or the server answers the Tauth with an error, as
+// servers that require no authentication do, AttachAuth attaches without.
+func (c *Conn) AttachAuth(a Authenticator, user, aname string) (*Fsys, error) {
+	if a == nil {
+		return c.Attach(nil, user, aname)
+	}
+	afid, err := c.Auth(user, aname)
+	var rerr Error
+	var uerr *UnixError
+	if errors.As(err, &rerr) || errors.As(err, &uerr) {
+		return c.Attach(nil, user, aname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer afid.Close()
+	if err := a.Authenticate(afid, user); err != nil {
+		return nil, fmt.Errorf("auth %s: %w", a.Proto(), err)
+	}
+	return c.Attach(afid, user, aname)
+}
+
+// None is an Authenticator for servers that accept an auth fid without any
+// conversation, typically to attach as the user "none".
+var None Authenticator = none{}
+
+type none struct{}
+
+func (none) Proto() string                            { return "none" }
+func (none) Authenticate(io.ReadWriter, string) error { return nil }
+
+// P9any returns an Authenticator that negotiates with the server which of
+// the protocols in auths to run, preferring them in order. The server
+// offers its protocols first. See authsrv(6).
+func P9any(auths ...Authenticator) Authenticator {
+	return p9any(auths)
+}
+
+type p9any []Authenticator
+
+func (p9any) Proto() string { return "p9any" }
+
+func (p p9any) Authenticate(rw io.ReadWriter, user string) error {
+	s, err := readString(rw)
+	if err != nil {
+		return err
+	}
+	v2 := strings.HasPrefix(s, "v.2 ")
+	if v2 {
+		s = s[4:]
+	}
+	offer := make(map[string]string) // proto -> dom
+	for _, f := range strings.Fields(s) {
+		proto, dom, _ := strings.Cut(f, "@")
+		if _, ok := offer[proto]; !ok {
+			offer[proto] = dom
+		}
+	}
+	for _, a := range p {
+		dom, ok := offer[a.Proto()]
+		if !ok {
+			continue
+		}
+		if _, err := io.WriteString(rw, a.Proto()+" "+dom+"\x00"); err != nil {
+			return err
+		}
+		if v2 {
+			if s, err := readString(rw); err != nil {
+				return err
+			} else if s != "OK" {
+				return fmt.Errorf("p9any: server said %q", s)
+			}
+		}
+		return a.Authenticate(rw, user)
+	}
+	return fmt.Errorf("p9any: no common protocol in %q", s)
+}
+
+// readString reads a NUL-terminated string from r, an auth fid. Servers
+// such as factotum answer each read with one whole message and refuse
+// reads too small to hold it, so readString asks for as much as a 9P
+// message can carry and drops anything after the NUL.
+func readString(r io.Reader) (string, error) {
+	buf := make([]byte, DefaultMsize)
+	var s []byte
+	for len(s) < 4096 {
+		n, err := r.Read(buf)
+		if i := bytes.IndexByte(buf[:n], 0); i >= 0 {
+			return string(append(s, buf[:i]...)), nil
+		}
+		s = append(s, buf[:n]...)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	}
+	return "", errors.New("string too long")
+}
+
+// SecretLen is the length of the challenges in the shared-secret protocol.
+const SecretLen = 32
+
+// SharedSecret returns an Authenticator for the protocol "secret", in which
+// client and server prove to each other that they know key:
+//
+//	S→C: sc
+//	C→S: cc, HMAC(key, "client" sc cc)
+//	S→C: HMAC(key, "server" cc sc)
+//
+// sc and cc are random challenges of SecretLen bytes, and HMAC is
+// HMAC-SHA256.
+func SharedSecret(key []byte) Authenticator {
+	return secret(key)
+}
+
+type secret []byte
+
+func (secret) Proto() string { return "secret" }
+
+func (key secret) Authenticate(rw io.ReadWriter, user string) error {
+	sc := make([]byte, SecretLen)
+	if _, err := io.ReadFull(rw, sc); err != nil {
+		return err
+	}
+	cc := make([]byte, SecretLen)
+	if _, err := rand.Read(cc); err != nil {
+		return err
+	}
+	msg := append(cc, SecretMAC(key, "client", sc, cc)...)
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(rw, mac); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, SecretMAC(key, "server", cc, sc)) {
+		return errors.New("server does not know the secret")
+	}
+	return nil
+}
+
+// SecretMAC returns HMAC-SHA256(key, role a b), as used by the server side
+// of the SharedSecret protocol.
+func SecretMAC(key []byte, role string, a, b []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(role))
+	m.Write(a)
+	m.Write(b)
+	return m.Sum(nil)
+}
@@ -0,0 +1,352 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/srv"
+)
+
+// authTree is a srv.Tree that requires the shared-secret protocol or
+// p9sk1, offered through p9any, before Attach.
+type authTree struct {
+	*srv.Tree
+	key  []byte // for the shared-secret protocol
+	skey []byte // the server's DES key, for p9sk1
+}
+
+// authConv is the server's side of the conversation on an auth fid. Like
+// factotum, the server answers each read with one whole message, refusing
+// reads too small to hold it.
+type authConv struct {
+	c2s  *io.PipeReader
+	cw   *io.PipeWriter
+	s2c  chan []byte
+	mu   sync.Mutex
+	next []byte // message refused as too large for the last read
+	done chan error
+}
+
+// send sends a message to the client.
+func (a *authConv) send(b []byte) {
+	a.s2c <- b
+}
+
+func (t *authTree) Auth(r *srv.Req) {
+	a := &authConv{s2c: make(chan []byte, 1), done: make(chan error, 1)}
+	a.c2s, a.cw = io.Pipe()
+	go func() {
+		err := t.converse(a)
+		a.done <- err
+		if err == nil {
+			err = io.EOF
+		}
+		a.c2s.CloseWithError(err)
+		close(a.s2c)
+	}()
+	r.Afid.Aux = a
+	r.Ofcall.Aqid = plan9.Qid{Type: plan9.QTAUTH}
+	r.Respond(nil)
+}
+
+func (t *authTree) converse(a *authConv) error {
+	a.send([]byte("v.2 none@local secret@local p9sk1@local\x00"))
+	s, err := readString(a.c2s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "secret local":
+		a.send([]byte("OK\x00"))
+		return t.secret(a)
+	case "p9sk1 local":
+		a.send([]byte("OK\x00"))
+		return t.p9sk1(a)
+	}
+	return errors.New("bad protocol " + s)
+}
+
+func (t *authTree) secret(a *authConv) error {
+	sc := make([]byte, SecretLen)
+	rand.Read(sc)
+	a.send(sc)
+	msg := make([]byte, SecretLen+32)
+	if _, err := io.ReadFull(a.c2s, msg); err != nil {
+		return err
+	}
+	cc := msg[:SecretLen]
+	if !hmac.Equal(msg[SecretLen:], SecretMAC(t.key, "client", sc, cc)) {
+		return errors.New("authentication failed")
+	}
+	a.send(SecretMAC(t.key, "server", cc, sc))
+	return nil
+}
+
+func (t *authTree) p9sk1(a *authConv) error {
+	var cchal [CHALLEN]byte
+	if _, err := io.ReadFull(a.c2s, cchal[:]); err != nil {
+		return err
+	}
+	tr := Ticketreq{Type: AuthTreq, AuthID: "glenda", AuthDom: "local"}
+	rand.Read(tr.Chal[:])
+	a.send(tr.Marshal())
+	msg := make([]byte, TICKETLEN+AUTHENTLEN)
+	if _, err := io.ReadFull(a.c2s, msg); err != nil {
+		return err
+	}
+	tk, err := decryptTicket(t.skey, msg[:TICKETLEN])
+	if err != nil {
+		return err
+	}
+	if tk.num != AuthTs || tk.chal != tr.Chal {
+		return errors.New("bad ticket")
+	}
+	if auth := decryptAuthenticator(tk.key[:], msg[TICKETLEN:]); auth != (authenticator{AuthAc, tr.Chal, 0}) {
+		return errors.New("bad authenticator")
+	}
+	a.send(encryptAuthenticator(tk.key[:], authenticator{AuthAs, cchal, 0}))
+	return nil
+}
+
+func (t *authTree) Attach(r *srv.Req) {
+	if r.Afid == nil {
+		r.Respond(errors.New("authentication required"))
+		return
+	}
+	a := r.Afid.Aux.(*authConv)
+	select {
+	case err := <-a.done:
+		a.done <- err
+		if err != nil {
+			r.Respond(err)
+			return
+		}
+	default:
+		r.Respond(errors.New("authentication incomplete"))
+		return
+	}
+	t.Tree.Attach(r)
+}
+
+func (t *authTree) Read(r *srv.Req) {
+	a, ok := r.Fid.Aux.(*authConv)
+	if !ok {
+		t.Tree.Read(r)
+		return
+	}
+	go func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.next == nil {
+			a.next = <-a.s2c
+		}
+		if int(r.Ifcall.Count) < len(a.next) {
+			r.Respond(fmt.Errorf("toosmall %d", len(a.next)))
+			return
+		}
+		r.Ofcall.Data, a.next = a.next, nil
+		r.Respond(nil)
+	}()
+}
+
+func (t *authTree) Write(r *srv.Req) {
+	a, ok := r.Fid.Aux.(*authConv)
+	if !ok {
+		t.Tree.Write(r)
+		return
+	}
+	go func() {
+		n, err := a.cw.Write(r.Ifcall.Data)
+		r.Ofcall.Count = uint32(n)
+		r.Respond(err)
+	}()
+}
+
+func TestAttachAuth(t *testing.T) {
+	tree := &authTree{Tree: srv.NewTree("glenda", "glenda", 0o555), key: []byte("sesame")}
+	dial := func() *Conn {
+		c1, c2 := net.Pipe()
+		go srv.Serve(c1, tree)
+		conn, err := NewConn(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	if _, err := dial().Attach(nil, "glenda", ""); err == nil {
+		t.Errorf("attached without authentication")
+	}
+	fsys, err := dial().AttachAuth(P9any(SharedSecret([]byte("sesame")), None), "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/"); err != nil {
+		t.Error(err)
+	}
+	_, err = dial().AttachAuth(P9any(SharedSecret([]byte("open sesame"))), "glenda", "")
+	if err == nil {
+		t.Errorf("authenticated with the wrong key")
+	}
+	_, err = dial().AttachAuth(failAuth{}, "glenda", "")
+	if !errors.Is(err, errFail) {
+		t.Errorf("failed authentication returned %v, want %v", err, errFail)
+	}
+	_, err = dial().AttachAuth(P9any(), "glenda", "")
+	if err == nil || !strings.Contains(err.Error(), "no common protocol") {
+		t.Errorf("negotiated without protocols: %v", err)
+	}
+}
+
+func TestAttachAuthNotRequired(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, srv.NewTree("glenda", "glenda", 0o555))
+	conn, err := NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.AttachAuth(SharedSecret([]byte("sesame")), "glenda", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var errFail = errors.New("failed")
+
+// failAuth is an Authenticator that always fails.
+type failAuth struct{}
+
+func (failAuth) Proto() string                                    { return "fail" }
+func (failAuth) Authenticate(rw io.ReadWriter, user string) error { return errFail }
+
+// keyServer stands in for an authentication server that knows the keys of
+// its users.
+type keyServer map[string][]byte
+
+func (ks keyServer) Tickets(tr *Ticketreq) (cticket, sticket []byte, err error) {
+	ckey, ok := ks[tr.HostID]
+	if !ok {
+		return nil, nil, fmt.Errorf("no key for %s", tr.HostID)
+	}
+	skey, ok := ks[tr.AuthID]
+	if !ok {
+		return nil, nil, fmt.Errorf("no key for %s", tr.AuthID)
+	}
+	t := ticket{num: AuthTc, chal: tr.Chal, cuid: tr.HostID, suid: tr.UID}
+	rand.Read(t.key[:])
+	cticket = encryptTicket(ckey, &t)
+	t.num = AuthTs
+	return cticket, encryptTicket(skey, &t), nil
+}
+
+// serve answers ticket requests on l as an authentication server would.
+func (ks keyServer) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, TICKREQLEN)
+		var tr Ticketreq
+		if _, err := io.ReadFull(c, buf); err == nil && tr.Unmarshal(buf) == nil {
+			if ct, st, err := ks.Tickets(&tr); err != nil {
+				c.Write(putName([]byte{AuthErr}, err.Error(), AERRLEN))
+			} else {
+				c.Write(append(append([]byte{AuthOK}, ct...), st...))
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestP9sk1(t *testing.T) {
+	ks := keyServer{"glenda": PassToKey("password"), "rob": PassToKey("a much longer password")}
+	tree := &authTree{Tree: srv.NewTree("glenda", "glenda", 0o555), skey: ks["glenda"]}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ks.serve(l)
+	as := AuthServer("tcp!" + strings.Replace(l.Addr().String(), ":", "!", 1))
+	attach := func(a Authenticator, user string) error {
+		c1, c2 := net.Pipe()
+		go srv.Serve(c1, tree)
+		conn, err := NewConn(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.AttachAuth(P9any(a), user, "")
+		return err
+	}
+
+	for _, tt := range []struct {
+		user, password string
+		tickets        TicketSource
+		ok             bool
+	}{
+		{"glenda", "password", ks, true},
+		{"rob", "a much longer password", ks, true},
+		{"rob", "a much longer password", as, true},
+		{"rob", "a much longer passwore", as, false},
+		{"rob", "password", ks, false},
+		{"ken", "password", as, false},
+	} {
+		err := attach(P9sk1(PassToKey(tt.password), tt.tickets), tt.user)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s with %q via %T: %v", tt.user, tt.password, tt.tickets, err)
+		}
+	}
+
+	// A server that does not know its key cannot answer.
+	tree.skey = PassToKey("wrong")
+	if err := attach(P9sk1(ks["glenda"], ks), "glenda"); err == nil {
+		t.Errorf("authenticated to a server with the wrong key")
+	}
+}
+
+func TestPassToKey(t *testing.T) {
+	seen := make(map[string]string)
+	for _, p := range []string{"", "a", "password", "passwore", "12345678", "123456789", strings.Repeat("x", ANAMELEN-1)} {
+		k := PassToKey(p)
+		if len(k) != DESKEYLEN {
+			t.Fatalf("PassToKey(%q) has %d bytes", p, len(k))
+		}
+		if q, ok := seen[string(k)]; ok {
+			t.Errorf("PassToKey(%q) = PassToKey(%q)", p, q)
+		}
+		seen[string(k)] = p
+	}
+	// Only the first ANAMELEN-1 bytes count.
+	if !bytes.Equal(PassToKey(strings.Repeat("x", 40)), PassToKey(strings.Repeat("x", ANAMELEN-1))) {
+		t.Errorf("PassToKey uses more than %d bytes", ANAMELEN-1)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	key := PassToKey("password")
+	for _, n := range []int{8, 13, 15, TICKETLEN, TICKREQLEN} {
+		b := make([]byte, n)
+		rand.Read(b)
+		c := append([]byte(nil), b...)
+		encrypt(key, c)
+		if bytes.Equal(b, c) {
+			t.Errorf("encrypt left %d bytes unchanged", n)
+		}
+		decrypt(key, c)
+		if !bytes.Equal(b, c) {
+			t.Errorf("decrypt did not undo encrypt of %d bytes", n)
+		}
+	}
+}
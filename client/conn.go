@@ -1,10 +1,14 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	"bwsd.dev/plan9"
 )
@@ -13,6 +17,34 @@ type Error string
 
 func (e Error) Error() string { return string(e) }
 
+// Is reports whether e is one of the io/fs errors, judging by the
+// conventional Plan 9 error strings, so that errors.Is(err,
+// fs.ErrNotExist) and the like work.
+func (e Error) Is(target error) bool {
+	s := string(e)
+	switch target {
+	case fs.ErrNotExist:
+		return strings.Contains(s, "does not exist") || strings.Contains(s, "not found")
+	case fs.ErrExist:
+		return strings.Contains(s, "already exists") || strings.HasSuffix(s, "file exists")
+	case fs.ErrPermission:
+		return strings.Contains(s, "permission denied")
+	}
+	return false
+}
+
+// A UnixError is an error reported by a 9P2000.u or 9P2000.L server along
+// with its Unix error number. Unwrap returns the number, so that
+// errors.Is(err, fs.ErrNotExist) and the like work.
+type UnixError struct {
+	Ename string
+	Errno syscall.Errno
+}
+
+func (e *UnixError) Error() string { return e.Ename }
+
+func (e *UnixError) Unwrap() error { return e.Errno }
+
 type Conn struct {
 	// We wrap the underlying conn type so that
 	// there's a clear distinction between Close,
@@ -74,58 +106,159 @@ type conn struct {
 	rwc      io.ReadWriteCloser
 	err      error
 	tagmap   map[uint16]chan *plan9.Fcall
+	written  map[uint16]bool // tags whose requests have been sent
 	freetag  map[uint16]bool
+	flushing map[uint16]bool // flushed tags awaiting Rflush
 	freefid  map[uint32]bool
 	nexttag  uint16
 	nextfid  uint32
 	msize    uint32
+	pipeline int // requests kept outstanding by StreamTo and StreamFrom
 	version  string
+	dialect  plan9.Dialect
 	w, x     sync.Mutex
 	muxer    bool
 	refCount int32 // atomic
 }
 
+// DefaultMsize is the message size requested by NewConn.
+const DefaultMsize = 131072
+
+// DefaultPipeline is the number of reads or writes Fid.StreamTo,
+// Fid.StreamFrom and CopyFile keep outstanding, unless ConnOptions says
+// otherwise.
+const DefaultPipeline = 8
+
+// ConnOptions controls the version negotiation done by NewConnOptions.
+type ConnOptions struct {
+	// Msize is the largest message the client is prepared to handle.
+	// If zero, DefaultMsize is used.
+	Msize uint32
+
+	// Versions lists the protocol versions the client is willing to
+	// speak, most preferred first. If empty, only plan9.VERSION9P is
+	// offered.
+	Versions []string
+
+	// Pipeline is the number of requests Fid.StreamTo, Fid.StreamFrom
+	// and CopyFile keep outstanding. If zero, DefaultPipeline is used;
+	// 1 disables pipelining.
+	Pipeline int
+}
+
+// NewConn establishes a 9P2000 session on rwc.
 func NewConn(rwc io.ReadWriteCloser) (*Conn, error) {
+	return NewConnOptions(rwc, nil)
+}
+
+// NewConnOptions establishes a 9P session on rwc, negotiating the protocol
+// version and message size according to opts, which may be nil.
+//
+// The versions in opts.Versions are offered in turn. The server may answer
+// with a version other than the one offered, typically by dropping a
+// dialect suffix ("9P2000.L" becomes "9P2000"); the answer is accepted if it
+// appears anywhere in opts.Versions. Otherwise, or if the server does not
+// know the version offered, the next one is tried.
+//
+// See: version(5)
+func NewConnOptions(rwc io.ReadWriteCloser, opts *ConnOptions) (*Conn, error) {
+	msize := uint32(DefaultMsize)
+	versions := []string{plan9.VERSION9P}
+	pipeline := DefaultPipeline
+	if opts != nil {
+		if opts.Pipeline > 0 {
+			pipeline = opts.Pipeline
+		}
+		if opts.Msize != 0 {
+			msize = opts.Msize
+		}
+		if len(opts.Versions) > 0 {
+			versions = opts.Versions
+		}
+	}
 	c := &conn{
 		rwc:      rwc,
 		tagmap:   make(map[uint16]chan *plan9.Fcall),
+		written:  make(map[uint16]bool),
 		freetag:  make(map[uint16]bool),
+		flushing: make(map[uint16]bool),
 		freefid:  make(map[uint32]bool),
 		nexttag:  1,
 		nextfid:  1,
-		msize:    131072,
-		version:  plan9.VERSION9P,
+		pipeline: pipeline,
 		refCount: 1,
 	}
-
-	//	XXX raw messages, not c.rpc
-	tx := &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: c.msize, Version: c.version}
-	err := c.write(tx)
-	if err != nil {
-		return nil, err
-	}
-	rx, err := c.read()
-	if err != nil {
+	if err := c.negotiate(msize, versions); err != nil {
 		return nil, err
 	}
+	return &Conn{
+		_c: c,
+	}, nil
+}
 
-	// TODO(bwsd): implement protocol version negotiation according to spec.
-	// See: 9pclient(3)
-
-	if rx.Type != plan9.Rversion || rx.Tag != plan9.NOTAG {
-		return nil, plan9.ProtocolError(fmt.Sprintf("invalid type/tag in Tversion exchange: %v %v", rx.Type, rx.Tag))
+// negotiate exchanges Tversion and Rversion messages until the client and
+// server agree on one of versions.
+func (c *conn) negotiate(msize uint32, versions []string) error {
+	var reply string
+	for _, v := range versions {
+		//	XXX raw messages, not c.rpc
+		tx := &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: v}
+		err := c.write(tx)
+		if err != nil {
+			return err
+		}
+		rx, err := c.read()
+		if err != nil {
+			return err
+		}
+		if rx.Tag != plan9.NOTAG {
+			return plan9.ProtocolError(fmt.Sprintf("invalid tag in Tversion exchange: %v", rx.Tag))
+		}
+		switch rx.Type {
+		default:
+			return plan9.ProtocolError(fmt.Sprintf("invalid type in Tversion exchange: %v", rx.Type))
+		case plan9.Rerror:
+			// Some servers reject versions they
+			// don't know instead of saying "unknown".
+			reply = rx.Ename
+			continue
+		case plan9.Rversion:
+		}
+		if rx.Msize > msize {
+			return plan9.ProtocolError(fmt.Sprintf("invalid msize %d in Rversion", rx.Msize))
+		}
+		if rx.Msize <= plan9.IOHDRSZ {
+			return plan9.ProtocolError(fmt.Sprintf("msize %d too small in Rversion", rx.Msize))
+		}
+		reply = rx.Version
+		for _, ok := range versions {
+			if rx.Version == ok {
+				c.msize = rx.Msize
+				c.version = rx.Version
+				c.dialect = plan9.DialectOf(rx.Version)
+				return nil
+			}
+		}
 	}
+	return plan9.ProtocolError(fmt.Sprintf("no common version: offered %v, server said %q", versions, reply))
+}
 
-	if rx.Msize > c.msize {
-		return nil, plan9.ProtocolError(fmt.Sprintf("invalid msize %d in Rversion", rx.Msize))
+// Version returns the protocol version negotiated for the connection.
+func (c *Conn) Version() string {
+	conn, err := c.conn()
+	if err != nil {
+		return ""
 	}
-	c.msize = rx.Msize
-	if rx.Version != plan9.VERSION9P {
-		return nil, plan9.ProtocolError(fmt.Sprintf("invalid version %s in Rversion", rx.Version))
+	return conn.version
+}
+
+// Msize returns the maximum message size negotiated for the connection.
+func (c *Conn) Msize() uint32 {
+	conn, err := c.conn()
+	if err != nil {
+		return 0
 	}
-	return &Conn{
-		_c: c,
-	}, nil
+	return conn.msize
 }
 
 func (c *conn) newFid(fid uint32, qid plan9.Qid) *Fid {
@@ -161,6 +294,10 @@ func (c *conn) putfidnum(fid uint32) {
 func (c *conn) newtag(ch chan *plan9.Fcall) (uint16, error) {
 	c.x.Lock()
 	defer c.x.Unlock()
+	return c.newtagLocked(ch)
+}
+
+func (c *conn) newtagLocked(ch chan *plan9.Fcall) (uint16, error) {
 	var tagnum uint16
 	for tagnum = range c.freetag {
 		delete(c.freetag, tagnum)
@@ -173,11 +310,26 @@ func (c *conn) newtag(ch chan *plan9.Fcall) (uint16, error) {
 	c.nexttag++
 found:
 	c.tagmap[tagnum] = ch
+	return tagnum, nil
+}
+
+// sent records that the request with the given tag has been written,
+// making it eligible for the job of reading the connection, and gives it
+// the job if no one has it. A request must not be given the job before it
+// is written: on a connection without buffering, such as a net.Pipe, the
+// server may be unable to read the request until a reply is read.
+func (c *conn) sent(tag uint16, ch chan *plan9.Fcall) {
+	c.x.Lock()
+	defer c.x.Unlock()
+	if c.tagmap[tag] != ch {
+		// Already answered.
+		return
+	}
+	c.written[tag] = true
 	if !c.muxer {
 		c.muxer = true
 		ch <- &yourTurn
 	}
-	return tagnum, nil
 }
 
 func (c *conn) puttag(tag uint16) chan *plan9.Fcall {
@@ -185,6 +337,7 @@ func (c *conn) puttag(tag uint16) chan *plan9.Fcall {
 	defer c.x.Unlock()
 	ch := c.tagmap[tag]
 	delete(c.tagmap, tag)
+	delete(c.written, tag)
 	c.freetag[tag] = true
 	return ch
 }
@@ -195,21 +348,36 @@ func (c *conn) mux(rx *plan9.Fcall) {
 
 	ch := c.tagmap[rx.Tag]
 	delete(c.tagmap, rx.Tag)
-	c.freetag[rx.Tag] = true
+	delete(c.written, rx.Tag)
+	if ch != nil && !c.flushing[rx.Tag] {
+		c.freetag[rx.Tag] = true
+	}
+	// Deliver rx before passing the turn, so that a request
+	// given the turn can see whether its Rflush has arrived.
+	if ch != nil {
+		ch <- rx
+	}
+	c.passTurn()
+}
+
+// passTurn hands the job of reading the connection to one of the
+// outstanding requests. It is called with c.x held.
+func (c *conn) passTurn() {
 	c.muxer = false
-	for _, ch2 := range c.tagmap {
-		c.muxer = true
-		ch2 <- &yourTurn
-		break
+	for tag, ch := range c.tagmap {
+		if c.written[tag] {
+			c.muxer = true
+			ch <- &yourTurn
+			break
+		}
 	}
-	ch <- rx
 }
 
 func (c *conn) read() (*plan9.Fcall, error) {
 	if err := c.getErr(); err != nil {
 		return nil, err
 	}
-	f, err := plan9.ReadFcall(c.rwc)
+	f, err := plan9.ReadFcallDialect(c.rwc, c.dialect)
 	if err != nil {
 		c.setErr(err)
 		return nil, err
@@ -221,7 +389,7 @@ func (c *conn) write(f *plan9.Fcall) error {
 	if err := c.getErr(); err != nil {
 		return err
 	}
-	err := plan9.WriteFcall(c.rwc, f)
+	err := plan9.WriteFcallDialect(c.rwc, f, c.dialect)
 	if err != nil {
 		c.setErr(err)
 	}
@@ -231,6 +399,18 @@ func (c *conn) write(f *plan9.Fcall) error {
 var yourTurn plan9.Fcall
 
 func (c *conn) rpc(tx *plan9.Fcall, clunkFid *Fid) (rx *plan9.Fcall, err error) {
+	return c.rpcContext(context.Background(), tx, clunkFid)
+}
+
+// rpcContext sends tx and waits for the reply. If ctx is done before the
+// reply arrives, rpcContext sends a Tflush for tx and waits for the Rflush
+// before freeing the tag, as flush(5) requires. If the reply arrives first,
+// the request has taken effect and the reply is returned; otherwise
+// rpcContext returns ctx.Err().
+func (c *conn) rpcContext(ctx context.Context, tx *plan9.Fcall, clunkFid *Fid) (rx *plan9.Fcall, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	ch := make(chan *plan9.Fcall, 1)
 	tx.Tag, err = c.newtag(ch)
 	if err != nil {
@@ -261,30 +441,166 @@ func (c *conn) rpc(tx *plan9.Fcall, clunkFid *Fid) (rx *plan9.Fcall, err error)
 	if err != nil {
 		return nil, err
 	}
-
-	for rx = range ch {
-		if rx != &yourTurn {
-			break
+	c.sent(tx.Tag, ch)
+
+	var (
+		fl   *flush
+		stop func() bool
+		sent <-chan struct{}   // closed when the Tflush has been dealt with
+		fch  chan *plan9.Fcall // receives the Rflush
+	)
+	if ctx.Done() != nil {
+		fl = &flush{c: c, oldtag: tx.Tag, oldch: ch, ch: make(chan *plan9.Fcall, 1), done: make(chan struct{})}
+		stop = context.AfterFunc(ctx, fl.send)
+		defer stop()
+		sent = fl.done
+		fch = fl.ch
+	}
+	for {
+		var m *plan9.Fcall
+		select {
+		case m = <-ch:
+		case m = <-fch:
+		case <-sent:
+			sent = nil
+			if fl.err != nil {
+				// The connection is broken.
+				return nil, fl.err
+			}
+			if !fl.sent && rx != nil {
+				return c.reply(tx, rx)
+			}
+			continue
 		}
-		rx, err = c.read()
-		if err != nil {
-			break
+		if m == &yourTurn {
+			select {
+			case <-fch:
+				// The Rflush is already here, so nothing
+				// more will arrive for tx: don't read.
+				if m := c.forget(tx.Tag, ch, true); m != nil {
+					rx = m
+				}
+				if rx != nil {
+					return c.reply(tx, rx)
+				}
+				return nil, ctx.Err()
+			default:
+			}
+			m, err = c.read()
+			if err != nil {
+				return nil, err
+			}
+			c.mux(m)
+			continue
+		}
+		if m.Tag == tx.Tag && rx == nil {
+			rx = m
+			if fl == nil || stop() {
+				return c.reply(tx, rx)
+			}
+			// A flush is under way; wait for its outcome.
+			continue
+		}
+		// Rflush: tx.Tag is ours to free now.
+		if m := c.forget(tx.Tag, ch, false); m != nil {
+			rx = m
 		}
-		c.mux(rx)
+		if rx != nil {
+			return c.reply(tx, rx)
+		}
+		return nil, ctx.Err()
 	}
+}
 
-	if rx == nil {
-		return nil, c.getErr()
-	}
+// reply interprets the reply rx to tx.
+func (c *conn) reply(tx, rx *plan9.Fcall) (*plan9.Fcall, error) {
 	if rx.Type == plan9.Rerror {
+		if rx.Errno != 0 {
+			return nil, &UnixError{rx.Ename, syscall.Errno(rx.Errno)}
+		}
 		return nil, Error(rx.Ename)
 	}
+	if rx.Type == plan9.Rlerror {
+		errno := syscall.Errno(rx.Errno)
+		return nil, &UnixError{errno.Error(), errno}
+	}
 	if rx.Type != tx.Type+1 {
 		return nil, plan9.ProtocolError("packet type mismatch")
 	}
 	return rx, nil
 }
 
+// A flush is a Tflush sent on behalf of a cancelled rpc.
+type flush struct {
+	c      *conn
+	oldtag uint16
+	oldch  chan *plan9.Fcall
+	ch     chan *plan9.Fcall // receives the Rflush
+	done   chan struct{}     // closed when send returns
+	sent   bool              // the Tflush was written
+	err    error             // the Tflush could not be written
+}
+
+// send sends the Tflush, unless the reply to the old request has already
+// been received.
+func (f *flush) send() {
+	defer close(f.done)
+	c := f.c
+	c.x.Lock()
+	if c.tagmap[f.oldtag] != f.oldch {
+		c.x.Unlock()
+		return
+	}
+	tag, err := c.newtagLocked(f.ch)
+	if err != nil {
+		// Out of tags; wait for the reply instead.
+		c.x.Unlock()
+		return
+	}
+	// The old tag must not be reused until the Rflush arrives,
+	// even if the reply to the old request comes first.
+	c.flushing[f.oldtag] = true
+	c.x.Unlock()
+
+	c.w.Lock()
+	err = c.write(&plan9.Fcall{Type: plan9.Tflush, Tag: tag, Oldtag: f.oldtag})
+	c.w.Unlock()
+	if err != nil {
+		f.err = err
+		return
+	}
+	c.sent(tag, f.ch)
+	f.sent = true
+}
+
+// forget frees tag, whose request has been flushed. If the caller holds
+// the job of reading the connection (turn), or it was given to the
+// request's channel ch, the job is passed on. If the reply to the request
+// is waiting in ch, forget returns it.
+func (c *conn) forget(tag uint16, ch chan *plan9.Fcall, turn bool) (rx *plan9.Fcall) {
+	c.x.Lock()
+	defer c.x.Unlock()
+	delete(c.flushing, tag)
+	if c.tagmap[tag] == ch {
+		delete(c.tagmap, tag)
+		delete(c.written, tag)
+	}
+	c.freetag[tag] = true
+	select {
+	case m := <-ch:
+		if m == &yourTurn {
+			turn = true
+		} else {
+			rx = m
+		}
+	default:
+	}
+	if turn {
+		c.passTurn()
+	}
+	return rx
+}
+
 func (c *conn) acquire() {
 	atomic.AddInt32(&c.refCount, 1)
 }
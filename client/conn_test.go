@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/srv"
+)
+
+// versionServer answers Tversion messages on c using answer, which maps the
+// offered version to the one to reply with. An empty reply means Rerror.
+func versionServer(c net.Conn, msize uint32, answer map[string]string) {
+	defer c.Close()
+	for {
+		tx, err := plan9.ReadFcall(c)
+		if err != nil {
+			return
+		}
+		rx := &plan9.Fcall{Type: plan9.Rversion, Tag: tx.Tag, Msize: msize}
+		if tx.Msize < msize {
+			rx.Msize = tx.Msize
+		}
+		if v, ok := answer[tx.Version]; !ok {
+			rx.Version = "unknown"
+		} else if v == "" {
+			rx.Type = plan9.Rerror
+			rx.Ename = "unrecognized 9P version"
+		} else {
+			rx.Version = v
+		}
+		if err := plan9.WriteFcall(c, rx); err != nil {
+			return
+		}
+	}
+}
+
+var versionTests = []struct {
+	offer   []string
+	answer  map[string]string
+	version string // "" means failure
+}{
+	{nil, map[string]string{"9P2000": "9P2000"}, "9P2000"},
+	{
+		[]string{plan9.VERSION9PL, plan9.VERSION9PU, plan9.VERSION9P},
+		map[string]string{"9P2000.L": "9P2000.L", "9P2000.u": "9P2000.u", "9P2000": "9P2000"},
+		"9P2000.L",
+	},
+	{
+		// downgrade
+		[]string{plan9.VERSION9PL, plan9.VERSION9P},
+		map[string]string{"9P2000.L": "9P2000", "9P2000": "9P2000"},
+		"9P2000",
+	},
+	{
+		// unknown, then Rerror, then success
+		[]string{plan9.VERSION9PL, plan9.VERSION9PU, plan9.VERSION9P},
+		map[string]string{"9P2000.u": "", "9P2000": "9P2000"},
+		"9P2000",
+	},
+	{
+		// downgrade to a version not offered
+		[]string{plan9.VERSION9PL},
+		map[string]string{"9P2000.L": "9P2000"},
+		"",
+	},
+	{
+		[]string{plan9.VERSION9P},
+		map[string]string{},
+		"",
+	},
+}
+
+func TestNewConnOptions(t *testing.T) {
+	for _, tt := range versionTests {
+		c1, c2 := net.Pipe()
+		go versionServer(c1, 8192, tt.answer)
+		conn, err := NewConnOptions(c2, &ConnOptions{Msize: 65536, Versions: tt.offer})
+		if tt.version == "" {
+			if err == nil {
+				t.Errorf("offer %v: negotiated %q, want error", tt.offer, conn.Version())
+				conn.Close()
+			}
+			c2.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("offer %v: %v", tt.offer, err)
+			c2.Close()
+			continue
+		}
+		if v := conn.Version(); v != tt.version {
+			t.Errorf("offer %v: negotiated %q, want %q", tt.offer, v, tt.version)
+		}
+		if m := conn.Msize(); m != 8192 {
+			t.Errorf("offer %v: msize %d, want 8192", tt.offer, m)
+		}
+		conn.Close()
+	}
+}
+
+// stuck is a srv.FileHandler whose reads are answered only by flushes.
+type stuck struct{}
+
+func (stuck) Read(r *srv.Req)  {}
+func (stuck) Write(r *srv.Req) { r.Respond(srv.ErrPerm) }
+
+// flushTree is a srv.Tree that handles Tflush by calling its flush function.
+type flushTree struct {
+	*srv.Tree
+	flush func(r *srv.Req)
+}
+
+func (t *flushTree) Flush(r *srv.Req) { t.flush(r) }
+
+func TestReadContext(t *testing.T) {
+	tree := &flushTree{Tree: srv.NewTree("glenda", "glenda", 0o555)}
+	tree.Root.Create("stuck", "glenda", 0o444, stuck{})
+	tree.Root.Create("hello", "glenda", 0o444, nil)
+
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, tree)
+	conn, err := NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Open("stuck", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+
+	// The server abandons the read.
+	nflush := 0
+	tree.flush = func(r *srv.Req) {
+		nflush++
+		r.Respond(nil)
+	}
+	buf := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		n, err := fid.ReadContext(ctx, buf)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("ReadContext = %d, %v; want DeadlineExceeded", n, err)
+		}
+	}
+	if nflush != 3 {
+		t.Errorf("server saw %d flushes, want 3", nflush)
+	}
+
+	// The server answers the read before the flush.
+	tree.flush = func(r *srv.Req) {
+		old := r.Oldreq
+		old.Ofcall.Data = []byte("late")
+		old.Respond(nil)
+		r.Respond(nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	n, err := fid.ReadContext(ctx, buf)
+	cancel()
+	if err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("ReadContext = %q, %v; want %q, nil", buf[:n], err, "late")
+	}
+
+	// The connection still works.
+	if _, err := fsys.Stat("hello"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := fsys.OpenContext(ctx, "hello", plan9.OREAD); err != context.Canceled {
+		t.Errorf("OpenContext with cancelled context: %v", err)
+	}
+}
@@ -18,19 +18,167 @@ directory paths. These strings should be treated as opaque data and ignored.
 */
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+// A DialString is a parsed network address of the form network!netaddr!service.
+type DialString struct {
+	Net     string // tcp, udp, unix or net
+	Addr    string // host name, network address or, for unix, path name
+	Service string // port number or service name; empty for unix
+}
+
+// ParseDialString parses the address s. Missing parts are taken from
+// defnet and defsrv, so that with defaults "net" and "9fs", "host" means
+// "net!host!9fs". A bare path name means "unix!path".
+func ParseDialString(s, defnet, defsrv string) (DialString, error) {
+	var d DialString
+	f := strings.SplitN(s, "!", 3)
+	switch len(f) {
+	case 1:
+		d = DialString{defnet, f[0], defsrv}
+	case 2:
+		d = DialString{f[0], f[1], defsrv}
+	case 3:
+		d = DialString{f[0], f[1], f[2]}
+	}
+	switch {
+	case d.Net == "unix" && len(f) > 1:
+		// Paths may contain '!'.
+		d.Addr = strings.TrimPrefix(s, "unix!")
+		d.Service = ""
+	case d.Net == "net" && isPath(d.Addr):
+		d.Net = "unix"
+		d.Service = ""
+	case len(f) == 1 && isPath(d.Addr):
+		d = DialString{"unix", d.Addr, ""}
+	}
+	if d.Net == "" || d.Addr == "" {
+		return DialString{}, fmt.Errorf("bad dial string %q", s)
+	}
+	if d.Net != "unix" && strings.Contains(d.Service, "!") {
+		return DialString{}, fmt.Errorf("bad dial string %q", s)
+	}
+	return d, nil
+}
+
+func isPath(addr string) bool {
+	return strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "./")
+}
+
+func (d DialString) String() string {
+	if d.Service == "" {
+		return d.Net + "!" + d.Addr
+	}
+	return d.Net + "!" + d.Addr + "!" + d.Service
+}
+
+// services maps Plan 9 service names without a standard Internet port to
+// their ports. See /lib/ndb/common.
+var services = map[string]int{
+	"9fs":      564,
+	"ticket":   567,
+	"exportfs": 17007,
+	"rexexec":  17009,
+	"ncpu":     17010,
+	"cpu":      17013,
+	"venti":    17034,
+}
+
+// port returns the port number for service on the Go network network.
+func port(network, service string) (int, error) {
+	if service == "" {
+		return 0, errors.New("missing service")
+	}
+	if p, err := strconv.Atoi(service); err == nil {
+		return p, nil
+	}
+	if p, ok := services[service]; ok {
+		return p, nil
+	}
+	return net.LookupPort(network, service)
+}
+
+// netaddr returns d's address in the form used by net.Dial for network.
+func (d DialString) netaddr(network string) (string, error) {
+	if network == "unix" {
+		return d.Addr, nil
+	}
+	p, err := port(network, d.Service)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", d, err)
+	}
+	return net.JoinHostPort(d.Addr, strconv.Itoa(p)), nil
+}
+
+// networks lists the networks to try, in order, for d.
+func (d DialString) networks() []string {
+	if d.Net != "net" {
+		return []string{d.Net}
+	}
+	if d.Service == "" {
+		return []string{"unix", "tcp"}
+	}
+	return []string{"tcp", "unix"}
+}
+
+// dial calls d, trying each network in turn if d.Net is net, and returns
+// the first error if none succeeds.
+func (d DialString) dial() (net.Conn, error) {
+	var first error
+	for _, network := range d.networks() {
+		addr, err := d.netaddr(network)
+		if err == nil {
+			var c net.Conn
+			if c, err = net.Dial(network, addr); err == nil {
+				return c, nil
+			}
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
 // Dial makes a call to destination addr on a multiplexed network.
 //
-// If the network in addr is net, dial will try all networks in succession that
+// If network is net, dial will try all networks in succession that
 // are common between the source and destination until the call succeeds.
 func Dial(network, addr string) (*Conn, error) {
-	c, err := net.Dial(network, addr)
+	var c net.Conn
+	var err error
+	if network == "net" {
+		d := DialString{Net: "net", Addr: addr}
+		if host, service, err1 := net.SplitHostPort(addr); err1 == nil {
+			d.Addr, d.Service = host, service
+		}
+		c, err = d.dial()
+	} else {
+		c, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c)
+}
+
+// DialAddr makes a call to the address addr, which has the form
+// network!netaddr!service, with network defaulting to net and service to
+// 9fs.
+func DialAddr(addr string) (*Conn, error) {
+	d, err := ParseDialString(addr, "net", "9fs")
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -40,8 +188,48 @@ func Dial(network, addr string) (*Conn, error) {
 // DialService is a convenience function that wraps Dial by calling the named
 // service.
 func DialService(service string) (*Conn, error) {
-	ns := Namespace()
-	return Dial("unix", ns+"/"+service)
+	ns, err := Namespace()
+	if err != nil {
+		return nil, err
+	}
+	return DialAddr("unix!" + ns + "/" + service)
+}
+
+// Announce listens on the address addr, which has the same form as for
+// DialAddr. The host * means all addresses.
+func Announce(addr string) (net.Listener, error) {
+	d, err := ParseDialString(addr, "tcp", "9fs")
+	if err != nil {
+		return nil, err
+	}
+	if d.Net == "net" {
+		d.Net = "tcp"
+	}
+	if d.Addr == "*" {
+		d.Addr = ""
+	}
+	a, err := d.netaddr(d.Net)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(d.Net, a)
+}
+
+// ListenService announces the named service in the name space directory,
+// for DialService to call. It replaces the socket of a service that has
+// died.
+func ListenService(service string) (net.Listener, error) {
+	ns, err := Namespace()
+	if err != nil {
+		return nil, err
+	}
+	addr := ns + "/" + service
+	if c, err := net.Dial("unix", addr); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s: service already posted", addr)
+	}
+	os.Remove(addr)
+	return net.Listen("unix", addr)
 }
 
 // Mount mounts a 9P server's files  into the file system.
@@ -50,7 +238,7 @@ func Mount(network, addr string) (*Fsys, error) {
 	if err != nil {
 		return nil, err
 	}
-	fsys, err := c.Attach(nil, getuser(), "")
+	fsys, err := c.AttachAuth(DefaultAuthenticator, getuser(), "")
 	if err != nil {
 		c.Close()
 	}
@@ -62,7 +250,7 @@ func MountService(service string) (*Fsys, error) {
 	if err != nil {
 		return nil, err
 	}
-	fsys, err := c.Attach(nil, getuser(), "")
+	fsys, err := c.AttachAuth(DefaultAuthenticator, getuser(), "")
 	if err != nil {
 		c.Close()
 	}
@@ -74,37 +262,92 @@ func MountServiceAname(service, aname string) (*Fsys, error) {
 	if err != nil {
 		return nil, err
 	}
-	fsys, err := c.Attach(nil, getuser(), aname)
+	fsys, err := c.AttachAuth(DefaultAuthenticator, getuser(), aname)
 	if err != nil {
 		c.Close()
 	}
 	return fsys, err
 }
 
-// Namespace returns the path to the name space directory.
-func Namespace() string {
-	var disp string
+// Namespace returns the path to the name space directory, in which
+// services are posted. It is $NAMESPACE if that is set, and otherwise
+// /tmp/ns.$USER.$DISPLAY, with the screen number dropped from the display.
+// A session without $DISPLAY, such as one logged in over the network, uses
+// the display :0, as plan9port does on macOS.
+//
+// Namespace creates the directory if it does not exist, readable only by
+// its owner. It returns an error unless the path names a directory, not a
+// symbolic link to one, that belongs to the user and has mode 0700.
+func Namespace() (string, error) {
+	ns := os.Getenv("NAMESPACE")
+	if ns == "" {
+		disp, err := canonDisplay(os.Getenv("DISPLAY"))
+		if err != nil {
+			return "", err
+		}
+		ns = fmt.Sprintf("/tmp/ns.%s.%s", getuser(), disp)
+	}
+	if err := os.Mkdir(ns, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	fi, err := os.Lstat(ns)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return "", fmt.Errorf("name space %s is a symbolic link", ns)
+	case !fi.IsDir():
+		return "", fmt.Errorf("name space %s is not a directory", ns)
+	case !ownedBySelf(fi):
+		return "", fmt.Errorf("name space directory %s is not owned by %s", ns, getuser())
+	case fi.Mode().Perm() != 0700:
+		return "", fmt.Errorf("name space directory %s has mode %v, want 0700", ns, fi.Mode().Perm())
+	}
+	return ns, nil
+}
 
-	disp = os.Getenv("DISPLAY")
+// canonDisplay returns the X display disp in the form used in the name
+// space directory: host:display.screen becomes host:display, and slashes,
+// as in the paths macOS uses, become underscores.
+func canonDisplay(disp string) (string, error) {
 	if disp == "" {
-		log.Fatalf("$DISPLAY is not set")
+		return ":0", nil
 	}
-
-	if i := strings.LastIndex(disp, ":"); i < 0 {
-		log.Fatalf("bad display: %s", disp)
+	i := strings.LastIndex(disp, ":")
+	if i < 0 {
+		return "", fmt.Errorf("bad $DISPLAY %q", disp)
 	}
-
-	// canonicalize: host:display.screen => host:display
-	if i := strings.LastIndex(disp, "."); i > 0 {
-		disp = disp[0 : i-1]
+	j := i + 1
+	for j < len(disp) && '0' <= disp[j] && disp[j] <= '9' {
+		j++
 	}
+	return strings.ReplaceAll(disp[:j], "/", "_"), nil
+}
 
-	// NOTE: plan9port creates this directory on demand.
-	// Maybe someday we'll need to do that.
-
-	if ns := os.Getenv("NAMESPACE"); len(ns) > 0 {
-		return ns
+// ListServices returns the names of the services posted in the name space
+// directory that are accepting calls, in sorted order. Sockets left behind
+// by services that have died are ignored.
+func ListServices() ([]string, error) {
+	ns, err := Namespace()
+	if err != nil {
+		return nil, err
 	}
-
-	return fmt.Sprintf("/tmp/ns/%s.%s", getuser(), disp)
+	entries, err := os.ReadDir(ns)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type()&fs.ModeSocket == 0 {
+			continue
+		}
+		c, err := net.Dial("unix", filepath.Join(ns, e.Name()))
+		if err != nil {
+			continue
+		}
+		c.Close()
+		names = append(names, e.Name())
+	}
+	return names, nil
 }
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package client
+
+import "io/fs"
+
+func ownedBySelf(fi fs.FileInfo) bool { return true }
@@ -1,24 +1,234 @@
 package client
 
 import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"bwsd.dev/plan9/srv"
 )
 
-func TestNamespace(t *testing.T) {
-	ns := `/tmp/ns/` + getuser() + `.:0`
-	nsTests := []struct {
+func TestCanonDisplay(t *testing.T) {
+	for _, tt := range []struct {
 		disp string
 		want string
 	}{
-		{":0", ns},
-		{":0.1234", ns},
-		{":0.0", ns},
-		{"hostfoo:0", ns},
-		{":0.0", ns},
+		{":0", ":0"},
+		{":0.1234", ":0"},
+		{":0.0", ":0"},
+		{":10.0", ":10"},
+		{"hostfoo:0", "hostfoo:0"},
+		{"hostfoo:0.1", "hostfoo:0"},
+		{"host.example.com:1.0", "host.example.com:1"},
+		{"/private/tmp/launch-x/org.xquartz:0", "_private_tmp_launch-x_org.xquartz:0"},
+		{"", ":0"},
+		{"hostfoo", ""},
+	} {
+		got, err := canonDisplay(tt.disp)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("canonDisplay(%q) = %q, want error", tt.disp, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("canonDisplay(%q) = %q, %v; want %q", tt.disp, got, err, tt.want)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	t.Setenv("NAMESPACE", "")
+	t.Setenv("DISPLAY", ":4242.0")
+	want := "/tmp/ns." + getuser() + ".:4242"
+	_, err := os.Stat(want)
+	existed := err == nil
+	ns, err := Namespace()
+	if err != nil || ns != want {
+		t.Fatalf("Namespace() = %q, %v; want %q", ns, err, want)
+	}
+	if !existed {
+		os.Remove(ns)
+	}
+
+	ns = filepath.Join(t.TempDir(), "ns")
+	t.Setenv("NAMESPACE", ns)
+	t.Setenv("DISPLAY", "")
+	if got, err := Namespace(); err != nil || got != ns {
+		t.Fatalf("Namespace() = %q, %v; want %q", got, err, ns)
+	}
+	if fi, err := os.Stat(ns); err != nil || fi.Mode().Perm() != 0o700 {
+		t.Errorf("name space directory: %v, %v", fi, err)
+	}
+	os.Chmod(ns, 0o755)
+	if _, err := Namespace(); err == nil {
+		t.Errorf("Namespace accepted a directory others can use")
+	}
+	os.Chmod(ns, 0o500)
+	if _, err := Namespace(); err == nil {
+		t.Errorf("Namespace accepted a directory with mode 0500")
 	}
-	for _, tt := range nsTests {
-		if got := Namespace(); got != tt.want {
-			t.Errorf("NameSpace(%q) == %q; want %q", tt.disp, got, tt.want)
+	os.Remove(ns)
+	os.WriteFile(ns, nil, 0o600)
+	if _, err := Namespace(); err == nil {
+		t.Errorf("Namespace accepted a file")
+	}
+
+	// A link to a good directory is not good enough, since whoever made
+	// it can point it elsewhere.
+	os.Remove(ns)
+	dir := filepath.Join(t.TempDir(), "real")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, ns); err != nil {
+		t.Skip(err)
+	}
+	if _, err := Namespace(); err == nil {
+		t.Errorf("Namespace accepted a symbolic link")
+	}
+}
+
+func TestListServices(t *testing.T) {
+	ns := filepath.Join(t.TempDir(), "ns")
+	t.Setenv("NAMESPACE", ns)
+	for _, name := range []string{"plumb", "acme"} {
+		l, err := ListenService(name)
+		if err != nil {
+			t.Fatal(err)
 		}
+		defer l.Close()
+	}
+	l, err := ListenService("dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	os.WriteFile(filepath.Join(ns, "notes"), nil, 0o600)
+
+	names, err := ListServices()
+	if err != nil || strings.Join(names, " ") != "acme plumb" {
+		t.Errorf("ListServices() = %q, %v; want [acme plumb]", names, err)
+	}
+}
+
+var dialStringTests = []struct {
+	s    string
+	want DialString
+	err  bool
+}{
+	{s: "tcp!host!564", want: DialString{"tcp", "host", "564"}},
+	{s: "tcp!host", want: DialString{"tcp", "host", "9fs"}},
+	{s: "host", want: DialString{"net", "host", "9fs"}},
+	{s: "net!host!9fs", want: DialString{"net", "host", "9fs"}},
+	{s: "tcp!127.0.0.1!venti", want: DialString{"tcp", "127.0.0.1", "venti"}},
+	{s: "tcp![::1]!564", want: DialString{"tcp", "[::1]", "564"}},
+	{s: "unix!/tmp/ns.glenda.:0/acme", want: DialString{"unix", "/tmp/ns.glenda.:0/acme", ""}},
+	{s: "unix!/tmp/a!b", want: DialString{"unix", "/tmp/a!b", ""}},
+	{s: "net!/tmp/sock", want: DialString{"unix", "/tmp/sock", ""}},
+	{s: "/tmp/sock", want: DialString{"unix", "/tmp/sock", ""}},
+	{s: "", err: true},
+	{s: "tcp!", err: true},
+	{s: "!host!564", err: true},
+	{s: "tcp!host!564!x", err: true},
+}
+
+func TestParseDialString(t *testing.T) {
+	for _, tt := range dialStringTests {
+		d, err := ParseDialString(tt.s, "net", "9fs")
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseDialString(%q) = %v, want error", tt.s, d)
+			}
+			continue
+		}
+		if err != nil || d != tt.want {
+			t.Errorf("ParseDialString(%q) = %v, %v; want %v", tt.s, d, err, tt.want)
+		}
+	}
+}
+
+func TestNetaddr(t *testing.T) {
+	for _, tt := range []struct {
+		d    DialString
+		want string
+	}{
+		{DialString{"tcp", "host", "9fs"}, "host:564"},
+		{DialString{"tcp", "::1", "564"}, "[::1]:564"},
+		{DialString{"tcp", "host", "cpu"}, "host:17013"},
+		{DialString{"unix", "/tmp/sock", ""}, "/tmp/sock"},
+	} {
+		network := tt.d.networks()[0]
+		if got, err := tt.d.netaddr(network); err != nil || got != tt.want {
+			t.Errorf("%v: netaddr = %q, %v; want %q", tt.d, got, err, tt.want)
+		}
+	}
+}
+
+func TestDialAddr(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.Serve(c, srv.NewTree("glenda", "glenda", 0o555))
+		}
+	}()
+
+	for _, addr := range []string{"unix!" + sock, "net!" + sock, sock} {
+		c, err := DialAddr(addr)
+		if err != nil {
+			t.Errorf("DialAddr(%q): %v", addr, err)
+			continue
+		}
+		c.Close()
+	}
+	if c, err := Dial("net", sock); err != nil {
+		t.Errorf("Dial(net, %q): %v", sock, err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestListenService(t *testing.T) {
+	ns := filepath.Join(t.TempDir(), "ns")
+	t.Setenv("NAMESPACE", ns)
+	l, err := ListenService("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(ns); err != nil || fi.Mode().Perm() != 0o700 {
+		t.Errorf("name space directory: %v, %v", fi, err)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			srv.Serve(c, srv.NewTree("glenda", "glenda", 0o555))
+		}
+	}()
+	c, err := DialService("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := ListenService("test"); err == nil {
+		t.Errorf("posted service twice")
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = ListenService("test")
+	if err != nil {
+		t.Fatalf("replacing dead service: %v", err)
 	}
+	l.Close()
 }
@@ -0,0 +1,16 @@
+//go:build unix
+
+package client
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// ownedBySelf reports whether the file described by fi belongs to the
+// user running the program.
+func ownedBySelf(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return !ok || int(st.Uid) == os.Getuid()
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bwsd.dev/plan9"
+)
+
+// The methods in this file send 9P2000.L requests. They are only
+// meaningful on connections that negotiated plan9.VERSION9PL; errors are
+// reported as *UnixError.
+
+// Statfs returns information about the file system containing fid.
+func (fid *Fid) Statfs() (*plan9.Statfs, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return nil, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tstatfs, Fid: fid.fid}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &rx.Statfs, nil
+}
+
+// Lopen opens fid for I/O with the Linux open(2) flags.
+func (fid *Fid) Lopen(flags uint32) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tlopen, Fid: fid.fid, Flags: flags}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return err
+	}
+	fid.mode = uint8(flags & 3)
+	fid.qid = rx.Qid
+	fid.iounit = rx.Iounit
+	return nil
+}
+
+// Lcreate creates the file name in the directory fid with the Linux mode
+// bits and group id, and opens it with the Linux open(2) flags. On success
+// fid refers to the new file.
+func (fid *Fid) Lcreate(name string, flags, mode, gid uint32) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tlcreate, Fid: fid.fid, Name: name, Flags: flags, Perm: mode, Gid: gid}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return err
+	}
+	fid.mode = uint8(flags & 3)
+	fid.qid = rx.Qid
+	fid.iounit = rx.Iounit
+	return nil
+}
+
+// Symlink creates a symbolic link called name in the directory fid that
+// points to target.
+func (fid *Fid) Symlink(name, target string, gid uint32) (plan9.Qid, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return plan9.Qid{}, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tsymlink, Fid: fid.fid, Name: name, Target: target, Gid: gid}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return plan9.Qid{}, err
+	}
+	return rx.Qid, nil
+}
+
+// Mknod creates the device, pipe or socket called name in the directory
+// fid. The file type is given by the Linux mode bits.
+func (fid *Fid) Mknod(name string, mode, major, minor, gid uint32) (plan9.Qid, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return plan9.Qid{}, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tmknod, Dfid: fid.fid, Name: name, Perm: mode, Major: major, Minor: minor, Gid: gid}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return plan9.Qid{}, err
+	}
+	return rx.Qid, nil
+}
+
+// Rename moves the file fid to name in the directory dir.
+func (fid *Fid) Rename(dir *Fid, name string) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Trename, Fid: fid.fid, Dfid: dir.fid, Name: name}
+	_, err = conn.rpc(tx, nil)
+	return err
+}
+
+// Readlink returns the target of the symbolic link fid.
+func (fid *Fid) Readlink() (string, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return "", err
+	}
+	tx := &plan9.Fcall{Type: plan9.Treadlink, Fid: fid.fid}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return "", err
+	}
+	return rx.Target, nil
+}
+
+// Getattr returns the attributes of fid selected by mask, a combination of
+// the plan9.GETATTR bits. The server may return more or fewer; the Valid
+// field of the result says which.
+func (fid *Fid) Getattr(mask uint64) (*plan9.Attr, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return nil, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tgetattr, Fid: fid.fid, Mask: mask}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &rx.Attr, nil
+}
+
+// Setattr changes the attributes of fid selected by a.Valid, a
+// combination of the plan9.SETATTR bits.
+func (fid *Fid) Setattr(a *plan9.Attr) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tsetattr, Fid: fid.fid, Attr: *a}
+	_, err = conn.rpc(tx, nil)
+	return err
+}
+
+// Xattrwalk returns a new fid for reading the extended attribute name of
+// fid, along with the attribute's size. If name is empty, the new fid
+// reads the list of attribute names.
+func (fid *Fid) Xattrwalk(name string) (*Fid, uint64, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return nil, 0, err
+	}
+	xfidnum, err := conn.newfidnum()
+	if err != nil {
+		return nil, 0, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Txattrwalk, Fid: fid.fid, Newfid: xfidnum, Name: name}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		conn.putfidnum(xfidnum)
+		return nil, 0, err
+	}
+	return conn.newFid(xfidnum, fid.qid), rx.Size, nil
+}
+
+// Xattrcreate turns fid into a fid for setting the extended attribute name
+// to the size bytes written to it before it is closed. Flags are the
+// setxattr(2) flags.
+func (fid *Fid) Xattrcreate(name string, size uint64, flags uint32) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Txattrcreate, Fid: fid.fid, Name: name, Size: size, Flags: flags}
+	_, err = conn.rpc(tx, nil)
+	return err
+}
+
+// Readdir reads directory entries from the open directory fid, starting at
+// offset, which is zero or the Offset of the last entry previously returned.
+// At the end of the directory it returns no entries and a nil error.
+func (fid *Fid) Readdir(offset uint64) ([]plan9.Dirent, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return nil, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Treaddir, Fid: fid.fid, Offset: offset, Count: fid.iosize(conn)}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return plan9.UnmarshalDirents(rx.Data)
+}
+
+// Readdirall reads all the entries in the open directory fid.
+func (fid *Fid) Readdirall() ([]plan9.Dirent, error) {
+	var dirs []plan9.Dirent
+	var offset uint64
+	for {
+		d, err := fid.Readdir(offset)
+		dirs = append(dirs, d...)
+		if err != nil || len(d) == 0 {
+			return dirs, err
+		}
+		offset = d[len(d)-1].Offset
+	}
+}
+
+// Fsync flushes the file fid to stable storage. If datasync is set, only
+// the data and the metadata needed to read it are flushed, as fdatasync(2).
+func (fid *Fid) Fsync(datasync bool) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tfsync, Fid: fid.fid}
+	if datasync {
+		tx.Datasync = 1
+	}
+	_, err = conn.rpc(tx, nil)
+	return err
+}
+
+// Lock acquires or releases the POSIX record lock l on fid and returns the
+// server's status, one of the plan9.LOCK status values.
+func (fid *Fid) Lock(l *plan9.Flock) (uint8, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return plan9.LOCKERROR, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tlock, Fid: fid.fid, Lock: *l}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return plan9.LOCKERROR, err
+	}
+	return rx.Status, nil
+}
+
+// Getlock tests whether the lock l could be placed on fid. It returns l
+// with Type set to plan9.LOCKUNLCK if so, or a description of a
+// conflicting lock.
+func (fid *Fid) Getlock(l *plan9.Flock) (*plan9.Flock, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return nil, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tgetlock, Fid: fid.fid, Lock: *l}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &rx.Lock, nil
+}
+
+// Link creates a hard link called name in the directory fid to the file
+// target.
+func (fid *Fid) Link(target *Fid, name string) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tlink, Dfid: fid.fid, Fid: target.fid, Name: name}
+	_, err = conn.rpc(tx, nil)
+	return err
+}
+
+// Mkdir creates the directory name in the directory fid.
+func (fid *Fid) Mkdir(name string, mode, gid uint32) (plan9.Qid, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return plan9.Qid{}, err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tmkdir, Dfid: fid.fid, Name: name, Perm: mode, Gid: gid}
+	rx, err := conn.rpc(tx, nil)
+	if err != nil {
+		return plan9.Qid{}, err
+	}
+	return rx.Qid, nil
+}
+
+// Renameat moves oldname in the directory fid to newname in the directory
+// newdir.
+func (fid *Fid) Renameat(oldname string, newdir *Fid, newname string) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Trenameat, Dfid: fid.fid, Name: oldname, Newdfid: newdir.fid, Newname: newname}
+	_, err = conn.rpc(tx, nil)
+	return err
+}
+
+// Unlinkat removes name from the directory fid. Flags may include
+// plan9.ATREMOVEDIR to remove a directory.
+func (fid *Fid) Unlinkat(name string, flags uint32) error {
+	conn, err := fid.conn()
+	if err != nil {
+		return err
+	}
+	tx := &plan9.Fcall{Type: plan9.Tunlinkat, Dfid: fid.fid, Name: name, Flags: flags}
+	_, err = conn.rpc(tx, nil)
+	return err
+}
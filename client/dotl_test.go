@@ -0,0 +1,677 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+
+	"bwsd.dev/plan9"
+)
+
+// Linux file type bits, as carried in 9P2000.L modes.
+const (
+	sIFMT  = 0o170000
+	sIFDIR = 0o040000
+	sIFREG = 0o100000
+	sIFLNK = 0o120000
+)
+
+// An lnode is a file held by an lserver.
+type lnode struct {
+	qid   plan9.Qid
+	attr  plan9.Attr // Mode, Uid, Gid, Nlink, Rdev and the times
+	data  []byte
+	dir   map[string]*lnode // nil unless a directory
+	link  string            // target of a symbolic link
+	xattr map[string][]byte
+}
+
+// An lfid is a fid on an lserver.
+type lfid struct {
+	n     *lnode
+	xdata []byte // contents of an extended attribute fid
+	xname string // attribute being created, if any
+	xsize uint64
+}
+
+// lserver is a 9P2000.L server holding its files in memory, for testing
+// the 9P2000.L Fid methods. It serves one connection, answering each
+// request before reading the next.
+type lserver struct {
+	iounit uint32 // given in Rlopen and Rlcreate
+
+	mu      sync.Mutex
+	root    *lnode
+	path    uint64
+	fids    map[uint32]*lfid
+	lock    *plan9.Flock // lock held, if any
+	readdir uint32       // largest Treaddir count seen
+}
+
+func newLserver() *lserver {
+	s := &lserver{fids: make(map[uint32]*lfid)}
+	s.root = s.newNode(sIFDIR|0o755, 0)
+	return s
+}
+
+func (s *lserver) newNode(mode, gid uint32) *lnode {
+	s.path++
+	n := &lnode{qid: plan9.Qid{Path: s.path}, xattr: make(map[string][]byte)}
+	n.attr.Mode = mode
+	n.attr.Gid = gid
+	n.attr.Nlink = 1
+	if mode&sIFMT == sIFDIR {
+		n.qid.Type = plan9.QTDIR
+		n.dir = make(map[string]*lnode)
+	}
+	return n
+}
+
+// dial returns a client connection to s over 9P2000.L.
+func (s *lserver) dial(t *testing.T) *Fid {
+	c1, c2 := net.Pipe()
+	go s.serve(c1)
+	conn, err := NewConnOptions(c2, &ConnOptions{Versions: []string{plan9.VERSION9PL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if v := conn.Version(); v != plan9.VERSION9PL {
+		t.Fatalf("negotiated %s", v)
+	}
+	fsys, err := conn.AttachUid(nil, "glenda", 1000, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys.root
+}
+
+func (s *lserver) serve(c net.Conn) {
+	defer c.Close()
+	d := plan9.Dialect9P
+	for {
+		tx, err := plan9.ReadFcallDialect(c, d)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		rx, errno := s.handle(tx)
+		s.mu.Unlock()
+		if errno != 0 {
+			rx = &plan9.Fcall{Type: plan9.Rlerror, Errno: uint32(errno)}
+		}
+		rx.Tag = tx.Tag
+		if rx.Type == plan9.Rversion {
+			d = plan9.DialectOf(rx.Version)
+		}
+		if err := plan9.WriteFcallDialect(c, rx, d); err != nil {
+			return
+		}
+	}
+}
+
+// entry returns the file name in the directory fid dfid.
+func (s *lserver) entry(dfid uint32, name string) (*lnode, *lnode, syscall.Errno) {
+	f := s.fids[dfid]
+	if f == nil {
+		return nil, nil, syscall.EBADF
+	}
+	if f.n.dir == nil {
+		return nil, nil, syscall.ENOTDIR
+	}
+	n := f.n.dir[name]
+	if n == nil {
+		return f.n, nil, syscall.ENOENT
+	}
+	return f.n, n, 0
+}
+
+// create adds a new file to the directory fid dfid.
+func (s *lserver) create(dfid uint32, name string, mode, gid uint32) (*lnode, syscall.Errno) {
+	dir, _, errno := s.entry(dfid, name)
+	if errno != syscall.ENOENT {
+		if errno == 0 {
+			errno = syscall.EEXIST
+		}
+		return nil, errno
+	}
+	n := s.newNode(mode, gid)
+	dir.dir[name] = n
+	return n, 0
+}
+
+// unlink removes n from every directory holding it, or the first only if
+// once is set.
+func (s *lserver) unlink(n *lnode, once bool) {
+	var walk func(d *lnode) bool
+	walk = func(d *lnode) bool {
+		for name, c := range d.dir {
+			if c == n {
+				delete(d.dir, name)
+				n.attr.Nlink--
+				if once {
+					return true
+				}
+			} else if c.dir != nil && walk(c) {
+				return true
+			}
+		}
+		return false
+	}
+	walk(s.root)
+}
+
+func (s *lserver) handle(tx *plan9.Fcall) (*plan9.Fcall, syscall.Errno) {
+	rx := &plan9.Fcall{Type: tx.Type + 1}
+	f := s.fids[tx.Fid]
+	switch tx.Type {
+	case plan9.Tversion, plan9.Tattach, plan9.Tmknod, plan9.Tlink, plan9.Tmkdir, plan9.Trenameat, plan9.Tunlinkat:
+		// Fid is new, or not used.
+	default:
+		if f == nil {
+			return nil, syscall.EBADF
+		}
+	}
+	switch tx.Type {
+	default:
+		return nil, syscall.EOPNOTSUPP
+
+	case plan9.Tversion:
+		rx.Msize = min(tx.Msize, 8192)
+		rx.Version = plan9.VERSION9PL
+
+	case plan9.Tattach:
+		s.fids[tx.Fid] = &lfid{n: s.root}
+		rx.Qid = s.root.qid
+
+	case plan9.Twalk:
+		n := f.n
+		for _, name := range tx.Wname {
+			if n.dir == nil || n.dir[name] == nil {
+				break
+			}
+			n = n.dir[name]
+			rx.Wqid = append(rx.Wqid, n.qid)
+		}
+		if len(rx.Wqid) == 0 && len(tx.Wname) > 0 {
+			return nil, syscall.ENOENT
+		}
+		if len(rx.Wqid) == len(tx.Wname) {
+			s.fids[tx.Newfid] = &lfid{n: n}
+		}
+
+	case plan9.Tclunk:
+		delete(s.fids, tx.Fid)
+		if f.xname != "" {
+			if uint64(len(f.xdata)) != f.xsize {
+				return nil, syscall.EINVAL
+			}
+			f.n.xattr[f.xname] = f.xdata
+		}
+
+	case plan9.Tlopen:
+		rx.Qid = f.n.qid
+		rx.Iounit = s.iounit
+
+	case plan9.Tlcreate:
+		n, errno := s.create(tx.Fid, tx.Name, sIFREG|tx.Perm&^sIFMT, tx.Gid)
+		if errno != 0 {
+			return nil, errno
+		}
+		f.n = n
+		rx.Qid = n.qid
+		rx.Iounit = s.iounit
+
+	case plan9.Tsymlink:
+		n, errno := s.create(tx.Fid, tx.Name, sIFLNK|0o777, tx.Gid)
+		if errno != 0 {
+			return nil, errno
+		}
+		n.link = tx.Target
+		rx.Qid = n.qid
+
+	case plan9.Tmknod:
+		n, errno := s.create(tx.Dfid, tx.Name, tx.Perm, tx.Gid)
+		if errno != 0 {
+			return nil, errno
+		}
+		n.attr.Rdev = uint64(tx.Major)<<8 | uint64(tx.Minor)
+		rx.Qid = n.qid
+
+	case plan9.Tmkdir:
+		n, errno := s.create(tx.Dfid, tx.Name, sIFDIR|tx.Perm&^sIFMT, tx.Gid)
+		if errno != 0 {
+			return nil, errno
+		}
+		rx.Qid = n.qid
+
+	case plan9.Tlink:
+		if f == nil {
+			return nil, syscall.EBADF
+		}
+		dir, _, errno := s.entry(tx.Dfid, tx.Name)
+		if errno != syscall.ENOENT {
+			return nil, syscall.EEXIST
+		}
+		dir.dir[tx.Name] = f.n
+		f.n.attr.Nlink++
+
+	case plan9.Trename:
+		dir, old, errno := s.entry(tx.Dfid, tx.Name)
+		if errno == 0 {
+			s.unlink(old, false)
+		} else if errno != syscall.ENOENT {
+			return nil, errno
+		}
+		s.unlink(f.n, true)
+		dir.dir[tx.Name] = f.n
+		f.n.attr.Nlink++
+
+	case plan9.Trenameat:
+		_, n, errno := s.entry(tx.Dfid, tx.Name)
+		if errno != 0 {
+			return nil, errno
+		}
+		dir, old, errno := s.entry(tx.Newdfid, tx.Newname)
+		if errno == 0 {
+			s.unlink(old, false)
+		} else if errno != syscall.ENOENT {
+			return nil, errno
+		}
+		delete(s.fids[tx.Dfid].n.dir, tx.Name)
+		dir.dir[tx.Newname] = n
+
+	case plan9.Tunlinkat:
+		dir, n, errno := s.entry(tx.Dfid, tx.Name)
+		switch {
+		case errno != 0:
+			return nil, errno
+		case n.dir == nil && tx.Flags&plan9.ATREMOVEDIR != 0:
+			return nil, syscall.ENOTDIR
+		case n.dir != nil && tx.Flags&plan9.ATREMOVEDIR == 0:
+			return nil, syscall.EISDIR
+		case len(n.dir) > 0:
+			return nil, syscall.ENOTEMPTY
+		}
+		delete(dir.dir, tx.Name)
+		n.attr.Nlink--
+
+	case plan9.Treadlink:
+		if f.n.attr.Mode&sIFMT != sIFLNK {
+			return nil, syscall.EINVAL
+		}
+		rx.Target = f.n.link
+
+	case plan9.Tgetattr:
+		rx.Attr = f.n.attr
+		rx.Attr.Valid = plan9.GETATTRBASIC
+		rx.Attr.Qid = f.n.qid
+		rx.Attr.Size = uint64(len(f.n.data))
+
+	case plan9.Tsetattr:
+		a, v := &f.n.attr, tx.Attr.Valid
+		if v&plan9.SETATTRMODE != 0 {
+			a.Mode = a.Mode&sIFMT | tx.Attr.Mode&^sIFMT
+		}
+		if v&plan9.SETATTRUID != 0 {
+			a.Uid = tx.Attr.Uid
+		}
+		if v&plan9.SETATTRGID != 0 {
+			a.Gid = tx.Attr.Gid
+		}
+		if v&plan9.SETATTRSIZE != 0 {
+			f.n.data = append(f.n.data, make([]byte, tx.Attr.Size)...)[:tx.Attr.Size]
+		}
+		if v&plan9.SETATTRMTIMESET != 0 {
+			a.MtimeSec, a.MtimeNsec = tx.Attr.MtimeSec, tx.Attr.MtimeNsec
+		}
+
+	case plan9.Txattrwalk:
+		x := &lfid{n: f.n}
+		if tx.Name == "" {
+			var names []string
+			for name := range f.n.xattr {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				x.xdata = append(append(x.xdata, name...), 0)
+			}
+		} else if v, ok := f.n.xattr[tx.Name]; ok {
+			x.xdata = v
+		} else {
+			return nil, syscall.ENODATA
+		}
+		s.fids[tx.Newfid] = x
+		rx.Size = uint64(len(x.xdata))
+
+	case plan9.Txattrcreate:
+		f.xname, f.xsize, f.xdata = tx.Name, tx.Size, nil
+
+	case plan9.Tread:
+		b := f.n.data
+		if f.xdata != nil {
+			b = f.xdata
+		}
+		if tx.Offset < uint64(len(b)) {
+			b = b[tx.Offset:]
+			rx.Data = b[:min(len(b), int(tx.Count))]
+		}
+
+	case plan9.Twrite:
+		if f.xname != "" {
+			f.xdata = append(f.xdata, tx.Data...)
+		} else {
+			end := tx.Offset + uint64(len(tx.Data))
+			if end > uint64(len(f.n.data)) {
+				f.n.data = append(f.n.data, make([]byte, end-uint64(len(f.n.data)))...)
+			}
+			copy(f.n.data[tx.Offset:], tx.Data)
+		}
+		rx.Count = uint32(len(tx.Data))
+
+	case plan9.Treaddir:
+		s.readdir = max(s.readdir, tx.Count)
+		var names []string
+		for name := range f.n.dir {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i := tx.Offset; i < uint64(len(names)); i++ {
+			n := f.n.dir[names[i]]
+			d := plan9.Dirent{Qid: n.qid, Offset: i + 1, Type: uint8(n.attr.Mode >> 12), Name: names[i]}
+			b := plan9.AppendDirent(rx.Data, &d)
+			if len(b) > int(tx.Count) {
+				break
+			}
+			rx.Data = b
+		}
+
+	case plan9.Tstatfs:
+		rx.Statfs = plan9.Statfs{Type: 0x01021997, Bsize: 4096, Files: s.path, Namelen: 255}
+
+	case plan9.Tfsync:
+
+	case plan9.Tlock:
+		l := tx.Lock
+		switch {
+		case l.Type == plan9.LOCKUNLCK:
+			s.lock = nil
+		case s.lock != nil && s.lock.ProcID != l.ProcID:
+			rx.Status = plan9.LOCKBLOCKED
+		default:
+			s.lock = &l
+		}
+
+	case plan9.Tgetlock:
+		rx.Lock = tx.Lock
+		if s.lock != nil && s.lock.ProcID != tx.Lock.ProcID {
+			rx.Lock = *s.lock
+		} else {
+			rx.Lock.Type = plan9.LOCKUNLCK
+		}
+	}
+	return rx, 0
+}
+
+// ldir lists the names in the directory fid, reading them with Readdirall.
+func ldir(t *testing.T, dir *Fid) []string {
+	t.Helper()
+	d, err := dir.Walk("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Lopen(0); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := d.Readdirall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestDotLFiles(t *testing.T) {
+	s := newLserver()
+	root := s.dial(t)
+
+	f, err := root.Walk("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Lcreate("file", 2, 0o644, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Fsync(true); err != nil {
+		t.Error(err)
+	}
+	if err := f.Lcreate("again", 2, 0o644, 100); err == nil {
+		t.Errorf("Lcreate on a file succeeded")
+	}
+	f.Close()
+
+	if _, err := root.Mkdir("dir", 0o750, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Mkdir("dir", 0o750, 100); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("second Mkdir: %v, want EEXIST", err)
+	}
+	if _, err := root.Symlink("link", "file", 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Mknod("fifo", 0o010644, 0, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if names := ldir(t, root); !slices.Equal(names, []string{"dir", "fifo", "file", "link"}) {
+		t.Errorf("root holds %q", names)
+	}
+
+	link, err := root.Walk("link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := link.Readlink(); err != nil || target != "file" {
+		t.Errorf("Readlink = %q, %v", target, err)
+	}
+	link.Close()
+
+	f, err = root.Walk("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	a, err := f.Getattr(plan9.GETATTRBASIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Mode != sIFREG|0o644 || a.Gid != 100 || a.Size != 12 || a.Qid != f.Qid() {
+		t.Errorf("Getattr = %v", a)
+	}
+	if err := f.Setattr(&plan9.Attr{Valid: plan9.SETATTRMODE | plan9.SETATTRSIZE, Mode: 0o600, Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := f.Getattr(plan9.GETATTRBASIC); err != nil || a.Mode != sIFREG|0o600 || a.Size != 5 {
+		t.Errorf("Getattr after Setattr = %v, %v", a, err)
+	}
+	if err := f.Lopen(0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if n, _ := f.ReadAt(buf[:5], 0); string(buf[:n]) != "hello" {
+		t.Errorf("read %q after truncation", buf[:n])
+	}
+
+	sfs, err := f.Statfs()
+	if err != nil || sfs.Bsize != 4096 || sfs.Namelen != 255 {
+		t.Errorf("Statfs = %+v, %v", sfs, err)
+	}
+
+	dir, err := root.Walk("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if err := f.Rename(dir, "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Link(f, "hard"); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := f.Getattr(plan9.GETATTRBASIC); err != nil || a.Nlink != 2 {
+		t.Errorf("Getattr after Link = %v, %v", a, err)
+	}
+	if err := dir.Renameat("moved", root, "back"); err != nil {
+		t.Fatal(err)
+	}
+	if names := ldir(t, root); !slices.Equal(names, []string{"back", "dir", "fifo", "link"}) {
+		t.Errorf("root holds %q", names)
+	}
+	if names := ldir(t, dir); !slices.Equal(names, []string{"hard"}) {
+		t.Errorf("dir holds %q", names)
+	}
+
+	if err := root.Unlinkat("dir", 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("Unlinkat of directory without ATREMOVEDIR: %v", err)
+	}
+	if err := root.Unlinkat("dir", plan9.ATREMOVEDIR); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("Unlinkat of full directory: %v", err)
+	}
+	if err := dir.Unlinkat("hard", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Unlinkat("dir", plan9.ATREMOVEDIR); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Unlinkat("dir", plan9.ATREMOVEDIR); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("second Unlinkat: %v, want ENOENT", err)
+	}
+}
+
+func TestDotLXattr(t *testing.T) {
+	s := newLserver()
+	root := s.dial(t)
+
+	for _, name := range []string{"user.b", "user.a"} {
+		x, err := root.Walk("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := []byte("value of " + name)
+		if err := x.Xattrcreate(name, uint64(len(val)), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := x.Write(val); err != nil {
+			t.Fatal(err)
+		}
+		if err := x.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	x, size, err := root.Xattrwalk("user.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	if _, err := x.ReadFull(buf); err != nil || string(buf) != "value of user.a" {
+		t.Errorf("user.a = %q, %v", buf, err)
+	}
+	x.Close()
+
+	x, size, err = root.Xattrwalk("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, size)
+	if _, err := x.ReadFull(buf); err != nil || string(buf) != "user.a\x00user.b\x00" {
+		t.Errorf("attribute list %q, %v", buf, err)
+	}
+	x.Close()
+
+	if _, _, err := root.Xattrwalk("user.c"); !errors.Is(err, syscall.ENODATA) {
+		t.Errorf("Xattrwalk of missing attribute: %v", err)
+	}
+}
+
+func TestDotLLock(t *testing.T) {
+	s := newLserver()
+	root := s.dial(t)
+	f, err := root.Walk("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Lcreate("file", 2, 0o644, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &plan9.Flock{Type: plan9.LOCKWRLCK, ProcID: 1, ClientID: "test"}
+	if st, err := f.Lock(l); err != nil || st != plan9.LOCKSUCCESS {
+		t.Fatalf("Lock = %d, %v", st, err)
+	}
+	other := &plan9.Flock{Type: plan9.LOCKRDLCK, ProcID: 2, ClientID: "test"}
+	if st, err := f.Lock(other); err != nil || st != plan9.LOCKBLOCKED {
+		t.Errorf("conflicting Lock = %d, %v", st, err)
+	}
+	if held, err := f.Getlock(other); err != nil || held.Type != plan9.LOCKWRLCK || held.ProcID != 1 {
+		t.Errorf("Getlock = %v, %v", held, err)
+	}
+	if _, err := f.Lock(&plan9.Flock{Type: plan9.LOCKUNLCK, ProcID: 1, ClientID: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := f.Getlock(other); err != nil || held.Type != plan9.LOCKUNLCK {
+		t.Errorf("Getlock after unlock = %v, %v", held, err)
+	}
+}
+
+func TestDotLReaddirIounit(t *testing.T) {
+	s := newLserver()
+	s.iounit = 64
+	root := s.dial(t)
+	var want []string
+	for i := 0; i < 20; i++ {
+		name := string(rune('a'+i)) + "-directory"
+		if _, err := root.Mkdir(name, 0o755, 100); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	if names := ldir(t, root); !slices.Equal(names, want) {
+		t.Errorf("Readdirall = %q, want %q", names, want)
+	}
+	if s.readdir > s.iounit {
+		t.Errorf("Treaddir count %d exceeds iounit %d", s.readdir, s.iounit)
+	}
+}
+
+func TestDotLErrors(t *testing.T) {
+	s := newLserver()
+	root := s.dial(t)
+	if _, err := root.Walk("missing"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Walk of missing file: %v", err)
+	}
+	var uerr *UnixError
+	if _, err := root.Readlink(); !errors.As(err, &uerr) || uerr.Errno != syscall.EINVAL {
+		t.Errorf("Readlink of directory: %v", err)
+	}
+	f, err := root.Walk("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := f.Getattr(plan9.GETATTRBASIC); err == nil {
+		t.Errorf("Getattr on closed fid succeeded")
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"io"
 	"os"
 	"strings"
@@ -12,9 +13,10 @@ import (
 func getuser() string { return os.Getenv("USER") }
 
 type Fid struct {
-	qid  plan9.Qid
-	fid  uint32
-	mode uint8
+	qid    plan9.Qid
+	fid    uint32
+	mode   uint8
+	iounit uint32 // from Ropen or Rcreate; 0 if unknown
 	// f guards offset and c.
 	f sync.Mutex
 	// c holds the underlying connection.
@@ -62,27 +64,50 @@ func (fid *Fid) clunked() error {
 }
 
 func (fid *Fid) Create(name string, mode uint8, perm uint32) error {
+	return fid.CreateContext(context.Background(), name, mode, perm)
+}
+
+// CreateContext is like Create but gives up when ctx is done.
+func (fid *Fid) CreateContext(ctx context.Context, name string, mode uint8, perm uint32) error {
+	return fid.createExtension(ctx, name, mode, perm, "")
+}
+
+// CreateExtension is like Create but also sends the 9P2000.u extension
+// string describing a special file: the target of a symbolic link
+// (DMSYMLINK), "b major minor" or "c major minor" for a device (DMDEVICE),
+// or the fid number of the target of a hard link (DMLINK).
+// The extension is dropped on connections not speaking 9P2000.u.
+func (fid *Fid) CreateExtension(name string, mode uint8, perm uint32, ext string) error {
+	return fid.createExtension(context.Background(), name, mode, perm, ext)
+}
+
+func (fid *Fid) createExtension(ctx context.Context, name string, mode uint8, perm uint32, ext string) error {
 	conn, err := fid.conn()
 	if err != nil {
 		return err
 	}
-	tx := &plan9.Fcall{Type: plan9.Tcreate, Fid: fid.fid, Name: name, Mode: mode, Perm: perm}
-	rx, err := conn.rpc(tx, nil)
+	tx := &plan9.Fcall{Type: plan9.Tcreate, Fid: fid.fid, Name: name, Mode: mode, Perm: perm, Extension: ext}
+	rx, err := conn.rpcContext(ctx, tx, nil)
 	if err != nil {
 		return err
 	}
 	fid.mode = mode
 	fid.qid = rx.Qid
+	fid.iounit = rx.Iounit
 	return nil
 }
 
 func (fid *Fid) Dirread() ([]*plan9.Dir, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return nil, err
+	}
 	buf := make([]byte, plan9.STATMAX)
 	n, err := fid.Read(buf)
 	if err != nil {
 		return nil, err
 	}
-	return dirUnpack(buf[0:n])
+	return dirUnpack(buf[0:n], conn.dialect)
 }
 
 func (fid *Fid) Dirreadall() ([]*plan9.Dir, error) {
@@ -103,7 +128,7 @@ func (fid *Fid) Dirreadall() ([]*plan9.Dir, error) {
 	}
 }
 
-func dirUnpack(b []byte) ([]*plan9.Dir, error) {
+func dirUnpack(b []byte, dl plan9.Dialect) ([]*plan9.Dir, error) {
 	var err error
 	dirs := make([]*plan9.Dir, 0, 10)
 	for len(b) > 0 {
@@ -117,7 +142,7 @@ func dirUnpack(b []byte) ([]*plan9.Dir, error) {
 			break
 		}
 		var d *plan9.Dir
-		d, err = plan9.UnmarshalDir(b[0 : n+2])
+		d, err = plan9.UnmarshalDirDialect(b[0:n+2], dl)
 		if err != nil {
 			break
 		}
@@ -135,15 +160,22 @@ func dirUnpack(b []byte) ([]*plan9.Dir, error) {
 }
 
 func (fid *Fid) Open(mode uint8) error {
+	return fid.OpenContext(context.Background(), mode)
+}
+
+// OpenContext is like Open but gives up when ctx is done.
+func (fid *Fid) OpenContext(ctx context.Context, mode uint8) error {
 	conn, err := fid.conn()
 	if err != nil {
 		return err
 	}
 	tx := &plan9.Fcall{Type: plan9.Topen, Fid: fid.fid, Mode: mode}
-	if _, err := conn.rpc(tx, nil); err != nil {
+	rx, err := conn.rpcContext(ctx, tx, nil)
+	if err != nil {
 		return err
 	}
 	fid.mode = mode
+	fid.iounit = rx.Iounit
 	return nil
 }
 
@@ -151,13 +183,36 @@ func (fid *Fid) Qid() plan9.Qid {
 	return fid.qid
 }
 
+// iosize returns the largest count to use in a Tread or Twrite on fid:
+// the iounit the server gave when fid was opened, if any, limited by the
+// message size.
+func (fid *Fid) iosize(c *conn) uint32 {
+	n := c.msize - plan9.IOHDRSZ
+	if fid.iounit != 0 && fid.iounit < n {
+		n = fid.iounit
+	}
+	return n
+}
+
 func (fid *Fid) Read(b []byte) (n int, err error) {
-	return fid.readAt(b, -1)
+	return fid.readAt(context.Background(), b, -1)
+}
+
+// ReadContext is like Read but gives up when ctx is done, returning
+// ctx.Err(). A read that completes despite the cancellation is returned
+// as usual.
+func (fid *Fid) ReadContext(ctx context.Context, b []byte) (n int, err error) {
+	return fid.readAt(ctx, b, -1)
 }
 
 func (fid *Fid) ReadAt(b []byte, offset int64) (n int, err error) {
+	return fid.ReadAtContext(context.Background(), b, offset)
+}
+
+// ReadAtContext is like ReadAt but gives up when ctx is done.
+func (fid *Fid) ReadAtContext(ctx context.Context, b []byte, offset int64) (n int, err error) {
 	for len(b) > 0 {
-		m, err := fid.readAt(b, offset)
+		m, err := fid.readAt(ctx, b, offset)
 		if err != nil {
 			return n, err
 		}
@@ -170,15 +225,14 @@ func (fid *Fid) ReadAt(b []byte, offset int64) (n int, err error) {
 	return n, nil
 }
 
-func (fid *Fid) readAt(b []byte, offset int64) (n int, err error) {
+func (fid *Fid) readAt(ctx context.Context, b []byte, offset int64) (n int, err error) {
 	conn, err := fid.conn()
 	if err != nil {
 		return 0, err
 	}
-	msize := conn.msize - plan9.IOHDRSZ
 	n = len(b)
-	if uint32(n) > msize {
-		n = int(msize)
+	if max := fid.iosize(conn); uint32(n) > max {
+		n = int(max)
 	}
 	o := offset
 	if o == -1 {
@@ -187,7 +241,7 @@ func (fid *Fid) readAt(b []byte, offset int64) (n int, err error) {
 		fid.f.Unlock()
 	}
 	tx := &plan9.Fcall{Type: plan9.Tread, Fid: fid.fid, Offset: uint64(o), Count: uint32(n)}
-	rx, err := conn.rpc(tx, nil)
+	rx, err := conn.rpcContext(ctx, tx, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -255,20 +309,30 @@ func (fid *Fid) Seek(n int64, whence int) (int64, error) {
 }
 
 func (fid *Fid) Stat() (*plan9.Dir, error) {
+	return fid.StatContext(context.Background())
+}
+
+// StatContext is like Stat but gives up when ctx is done.
+func (fid *Fid) StatContext(ctx context.Context) (*plan9.Dir, error) {
 	conn, err := fid.conn()
 	if err != nil {
 		return nil, err
 	}
 	tx := &plan9.Fcall{Type: plan9.Tstat, Fid: fid.fid}
-	rx, err := conn.rpc(tx, nil)
+	rx, err := conn.rpcContext(ctx, tx, nil)
 	if err != nil {
 		return nil, err
 	}
-	return plan9.UnmarshalDir(rx.Stat)
+	return plan9.UnmarshalDirDialect(rx.Stat, conn.dialect)
 }
 
 // TODO(rsc): Could use ...string instead?
 func (fid *Fid) Walk(name string) (*Fid, error) {
+	return fid.WalkContext(context.Background(), name)
+}
+
+// WalkContext is like Walk but gives up when ctx is done.
+func (fid *Fid) WalkContext(ctx context.Context, name string) (*Fid, error) {
 	conn, err := fid.conn()
 	if err != nil {
 		return nil, err
@@ -297,7 +361,7 @@ func (fid *Fid) Walk(name string) (*Fid, error) {
 			n = plan9.MAXWELEM
 		}
 		tx := &plan9.Fcall{Type: plan9.Twalk, Fid: fromfidnum, Newfid: wfidnum, Wname: elem[0:n]}
-		rx, err := conn.rpc(tx, nil)
+		rx, err := conn.rpcContext(ctx, tx, nil)
 		if err == nil && len(rx.Wqid) != n {
 			err = Error("file '" + name + "' not found")
 		}
@@ -322,24 +386,35 @@ func (fid *Fid) Walk(name string) (*Fid, error) {
 }
 
 func (fid *Fid) Write(b []byte) (n int, err error) {
-	return fid.WriteAt(b, -1)
+	return fid.WriteAtContext(context.Background(), b, -1)
+}
+
+// WriteContext is like Write but gives up when ctx is done, returning the
+// number of bytes known to have been written and ctx.Err().
+func (fid *Fid) WriteContext(ctx context.Context, b []byte) (n int, err error) {
+	return fid.WriteAtContext(ctx, b, -1)
 }
 
 func (fid *Fid) WriteAt(b []byte, offset int64) (n int, err error) {
+	return fid.WriteAtContext(context.Background(), b, offset)
+}
+
+// WriteAtContext is like WriteAt but gives up when ctx is done.
+func (fid *Fid) WriteAtContext(ctx context.Context, b []byte, offset int64) (n int, err error) {
 	conn, err := fid.conn()
 	if err != nil {
 		return 0, err
 	}
-	msize := conn.msize - plan9.IOHDRSZ
+	max := fid.iosize(conn)
 	tot := 0
 	n = len(b)
 	first := true
 	for tot < n || first {
 		want := n - tot
-		if uint32(want) > msize {
-			want = int(msize)
+		if uint32(want) > max {
+			want = int(max)
 		}
-		got, err := fid.writeAt(b[tot:tot+want], offset)
+		got, err := fid.writeAt(ctx, b[tot:tot+want], offset)
 		tot += got
 		if err != nil {
 			return tot, err
@@ -352,7 +427,7 @@ func (fid *Fid) WriteAt(b []byte, offset int64) (n int, err error) {
 	return tot, nil
 }
 
-func (fid *Fid) writeAt(b []byte, offset int64) (n int, err error) {
+func (fid *Fid) writeAt(ctx context.Context, b []byte, offset int64) (n int, err error) {
 	conn, err := fid.conn()
 	if err != nil {
 		return 0, err
@@ -364,7 +439,7 @@ func (fid *Fid) writeAt(b []byte, offset int64) (n int, err error) {
 		fid.f.Unlock()
 	}
 	tx := &plan9.Fcall{Type: plan9.Twrite, Fid: fid.fid, Offset: uint64(o), Data: b}
-	rx, err := conn.rpc(tx, nil)
+	rx, err := conn.rpcContext(ctx, tx, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -377,15 +452,20 @@ func (fid *Fid) writeAt(b []byte, offset int64) (n int, err error) {
 }
 
 func (fid *Fid) Wstat(d *plan9.Dir) error {
+	return fid.WstatContext(context.Background(), d)
+}
+
+// WstatContext is like Wstat but gives up when ctx is done.
+func (fid *Fid) WstatContext(ctx context.Context, d *plan9.Dir) error {
 	conn, err := fid.conn()
 	if err != nil {
 		return err
 	}
-	b, err := d.Bytes()
+	b, err := d.BytesDialect(conn.dialect)
 	if err != nil {
 		return err
 	}
 	tx := &plan9.Fcall{Type: plan9.Twstat, Fid: fid.fid, Stat: b}
-	_, err = conn.rpc(tx, nil)
+	_, err = conn.rpcContext(ctx, tx, nil)
 	return err
 }
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"bwsd.dev/plan9"
+)
+
+// FuzzDirUnpack checks that the stats dirUnpack decodes from a directory
+// read are encoded back the same.
+func FuzzDirUnpack(f *testing.F) {
+	dirs := []*plan9.Dir{
+		{Qid: plan9.Qid{Path: 1, Type: plan9.QTDIR}, Mode: plan9.DMDIR | 0o755, Name: "lib", Uid: "glenda", Gid: "glenda", Muid: "glenda"},
+		{Qid: plan9.Qid{Path: 2}, Mode: 0o644, Length: 12, Name: "profile", Uid: "glenda", Gid: "glenda", Muid: "glenda"},
+		{Qid: plan9.Qid{Path: 3}, Mode: plan9.DMSYMLINK | 0o777, Name: "l", Uid: "glenda", Gid: "glenda", Uidnum: 1000, Gidnum: 100, Muidnum: plan9.NOUID, Extension: "profile"},
+	}
+	for _, dl := range []plan9.Dialect{plan9.Dialect9P, plan9.Dialect9PU} {
+		var b []byte
+		for _, d := range dirs {
+			db, _ := d.BytesDialect(dl)
+			b = append(b, db...)
+			f.Add(db, uint8(dl))
+		}
+		f.Add(b, uint8(dl))
+	}
+	f.Fuzz(func(t *testing.T, b []byte, dl uint8) {
+		d := plan9.Dialect(dl % 3)
+		dirs, err := dirUnpack(b, d)
+		var b1 []byte
+		for _, dir := range dirs {
+			db, err := dir.BytesDialect(d)
+			if err != nil {
+				t.Fatalf("%v: %v", dir, err)
+			}
+			b1 = append(b1, db...)
+		}
+		if !bytes.HasPrefix(b, b1) || err == nil && len(b1) != len(b) {
+			t.Fatalf("dirUnpack(%x) = %v, %v; encoded back as %x", b, dirs, err, b1)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"bwsd.dev/plan9"
+)
+
+// FS returns an fs.FS serving the files of fsys. The result also
+// implements fs.ReadDirFS, fs.ReadFileFS and fs.StatFS, and the files it
+// opens implement fs.ReadDirFile, io.Seeker and io.ReaderAt.
+//
+// Closing fsys invalidates the result.
+func (fsys *Fsys) FS() fs.FS {
+	return ioFS{fsys}
+}
+
+type ioFS struct {
+	fsys *Fsys
+}
+
+// walk returns a fid for the file called name, an fs.FS path.
+func (f ioFS) walk(op, name string) (*Fid, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	wname := name
+	if wname == "." {
+		wname = ""
+	}
+	fid, err := f.fsys.root.Walk(wname)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return fid, nil
+}
+
+func (f ioFS) Open(name string) (fs.File, error) {
+	fid, err := f.walk("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fid.Open(plan9.OREAD); err != nil {
+		fid.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{fid: fid, name: name}, nil
+}
+
+func (f ioFS) Stat(name string) (fs.FileInfo, error) {
+	fid, err := f.walk("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	d, err := fid.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fileInfo(name, d), nil
+}
+
+func (f ioFS) ReadFile(name string) ([]byte, error) {
+	ff, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer ff.Close()
+	fid := ff.(*file).fid
+	if fid.Qid().Type&plan9.QTDIR != 0 {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	b, err := io.ReadAll(fid)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+func (f ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ff, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer ff.Close()
+	dirs, err := ff.(*file).ReadDir(-1)
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
+	return dirs, err
+}
+
+var (
+	errIsDir  = errors.New("is a directory")
+	errNotDir = errors.New("not a directory")
+)
+
+// fileInfo returns the fs.FileInfo for d, found at the fs.FS path name.
+// The root of a 9P tree is often called "/", which fs.FS does not allow.
+func fileInfo(name string, d *plan9.Dir) fs.FileInfo {
+	if name == "." || name == "" {
+		d.Name = "."
+	} else if d.Name == "/" || d.Name == "" {
+		d.Name = path.Base(name)
+	}
+	return d.FileInfo()
+}
+
+// A file is an open file in an ioFS.
+type file struct {
+	fid  *Fid
+	name string
+	dirs []*plan9.Dir // read by ReadDir but not yet returned
+	eof  bool         // all directory entries have been read
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	d, err := f.fid.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+	return fileInfo(f.name, d), nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.fid.Qid().Type&plan9.QTDIR != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.fid.Read(b)
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.fid.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return n, err
+}
+
+func (f *file) Seek(off int64, whence int) (int64, error) {
+	return f.fid.Seek(off, whence)
+}
+
+func (f *file) Close() error {
+	return f.fid.Close()
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.fid.Qid().Type&plan9.QTDIR == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	for !f.eof && (n <= 0 || len(f.dirs) < n) {
+		d, err := f.fid.Dirread()
+		f.dirs = append(f.dirs, d...)
+		if err == io.EOF {
+			f.eof = true
+		} else if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+	}
+	m := len(f.dirs)
+	if n > 0 && m > n {
+		m = n
+	}
+	if n > 0 && m == 0 {
+		return nil, io.EOF
+	}
+	entries := make([]fs.DirEntry, m)
+	for i, d := range f.dirs[:m] {
+		entries[i] = fs.FileInfoToDirEntry(d.FileInfo())
+	}
+	f.dirs = f.dirs[m:]
+	return entries, nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"testing"
+	"testing/fstest"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/srv"
+)
+
+// text is a read-only srv.FileHandler.
+type text string
+
+func (t text) Read(r *srv.Req)  { srv.ReadString(r, string(t)); r.Respond(nil) }
+func (t text) Write(r *srv.Req) { r.Respond(srv.ErrPerm) }
+
+func TestFS(t *testing.T) {
+	tree := srv.NewTree("glenda", "glenda", 0o555)
+	add := func(dir *srv.File, name, s string) {
+		f, err := dir.Create(name, "glenda", 0o444, text(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Length = uint64(len(s))
+	}
+	add(tree.Root, "hello", "hello, world\n")
+	sub, err := tree.Root.Create("sub", "glenda", plan9.DMDIR|0o555, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(sub, "a", "a\n")
+	add(sub, "b", "")
+
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, tree)
+	conn, err := NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys9 := fsys.FS()
+	if err := fstest.TestFS(fsys9, "hello", "sub/a", "sub/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys9, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat missing: %v, want ErrNotExist", err)
+	}
+	fi, err := fs.Stat(fsys9, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != fs.ModeDir|0o555 {
+		t.Errorf("sub mode = %v", fi.Mode())
+	}
+}
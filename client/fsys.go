@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"strings"
 
 	"bwsd.dev/plan9"
@@ -11,6 +12,8 @@ type Fsys struct {
 	root *Fid
 }
 
+// Auth returns an auth fid with which to authenticate uname for attaching
+// to aname. See AttachAuth.
 func (c *Conn) Auth(uname, aname string) (*Fid, error) {
 	conn, err := c.conn()
 	if err != nil {
@@ -20,13 +23,13 @@ func (c *Conn) Auth(uname, aname string) (*Fid, error) {
 	if err != nil {
 		return nil, err
 	}
-	tx := &plan9.Fcall{Type: plan9.Tauth, Afid: afidnum, Uname: uname, Aname: aname}
+	tx := &plan9.Fcall{Type: plan9.Tauth, Afid: afidnum, Uname: uname, Aname: aname, Uid: plan9.NOUID}
 	rx, err := conn.rpc(tx, nil)
 	if err != nil {
 		conn.putfidnum(afidnum)
 		return nil, err
 	}
-	return conn.newFid(afidnum, rx.Qid), nil
+	return conn.newFid(afidnum, rx.Aqid), nil
 }
 
 // Attach establishes a 9P fileserver connection for a given user.
@@ -34,6 +37,13 @@ func (c *Conn) Auth(uname, aname string) (*Fid, error) {
 // The afid argument specifies a fid to reuse from a previous auth message.  To
 // connect without authentication, the afid field should be set to NOFID.
 func (c *Conn) Attach(afid *Fid, user, aname string) (*Fsys, error) {
+	return c.AttachUid(afid, user, plan9.NOUID, aname)
+}
+
+// AttachUid is like Attach but also identifies the user by the numeric id
+// uid, as 9P2000.u and 9P2000.L servers expect. On 9P2000 connections uid
+// is not sent.
+func (c *Conn) AttachUid(afid *Fid, user string, uid uint32, aname string) (*Fsys, error) {
 	conn, err := c.conn()
 	if err != nil {
 		return nil, err
@@ -42,7 +52,7 @@ func (c *Conn) Attach(afid *Fid, user, aname string) (*Fsys, error) {
 	if err != nil {
 		return nil, err
 	}
-	tx := &plan9.Fcall{Type: plan9.Tattach, Afid: plan9.NOFID, Fid: fidnum, Uname: user, Aname: aname}
+	tx := &plan9.Fcall{Type: plan9.Tattach, Afid: plan9.NOFID, Fid: fidnum, Uname: user, Aname: aname, Uid: uid}
 	if afid != nil {
 		tx.Afid = afid.fid
 	}
@@ -106,6 +116,11 @@ func (fs *Fsys) Access(name string, mode int) error {
 //
 // See: open(9p)
 func (fs *Fsys) Create(name string, mode uint8, perm uint32) (*Fid, error) {
+	return fs.CreateContext(context.Background(), name, mode, perm)
+}
+
+// CreateContext is like Create but gives up when ctx is done.
+func (fs *Fsys) CreateContext(ctx context.Context, name string, mode uint8, perm uint32) (*Fid, error) {
 	i := strings.LastIndex(name, "/")
 	var dir, elem string
 	if i < 0 {
@@ -113,11 +128,11 @@ func (fs *Fsys) Create(name string, mode uint8, perm uint32) (*Fid, error) {
 	} else {
 		dir, elem = name[0:i], name[i+1:]
 	}
-	fid, err := fs.root.Walk(dir)
+	fid, err := fs.root.WalkContext(ctx, dir)
 	if err != nil {
 		return nil, err
 	}
-	err = fid.Create(elem, mode, perm)
+	err = fid.CreateContext(ctx, elem, mode, perm)
 	if err != nil {
 		fid.Close()
 		return nil, err
@@ -141,11 +156,16 @@ func (fs *Fsys) Create(name string, mode uint8, perm uint32) (*Fid, error) {
 // permission on the file if the OTRUNC bit is set.  For the open system call,
 // unlike the implicit open in exec(3), OEXEC is actually identical to OREAD.
 func (fs *Fsys) Open(name string, mode uint8) (*Fid, error) {
-	fid, err := fs.root.Walk(name)
+	return fs.OpenContext(context.Background(), name, mode)
+}
+
+// OpenContext is like Open but gives up when ctx is done.
+func (fs *Fsys) OpenContext(ctx context.Context, name string, mode uint8) (*Fid, error) {
+	fid, err := fs.root.WalkContext(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	if err := fid.Open(mode); err != nil {
+	if err := fid.OpenContext(ctx, mode); err != nil {
 		fid.Close()
 		return nil, err
 	}
@@ -161,11 +181,16 @@ func (fs *Fsys) Remove(name string) error {
 }
 
 func (fs *Fsys) Stat(name string) (*plan9.Dir, error) {
-	fid, err := fs.root.Walk(name)
+	return fs.StatContext(context.Background(), name)
+}
+
+// StatContext is like Stat but gives up when ctx is done.
+func (fs *Fsys) StatContext(ctx context.Context, name string) (*plan9.Dir, error) {
+	fid, err := fs.root.WalkContext(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	d, err := fid.Stat()
+	d, err := fid.StatContext(ctx)
 	fid.Close()
 	return d, err
 }
@@ -0,0 +1,363 @@
+package client
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Sizes of the p9sk1 messages and their fields. See authsrv(6).
+const (
+	ANAMELEN   = 28 // user and host names
+	AERRLEN    = 64 // authentication server errors
+	DOMLEN     = 48 // authentication domains
+	DESKEYLEN  = 7  // DES keys
+	CHALLEN    = 8  // challenges
+	TICKREQLEN = 3*ANAMELEN + CHALLEN + DOMLEN + 1
+	TICKETLEN  = CHALLEN + 2*ANAMELEN + DESKEYLEN + 1
+	AUTHENTLEN = CHALLEN + 4 + 1
+)
+
+// Message types of the p9sk1 protocol and its authentication server.
+const (
+	AuthTreq = 1  // ticket request
+	AuthOK   = 4  // server's reply to a ticket request
+	AuthErr  = 5  // server's error, followed by AERRLEN bytes of text
+	AuthTs   = 64 // ticket encrypted with the server's key
+	AuthTc   = 65 // ticket encrypted with the client's key
+	AuthAs   = 66 // server's authenticator
+	AuthAc   = 67 // client's authenticator
+)
+
+// A Ticketreq is a request for p9sk1 tickets. The server fills in Type,
+// AuthID, AuthDom and Chal; the client adds HostID and UID before passing
+// it to the authentication server.
+type Ticketreq struct {
+	Type    byte
+	AuthID  string // the server's user
+	AuthDom string // the server's authentication domain
+	Chal    [CHALLEN]byte
+	HostID  string // the client's user
+	UID     string // the user to authenticate as
+}
+
+// Marshal returns tr in its TICKREQLEN-byte wire form.
+func (tr *Ticketreq) Marshal() []byte {
+	b := make([]byte, 0, TICKREQLEN)
+	b = append(b, tr.Type)
+	b = putName(b, tr.AuthID, ANAMELEN)
+	b = putName(b, tr.AuthDom, DOMLEN)
+	b = append(b, tr.Chal[:]...)
+	b = putName(b, tr.HostID, ANAMELEN)
+	b = putName(b, tr.UID, ANAMELEN)
+	return b
+}
+
+// Unmarshal sets tr from its wire form in b.
+func (tr *Ticketreq) Unmarshal(b []byte) error {
+	if len(b) != TICKREQLEN {
+		return fmt.Errorf("ticket request of %d bytes, want %d", len(b), TICKREQLEN)
+	}
+	tr.Type, b = b[0], b[1:]
+	tr.AuthID, b = getName(b, ANAMELEN)
+	tr.AuthDom, b = getName(b, DOMLEN)
+	b = b[copy(tr.Chal[:], b):]
+	tr.HostID, b = getName(b, ANAMELEN)
+	tr.UID, _ = getName(b, ANAMELEN)
+	return nil
+}
+
+// A TicketSource obtains the tickets p9sk1 needs from an authentication
+// server, or something standing in for one.
+type TicketSource interface {
+	// Tickets returns the tickets answering tr, each TICKETLEN bytes:
+	// one encrypted with the client's key and one with the server's.
+	Tickets(tr *Ticketreq) (cticket, sticket []byte, err error)
+}
+
+// AuthServer returns a TicketSource that asks the authentication server at
+// addr, a dial string whose network and service default to net and ticket.
+func AuthServer(addr string) TicketSource {
+	return authServer(addr)
+}
+
+type authServer string
+
+func (addr authServer) Tickets(tr *Ticketreq) (cticket, sticket []byte, err error) {
+	d, err := ParseDialString(string(addr), "net", "ticket")
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := d.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+	req := *tr
+	req.Type = AuthTreq
+	if _, err := c.Write(req.Marshal()); err != nil {
+		return nil, nil, err
+	}
+	var typ [1]byte
+	if _, err := io.ReadFull(c, typ[:]); err != nil {
+		return nil, nil, err
+	}
+	switch typ[0] {
+	case AuthOK:
+	case AuthErr:
+		msg := make([]byte, AERRLEN)
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return nil, nil, err
+		}
+		s, _ := getName(msg, AERRLEN)
+		return nil, nil, fmt.Errorf("%s: %s", addr, s)
+	default:
+		return nil, nil, fmt.Errorf("%s: unexpected reply type %d", addr, typ[0])
+	}
+	b := make([]byte, 2*TICKETLEN)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, nil, err
+	}
+	return b[:TICKETLEN], b[TICKETLEN:], nil
+}
+
+// P9sk1 returns an Authenticator for the protocol "p9sk1", in which client
+// and server prove their identities to each other with tickets from an
+// authentication server:
+//
+//	C→S: CHc
+//	S→C: AuthTreq, IDs, DN, CHs, -, -
+//	C→A: AuthTreq, IDs, DN, CHs, IDc, IDr
+//	A→C: Kc{AuthTc, CHs, IDc, IDr, Kn}, Ks{AuthTs, CHs, IDc, IDr, Kn}
+//	C→S: Ks{AuthTs, CHs, IDc, IDr, Kn}, Kn{AuthAc, CHs}
+//	S→C: Kn{AuthAs, CHc}
+//
+// key is the client's DES key, as returned by PassToKey, and tickets
+// stands in for the authentication server A.
+func P9sk1(key []byte, tickets TicketSource) Authenticator {
+	return &p9sk1{key: key, tickets: tickets}
+}
+
+type p9sk1 struct {
+	key     []byte
+	tickets TicketSource
+}
+
+func (*p9sk1) Proto() string { return "p9sk1" }
+
+func (a *p9sk1) Authenticate(rw io.ReadWriter, user string) error {
+	var cchal [CHALLEN]byte
+	if _, err := rand.Read(cchal[:]); err != nil {
+		return err
+	}
+	if _, err := rw.Write(cchal[:]); err != nil {
+		return err
+	}
+	buf := make([]byte, TICKREQLEN)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	var tr Ticketreq
+	if err := tr.Unmarshal(buf); err != nil {
+		return err
+	}
+	if tr.Type != AuthTreq {
+		return fmt.Errorf("p9sk1: unexpected ticket request type %d", tr.Type)
+	}
+	tr.HostID = user
+	tr.UID = user
+	cticket, sticket, err := a.tickets.Tickets(&tr)
+	if err != nil {
+		return err
+	}
+	if len(cticket) != TICKETLEN || len(sticket) != TICKETLEN {
+		return errors.New("p9sk1: bad ticket length")
+	}
+	t, err := decryptTicket(a.key, cticket)
+	if err != nil {
+		return err
+	}
+	if t.num != AuthTc || t.chal != tr.Chal {
+		return errors.New("p9sk1: bad ticket; wrong password?")
+	}
+
+	msg := append(append([]byte(nil), sticket...), encryptAuthenticator(t.key[:], authenticator{AuthAc, tr.Chal, 0})...)
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+	buf = make([]byte, AUTHENTLEN)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if reply := decryptAuthenticator(t.key[:], buf); reply != (authenticator{AuthAs, cchal, 0}) {
+		return errors.New("server failed to authenticate")
+	}
+	return nil
+}
+
+// A ticket is a decrypted p9sk1 ticket.
+type ticket struct {
+	num  byte
+	chal [CHALLEN]byte
+	cuid string
+	suid string
+	key  [DESKEYLEN]byte // the session key, Kn
+}
+
+func (t *ticket) marshal() []byte {
+	b := make([]byte, 0, TICKETLEN)
+	b = append(b, t.num)
+	b = append(b, t.chal[:]...)
+	b = putName(b, t.cuid, ANAMELEN)
+	b = putName(b, t.suid, ANAMELEN)
+	return append(b, t.key[:]...)
+}
+
+// encryptTicket returns t encrypted with key.
+func encryptTicket(key []byte, t *ticket) []byte {
+	b := t.marshal()
+	encrypt(key, b)
+	return b
+}
+
+// decryptTicket decrypts b, a ticket encrypted with key.
+func decryptTicket(key, b []byte) (*ticket, error) {
+	if len(b) != TICKETLEN {
+		return nil, fmt.Errorf("ticket of %d bytes, want %d", len(b), TICKETLEN)
+	}
+	b = append([]byte(nil), b...)
+	decrypt(key, b)
+	t := &ticket{num: b[0]}
+	b = b[1+copy(t.chal[:], b[1:]):]
+	t.cuid, b = getName(b, ANAMELEN)
+	t.suid, b = getName(b, ANAMELEN)
+	copy(t.key[:], b)
+	return t, nil
+}
+
+// An authenticator proves knowledge of a ticket's session key.
+type authenticator struct {
+	num  byte
+	chal [CHALLEN]byte
+	id   uint32
+}
+
+func encryptAuthenticator(key []byte, a authenticator) []byte {
+	b := append([]byte{a.num}, a.chal[:]...)
+	b = binary.LittleEndian.AppendUint32(b, a.id)
+	encrypt(key, b)
+	return b
+}
+
+func decryptAuthenticator(key, b []byte) authenticator {
+	b = append([]byte(nil), b...)
+	decrypt(key, b)
+	a := authenticator{num: b[0], id: binary.LittleEndian.Uint32(b[1+CHALLEN:])}
+	copy(a.chal[:], b[1:])
+	return a
+}
+
+// putName appends s to b as a NUL-padded field of n bytes, truncating it
+// to leave room for at least one NUL.
+func putName(b []byte, s string, n int) []byte {
+	if len(s) >= n {
+		s = s[:n-1]
+	}
+	b = append(b, s...)
+	return append(b, make([]byte, n-len(s))...)
+}
+
+// getName returns the NUL-padded string in the first n bytes of b, and the
+// rest of b.
+func getName(b []byte, n int) (string, []byte) {
+	s := b[:n]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return string(s), b[n:]
+}
+
+// PassToKey returns the DES key derived from password, as the
+// authentication server stores it.
+func PassToKey(password string) []byte {
+	buf := make([]byte, ANAMELEN)
+	n := len(password)
+	if n >= ANAMELEN {
+		n = ANAMELEN - 1
+	}
+	copy(buf, "        ")
+	copy(buf, password[:n])
+	buf[n] = 0
+	key := make([]byte, DESKEYLEN)
+	t := 0
+	for {
+		for i := 0; i < DESKEYLEN; i++ {
+			key[i] = buf[t+i]>>i + buf[t+i+1]<<(8-(i+1))
+		}
+		if n <= 8 {
+			return key
+		}
+		n -= 8
+		t += 8
+		if n < 8 {
+			t -= 8 - n
+			n = 8
+		}
+		encrypt(key, buf[t:t+8])
+	}
+}
+
+// desCipher returns the DES cipher for a 7-byte key, spreading its 56 bits
+// over the 8 bytes DES expects, leaving the parity bits, which it ignores,
+// clear.
+func desCipher(key []byte) cipher.Block {
+	hi := binary.BigEndian.Uint32(key[0:4])
+	lo := uint32(key[4])<<24 | uint32(key[5])<<16 | uint32(key[6])<<8
+	c, err := des.NewCipher([]byte{
+		byte(hi >> 24), byte(hi >> 17), byte(hi >> 10), byte(hi >> 3),
+		byte(hi<<4 | lo>>28), byte(lo >> 21), byte(lo >> 14), byte(lo >> 7),
+	})
+	if err != nil {
+		panic(err) // the key is always 8 bytes
+	}
+	return c
+}
+
+// encrypt encrypts b, at least 8 bytes, in place with key, the way Plan 9
+// does: DES in 8-byte blocks advancing 7 bytes at a time, with the last
+// block ending at the end of b.
+func encrypt(key, b []byte) {
+	if len(b) < 8 {
+		return
+	}
+	c := desCipher(key)
+	n := (len(b) - 1) / 7
+	r := (len(b) - 1) % 7
+	for i := 0; i < n; i++ {
+		c.Encrypt(b[7*i:7*i+8], b[7*i:7*i+8])
+	}
+	if r != 0 {
+		c.Encrypt(b[len(b)-8:], b[len(b)-8:])
+	}
+}
+
+// decrypt undoes encrypt.
+func decrypt(key, b []byte) {
+	if len(b) < 8 {
+		return
+	}
+	c := desCipher(key)
+	n := (len(b) - 1) / 7
+	r := (len(b) - 1) % 7
+	if r != 0 {
+		c.Decrypt(b[len(b)-8:], b[len(b)-8:])
+	}
+	for i := n - 1; i >= 0; i-- {
+		c.Decrypt(b[7*i:7*i+8], b[7*i:7*i+8])
+	}
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"io"
+
+	"bwsd.dev/plan9"
+)
+
+// Streaming copies keep several Treads or Twrites outstanding, so that a
+// large copy over a slow link is limited by bandwidth rather than latency.
+//
+// The number outstanding starts at one and doubles after each full-sized
+// transfer, up to the connection's pipeline depth. A short read or write
+// drops it back to one.
+//
+// Reading ahead is only safe on files that hold data, since a read past
+// the end of a file that behaves like a stream, such as a plumb port or
+// acme's event file, waits for the next message and takes it. Writing
+// ahead is only safe on files that do not care about the order of writes,
+// since a server may carry out requests in any order; control files such
+// as acme's ctl do care. WriteTo and ReadFrom, which io.Copy uses,
+// therefore keep a single request outstanding; StreamTo, StreamFrom and
+// CopyFile pipeline.
+
+// An ioResult is the outcome of one pipelined Tread or Twrite.
+type ioResult struct {
+	data []byte // Tread: the data read
+	n    int    // Twrite: the count written
+	err  error
+}
+
+// pipe issues and collects pipelined requests on a fid, in offset order.
+type pipe struct {
+	fid     *Fid
+	conn    *conn
+	pending []chan ioResult
+	window  int
+	max     int // largest window
+}
+
+func newPipe(fid *Fid) (*pipe, error) {
+	conn, err := fid.conn()
+	if err != nil {
+		return nil, err
+	}
+	return &pipe{fid: fid, conn: conn, window: 1, max: conn.pipeline}, nil
+}
+
+// full reports whether the pipe has as many requests outstanding as it may.
+func (p *pipe) full() bool {
+	return len(p.pending) >= p.window
+}
+
+// start sends tx in the background.
+func (p *pipe) start(tx *plan9.Fcall) {
+	ch := make(chan ioResult, 1)
+	p.pending = append(p.pending, ch)
+	go func() {
+		rx, err := p.conn.rpc(tx, nil)
+		if err != nil {
+			ch <- ioResult{err: err}
+			return
+		}
+		ch <- ioResult{data: rx.Data, n: int(rx.Count)}
+	}()
+}
+
+// next waits for the oldest outstanding request.
+func (p *pipe) next() ioResult {
+	r := <-p.pending[0]
+	p.pending = p.pending[1:]
+	return r
+}
+
+// grow widens the window after a full-sized transfer; reset narrows it
+// after a short one.
+func (p *pipe) grow() {
+	if p.window *= 2; p.window > p.max {
+		p.window = p.max
+	}
+}
+
+func (p *pipe) reset() {
+	p.drain()
+	p.window = 1
+}
+
+// drain waits for, and discards, the outstanding requests.
+func (p *pipe) drain() {
+	for len(p.pending) > 0 {
+		p.next()
+	}
+}
+
+// WriteTo writes the contents of fid, from its current offset to the end,
+// to w. It implements io.WriterTo, reading as much as a message holds at
+// a time but sending each read only once the last has been answered.
+func (fid *Fid) WriteTo(w io.Writer) (int64, error) {
+	return fid.writeTo(w, false)
+}
+
+// StreamTo is like WriteTo but keeps several reads outstanding. It must
+// not be used on files that block at the end instead of returning no data.
+func (fid *Fid) StreamTo(w io.Writer) (int64, error) {
+	return fid.writeTo(w, true)
+}
+
+func (fid *Fid) writeTo(w io.Writer, ahead bool) (int64, error) {
+	p, err := newPipe(fid)
+	if err != nil {
+		return 0, err
+	}
+	defer p.drain()
+	if !ahead {
+		p.max = 1
+	}
+	size := fid.iosize(p.conn)
+	fid.f.Lock()
+	off := fid.offset
+	fid.f.Unlock()
+	next := off // offset of the next read to send
+	var tot int64
+	for {
+		for !p.full() {
+			p.start(&plan9.Fcall{Type: plan9.Tread, Fid: fid.fid, Offset: uint64(next), Count: size})
+			next += int64(size)
+		}
+		r := p.next()
+		if r.err != nil {
+			return tot, r.err
+		}
+		if len(r.data) == 0 {
+			return tot, nil
+		}
+		n, err := w.Write(r.data)
+		tot += int64(n)
+		fid.f.Lock()
+		fid.offset = off + tot
+		fid.f.Unlock()
+		if err != nil {
+			return tot, err
+		}
+		if len(r.data) < int(size) {
+			// Reads already sent began at the wrong offset.
+			p.reset()
+			next = off + tot
+		} else {
+			p.grow()
+		}
+	}
+}
+
+// ReadFrom writes the data from r to fid, starting at its current offset,
+// until r returns io.EOF. It implements io.ReaderFrom, writing what each
+// read of r returns and sending each write only once the last has been
+// answered.
+func (fid *Fid) ReadFrom(r io.Reader) (int64, error) {
+	return fid.readFrom(r, false)
+}
+
+// StreamFrom is like ReadFrom but keeps several writes outstanding. It
+// must only be used on files that accept writes in any order.
+func (fid *Fid) StreamFrom(r io.Reader) (int64, error) {
+	return fid.readFrom(r, true)
+}
+
+func (fid *Fid) readFrom(r io.Reader, ahead bool) (int64, error) {
+	p, err := newPipe(fid)
+	if err != nil {
+		return 0, err
+	}
+	defer p.drain()
+	if !ahead {
+		p.max = 1
+	}
+	size := fid.iosize(p.conn)
+	fid.f.Lock()
+	off := fid.offset
+	fid.f.Unlock()
+	next := off // offset of the next write to send
+	var sent []int
+	var tot int64
+	var rerr error
+	for {
+		for rerr == nil && !p.full() {
+			buf := make([]byte, size)
+			n, err := r.Read(buf)
+			if n > 0 {
+				p.start(&plan9.Fcall{Type: plan9.Twrite, Fid: fid.fid, Offset: uint64(next), Data: buf[:n]})
+				next += int64(n)
+				sent = append(sent, n)
+			}
+			if err != nil {
+				rerr = err
+			} else if n < int(size) {
+				// Send what we have before reading more.
+				break
+			}
+		}
+		if len(p.pending) == 0 {
+			break
+		}
+		res, want := p.next(), sent[0]
+		sent = sent[1:]
+		if res.err != nil {
+			return tot, res.err
+		}
+		tot += int64(res.n)
+		fid.f.Lock()
+		fid.offset = off + tot
+		fid.f.Unlock()
+		if res.n < want {
+			return tot, io.ErrShortWrite
+		}
+		if want == int(size) {
+			p.grow()
+		}
+	}
+	if rerr == io.EOF {
+		rerr = nil
+	}
+	return tot, rerr
+}
+
+// CopyFile copies the contents of src, from its current offset to the end,
+// to dst at its current offset, keeping several reads and writes
+// outstanding on each. It returns the number of bytes copied.
+func CopyFile(dst, src *Fid) (int64, error) {
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := src.StreamTo(pw)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	n, err := dst.StreamFrom(pr)
+	pr.CloseWithError(err)
+	if rerr := <-errc; rerr != nil && rerr != io.ErrClosedPipe {
+		return n, rerr
+	}
+	return n, err
+}
@@ -0,0 +1,437 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/srv"
+)
+
+// memFile is a read-write srv.FileHandler holding its data in memory.
+// If chunk is non-zero, reads return at most chunk bytes.
+type memFile struct {
+	mu    sync.Mutex
+	b     []byte
+	chunk int
+}
+
+func (m *memFile) Read(r *srv.Req) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	srv.ReadBytes(r, m.b)
+	if m.chunk > 0 && len(r.Ofcall.Data) > m.chunk {
+		r.Ofcall.Data = r.Ofcall.Data[:m.chunk]
+	}
+	r.Ofcall.Data = append([]byte(nil), r.Ofcall.Data...)
+	r.Respond(nil)
+}
+
+func (m *memFile) Write(r *srv.Req) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	off := int(r.Ifcall.Offset)
+	if n := off + len(r.Ifcall.Data); len(m.b) < n {
+		m.b = append(m.b, make([]byte, n-len(m.b))...)
+	}
+	copy(m.b[off:], r.Ifcall.Data)
+	r.Ofcall.Count = uint32(len(r.Ifcall.Data))
+	r.Respond(nil)
+}
+
+// latencyPipe is like net.Pipe but delivers each write after a delay,
+// without limiting how many writes are in flight.
+func latencyPipe(d time.Duration) (io.ReadWriteCloser, io.ReadWriteCloser) {
+	a, b := newLatencyEnd(d), newLatencyEnd(d)
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+type latencyEnd struct {
+	d    time.Duration
+	peer *latencyEnd
+	in   chan packet
+	done chan struct{}
+	once sync.Once
+	buf  []byte
+}
+
+// A packet is a write to be delivered at a given time.
+type packet struct {
+	b  []byte
+	at time.Time
+}
+
+func newLatencyEnd(d time.Duration) *latencyEnd {
+	return &latencyEnd{d: d, in: make(chan packet, 1024), done: make(chan struct{})}
+}
+
+func (e *latencyEnd) Write(b []byte) (int, error) {
+	p := packet{append([]byte(nil), b...), time.Now().Add(e.d)}
+	select {
+	case e.peer.in <- p:
+	case <-e.done:
+		return 0, io.ErrClosedPipe
+	}
+	return len(b), nil
+}
+
+func (e *latencyEnd) Read(b []byte) (int, error) {
+	for len(e.buf) == 0 {
+		select {
+		case p := <-e.in:
+			time.Sleep(time.Until(p.at))
+			e.buf = p.b
+		case <-e.done:
+			return 0, io.EOF
+		case <-e.peer.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func (e *latencyEnd) Close() error {
+	e.once.Do(func() { close(e.done) })
+	return nil
+}
+
+func mountMem(tb testing.TB, rwc1, rwc2 io.ReadWriteCloser, files map[string]*memFile) *Fsys {
+	tree := srv.NewTree("glenda", "glenda", 0o777)
+	for name, f := range files {
+		if _, err := tree.Root.Create(name, "glenda", 0o666, f); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	go srv.Serve(rwc1, tree)
+	conn, err := NewConn(rwc2)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fsys
+}
+
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func TestStreaming(t *testing.T) {
+	data := randomData(1<<20 + 12345)
+	for _, chunk := range []int{0, 1000} {
+		src := &memFile{b: data, chunk: chunk}
+		dst := &memFile{}
+		c1, c2 := net.Pipe()
+		fsys := mountMem(t, c1, c2, map[string]*memFile{"src": src, "dst": dst})
+
+		fid, err := fsys.Open("src", plan9.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if n, err := fid.WriteTo(&buf); err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("chunk %d: WriteTo = %d, %v; data match %v", chunk, n, err, bytes.Equal(buf.Bytes(), data))
+		}
+		fid.Close()
+
+		fid, err = fsys.Open("src", plan9.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		if n, err := fid.StreamTo(&buf); err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("chunk %d: StreamTo = %d, %v; data match %v", chunk, n, err, bytes.Equal(buf.Bytes(), data))
+		}
+		fid.Close()
+
+		fid, err = fsys.Open("dst", plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := fid.ReadFrom(bytes.NewReader(data)); err != nil || n != int64(len(data)) || !bytes.Equal(dst.b, data) {
+			t.Errorf("ReadFrom = %d, %v; data match %v", n, err, bytes.Equal(dst.b, data))
+		}
+		fid.Close()
+
+		dst.b = nil
+		fid, err = fsys.Open("dst", plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := fid.StreamFrom(bytes.NewReader(data)); err != nil || n != int64(len(data)) || !bytes.Equal(dst.b, data) {
+			t.Errorf("StreamFrom = %d, %v; data match %v", n, err, bytes.Equal(dst.b, data))
+		}
+		fid.Close()
+
+		dst.b = nil
+		sfid, err := fsys.Open("src", plan9.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dfid, err := fsys.Open("dst", plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := CopyFile(dfid, sfid); err != nil || n != int64(len(data)) || !bytes.Equal(dst.b, data) {
+			t.Errorf("chunk %d: CopyFile = %d, %v; data match %v", chunk, n, err, bytes.Equal(dst.b, data))
+		}
+		sfid.Close()
+		dfid.Close()
+	}
+}
+
+// streamFile is a srv.FileHandler that, like a plumb port, answers each
+// read with the next message sent to it, waiting for one if need be.
+type streamFile chan []byte
+
+func (f streamFile) Read(r *srv.Req) {
+	go func() {
+		r.Ofcall.Data = <-f
+		r.Respond(nil)
+	}()
+}
+
+func (f streamFile) Write(r *srv.Req) {
+	r.Respond(srv.ErrPerm)
+}
+
+func TestWriteToStream(t *testing.T) {
+	tree := srv.NewTree("glenda", "glenda", 0o777)
+	f := make(streamFile)
+	if _, err := tree.Root.Create("port", "glenda", 0o444, f); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, tree)
+	conn, err := NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Open("port", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+
+	// A full-sized message, then a short one and the end of the file,
+	// then a message that must be left for the next read.
+	c, err := fid.conn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := randomData(int(fid.iosize(c)))
+	go func() {
+		for _, m := range [][]byte{full, []byte("short"), nil, []byte("next")} {
+			f <- m
+		}
+	}()
+	var buf bytes.Buffer
+	if _, err := fid.WriteTo(&buf); err != nil || buf.String() != string(full)+"short" {
+		t.Fatalf("WriteTo read %d bytes, %v", buf.Len(), err)
+	}
+	b := make([]byte, 100)
+	if n, err := fid.Read(b); err != nil || string(b[:n]) != "next" {
+		t.Errorf("Read after WriteTo = %q, %v; want next", b[:n], err)
+	}
+}
+
+// orderFile is a srv.FileHandler that, like acme, carries out each write
+// in a goroutine of its own, after a random delay. It records the offsets
+// of the writes in the order it carries them out.
+type orderFile struct {
+	mu   sync.Mutex
+	offs []uint64
+}
+
+func (f *orderFile) Read(r *srv.Req) {
+	r.Respond(srv.ErrPerm)
+}
+
+func (f *orderFile) Write(r *srv.Req) {
+	go func() {
+		time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+		f.mu.Lock()
+		f.offs = append(f.offs, r.Ifcall.Offset)
+		f.mu.Unlock()
+		r.Ofcall.Count = uint32(len(r.Ifcall.Data))
+		r.Respond(nil)
+	}()
+}
+
+func TestReadFromOrder(t *testing.T) {
+	tree := srv.NewTree("glenda", "glenda", 0o777)
+	f := new(orderFile)
+	if _, err := tree.Root.Create("ctl", "glenda", 0o222, f); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, tree)
+	conn, err := NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Open("ctl", plan9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+	// Hide bytes.Reader.WriteTo, so that io.Copy uses Fid.ReadFrom.
+	r := struct{ io.Reader }{bytes.NewReader(randomData(1 << 20))}
+	if _, err := io.Copy(fid, r); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(f.offs); i++ {
+		if f.offs[i] < f.offs[i-1] {
+			t.Fatalf("write at %d carried out after write at %d", f.offs[i], f.offs[i-1])
+		}
+	}
+}
+
+const (
+	benchSize    = 4 << 20
+	benchLatency = 200 * time.Microsecond
+)
+
+func benchFsys(b *testing.B) *Fsys {
+	c1, c2 := latencyPipe(benchLatency)
+	return mountMem(b, c1, c2, map[string]*memFile{
+		"src": {b: randomData(benchSize)},
+		"dst": {},
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	fsys := benchFsys(b)
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		fid, err := fsys.Open("src", plan9.OREAD)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, struct{ io.Reader }{fid}); err != nil {
+			b.Fatal(err)
+		}
+		fid.Close()
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	fsys := benchFsys(b)
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		fid, err := fsys.Open("src", plan9.OREAD)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fid.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+		fid.Close()
+	}
+}
+
+func BenchmarkStreamTo(b *testing.B) {
+	fsys := benchFsys(b)
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		fid, err := fsys.Open("src", plan9.OREAD)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fid.StreamTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+		fid.Close()
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	fsys := benchFsys(b)
+	data := randomData(benchSize)
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		fid, err := fsys.Open("dst", plan9.OWRITE)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fid.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		fid.Close()
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	fsys := benchFsys(b)
+	data := randomData(benchSize)
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		fid, err := fsys.Open("dst", plan9.OWRITE)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fid.ReadFrom(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+		fid.Close()
+	}
+}
+
+func BenchmarkStreamFrom(b *testing.B) {
+	fsys := benchFsys(b)
+	data := randomData(benchSize)
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		fid, err := fsys.Open("dst", plan9.OWRITE)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fid.StreamFrom(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+		fid.Close()
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	fsys := benchFsys(b)
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		src, err := fsys.Open("src", plan9.OREAD)
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst, err := fsys.Open("dst", plan9.OWRITE)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := CopyFile(dst, src); err != nil {
+			b.Fatal(err)
+		}
+		src.Close()
+		dst.Close()
+	}
+}
@@ -0,0 +1,401 @@
+// 9p reads and writes the files of a 9P server, like plan9port's 9p(1).
+//
+// Usage:
+//
+//	9p [-a address] [-A aname] cmd args...
+//
+// The commands are:
+//
+//	ls [-ld] path...     list directories, or with -d the files themselves
+//	read path            copy the file to standard output
+//	readfd path          like read, but with one read outstanding at a time
+//	write [-l] path      copy standard input to the file, with -l a line per write
+//	stat path            print the file's directory entry
+//	create path...       create files
+//	rm path...           remove files
+//	rdwr path            alternately read the file and write a line of input to it
+//
+// Without -a, the first element of each path names a service in the name
+// space directory, as posted by client.ListenService: "9p read
+// acme/1/body" reads the file 1/body of the service acme. With -a, 9p
+// dials address, of the form network!netaddr!service, and paths are
+// relative to the root of its files.
+//
+// Readfd suits files whose reads have side effects, such as acme's event
+// files, where read ahead would consume data that is never printed.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: 9p [-a address] [-A aname] cmd args...\n")
+	fmt.Fprintf(os.Stderr, "possible cmds:\n")
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "\t%s\n", c.usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("9p: ")
+
+	addr := flag.String("a", "", "dial `address` instead of a posted service")
+	aname := flag.String("A", "", "attach to `aname`")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	s := &session{addr: *addr, aname: *aname, stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+	if err := s.run(flag.Args()); err != nil {
+		if errors.Is(err, errUsage) {
+			usage()
+		}
+		log.Fatal(err)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+// A session holds the settings a command runs with.
+type session struct {
+	addr   string // address to dial, or "" for a posted service
+	aname  string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(s *session, args []string) error
+}
+
+var cmds = []command{
+	{"ls", "ls [-ld] path...", (*session).ls},
+	{"read", "read path", (*session).read},
+	{"readfd", "readfd path", (*session).readfd},
+	{"write", "write [-l] path", (*session).write},
+	{"stat", "stat path", (*session).stat},
+	{"create", "create path...", (*session).create},
+	{"rm", "rm path...", (*session).rm},
+	{"rdwr", "rdwr path", (*session).rdwr},
+}
+
+// run runs the command named by args[0].
+func (s *session) run(args []string) error {
+	for _, c := range cmds {
+		if c.name == args[0] {
+			return c.run(s, args)
+		}
+	}
+	return errUsage
+}
+
+// mount connects to the server holding path and returns its files and the
+// name of path within them. Calling unmount hangs up.
+func (s *session) mount(path string) (fsys *client.Fsys, name string, unmount func(), err error) {
+	var c *client.Conn
+	if s.addr != "" {
+		c, err = client.DialAddr(s.addr)
+		name = path
+	} else {
+		service, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		if service == "" {
+			return nil, "", nil, fmt.Errorf("%s: no service named", path)
+		}
+		c, err = client.DialService(service)
+		name = rest
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	fsys, err = c.AttachAuth(client.DefaultAuthenticator, os.Getenv("USER"), s.aname)
+	if err != nil {
+		c.Close()
+		return nil, "", nil, err
+	}
+	return fsys, name, func() { fsys.Close(); c.Close() }, nil
+}
+
+// open mounts path and opens it with the given mode. Calling closeFid
+// closes the file and hangs up.
+func (s *session) open(path string, mode uint8) (fid *client.Fid, closeFid func(), err error) {
+	fsys, name, unmount, err := s.mount(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fid, err = fsys.Open(name, mode)
+	if err != nil {
+		unmount()
+		return nil, nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return fid, func() { fid.Close(); unmount() }, nil
+}
+
+// flags parses the flags of a command, returning the remaining arguments.
+// It requires there to be at least min of them, and at most max if max
+// is not -1.
+func flags(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args[1:]); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() < min || max >= 0 && fs.NArg() > max {
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+func (s *session) ls(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := fs.Bool("l", false, "")
+	dirOnly := fs.Bool("d", false, "")
+	args, err := flags(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, path := range args {
+		if err := s.ls1(path, *long, *dirOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) ls1(path string, long, dirOnly bool) error {
+	fsys, name, unmount, err := s.mount(path)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	d, err := fsys.Stat(name)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	dirs := []*plan9.Dir{d}
+	if d.Mode&plan9.DMDIR != 0 && !dirOnly {
+		fid, err := fsys.Open(name, plan9.OREAD)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", path, err)
+		}
+		dirs, err = fid.Dirreadall()
+		fid.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name < dirs[j].Name })
+	} else {
+		// Name the file as it was given.
+		d.Name = path
+	}
+	w := bufio.NewWriter(s.stdout)
+	for _, d := range dirs {
+		if long {
+			fmt.Fprintf(w, "%v %c %d %s %s %d %s %s\n",
+				plan9.Perm(d.Mode), typeChar(d.Type), d.Dev, d.Uid, d.Gid, d.Length,
+				lsTime(d.Mtime), d.Name)
+		} else {
+			fmt.Fprintf(w, "%s\n", d.Name)
+		}
+	}
+	return w.Flush()
+}
+
+// typeChar returns the character ls -l shows for the device type t.
+func typeChar(t uint16) rune {
+	if t == 0 {
+		return 'M'
+	}
+	return rune(t)
+}
+
+// lsTime formats a modification time as ls -l does: the time of day for
+// the last six months, the year before that.
+func lsTime(mtime uint32) string {
+	t := time.Unix(int64(mtime), 0)
+	if time.Since(t) < 180*24*time.Hour {
+		return t.Format("Jan _2 15:04")
+	}
+	return t.Format("Jan _2  2006")
+}
+
+func (s *session) read(args []string) error {
+	args, err := flags(flag.NewFlagSet("read", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	fid, closeFid, err := s.open(args[0], plan9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer closeFid()
+	if _, err := fid.WriteTo(s.stdout); err != nil {
+		return fmt.Errorf("read %s: %w", args[0], err)
+	}
+	return nil
+}
+
+func (s *session) readfd(args []string) error {
+	args, err := flags(flag.NewFlagSet("readfd", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	fid, closeFid, err := s.open(args[0], plan9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer closeFid()
+	// Hide Fid.WriteTo, reading in io.Copy's buffer size instead.
+	if _, err := io.Copy(s.stdout, struct{ io.Reader }{fid}); err != nil {
+		return fmt.Errorf("read %s: %w", args[0], err)
+	}
+	return nil
+}
+
+func (s *session) write(args []string) error {
+	fs := flag.NewFlagSet("write", flag.ContinueOnError)
+	byLine := fs.Bool("l", false, "")
+	args, err := flags(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	fid, closeFid, err := s.open(args[0], plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		return err
+	}
+	defer closeFid()
+	if *byLine {
+		b := bufio.NewReader(s.stdin)
+		for {
+			line, err := b.ReadString('\n')
+			if line != "" {
+				if _, err := fid.Write([]byte(line)); err != nil {
+					return fmt.Errorf("write %s: %w", args[0], err)
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Fid.ReadFrom sends one write for each read of standard input, in
+	// order, as control files need.
+	if _, err := io.Copy(fid, s.stdin); err != nil {
+		return fmt.Errorf("write %s: %w", args[0], err)
+	}
+	return nil
+}
+
+func (s *session) stat(args []string) error {
+	args, err := flags(flag.NewFlagSet("stat", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	fsys, name, unmount, err := s.mount(args[0])
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	d, err := fsys.Stat(name)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", args[0], err)
+	}
+	_, err = fmt.Fprintf(s.stdout, "%v\n", d)
+	return err
+}
+
+func (s *session) create(args []string) error {
+	args, err := flags(flag.NewFlagSet("create", flag.ContinueOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, path := range args {
+		fsys, name, unmount, err := s.mount(path)
+		if err != nil {
+			return err
+		}
+		fid, err := fsys.Create(name, plan9.OREAD, 0o666)
+		if err == nil {
+			fid.Close()
+		}
+		unmount()
+		if err != nil {
+			return fmt.Errorf("create %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (s *session) rm(args []string) error {
+	args, err := flags(flag.NewFlagSet("rm", flag.ContinueOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, path := range args {
+		fsys, name, unmount, err := s.mount(path)
+		if err != nil {
+			return err
+		}
+		err = fsys.Remove(name)
+		unmount()
+		if err != nil {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// rdwr prints the result of one read of the file, then writes it a line
+// of standard input, and so on until the input runs out. Both happen at
+// offset 0. Errors reading and writing the file are reported but do not
+// stop the loop.
+func (s *session) rdwr(args []string) error {
+	args, err := flags(flag.NewFlagSet("rdwr", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	fid, closeFid, err := s.open(args[0], plan9.ORDWR)
+	if err != nil {
+		return err
+	}
+	defer closeFid()
+	in := bufio.NewScanner(s.stdin)
+	buf := make([]byte, 4096)
+	for {
+		fid.Seek(0, io.SeekStart)
+		n, err := fid.Read(buf)
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(s.stderr, "read: %v\n", err)
+		} else {
+			fmt.Fprintf(s.stdout, "%s\n", buf[:n])
+		}
+		if !in.Scan() {
+			return in.Err()
+		}
+		fid.Seek(0, io.SeekStart)
+		if _, err := fid.Write(in.Bytes()); err != nil {
+			fmt.Fprintf(s.stderr, "write: %v\n", err)
+		}
+	}
+}
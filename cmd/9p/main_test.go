@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/srv"
+)
+
+// serve serves the directory dir on l until the test ends.
+func serve(t *testing.T, l net.Listener, dir string) {
+	t.Helper()
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.Serve(c, srv.DirFS(dir))
+		}
+	}()
+}
+
+// newSession returns a session dialing a server of a new directory,
+// which it also returns.
+func newSession(t *testing.T) (*session, string) {
+	dir := t.TempDir()
+	sock := filepath.Join(t.TempDir(), "sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, l, dir)
+	return &session{addr: "unix!" + sock}, dir
+}
+
+// do runs the command args with the given standard input, returning its
+// standard output.
+func (s *session) do(t *testing.T, in string, args ...string) string {
+	t.Helper()
+	var out, errs bytes.Buffer
+	s.stdin = strings.NewReader(in)
+	s.stdout = &out
+	s.stderr = &errs
+	if err := s.run(args); err != nil {
+		t.Fatalf("9p %s: %v", strings.Join(args, " "), err)
+	}
+	if errs.Len() > 0 {
+		t.Errorf("9p %s: %s", strings.Join(args, " "), errs.String())
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	s, dir := newSession(t)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	s.do(t, "", "create", "b", "a")
+	s.do(t, "hello, world\n", "write", "a")
+	if out := s.do(t, "", "read", "a"); out != "hello, world\n" {
+		t.Errorf("read a = %q", out)
+	}
+	if out := s.do(t, "", "readfd", "a"); out != "hello, world\n" {
+		t.Errorf("readfd a = %q", out)
+	}
+	if out := s.do(t, "", "ls", "/"); out != "a\nb\nsub\n" {
+		t.Errorf("ls / = %q", out)
+	}
+	if out := s.do(t, "", "ls", "-d", "sub"); out != "sub\n" {
+		t.Errorf("ls -d sub = %q", out)
+	}
+	out := s.do(t, "", "ls", "-l", "a")
+	if f := strings.Fields(out); len(f) < 6 || f[0] != "--rw-r--r--" && f[0] != "--rw-rw-rw-" || f[5] != "13" || f[len(f)-1] != "a" {
+		t.Errorf("ls -l a = %q", out)
+	}
+	if out := s.do(t, "", "stat", "a"); !strings.HasPrefix(out, "'a' ") || !strings.Contains(out, " l 13 ") {
+		t.Errorf("stat a = %q", out)
+	}
+
+	// Write truncates.
+	s.do(t, "one\ntwo\n", "write", "-l", "a")
+	if out := s.do(t, "", "read", "a"); out != "one\ntwo\n" {
+		t.Errorf("read a after write -l = %q", out)
+	}
+	if out := s.do(t, "xyz\n", "rdwr", "a"); out != "one\ntwo\n\nxyz\ntwo\n\n" {
+		t.Errorf("rdwr a = %q", out)
+	}
+
+	s.do(t, "", "rm", "a", "b")
+	if out := s.do(t, "", "ls", "/"); out != "sub\n" {
+		t.Errorf("ls / after rm = %q", out)
+	}
+	if err := s.run([]string{"read", "a"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("read of removed file: %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	s := new(session)
+	for _, args := range [][]string{
+		{"frob"},
+		{"read"},
+		{"read", "a", "b"},
+		{"ls", "-x", "a"},
+		{"rm"},
+	} {
+		if err := s.run(args); !errors.Is(err, errUsage) {
+			t.Errorf("9p %s: %v, want usage", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestService(t *testing.T) {
+	t.Setenv("DISPLAY", ":0")
+	t.Setenv("NAMESPACE", filepath.Join(t.TempDir(), "ns"))
+	l, err := client.ListenService("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0o644)
+	serve(t, l, dir)
+
+	s := new(session)
+	if out := s.do(t, "", "read", "test/f"); out != "data" {
+		t.Errorf("read test/f = %q", out)
+	}
+	if out := s.do(t, "", "ls", "test"); out != "f\n" {
+		t.Errorf("ls test = %q", out)
+	}
+	if err := s.run([]string{"read", "nosuch/f"}); err == nil {
+		t.Errorf("read of missing service succeeded")
+	}
+}
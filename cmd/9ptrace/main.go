@@ -0,0 +1,143 @@
+// 9ptrace relays connections to a 9P service, tracing the messages.
+//
+// Usage:
+//
+//	9ptrace [-j] [-o file] [-p name] service
+//
+// 9ptrace posts the service name, by default service.trace, in the name
+// space directory. It relays each connection to it to service, writing
+// the messages that pass to standard error, or with -o to file. Service
+// may also be the path name of a unix socket. The -j flag writes the
+// trace as JSON lines rather than text; see package trace.
+//
+// For example, to watch the messages of a 9p command reading acme's
+// index:
+//
+//	9ptrace acme &
+//	9p read acme.trace/index
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/trace"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: 9ptrace [-j] [-o file] [-p name] service\n")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("9ptrace: ")
+
+	jsonFlag := flag.Bool("j", false, "write the trace as JSON lines")
+	file := flag.String("o", "", "write the trace to `file`")
+	post := flag.String("p", "", "post the relay as service `name`")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+
+	service := flag.Arg(0)
+	addr := service
+	if !strings.Contains(service, "/") {
+		ns, err := client.Namespace()
+		if err != nil {
+			log.Fatal(err)
+		}
+		addr = filepath.Join(ns, service)
+	}
+	name := *post
+	if name == "" {
+		name = filepath.Base(service) + ".trace"
+	}
+
+	var w io.Writer = os.Stderr
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w = f
+	}
+	opts := trace.Options{Format: trace.Text}
+	if *jsonFlag {
+		opts.Format = trace.JSON
+	}
+
+	l, err := client.ListenService(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := &relay{addr: addr, w: &lineWriter{w: w}, opts: opts}
+	log.Fatal(r.serve(l))
+}
+
+// A relay forwards connections to the service at addr, tracing them.
+type relay struct {
+	addr string
+	w    io.Writer
+	opts trace.Options
+}
+
+// serve accepts connections on l until it fails, numbering them from 1
+// in the trace.
+func (r *relay) serve(l net.Listener) error {
+	for n := 1; ; n++ {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.relay(c, strconv.Itoa(n))
+	}
+}
+
+// relay forwards c to the service until either side hangs up.
+func (r *relay) relay(c net.Conn, name string) {
+	defer c.Close()
+	s, err := net.Dial("unix", r.addr)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	opts := r.opts
+	opts.Name = name
+	ts := trace.New(s, r.w, &opts)
+	defer ts.Close()
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(ts, c)
+		done <- true
+	}()
+	go func() {
+		io.Copy(c, ts)
+		done <- true
+	}()
+	<-done
+}
+
+// A lineWriter serializes the writes of the connections' traces,
+// each of which is a whole line.
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
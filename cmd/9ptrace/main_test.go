@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/srv"
+	"bwsd.dev/plan9/trace"
+)
+
+func listen(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestRelay(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0o644)
+	sl := listen(t, "service")
+	go func() {
+		for {
+			c, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go srv.Serve(c, srv.DirFS(dir))
+		}
+	}()
+
+	var log bytes.Buffer
+	r := &relay{addr: sl.Addr().String(), w: &lineWriter{w: &log}, opts: trace.Options{Format: trace.Text}}
+	rl := listen(t, "relay")
+	go r.serve(rl)
+
+	fsys, err := client.Mount("unix", rl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Open("f", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := fid.ReadFull(buf); err != nil || string(buf) != "data" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	fid.Close()
+	fsys.Close()
+
+	r.w.(*lineWriter).mu.Lock()
+	out := log.String()
+	r.w.(*lineWriter).mu.Unlock()
+	for _, want := range []string{" 1 -> Tversion ", " 1 <- Rattach ", " 1 <- Rread tag 1 count 4 \"data\" "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace lacks %q:\n%s", want, out)
+		}
+	}
+}
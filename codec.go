@@ -0,0 +1,88 @@
+package plan9
+
+import "io"
+
+// An Encoder writes messages to a stream, encoding each into a buffer that
+// it reuses, so that once the buffer has grown to the size of the largest
+// message, encoding allocates nothing.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+
+	// Dialect is the dialect to encode in. It may be changed between
+	// messages, as after the Tversion exchange.
+	Dialect Dialect
+}
+
+// NewEncoder returns an Encoder writing 9P2000 messages to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the encoding of f, with a single call to the Write method
+// of the underlying writer.
+func (e *Encoder) Encode(f *Fcall) error {
+	b, err := f.AppendDialect(e.buf[:0], e.Dialect)
+	if err != nil {
+		return err
+	}
+	e.buf = b
+	_, err = e.w.Write(b)
+	return err
+}
+
+// A Decoder reads messages from a stream into a buffer that it reuses.
+// Decoding a message into the same Fcall as the last allocates only the
+// strings in it.
+type Decoder struct {
+	r   io.Reader
+	buf []byte
+
+	// Dialect is the dialect to decode. It may be changed between
+	// messages, as after the Tversion exchange.
+	Dialect Dialect
+
+	// Msize, if not zero, is the size of the largest message to accept.
+	// Larger messages are errors, so that a peer cannot make the Decoder
+	// allocate a buffer of its choosing.
+	Msize uint32
+}
+
+// NewDecoder returns a Decoder reading 9P2000 messages from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next message into f, as Fcall.UnmarshalDialect does.
+// The Data and Stat of f refer to the Decoder's buffer, and are
+// overwritten by the next call to Decode. At the end of the stream, Decode
+// returns io.EOF; a message cut short is io.ErrUnexpectedEOF.
+func (d *Decoder) Decode(f *Fcall) error {
+	if cap(d.buf) < 4 {
+		d.buf = make([]byte, 4, 128)
+	}
+	b := d.buf[:4]
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return err
+	}
+	n := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	if n < 4+1+2 {
+		return ProtocolError("invalid length")
+	}
+	if d.Msize != 0 && n > d.Msize {
+		return ProtocolError("message too long")
+	}
+	if uint64(n) > uint64(cap(b)) {
+		b = make([]byte, 4, n)
+		copy(b, d.buf[:4])
+		d.buf = b
+	}
+	b = b[:n]
+	if _, err := io.ReadFull(d.r, b[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return f.UnmarshalDialect(b, d.Dialect)
+}
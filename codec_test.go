@@ -0,0 +1,276 @@
+package plan9
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var codecTests = []Fcall{
+	{Type: Tversion, Tag: NOTAG, Msize: 8192, Version: VERSION9P},
+	{Type: Rversion, Tag: NOTAG, Msize: 8192, Version: VERSION9P},
+	{Type: Tflush, Tag: 2, Oldtag: 1},
+	{Type: Rflush, Tag: 2},
+	{Type: Tattach, Tag: 1, Fid: 1, Afid: NOFID, Uname: "glenda", Aname: "main"},
+	{Type: Rattach, Tag: 1, Qid: Qid{Path: 1, Type: QTDIR}},
+	{Type: Twalk, Tag: 1, Fid: 1, Newfid: 2, Wname: []string{"usr", "glenda", "lib"}},
+	{Type: Rwalk, Tag: 1, Wqid: []Qid{{Path: 2, Type: QTDIR}, {Path: 3, Type: QTDIR}, {Path: 4}}},
+	{Type: Topen, Tag: 1, Fid: 2, Mode: ORDWR},
+	{Type: Ropen, Tag: 1, Qid: Qid{Path: 4}, Iounit: 8168},
+	{Type: Tcreate, Tag: 1, Fid: 2, Name: "new", Perm: 0o644, Mode: OWRITE},
+	{Type: Rcreate, Tag: 1, Qid: Qid{Path: 5}},
+	{Type: Tread, Tag: 1, Fid: 2, Offset: 1 << 40, Count: 8192},
+	{Type: Rread, Tag: 1, Data: []byte("hello, world\n")},
+	{Type: Twrite, Tag: 1, Fid: 2, Offset: 5, Data: []byte("data")},
+	{Type: Rwrite, Tag: 1, Count: 4},
+	{Type: Tclunk, Tag: 1, Fid: 2},
+	{Type: Rclunk, Tag: 1},
+	{Type: Tremove, Tag: 1, Fid: 2},
+	{Type: Rremove, Tag: 1},
+	{Type: Tstat, Tag: 1, Fid: 2},
+	{Type: Rstat, Tag: 1, Stat: []byte{1, 2, 3}},
+	{Type: Twstat, Tag: 1, Fid: 2, Stat: []byte{4, 5}},
+	{Type: Rwstat, Tag: 1},
+	{Type: Rerror, Tag: 1, Ename: "file does not exist"},
+}
+
+func TestAppend(t *testing.T) {
+	prefix := []byte("prefix")
+	for i := range codecTests {
+		f := &codecTests[i]
+		want, err := f.Bytes()
+		if err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		b, err := f.Append(append([]byte(nil), prefix...))
+		if err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		if !bytes.Equal(b[:len(prefix)], prefix) || !bytes.Equal(b[len(prefix):], want) {
+			t.Errorf("%v: Append = %x, want %x after prefix", f, b, want)
+		}
+	}
+	bad := &Fcall{Type: Twalk, Wname: make([]string, MAXWELEM+1)}
+	if b, err := bad.Append(prefix); err == nil || !bytes.Equal(b, prefix) {
+		t.Errorf("Append of bad walk = %q, %v", b, err)
+	}
+}
+
+func TestUnmarshalReuse(t *testing.T) {
+	var f Fcall
+	for i := range codecTests {
+		tx := &codecTests[i]
+		b, _ := tx.Bytes()
+		if err := f.Unmarshal(b); err != nil {
+			t.Fatalf("%v: %v", tx, err)
+		}
+		// Compare ignoring the difference between nil and empty slices,
+		// which the reused arrays make.
+		got := f
+		if len(got.Wname) == 0 {
+			got.Wname = nil
+		}
+		if len(got.Wqid) == 0 {
+			got.Wqid = nil
+		}
+		if !reflect.DeepEqual(&got, tx) {
+			t.Errorf("decoded %v after earlier messages, want %v", &got, tx)
+		}
+		if tx.Type == Rread && &f.Data[0] != &b[len(b)-len(tx.Data)] {
+			t.Errorf("Rread data was copied")
+		}
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	var f Fcall
+	for i := range codecTests {
+		tx := &codecTests[i]
+		b, _ := tx.Bytes()
+		for n := 0; n < len(b); n++ {
+			// With the length as it was, and as it would be.
+			short := append([]byte(nil), b[:n]...)
+			if err := f.Unmarshal(short); err == nil {
+				t.Errorf("%v: decoded from %d of %d bytes", tx, n, len(b))
+			}
+			if n >= 4 {
+				pbit32(short[:0], uint32(n))
+				if err := f.Unmarshal(short); err == nil {
+					t.Errorf("%v: decoded %d of %d bytes with adjusted length", tx, n, len(b))
+				}
+			}
+		}
+		long := append(append([]byte(nil), b...), 0)
+		pbit32(long[:0], uint32(len(long)))
+		if err := f.Unmarshal(long); err == nil {
+			t.Errorf("%v: decoded with a byte left over", tx)
+		}
+	}
+}
+
+func TestCodecAllocs(t *testing.T) {
+	for _, tx := range []*Fcall{
+		{Type: Tread, Tag: 1, Fid: 2, Offset: 3, Count: 8192},
+		{Type: Rread, Tag: 1, Data: make([]byte, 8192)},
+		{Type: Twrite, Tag: 1, Fid: 2, Data: make([]byte, 8192)},
+		{Type: Rwalk, Tag: 1, Wqid: []Qid{{Path: 1}, {Path: 2}}},
+	} {
+		buf := make([]byte, 0, 9000)
+		if n := testing.AllocsPerRun(100, func() { tx.Append(buf) }); n != 0 {
+			t.Errorf("%v: Append made %v allocations", tx, n)
+		}
+		b, _ := tx.Bytes()
+		var f Fcall
+		f.Unmarshal(b)
+		if n := testing.AllocsPerRun(100, func() { f.Unmarshal(b) }); n != 0 {
+			t.Errorf("%v: Unmarshal made %v allocations", tx, n)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	var stream bytes.Buffer
+	enc := NewEncoder(&stream)
+	for i := range codecTests {
+		if err := enc.Encode(&codecTests[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := NewDecoder(&stream)
+	var f Fcall
+	for i := range codecTests {
+		if err := dec.Decode(&f); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if f.String() != codecTests[i].String() {
+			t.Errorf("decoded %v, want %v", &f, &codecTests[i])
+		}
+	}
+	if err := dec.Decode(&f); err != io.EOF {
+		t.Errorf("Decode at end = %v, want io.EOF", err)
+	}
+
+	b, _ := codecTests[0].Bytes()
+	if err := NewDecoder(bytes.NewReader(b[:len(b)-1])).Decode(&f); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode of short message = %v, want io.ErrUnexpectedEOF", err)
+	}
+	dec = NewDecoder(bytes.NewReader(b))
+	dec.Msize = uint32(len(b) - 1)
+	if err := dec.Decode(&f); err == nil {
+		t.Errorf("Decode accepted message longer than Msize")
+	}
+	if err := NewDecoder(bytes.NewReader([]byte{6, 0, 0, 0, 0, 0})).Decode(&f); err == nil {
+		t.Errorf("Decode accepted a message shorter than its header")
+	}
+}
+
+func TestStreamAllocs(t *testing.T) {
+	tx := &Fcall{Type: Rread, Tag: 1, Data: make([]byte, 8192)}
+	b, _ := tx.Bytes()
+	r := bytes.NewReader(b)
+	dec := NewDecoder(r)
+	enc := NewEncoder(io.Discard)
+	var f Fcall
+	n := testing.AllocsPerRun(100, func() {
+		r.Reset(b)
+		if err := dec.Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		enc.Encode(&f)
+	})
+	if n != 0 {
+		t.Errorf("Decode and Encode made %v allocations", n)
+	}
+}
+
+var benchMsgs = []struct {
+	name string
+	f    *Fcall
+}{
+	{"Tread", &Fcall{Type: Tread, Tag: 1, Fid: 2, Offset: 3, Count: 8192}},
+	{"Rread", &Fcall{Type: Rread, Tag: 1, Data: make([]byte, 8192)}},
+	{"Twalk", &Fcall{Type: Twalk, Tag: 1, Fid: 1, Newfid: 2, Wname: []string{"usr", "glenda", "lib", "profile"}}},
+}
+
+func BenchmarkBytes(b *testing.B) {
+	for _, bm := range benchMsgs {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bm.f.Bytes()
+			}
+		})
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, bm := range benchMsgs {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			buf := make([]byte, 0, 9000)
+			for i := 0; i < b.N; i++ {
+				bm.f.Append(buf)
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshalFcall(b *testing.B) {
+	for _, bm := range benchMsgs {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			msg, _ := bm.f.Bytes()
+			for i := 0; i < b.N; i++ {
+				UnmarshalFcall(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	for _, bm := range benchMsgs {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			msg, _ := bm.f.Bytes()
+			var f Fcall
+			for i := 0; i < b.N; i++ {
+				f.Unmarshal(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkReadFcall(b *testing.B) {
+	for _, bm := range benchMsgs {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			msg, _ := bm.f.Bytes()
+			r := bytes.NewReader(msg)
+			for i := 0; i < b.N; i++ {
+				r.Reset(msg)
+				if _, err := ReadFcall(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	for _, bm := range benchMsgs {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			msg, _ := bm.f.Bytes()
+			r := bytes.NewReader(msg)
+			dec := NewDecoder(r)
+			var f Fcall
+			for i := 0; i < b.N; i++ {
+				r.Reset(msg)
+				if err := dec.Decode(&f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package plan9
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A goldenMsg is a message from testdata/fcall.golden.
+type goldenMsg struct {
+	d Dialect
+	b []byte
+	s string // as printed by Fcall.String
+}
+
+func readGolden(t testing.TB) []goldenMsg {
+	file, err := os.Open("testdata/fcall.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var msgs []goldenMsg
+	sc := bufio.NewScanner(file)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.SplitN(line, "\t", 3)
+		if len(f) != 3 {
+			t.Fatalf("fcall.golden:%d: want 3 fields", n)
+		}
+		b, err := hex.DecodeString(f[1])
+		if err != nil {
+			t.Fatalf("fcall.golden:%d: %v", n, err)
+		}
+		msgs = append(msgs, goldenMsg{DialectOf(f[0]), b, f[2]})
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func TestGolden(t *testing.T) {
+	seen := make(map[Dialect]map[uint8]bool)
+	for _, m := range readGolden(t) {
+		f, err := UnmarshalFcallDialect(m.b, m.d)
+		if err != nil {
+			t.Errorf("%v %q: %v", m.d, m.s, err)
+			continue
+		}
+		if s := f.String(); s != m.s {
+			t.Errorf("%v message decoded as %q, want %q", m.d, s, m.s)
+		}
+		b, err := f.BytesDialect(m.d)
+		if err != nil || !bytes.Equal(b, m.b) {
+			t.Errorf("%v %v: encoded as %x, %v; want %x", m.d, f, b, err, m.b)
+		}
+		if seen[m.d] == nil {
+			seen[m.d] = make(map[uint8]bool)
+		}
+		seen[m.d][f.Type] = true
+	}
+	for typ := uint8(Tversion); typ <= Rwstat; typ++ {
+		if typ != Terror && !seen[Dialect9P][typ] {
+			t.Errorf("no 9P2000 message of type %s", typeName(typ))
+		}
+	}
+	for i := range dotlTests {
+		if typ := dotlTests[i].Type; !seen[Dialect9PL][typ] {
+			t.Errorf("no 9P2000.L message of type %s", typeName(typ))
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	tread, _ := (&Fcall{Type: Tread, Tag: 1, Fid: 2, Count: 10}).Bytes()
+	short := append([]byte(nil), tread[:len(tread)-2]...)
+	pbit32(short[:0], uint32(len(short)))
+	long := append(append([]byte(nil), tread...), 0)
+	pbit32(long[:0], uint32(len(long)))
+	unknown := append([]byte(nil), tread...)
+	unknown[4] = 250
+	walk, _ := (&Fcall{Type: Twalk, Tag: 1, Wname: make([]string, MAXWELEM)}).Bytes()
+	walk[4+1+2+4+4]++ // one name too many
+
+	tests := []struct {
+		b    []byte
+		want DecodeError
+	}{
+		{tread[:6], DecodeError{"Fcall", 5, errTruncated}},
+		{tread[:len(tread)-1], DecodeError{"Tread", 0, errLength}},
+		{short, DecodeError{"Tread", 7 + 4 + 8, errTruncated}},
+		{long, DecodeError{"Tread", len(tread), errTrailing}},
+		{unknown, DecodeError{"Fcall type 250", 4, errType}},
+		{walk, DecodeError{"Twalk", 7 + 4 + 4, errWalk}},
+	}
+	for _, tt := range tests {
+		_, err := UnmarshalFcall(tt.b)
+		var e *DecodeError
+		if !errors.As(err, &e) || *e != tt.want {
+			t.Errorf("UnmarshalFcall(%x) = %v, want %v", tt.b, err, &tt.want)
+			continue
+		}
+		var pe ProtocolError
+		if !errors.As(err, &pe) {
+			t.Errorf("%v does not wrap a ProtocolError", err)
+		}
+	}
+
+	d, _ := (&Dir{Name: "f"}).Bytes()
+	pbit16(d[:0], uint16(len(d)-2+1))
+	_, err := UnmarshalDir(append(d, 0))
+	want := &DecodeError{"Dir", len(d), errTrailing}
+	if e := new(DecodeError); !errors.As(err, &e) || *e != *want {
+		t.Errorf("UnmarshalDir with a byte left over = %v, want %v", err, want)
+	}
+	if _, err := UnmarshalDirents(AppendDirent(nil, &Dirent{Name: "f"})[:20]); err == nil {
+		t.Errorf("UnmarshalDirents accepted truncated entry")
+	}
+}
+
+// FuzzUnmarshalFcall checks that any message that decodes is encoded
+// back the same.
+func FuzzUnmarshalFcall(f *testing.F) {
+	for _, m := range readGolden(f) {
+		f.Add(m.b, uint8(m.d))
+	}
+	f.Fuzz(func(t *testing.T, b []byte, dl uint8) {
+		d := Dialect(dl % 3)
+		fc, err := UnmarshalFcallDialect(b, d)
+		if err != nil {
+			var e *DecodeError
+			if !errors.As(err, &e) || e.Offset < 0 || e.Offset > len(b) {
+				t.Fatalf("bad error %v", err)
+			}
+			return
+		}
+		b1, err := fc.BytesDialect(d)
+		if err != nil {
+			t.Fatalf("%v: decoded but not encoded: %v", fc, err)
+		}
+		// Only a Tauth or Tattach without its numeric id, which
+		// decodes as NOUID, is not encoded back to the same bytes.
+		if d == Dialect9P && !bytes.Equal(b, b1) {
+			t.Fatalf("%v: encoded as %x, decoded from %x", fc, b1, b)
+		}
+		fc1, err := UnmarshalFcallDialect(b1, d)
+		if err != nil {
+			t.Fatalf("%v: encoding does not decode: %v", fc, err)
+		}
+		if !reflect.DeepEqual(fc, fc1) {
+			t.Fatalf("%v: decoded again as %v", fc, fc1)
+		}
+	})
+}
+
+// FuzzUnmarshalDir checks that any stat that decodes is encoded back the
+// same.
+func FuzzUnmarshalDir(f *testing.F) {
+	for _, m := range readGolden(f) {
+		fc, err := UnmarshalFcallDialect(m.b, m.d)
+		if err == nil && (fc.Type == Rstat || fc.Type == Twstat) {
+			f.Add(fc.Stat, uint8(m.d))
+		}
+	}
+	f.Fuzz(func(t *testing.T, b []byte, dl uint8) {
+		d := Dialect(dl % 3)
+		dir, err := UnmarshalDirDialect(b, d)
+		if err != nil {
+			var e *DecodeError
+			if !errors.As(err, &e) || e.Offset < 0 || e.Offset > len(b) {
+				t.Fatalf("bad error %v", err)
+			}
+			return
+		}
+		b1, err := dir.BytesDialect(d)
+		if err != nil || !bytes.Equal(b, b1) {
+			t.Fatalf("%v: encoded as %x, %v; decoded from %x", dir, b1, err, b)
+		}
+	})
+}
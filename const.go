@@ -4,10 +4,12 @@ package plan9
 
 // TODO: document constants
 const (
-	VERSION9P = "9P2000"
-	MAXWELEM  = 16 // Maximum number of elements or Qids allowed in a single message
-	IOHDRSZ   = 24 // Buffer size to reserve for a 9P header
-	STATMAX   = (1 << 16) - 1
+	VERSION9P  = "9P2000"
+	VERSION9PU = "9P2000.u" // Unix extensions
+	VERSION9PL = "9P2000.L" // Linux extensions
+	MAXWELEM   = 16         // Maximum number of elements or Qids allowed in a single message
+	IOHDRSZ    = 24         // Buffer size to reserve for a 9P header
+	STATMAX    = (1 << 16) - 1
 )
 
 const (
@@ -0,0 +1,41 @@
+package plan9
+
+// A Dialect is a variant of the 9P2000 protocol. The dialect spoken on a
+// connection is the one named by the version agreed in the Tversion exchange;
+// it changes the encoding of some messages and of directory entries.
+type Dialect int
+
+const (
+	Dialect9P  Dialect = iota // 9P2000
+	Dialect9PU                // 9P2000.u
+	Dialect9PL                // 9P2000.L
+)
+
+// DialectOf returns the dialect named by a protocol version string.
+// Versions other than the extended ones select Dialect9P.
+func DialectOf(version string) Dialect {
+	switch version {
+	case VERSION9PU:
+		return Dialect9PU
+	case VERSION9PL:
+		return Dialect9PL
+	}
+	return Dialect9P
+}
+
+// String returns the version string that negotiates d.
+func (d Dialect) String() string {
+	switch d {
+	case Dialect9PU:
+		return VERSION9PU
+	case Dialect9PL:
+		return VERSION9PL
+	}
+	return VERSION9P
+}
+
+// numericIds reports whether attach and auth messages in d carry the numeric
+// user id n_uname.
+func (d Dialect) numericIds() bool {
+	return d == Dialect9PU || d == Dialect9PL
+}
@@ -35,24 +35,23 @@ type Dir struct {
 	// 9P2000.u extension fields
 	// Plan 9 represents user identifiers using strings whereas Unix-like and POSIX
 	// environments use numeric identifiers.
-	// Uidnum uint
-	// Gidnum uint
-	// Muidnum uint
-	// Ext []byte extended info
+	Uidnum    uint32 // numeric owner id, or NOUID
+	Gidnum    uint32 // numeric group id, or NOUID
+	Muidnum   uint32 // numeric id of the last modifier, or NOUID
+	Extension string // symlink target, device numbers etc. for special files
 }
 
 var nullDir = Dir{
-	^uint16(0),
-	^uint32(0),
-	Qid{^uint64(0), ^uint32(0), ^uint8(0)},
-	^uint32(0),
-	^uint32(0),
-	^uint32(0),
-	^uint64(0),
-	"",
-	"",
-	"",
-	"",
+	Type:    ^uint16(0),
+	Dev:     ^uint32(0),
+	Qid:     Qid{^uint64(0), ^uint32(0), ^uint8(0)},
+	Mode:    ^uint32(0),
+	Atime:   ^uint32(0),
+	Mtime:   ^uint32(0),
+	Length:  ^uint64(0),
+	Uidnum:  NOUID,
+	Gidnum:  NOUID,
+	Muidnum: NOUID,
 }
 
 // Null assigns special "don't touch" values to members of d to avoid modifying
@@ -61,8 +60,8 @@ func (d *Dir) Null() {
 	*d = nullDir
 }
 
-// pdir encodes a 9P stat call on dir d into buffer b.
-func pdir(b []byte, d *Dir) []byte {
+// pdir encodes a 9P stat call on dir d in dialect dl into buffer b.
+func pdir(b []byte, d *Dir, dl Dialect) []byte {
 	n := len(b)
 	b = pbit16(b, 0) // length, filled in later
 	b = pbit16(b, d.Type)
@@ -76,47 +75,64 @@ func pdir(b []byte, d *Dir) []byte {
 	b = pstring(b, d.Uid)
 	b = pstring(b, d.Gid)
 	b = pstring(b, d.Muid)
+	if dl == Dialect9PU {
+		b = pstring(b, d.Extension)
+		b = pbit32(b, d.Uidnum)
+		b = pbit32(b, d.Gidnum)
+		b = pbit32(b, d.Muidnum)
+	}
 	pbit16(b[0:n], uint16(len(b)-(n+2)))
 	return b
 }
 
+// Bytes returns the 9P2000 stat encoding of d.
 func (d *Dir) Bytes() ([]byte, error) {
-	return pdir(nil, d), nil
+	return pdir(nil, d, Dialect9P), nil
+}
+
+// BytesDialect returns the stat encoding of d in dialect dl. The 9P2000.u
+// encoding adds the extension and numeric ids.
+func (d *Dir) BytesDialect(dl Dialect) ([]byte, error) {
+	return pdir(nil, d, dl), nil
 }
 
 // UnmarshalDir decodes a single 9P stat message from b and returns the
-// resulting Dir.
-//
-// If b is too small to hold a valid stat message, ErrShortStat is returned.  If
-// the stat message itself is invalid, ErrBadStat is returned.
+// resulting Dir. If b does not hold exactly one stat message, the error is
+// a *DecodeError.
 func UnmarshalDir(b []byte) (d *Dir, err error) {
-	defer func() {
-		if v := recover(); v != nil {
-			d = nil
-			err = ProtocolError("malformed Dir")
-		}
-	}()
+	return UnmarshalDirDialect(b, Dialect9P)
+}
 
-	n, b := gbit16(b)
-	if int(n) != len(b) {
-		panic(1)
+// UnmarshalDirDialect is like UnmarshalDir but decodes a stat message encoded
+// in dialect dl. Numeric ids absent from the encoding are set to NOUID.
+func UnmarshalDirDialect(b []byte, dl Dialect) (d *Dir, err error) {
+	u := unpacker{b: b}
+	if n := u.bit16(); !u.bad && int(n) != len(b)-2 {
+		return nil, &DecodeError{"Dir", 0, errLength}
 	}
 
 	d = new(Dir)
-	d.Type, b = gbit16(b)
-	d.Dev, b = gbit32(b)
-	d.Qid, b = gqid(b)
-	d.Mode, b = gbit32(b)
-	d.Atime, b = gbit32(b)
-	d.Mtime, b = gbit32(b)
-	d.Length, b = gbit64(b)
-	d.Name, b = gstring(b)
-	d.Uid, b = gstring(b)
-	d.Gid, b = gstring(b)
-	d.Muid, b = gstring(b)
-
-	if len(b) != 0 {
-		panic(1)
+	d.Type = u.bit16()
+	d.Dev = u.bit32()
+	d.Qid = u.qid()
+	d.Mode = u.bit32()
+	d.Atime = u.bit32()
+	d.Mtime = u.bit32()
+	d.Length = u.bit64()
+	d.Name = u.string()
+	d.Uid = u.string()
+	d.Gid = u.string()
+	d.Muid = u.string()
+	d.Uidnum, d.Gidnum, d.Muidnum = NOUID, NOUID, NOUID
+	if dl == Dialect9PU {
+		d.Extension = u.string()
+		d.Uidnum = u.bit32()
+		d.Gidnum = u.bit32()
+		d.Muidnum = u.bit32()
+	}
+
+	if off, err := u.check(); err != nil {
+		return nil, &DecodeError{"Dir", off, err}
 	}
 	return d, nil
 }
@@ -230,12 +246,12 @@ func (q Qid) String() string {
 	return fmt.Sprintf("(%.16x %d %s)", q.Path, q.Vers, t)
 }
 
-func gqid(b []byte) (Qid, []byte) {
+func (u *unpacker) qid() Qid {
 	var q Qid
-	q.Type, b = gbit8(b)
-	q.Vers, b = gbit32(b)
-	q.Path, b = gbit64(b)
-	return q, b
+	q.Type = u.bit8()
+	q.Vers = u.bit32()
+	q.Path = u.bit64()
+	return q
 }
 
 func pqid(b []byte, q Qid) []byte {
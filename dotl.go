@@ -0,0 +1,337 @@
+package plan9
+
+import "fmt"
+
+// 9P2000.L messages. They extend 9P2000 with the operations needed to serve
+// Linux file systems; see the diod protocol description or the Linux v9fs
+// documentation. Tversion, Tauth, Tattach, Tflush, Twalk, Tread, Twrite and
+// Tclunk keep their 9P2000 meanings; errors are reported with Rlerror.
+const (
+	Tlerror      = 6 // illegal
+	Rlerror      = 7
+	Tstatfs      = 8
+	Rstatfs      = 9
+	Tlopen       = 12
+	Rlopen       = 13
+	Tlcreate     = 14
+	Rlcreate     = 15
+	Tsymlink     = 16
+	Rsymlink     = 17
+	Tmknod       = 18
+	Rmknod       = 19
+	Trename      = 20
+	Rrename      = 21
+	Treadlink    = 22
+	Rreadlink    = 23
+	Tgetattr     = 24
+	Rgetattr     = 25
+	Tsetattr     = 26
+	Rsetattr     = 27
+	Txattrwalk   = 30
+	Rxattrwalk   = 31
+	Txattrcreate = 32
+	Rxattrcreate = 33
+	Treaddir     = 40
+	Rreaddir     = 41
+	Tfsync       = 50
+	Rfsync       = 51
+	Tlock        = 52
+	Rlock        = 53
+	Tgetlock     = 54
+	Rgetlock     = 55
+	Tlink        = 70
+	Rlink        = 71
+	Tmkdir       = 72
+	Rmkdir       = 73
+	Trenameat    = 74
+	Rrenameat    = 75
+	Tunlinkat    = 76
+	Runlinkat    = 77
+)
+
+// Tgetattr request mask and Rgetattr valid bits
+const (
+	GETATTRMODE        = 0x00000001
+	GETATTRNLINK       = 0x00000002
+	GETATTRUID         = 0x00000004
+	GETATTRGID         = 0x00000008
+	GETATTRRDEV        = 0x00000010
+	GETATTRATIME       = 0x00000020
+	GETATTRMTIME       = 0x00000040
+	GETATTRCTIME       = 0x00000080
+	GETATTRINO         = 0x00000100
+	GETATTRSIZE        = 0x00000200
+	GETATTRBLOCKS      = 0x00000400
+	GETATTRBTIME       = 0x00000800
+	GETATTRGEN         = 0x00001000
+	GETATTRDATAVERSION = 0x00002000
+	GETATTRBASIC       = 0x000007ff // mode through blocks
+	GETATTRALL         = 0x00003fff
+)
+
+// Tsetattr valid bits
+const (
+	SETATTRMODE     = 0x00000001
+	SETATTRUID      = 0x00000002
+	SETATTRGID      = 0x00000004
+	SETATTRSIZE     = 0x00000008
+	SETATTRATIME    = 0x00000010 // set atime to the current time
+	SETATTRMTIME    = 0x00000020 // set mtime to the current time
+	SETATTRCTIME    = 0x00000040
+	SETATTRATIMESET = 0x00000080 // set atime to the time given
+	SETATTRMTIMESET = 0x00000100 // set mtime to the time given
+)
+
+// Tlock and Tgetlock types, Tlock flags and Rlock status
+const (
+	LOCKRDLCK = 0
+	LOCKWRLCK = 1
+	LOCKUNLCK = 2
+
+	LOCKFLAGSBLOCK   = 1 // blocking request
+	LOCKFLAGSRECLAIM = 2 // reclaim lost lock after server restart
+
+	LOCKSUCCESS = 0
+	LOCKBLOCKED = 1
+	LOCKERROR   = 2
+	LOCKGRACE   = 3
+)
+
+// Tunlinkat flags
+const (
+	ATREMOVEDIR = 0x200 // remove a directory
+)
+
+// An Attr holds the attributes of a file in 9P2000.L. Rgetattr sets every
+// field and says in Valid which of them the server filled in; Tsetattr sends
+// Mode through MtimeNsec and says in Valid which of them to change.
+type Attr struct {
+	Valid       uint64 // GETATTR or SETATTR bits
+	Qid         Qid
+	Mode        uint32 // Linux st_mode
+	Uid         uint32
+	Gid         uint32
+	Nlink       uint64
+	Rdev        uint64
+	Size        uint64
+	Blksize     uint64
+	Blocks      uint64
+	AtimeSec    uint64
+	AtimeNsec   uint64
+	MtimeSec    uint64
+	MtimeNsec   uint64
+	CtimeSec    uint64
+	CtimeNsec   uint64
+	BtimeSec    uint64
+	BtimeNsec   uint64
+	Gen         uint64
+	DataVersion uint64
+}
+
+func (a *Attr) String() string {
+	return fmt.Sprintf("valid %#x qid %v mode %#o uid %d gid %d nlink %d rdev %d size %d blksize %d blocks %d atime %d.%09d mtime %d.%09d ctime %d.%09d",
+		a.Valid, a.Qid, a.Mode, a.Uid, a.Gid, a.Nlink, a.Rdev, a.Size, a.Blksize, a.Blocks,
+		a.AtimeSec, a.AtimeNsec, a.MtimeSec, a.MtimeNsec, a.CtimeSec, a.CtimeNsec)
+}
+
+func (u *unpacker) attr() Attr {
+	var a Attr
+	a.Valid = u.bit64()
+	a.Qid = u.qid()
+	a.Mode = u.bit32()
+	a.Uid = u.bit32()
+	a.Gid = u.bit32()
+	a.Nlink = u.bit64()
+	a.Rdev = u.bit64()
+	a.Size = u.bit64()
+	a.Blksize = u.bit64()
+	a.Blocks = u.bit64()
+	a.AtimeSec = u.bit64()
+	a.AtimeNsec = u.bit64()
+	a.MtimeSec = u.bit64()
+	a.MtimeNsec = u.bit64()
+	a.CtimeSec = u.bit64()
+	a.CtimeNsec = u.bit64()
+	a.BtimeSec = u.bit64()
+	a.BtimeNsec = u.bit64()
+	a.Gen = u.bit64()
+	a.DataVersion = u.bit64()
+	return a
+}
+
+func pattr(b []byte, a *Attr) []byte {
+	b = pbit64(b, a.Valid)
+	b = pqid(b, a.Qid)
+	b = pbit32(b, a.Mode)
+	b = pbit32(b, a.Uid)
+	b = pbit32(b, a.Gid)
+	b = pbit64(b, a.Nlink)
+	b = pbit64(b, a.Rdev)
+	b = pbit64(b, a.Size)
+	b = pbit64(b, a.Blksize)
+	b = pbit64(b, a.Blocks)
+	b = pbit64(b, a.AtimeSec)
+	b = pbit64(b, a.AtimeNsec)
+	b = pbit64(b, a.MtimeSec)
+	b = pbit64(b, a.MtimeNsec)
+	b = pbit64(b, a.CtimeSec)
+	b = pbit64(b, a.CtimeNsec)
+	b = pbit64(b, a.BtimeSec)
+	b = pbit64(b, a.BtimeNsec)
+	b = pbit64(b, a.Gen)
+	b = pbit64(b, a.DataVersion)
+	return b
+}
+
+// setattr and psetattr handle the shorter attribute list in Tsetattr.
+func (u *unpacker) setattr() Attr {
+	var a Attr
+	a.Valid = uint64(u.bit32())
+	a.Mode = u.bit32()
+	a.Uid = u.bit32()
+	a.Gid = u.bit32()
+	a.Size = u.bit64()
+	a.AtimeSec = u.bit64()
+	a.AtimeNsec = u.bit64()
+	a.MtimeSec = u.bit64()
+	a.MtimeNsec = u.bit64()
+	return a
+}
+
+func psetattr(b []byte, a *Attr) []byte {
+	b = pbit32(b, uint32(a.Valid))
+	b = pbit32(b, a.Mode)
+	b = pbit32(b, a.Uid)
+	b = pbit32(b, a.Gid)
+	b = pbit64(b, a.Size)
+	b = pbit64(b, a.AtimeSec)
+	b = pbit64(b, a.AtimeNsec)
+	b = pbit64(b, a.MtimeSec)
+	b = pbit64(b, a.MtimeNsec)
+	return b
+}
+
+// A Statfs describes a file system in a 9P2000.L Rstatfs, like statfs(2).
+type Statfs struct {
+	Type    uint32
+	Bsize   uint32
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Fsid    uint64
+	Namelen uint32
+}
+
+func (u *unpacker) statfs() Statfs {
+	var s Statfs
+	s.Type = u.bit32()
+	s.Bsize = u.bit32()
+	s.Blocks = u.bit64()
+	s.Bfree = u.bit64()
+	s.Bavail = u.bit64()
+	s.Files = u.bit64()
+	s.Ffree = u.bit64()
+	s.Fsid = u.bit64()
+	s.Namelen = u.bit32()
+	return s
+}
+
+func pstatfs(b []byte, s *Statfs) []byte {
+	b = pbit32(b, s.Type)
+	b = pbit32(b, s.Bsize)
+	b = pbit64(b, s.Blocks)
+	b = pbit64(b, s.Bfree)
+	b = pbit64(b, s.Bavail)
+	b = pbit64(b, s.Files)
+	b = pbit64(b, s.Ffree)
+	b = pbit64(b, s.Fsid)
+	b = pbit32(b, s.Namelen)
+	return b
+}
+
+// A Flock describes a POSIX record lock in 9P2000.L Tlock, Tgetlock and
+// Rgetlock messages. Flags is sent only in Tlock.
+type Flock struct {
+	Type     uint8 // LOCKRDLCK, LOCKWRLCK or LOCKUNLCK
+	Flags    uint32
+	Start    uint64
+	Length   uint64 // zero means to the end of the file
+	ProcID   uint32
+	ClientID string
+}
+
+func (l *Flock) String() string {
+	return fmt.Sprintf("type %d flags %#x start %d length %d proc_id %d client_id %q",
+		l.Type, l.Flags, l.Start, l.Length, l.ProcID, l.ClientID)
+}
+
+func (u *unpacker) flock(flags bool) Flock {
+	var l Flock
+	l.Type = u.bit8()
+	if flags {
+		l.Flags = u.bit32()
+	}
+	l.Start = u.bit64()
+	l.Length = u.bit64()
+	l.ProcID = u.bit32()
+	l.ClientID = u.string()
+	return l
+}
+
+func pflock(b []byte, l *Flock, flags bool) []byte {
+	b = pbit8(b, l.Type)
+	if flags {
+		b = pbit32(b, l.Flags)
+	}
+	b = pbit64(b, l.Start)
+	b = pbit64(b, l.Length)
+	b = pbit32(b, l.ProcID)
+	b = pstring(b, l.ClientID)
+	return b
+}
+
+// A Dirent is a directory entry in the data of a 9P2000.L Rreaddir.
+type Dirent struct {
+	Qid    Qid
+	Offset uint64 // offset of the next entry
+	Type   uint8  // Linux d_type
+	Name   string
+}
+
+func (d *Dirent) String() string {
+	return fmt.Sprintf("'%s' q %v off %d t %d", d.Name, d.Qid, d.Offset, d.Type)
+}
+
+// Bytes returns the encoding of d for the data of an Rreaddir.
+func (d *Dirent) Bytes() []byte {
+	return AppendDirent(nil, d)
+}
+
+// AppendDirent appends the encoding of d to b and returns the result.
+func AppendDirent(b []byte, d *Dirent) []byte {
+	b = pqid(b, d.Qid)
+	b = pbit64(b, d.Offset)
+	b = pbit8(b, d.Type)
+	b = pstring(b, d.Name)
+	return b
+}
+
+// UnmarshalDirents decodes the directory entries in the data of an Rreaddir.
+// If the data ends within an entry, the error is a *DecodeError.
+func UnmarshalDirents(b []byte) (dirs []Dirent, err error) {
+	u := unpacker{b: b}
+	for !u.empty() {
+		var d Dirent
+		d.Qid = u.qid()
+		d.Offset = u.bit64()
+		d.Type = u.bit8()
+		d.Name = u.string()
+		if u.bad {
+			return nil, &DecodeError{"Dirent", u.fail, errTruncated}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
@@ -0,0 +1,1156 @@
+package devdraw
+
+import (
+	"errors"
+	"fmt"
+
+	"bwsd.dev/plan9/draw"
+	"bwsd.dev/plan9/draw/memdraw"
+)
+
+var (
+	errNoImage      = errors.New("unknown id for draw image")
+	errNoScreen     = errors.New("unknown id for draw screen")
+	errShortDraw    = errors.New("short draw message")
+	errImageExists  = errors.New("image id in use")
+	errScreenExists = errors.New("screen id in use")
+	errDrawMem      = errors.New("image memory allocation failed")
+	errReadOutside  = errors.New("readimage outside image")
+	errWriteOutside = errors.New("writeimage outside image")
+	errNotFont      = errors.New("image not a font")
+	errIndex        = errors.New("character index out of range")
+	errNameUsed     = errors.New("image name in use")
+	errNoName       = errors.New("no image with that name")
+	errNamed        = errors.New("image already has name")
+	errWrongName    = errors.New("wrong name for image")
+	errBadArg       = errors.New("bad argument in draw message")
+	errNoData       = errors.New("no draw data")
+	errShortRead    = errors.New("short read")
+)
+
+// maxImage is the most bytes of pixels an image may have.
+const maxImage = 1 << 30
+
+// A dimage is an image as known to the client, by id.
+type dimage struct {
+	id       int
+	ref      int
+	name     string // if acquired by name
+	vers     int
+	image    *memdraw.Image
+	ascent   int
+	fchar    []fchar // if a font
+	dscreen  *dscreen
+	fromname *dimage // the named image, owned by another id
+}
+
+// An fchar is a character loaded into a font image.
+type fchar struct {
+	minx, maxx int // left and right edges in the font image
+	miny, maxy int // top and bottom edges in the font image
+	left       int // offset of the left edge from the drawing point
+	width      int // width of the character
+}
+
+// A dscreen is a screen, on which windows are made.
+type dscreen struct {
+	id     int
+	ref    int
+	public bool
+	dimage *dimage
+	dfill  *dimage
+	screen *memdraw.Screen
+}
+
+// A dname is a name given to an image.
+type dname struct {
+	name   string
+	dimage *dimage
+	vers   int
+}
+
+// A client holds the state of a connection to the server: its images,
+// screens and names, and the data waiting to be read.
+type client struct {
+	screen    *memdraw.Image // the window
+	images    map[int]*dimage
+	dscreens  []*dscreen // screens made by the client
+	cscreens  []*dscreen // screens in use by the client, with repeats
+	names     []*dname
+	vers      int
+	infoid    int
+	op        draw.Op
+	readdata  []byte
+	flushrect draw.Rectangle
+	waste     int
+	dpi       int
+
+	// flush makes a rectangle of the screen visible.
+	flush func(r draw.Rectangle)
+}
+
+func newClient(screen *memdraw.Image, dpi int, flush func(draw.Rectangle)) *client {
+	return &client{
+		screen:    screen,
+		images:    make(map[int]*dimage),
+		infoid:    -1,
+		op:        draw.SoverD,
+		flushrect: draw.Rect(10000, 10000, -10000, -10000),
+		dpi:       dpi,
+		flush:     flush,
+	}
+}
+
+// addflush adds r to the rectangle of the screen to be made visible,
+// making the accumulated one visible first if the two are far apart.
+func (c *client) addflush(r draw.Rectangle) {
+	if !draw.RectClip(&r, c.screen.R) {
+		return
+	}
+	if c.flushrect.Min.X >= c.flushrect.Max.X {
+		c.flushrect = r
+		c.waste = 0
+		return
+	}
+	nbb := c.flushrect
+	draw.CombineRect(&nbb, r)
+	ar := r.Dx() * r.Dy()
+	abb := c.flushrect.Dx() * c.flushrect.Dy()
+	anbb := nbb.Dx() * nbb.Dy()
+
+	// The area of new waste is that of the new bounding box less
+	// that of the old one, less that of the new rectangle, which is
+	// assumed not to be waste.
+	c.waste += anbb - abb - ar
+	if c.waste < 0 {
+		c.waste = 0
+	}
+
+	// Absorb r if the total area is small, if the waste is less than
+	// half of it, or if the rectangles touch.
+	if anbb <= 1024 || c.waste*2 < anbb || draw.RectXRect(c.flushrect, r) {
+		c.flushrect = nbb
+		return
+	}
+	fr := c.flushrect
+	c.flushrect = r
+	c.waste = 0
+	if fr.Min.X < fr.Max.X {
+		c.flush(fr)
+	}
+}
+
+// dstflush notes that r of the image dst, with the given id, has been
+// drawn on.
+func (c *client) dstflush(dstid int, dst *memdraw.Image, r draw.Rectangle) {
+	if dstid == 0 {
+		draw.CombineRect(&c.flushrect, r)
+		return
+	}
+	l := dst.Layer
+	if l == nil {
+		return
+	}
+	for l != nil {
+		if l.Screen.Image.Data != c.screen.Data {
+			return
+		}
+		r = r.Add(l.Delta)
+		l = l.Screen.Image.Layer
+	}
+	c.addflush(r)
+}
+
+// drawflush makes the accumulated rectangle visible.
+func (c *client) drawflush() {
+	r := c.flushrect
+	c.flushrect = draw.Rect(10000, 10000, -10000, -10000)
+	if r.Min.X < r.Max.X {
+		c.flush(r)
+	}
+}
+
+func (c *client) lookupname(name string) *dname {
+	for _, n := range c.names {
+		if n.name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// goodname reports whether the names d and its screen were acquired by
+// still refer to the same images.
+func (c *client) goodname(d *dimage) bool {
+	if d.dscreen != nil {
+		if !c.goodname(d.dscreen.dimage) || !c.goodname(d.dscreen.dfill) {
+			return false
+		}
+	}
+	if d.name == "" {
+		return true
+	}
+	n := c.lookupname(d.name)
+	return n != nil && n.vers == d.vers
+}
+
+func (c *client) lookup(id int, checkname bool) *dimage {
+	d := c.images[id]
+	if d == nil || checkname && !c.goodname(d) {
+		return nil
+	}
+	return d
+}
+
+// lookupdscreen returns the screen the client made with the given id.
+func (c *client) lookupdscreen(id int) *dscreen {
+	for _, s := range c.dscreens {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// lookupscreen returns the index in c.cscreens of a screen in use with the
+// given id, or -1.
+func (c *client) lookupscreen(id int) int {
+	for i, s := range c.cscreens {
+		if s.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *client) install(id int, i *memdraw.Image, ds *dscreen) *dimage {
+	d := &dimage{id: id, ref: 1, image: i, dscreen: ds}
+	c.images[id] = d
+	return d
+}
+
+// installscreen starts using the screen ds, making it first if it is nil.
+func (c *client) installscreen(ds *dscreen, id int, di, dfill *dimage, public bool) *memdraw.Screen {
+	if ds == nil {
+		ds = &dscreen{
+			id:     id,
+			public: public,
+			dimage: di,
+			dfill:  dfill,
+			screen: &memdraw.Screen{Image: di.image, Fill: dfill.image},
+		}
+		di.ref++
+		dfill.ref++
+		c.dscreens = append(c.dscreens, ds)
+	}
+	ds.ref++
+	c.cscreens = append(c.cscreens, ds)
+	return ds.screen
+}
+
+func (c *client) delname(n *dname) {
+	for i, n1 := range c.names {
+		if n1 == n {
+			c.names = append(c.names[:i], c.names[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *client) freedscreen(ds *dscreen) {
+	ds.ref--
+	if ds.ref > 0 {
+		return
+	}
+	for i, ds1 := range c.dscreens {
+		if ds1 == ds {
+			c.dscreens = append(c.dscreens[:i], c.dscreens[i+1:]...)
+			c.freedimage(ds.dimage)
+			c.freedimage(ds.dfill)
+			return
+		}
+	}
+}
+
+func (c *client) freedimage(d *dimage) {
+	d.ref--
+	if d.ref > 0 {
+		return
+	}
+	for i := 0; i < len(c.names); {
+		if c.names[i].dimage == d {
+			c.delname(c.names[i])
+		} else {
+			i++
+		}
+	}
+	if d.fromname != nil {
+		// Acquired by name; owned by another id.
+		c.freedimage(d.fromname)
+		return
+	}
+	ds := d.dscreen
+	l := d.image
+	d.dscreen = nil
+	d.image = nil
+	if ds != nil {
+		if l.Data == c.screen.Data {
+			c.addflush(l.Layer.Screenr)
+		}
+		if c.goodname(d) {
+			memdraw.LDelete(l)
+		} else {
+			memdraw.LFree(l)
+		}
+		c.freedscreen(ds)
+	}
+}
+
+func (c *client) uninstallscreen(i int) {
+	ds := c.cscreens[i]
+	c.cscreens = append(c.cscreens[:i], c.cscreens[i+1:]...)
+	c.freedscreen(ds)
+}
+
+func (c *client) uninstall(id int) error {
+	d := c.images[id]
+	if d == nil {
+		return errNoImage
+	}
+	delete(c.images, id)
+	c.freedimage(d)
+	return nil
+}
+
+func (c *client) addname(d *dimage, name string) error {
+	if c.lookupname(name) != nil {
+		return errNameUsed
+	}
+	c.vers++
+	c.names = append(c.names, &dname{name: name, dimage: d, vers: c.vers})
+	return nil
+}
+
+// clientop returns the compositing operator for the next drawing
+// operation, resetting it to SoverD for the one after.
+func (c *client) clientop() draw.Op {
+	op := c.op
+	c.op = draw.SoverD
+	return op
+}
+
+func (c *client) image(a []byte) *memdraw.Image {
+	d := c.lookup(int(glong(a)), true)
+	if d == nil {
+		return nil
+	}
+	return d.image
+}
+
+func glong(a []byte) int32 {
+	return int32(uint32(a[0]) | uint32(a[1])<<8 | uint32(a[2])<<16 | uint32(a[3])<<24)
+}
+
+func gshort(a []byte) int {
+	return int(a[0]) | int(a[1])<<8
+}
+
+func gpoint(a []byte) draw.Point {
+	return draw.Pt(int(glong(a)), int(glong(a[4:])))
+}
+
+func grect(a []byte) draw.Rectangle {
+	return draw.Rect(int(glong(a)), int(glong(a[4:])), int(glong(a[8:])), int(glong(a[12:])))
+}
+
+// drawchar draws character index of font on dst at p, returning the point
+// after it and advancing the source point sp.
+func drawchar(dst *memdraw.Image, p draw.Point, src *memdraw.Image, sp *draw.Point, font *dimage, index int, op draw.Op) draw.Point {
+	fc := &font.fchar[index]
+	var r draw.Rectangle
+	r.Min.X = p.X + fc.left
+	r.Min.Y = p.Y - (font.ascent - fc.miny)
+	r.Max.X = r.Min.X + (fc.maxx - fc.minx)
+	r.Max.Y = r.Min.Y + (fc.maxy - fc.miny)
+	sp1 := draw.Pt(sp.X+fc.left, sp.Y+fc.miny)
+	memdraw.Draw(dst, r, src, sp1, font.image, draw.Pt(fc.minx, fc.miny), op)
+	p.X += fc.width
+	sp.X += fc.width
+	return p
+}
+
+// drawcoord decodes a polygon coordinate from a, which is either a 7-bit
+// difference from old or, if the high bit is set, a 23-bit value.
+func drawcoord(a []byte, old int) (x int, rest []byte, ok bool) {
+	if len(a) == 0 {
+		return 0, nil, false
+	}
+	b := a[0]
+	a = a[1:]
+	x = int(b & 0x7F)
+	if b&0x80 != 0 {
+		if len(a) < 2 {
+			return 0, nil, false
+		}
+		x |= int(a[0])<<7 | int(a[1])<<15
+		a = a[2:]
+		if x&(1<<22) != 0 {
+			x |= ^0 << 23
+		}
+	} else {
+		if b&0x40 != 0 {
+			x |= ^0 << 7
+		}
+		x += old
+	}
+	return x, a, true
+}
+
+// read returns the data waiting to be read, if it fits in n bytes.
+func (c *client) read(n int) ([]byte, error) {
+	if c.readdata == nil {
+		return nil, errNoData
+	}
+	if n < len(c.readdata) {
+		return nil, errShortRead
+	}
+	b := c.readdata
+	c.readdata = nil
+	return b, nil
+}
+
+// write carries out the draw messages in a.
+func (c *client) write(a []byte) error {
+	for len(a) > 0 {
+		m, err := c.msg(a)
+		if err != nil {
+			return err
+		}
+		a = a[m:]
+	}
+	return nil
+}
+
+// msg carries out the draw message at the start of a, returning its
+// length.
+func (c *client) msg(a []byte) (m int, err error) {
+	n := len(a)
+	switch a[0] {
+	default:
+		return 0, fmt.Errorf("bad draw command %q", a[0])
+
+	// allocate: 'b' id[4] screenid[4] refresh[1] chan[4] repl[1]
+	//	R[4*4] clipR[4*4] rrggbbaa[4]
+	case 'b':
+		m = 1 + 4 + 4 + 1 + 4 + 1 + 4*4 + 4*4 + 4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dstid := int(glong(a[1:]))
+		scrnid := int(glong(a[5:]))
+		refresh := a[9]
+		pix := draw.Pix(glong(a[10:]))
+		repl := a[14] != 0
+		r := grect(a[15:])
+		clipr := grect(a[31:])
+		value := draw.Color(glong(a[47:]))
+		if c.lookup(dstid, false) != nil {
+			return 0, errImageExists
+		}
+		if d := pix.Depth(); d > 0 && r.Dx() > 0 && r.Dy() > 0 && draw.BytesPerLine(r, d) > maxImage/r.Dy() {
+			return 0, errDrawMem
+		}
+		if scrnid != 0 {
+			i := c.lookupscreen(scrnid)
+			if i < 0 {
+				return 0, errNoScreen
+			}
+			ds := c.cscreens[i]
+			scrn := ds.screen
+			if repl || pix != scrn.Image.Pix {
+				return 0, errors.New("image parameters incompatible with screen")
+			}
+			var reffn memdraw.Refreshfn
+			switch refresh {
+			case draw.RefBackup:
+			case draw.RefNone, draw.RefMesg:
+				// Nothing reads refresh messages, so there is
+				// no more to do than for RefNone.
+				reffn = memdraw.LNoRefresh
+			default:
+				return 0, errors.New("unknown refresh method")
+			}
+			l, err := memdraw.LAlloc(scrn, r, reffn, nil, value)
+			if err != nil {
+				return 0, errDrawMem
+			}
+			c.addflush(l.Layer.Screenr)
+			l.Clipr = clipr
+			draw.RectClip(&l.Clipr, r)
+			c.install(dstid, l, ds)
+			ds.ref++
+			return m, nil
+		}
+		i, err := memdraw.AllocImage(r, pix)
+		if err != nil {
+			return 0, errDrawMem
+		}
+		if repl {
+			i.Flags |= memdraw.Frepl
+		}
+		i.Clipr = clipr
+		if !repl {
+			draw.RectClip(&i.Clipr, r)
+		}
+		c.install(dstid, i, nil)
+		memdraw.FillColor(i, value)
+		return m, nil
+
+	// allocate screen: 'A' id[4] imageid[4] fillid[4] public[1]
+	case 'A':
+		m = 1 + 4 + 4 + 4 + 1
+		if n < m {
+			return 0, errShortDraw
+		}
+		dstid := int(glong(a[1:]))
+		if dstid == 0 {
+			return 0, errBadArg
+		}
+		if c.lookupdscreen(dstid) != nil {
+			return 0, errScreenExists
+		}
+		ddst := c.lookup(int(glong(a[5:])), true)
+		dsrc := c.lookup(int(glong(a[9:])), true)
+		if ddst == nil || dsrc == nil {
+			return 0, errNoImage
+		}
+		c.installscreen(nil, dstid, ddst, dsrc, a[13] != 0)
+		return m, nil
+
+	// set repl and clip: 'c' dstid[4] repl[1] clipR[4*4]
+	case 'c':
+		m = 1 + 4 + 1 + 4*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		ddst := c.lookup(int(glong(a[1:])), true)
+		if ddst == nil {
+			return 0, errNoImage
+		}
+		if ddst.name != "" {
+			return 0, errors.New("can't change repl/clipr of shared image")
+		}
+		dst := ddst.image
+		if a[5] != 0 {
+			dst.Flags |= memdraw.Frepl
+		} else {
+			dst.Flags &^= memdraw.Frepl
+		}
+		dst.Clipr = grect(a[6:])
+		return m, nil
+
+	// draw: 'd' dstid[4] srcid[4] maskid[4] R[4*4] P[2*4] P[2*4]
+	case 'd':
+		m = 1 + 4 + 4 + 4 + 4*4 + 2*4 + 2*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dst := c.image(a[1:])
+		dstid := int(glong(a[1:]))
+		src := c.image(a[5:])
+		mask := c.image(a[9:])
+		if dst == nil || src == nil || mask == nil {
+			return 0, errNoImage
+		}
+		r := grect(a[13:])
+		p := gpoint(a[29:])
+		q := gpoint(a[37:])
+		memdraw.Draw(dst, r, src, p, mask, q, c.clientop())
+		c.dstflush(dstid, dst, r)
+		return m, nil
+
+	// toggle debugging: 'D' val[1]
+	case 'D':
+		m = 1 + 1
+		if n < m {
+			return 0, errShortDraw
+		}
+		return m, nil
+
+	// ellipse: 'e' dstid[4] srcid[4] center[2*4] a[4] b[4] thick[4] sp[2*4] alpha[4] phi[4]
+	case 'e', 'E':
+		m = 1 + 4 + 4 + 2*4 + 4 + 4 + 4 + 2*4 + 2*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dst := c.image(a[1:])
+		dstid := int(glong(a[1:]))
+		src := c.image(a[5:])
+		if dst == nil || src == nil {
+			return 0, errNoImage
+		}
+		p := gpoint(a[9:])
+		e0 := int(glong(a[17:]))
+		e1 := int(glong(a[21:]))
+		if e0 < 0 || e1 < 0 {
+			return 0, errors.New("invalid ellipse semidiameter")
+		}
+		j := int(glong(a[25:]))
+		if j < 0 {
+			return 0, errors.New("negative ellipse thickness")
+		}
+		sp := gpoint(a[29:])
+		t := j
+		if a[0] == 'E' {
+			t = -1
+		}
+		ox := uint32(glong(a[37:]))
+		oy := int(glong(a[41:]))
+		op := c.clientop()
+		// The high bit says arc angles are present.
+		if ox&(1<<31) != 0 {
+			if ox&(1<<30) == 0 {
+				ox &^= 1 << 31
+			}
+			memdraw.Arc(dst, p, e0, e1, t, src, sp, int(int32(ox)), oy, op)
+		} else {
+			memdraw.Ellipse(dst, p, e0, e1, t, src, sp, op)
+		}
+		c.dstflush(dstid, dst, draw.Rect(p.X-e0-j, p.Y-e1-j, p.X+e0+j+1, p.Y+e1+j+1))
+		return m, nil
+
+	// free: 'f' id[4]
+	case 'f':
+		m = 1 + 4
+		if n < m {
+			return 0, errShortDraw
+		}
+		if err := c.uninstall(int(glong(a[1:]))); err != nil {
+			return 0, err
+		}
+		return m, nil
+
+	// free screen: 'F' id[4]
+	case 'F':
+		m = 1 + 4
+		if n < m {
+			return 0, errShortDraw
+		}
+		i := c.lookupscreen(int(glong(a[1:])))
+		if i < 0 {
+			return 0, errNoScreen
+		}
+		c.uninstallscreen(i)
+		return m, nil
+
+	// initialize font: 'i' fontid[4] nchars[4] ascent[1]
+	case 'i':
+		m = 1 + 4 + 4 + 1
+		if n < m {
+			return 0, errShortDraw
+		}
+		dstid := int(glong(a[1:]))
+		if dstid == 0 {
+			return 0, errors.New("can't use display as font")
+		}
+		font := c.lookup(dstid, true)
+		if font == nil {
+			return 0, errNoImage
+		}
+		if font.image.Layer != nil {
+			return 0, errors.New("can't use window as font")
+		}
+		ni := int(glong(a[5:]))
+		if ni <= 0 || ni > 4096 {
+			return 0, errors.New("bad font size (4096 chars max)")
+		}
+		font.fchar = make([]fchar, ni)
+		font.ascent = int(a[9])
+		return m, nil
+
+	// set image 0 to screen image: 'J'
+	case 'J':
+		m = 1
+		if c.lookup(0, false) != nil {
+			return 0, errImageExists
+		}
+		c.install(0, c.screen, nil)
+		c.infoid = 0
+		return m, nil
+
+	// get image info: 'I'
+	case 'I':
+		m = 1
+		if c.infoid < 0 {
+			return 0, errNoImage
+		}
+		var i *memdraw.Image
+		if c.infoid == 0 {
+			i = c.screen
+		} else {
+			di := c.lookup(c.infoid, true)
+			if di == nil {
+				return 0, errNoImage
+			}
+			i = di.image
+		}
+		repl := 0
+		if i.Flags&memdraw.Frepl != 0 {
+			repl = 1
+		}
+		c.readdata = []byte(fmt.Sprintf("%11d %11d %11s %11d %11d %11d %11d %11d %11d %11d %11d %11d ",
+			1, c.infoid, i.Pix, repl,
+			i.R.Min.X, i.R.Min.Y, i.R.Max.X, i.R.Max.Y,
+			i.Clipr.Min.X, i.Clipr.Min.Y, i.Clipr.Max.X, i.Clipr.Max.Y))
+		c.infoid = -1
+		return m, nil
+
+	// query: 'q' n[1] queryspec[n]
+	case 'q':
+		if n < 2 {
+			return 0, errShortDraw
+		}
+		m = 1 + 1 + int(a[1])
+		if n < m {
+			return 0, errShortDraw
+		}
+		var b []byte
+		for _, q := range a[2:m] {
+			switch q {
+			default:
+				return 0, errors.New("unknown query")
+			case 'd': // dpi
+				b = fmt.Appendf(b, "%11d ", c.dpi)
+			}
+		}
+		c.readdata = b
+		return m, nil
+
+	// load character: 'l' fontid[4] srcid[4] index[2] R[4*4] P[2*4] left[1] width[1]
+	case 'l':
+		m = 1 + 4 + 4 + 2 + 4*4 + 2*4 + 1 + 1
+		if n < m {
+			return 0, errShortDraw
+		}
+		font := c.lookup(int(glong(a[1:])), true)
+		if font == nil {
+			return 0, errNoImage
+		}
+		if len(font.fchar) == 0 {
+			return 0, errNotFont
+		}
+		src := c.image(a[5:])
+		if src == nil {
+			return 0, errNoImage
+		}
+		ci := gshort(a[9:])
+		if ci >= len(font.fchar) {
+			return 0, errIndex
+		}
+		r := grect(a[11:])
+		p := gpoint(a[27:])
+		memdraw.Draw(font.image, r, src, p, memdraw.Opaque, p, draw.S)
+		font.fchar[ci] = fchar{
+			minx:  r.Min.X,
+			maxx:  r.Max.X,
+			miny:  int(uint8(r.Min.Y)),
+			maxy:  int(uint8(r.Max.Y)),
+			left:  int(int8(a[35])),
+			width: int(a[36]),
+		}
+		return m, nil
+
+	// draw line: 'L' dstid[4] p0[2*4] p1[2*4] end0[4] end1[4] radius[4] srcid[4] sp[2*4]
+	case 'L':
+		m = 1 + 4 + 2*4 + 2*4 + 4 + 4 + 4 + 4 + 2*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dst := c.image(a[1:])
+		dstid := int(glong(a[1:]))
+		p := gpoint(a[5:])
+		q := gpoint(a[13:])
+		e0 := draw.End(glong(a[21:]))
+		e1 := draw.End(glong(a[25:]))
+		j := int(glong(a[29:]))
+		if j < 0 {
+			return 0, errors.New("negative line width")
+		}
+		src := c.image(a[33:])
+		if dst == nil || src == nil {
+			return 0, errNoImage
+		}
+		sp := gpoint(a[37:])
+		memdraw.Line(dst, p, q, e0, e1, j, src, sp, c.clientop())
+		if dstid == 0 || dst.Layer != nil {
+			r := memdraw.LineBBox(p, q, e0, e1, j)
+			c.dstflush(dstid, dst, r.Inset(-(1 + 1 + j)))
+		}
+		return m, nil
+
+	// attach to a named image: 'n' dstid[4] j[1] name[j]
+	case 'n':
+		m = 1 + 4 + 1
+		if n < m {
+			return 0, errShortDraw
+		}
+		j := int(a[5])
+		if j == 0 { // give me a non-empty name please
+			return 0, errShortDraw
+		}
+		m += j
+		if n < m {
+			return 0, errShortDraw
+		}
+		dstid := int(glong(a[1:]))
+		if c.lookup(dstid, false) != nil {
+			return 0, errImageExists
+		}
+		name := string(a[6:m])
+		dn := c.lookupname(name)
+		if dn == nil {
+			return 0, errNoName
+		}
+		di := c.install(dstid, dn.dimage.image, nil)
+		di.vers = dn.vers
+		di.name = name
+		di.fromname = dn.dimage
+		di.fromname.ref++
+		c.infoid = dstid
+		return m, nil
+
+	// name an image: 'N' dstid[4] in[1] j[1] name[j]
+	case 'N':
+		m = 1 + 4 + 1 + 1
+		if n < m {
+			return 0, errShortDraw
+		}
+		in := a[5] != 0
+		j := int(a[6])
+		if j == 0 { // give me a non-empty name please
+			return 0, errShortDraw
+		}
+		m += j
+		if n < m {
+			return 0, errShortDraw
+		}
+		di := c.lookup(int(glong(a[1:])), false)
+		if di == nil {
+			return 0, errNoImage
+		}
+		if di.name != "" {
+			return 0, errNamed
+		}
+		name := string(a[7:m])
+		if in {
+			if err := c.addname(di, name); err != nil {
+				return 0, err
+			}
+		} else {
+			dn := c.lookupname(name)
+			if dn == nil {
+				return 0, errNoName
+			}
+			if dn.dimage != di {
+				return 0, errWrongName
+			}
+			c.delname(dn)
+		}
+		return m, nil
+
+	// position window: 'o' id[4] r.min [2*4] screenr.min [2*4]
+	case 'o':
+		m = 1 + 4 + 2*4 + 2*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dst := c.image(a[1:])
+		if dst == nil {
+			return 0, errNoImage
+		}
+		if dst.Layer != nil {
+			p := gpoint(a[5:])
+			q := gpoint(a[13:])
+			r := dst.Layer.Screenr
+			ni, err := memdraw.LOrigin(dst, p, q)
+			if err != nil {
+				return 0, errors.New("image origin failed")
+			}
+			if ni > 0 {
+				c.addflush(r)
+				c.addflush(dst.Layer.Screenr)
+			}
+		}
+		return m, nil
+
+	// set compositing operator for next draw operation: 'O' op
+	case 'O':
+		m = 1 + 1
+		if n < m {
+			return 0, errShortDraw
+		}
+		c.op = draw.Op(a[1])
+		return m, nil
+
+	// filled polygon: 'P' dstid[4] n[2] wind[4] ignore[2*4] srcid[4] sp[2*4] p0[2*4] dp[2*2*n]
+	// polygon: 'p' dstid[4] n[2] end0[4] end1[4] radius[4] srcid[4] sp[2*4] p0[2*4] dp[2*2*n]
+	case 'p', 'P':
+		m = 1 + 4 + 2 + 4 + 4 + 4 + 4 + 2*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dstid := int(glong(a[1:]))
+		dst := c.image(a[1:])
+		ni := gshort(a[5:])
+		e0 := int(glong(a[7:]))
+		e1 := int(glong(a[11:]))
+		j := 0
+		if a[0] == 'p' {
+			j = int(glong(a[15:]))
+			if j < 0 {
+				return 0, errors.New("negative polygon line width")
+			}
+		}
+		src := c.image(a[19:])
+		if dst == nil || src == nil {
+			return 0, errNoImage
+		}
+		sp := gpoint(a[23:])
+		p := gpoint(a[31:])
+		ni++
+		pp := make([]draw.Point, ni)
+		// Flush only what is drawn on the screen.
+		doflush := dstid == 0 || dst.Layer != nil && dst.Layer.Screen.Image.Data == c.screen.Data
+		ox, oy := 0, 0
+		esize := 0
+		u := a[m:]
+		var ok bool
+		var r draw.Rectangle
+		for y := 0; y < ni; y++ {
+			q := p
+			oesize := esize
+			if p.X, u, ok = drawcoord(u, ox); !ok {
+				return 0, errShortDraw
+			}
+			if p.Y, u, ok = drawcoord(u, oy); !ok {
+				return 0, errShortDraw
+			}
+			ox, oy = p.X, p.Y
+			if doflush {
+				esize = j
+				if a[0] == 'p' {
+					if y == 0 {
+						if s := memdraw.LineEndSize(draw.End(e0)); s > esize {
+							esize = s
+						}
+					}
+					if y == ni-1 {
+						if s := memdraw.LineEndSize(draw.End(e1)); s > esize {
+							esize = s
+						}
+					}
+				}
+				if a[0] == 'P' && e0 != 1 && e0 != ^0 {
+					r = dst.Clipr
+				} else if y > 0 {
+					r = draw.Rect(q.X-oesize, q.Y-oesize, q.X+oesize+1, q.Y+oesize+1)
+					draw.CombineRect(&r, draw.Rect(p.X-esize, p.Y-esize, p.X+esize+1, p.Y+esize+1))
+				}
+				if draw.RectClip(&r, dst.Clipr) {
+					c.dstflush(dstid, dst, r)
+				}
+			}
+			pp[y] = p
+		}
+		if ni == 1 {
+			c.dstflush(dstid, dst, draw.Rect(p.X-esize, p.Y-esize, p.X+esize+1, p.Y+esize+1))
+		}
+		op := c.clientop()
+		if a[0] == 'p' {
+			memdraw.Poly(dst, pp, draw.End(e0), draw.End(e1), j, src, sp, op)
+		} else {
+			memdraw.FillPoly(dst, pp, e0, src, sp, op)
+		}
+		return n - len(u), nil
+
+	// read: 'r' id[4] R[4*4]
+	case 'r':
+		m = 1 + 4 + 4*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		i := c.image(a[1:])
+		if i == nil {
+			return 0, errNoImage
+		}
+		r := grect(a[5:])
+		if !r.In(i.R) || r.Empty() {
+			return 0, errReadOutside
+		}
+		b := make([]byte, draw.BytesPerLine(r, i.Depth)*r.Dy())
+		nb, err := memdraw.Unload(i, r, b)
+		if err != nil {
+			return 0, errors.New("bad readimage call")
+		}
+		c.readdata = b[:nb]
+		return m, nil
+
+	// string: 's' dstid[4] srcid[4] fontid[4] P[2*4] clipr[4*4] sp[2*4] ni[2] ni*(index[2])
+	// stringbg: 'x' dstid[4] srcid[4] fontid[4] P[2*4] clipr[4*4] sp[2*4] ni[2] bgid[4] bgpt[2*4] ni*(index[2])
+	case 's', 'x':
+		m = 1 + 4 + 4 + 4 + 2*4 + 4*4 + 2*4 + 2
+		if a[0] == 'x' {
+			m += 4 + 2*4
+		}
+		if n < m {
+			return 0, errShortDraw
+		}
+		dst := c.image(a[1:])
+		dstid := int(glong(a[1:]))
+		src := c.image(a[5:])
+		if dst == nil || src == nil {
+			return 0, errNoImage
+		}
+		font := c.lookup(int(glong(a[9:])), true)
+		if font == nil {
+			return 0, errNoImage
+		}
+		if len(font.fchar) == 0 {
+			return 0, errNotFont
+		}
+		p := gpoint(a[13:])
+		r := grect(a[21:])
+		sp := gpoint(a[37:])
+		ni := gshort(a[45:])
+		u := a[m:]
+		m += ni * 2
+		if n < m {
+			return 0, errShortDraw
+		}
+		index := make([]int, ni)
+		for k := range index {
+			index[k] = gshort(u[2*k:])
+			if index[k] >= len(font.fchar) {
+				return 0, errIndex
+			}
+		}
+		clipr := dst.Clipr
+		dst.Clipr = r
+		op := c.clientop()
+		if a[0] == 'x' {
+			// Paint the background.
+			l := c.image(a[47:])
+			if l == nil {
+				dst.Clipr = clipr
+				return 0, errNoImage
+			}
+			q := gpoint(a[51:])
+			r.Min.X = p.X
+			r.Min.Y = p.Y - font.ascent
+			r.Max.X = p.X
+			r.Max.Y = r.Min.Y + font.image.R.Dy()
+			for _, ci := range index {
+				r.Max.X += font.fchar[ci].width
+			}
+			memdraw.Draw(dst, r, l, q, memdraw.Opaque, draw.ZP, op)
+		}
+		q := p
+		for _, ci := range index {
+			q = drawchar(dst, q, src, &sp, font, ci, op)
+		}
+		dst.Clipr = clipr
+		p.Y -= font.ascent
+		c.dstflush(dstid, dst, draw.Rect(p.X, p.Y, q.X, p.Y+font.image.R.Dy()))
+		return m, nil
+
+	// use public screen: 'S' id[4] chan[4]
+	case 'S':
+		m = 1 + 4 + 4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dstid := int(glong(a[1:]))
+		if dstid == 0 {
+			return 0, errBadArg
+		}
+		ds := c.lookupdscreen(dstid)
+		if ds == nil {
+			return 0, errNoScreen
+		}
+		if ds.screen.Image.Pix != draw.Pix(glong(a[5:])) {
+			return 0, errors.New("inconsistent chan")
+		}
+		c.installscreen(ds, 0, nil, nil, false)
+		return m, nil
+
+	// top or bottom windows: 't' top[1] nw[2] n*id[4]
+	case 't':
+		m = 1 + 1 + 2
+		if n < m {
+			return 0, errShortDraw
+		}
+		nw := gshort(a[2:])
+		if nw == 0 {
+			return m, nil
+		}
+		m += nw * 4
+		if n < m {
+			return 0, errShortDraw
+		}
+		lp := make([]*memdraw.Image, nw)
+		for j := range lp {
+			lp[j] = c.image(a[1+1+2+j*4:])
+			if lp[j] == nil {
+				return 0, errNoImage
+			}
+		}
+		if lp[0].Layer == nil {
+			return 0, errors.New("images are not windows")
+		}
+		for _, l := range lp[1:] {
+			if l.Layer == nil || l.Layer.Screen != lp[0].Layer.Screen {
+				return 0, errors.New("images not on same screen")
+			}
+		}
+		if a[1] != 0 {
+			memdraw.LToFrontN(lp, nw)
+		} else {
+			memdraw.LToRearN(lp, nw)
+		}
+		if lp[0].Layer.Screen.Image.Data == c.screen.Data {
+			for _, l := range lp {
+				c.addflush(l.Layer.Screenr)
+			}
+		}
+		return m, nil
+
+	// visible: 'v'
+	case 'v':
+		m = 1
+		c.drawflush()
+		return m, nil
+
+	// write: 'y' id[4] R[4*4] data[x*1]
+	// write from compressed data: 'Y' id[4] R[4*4] data[x*1]
+	case 'y', 'Y':
+		m = 1 + 4 + 4*4
+		if n < m {
+			return 0, errShortDraw
+		}
+		dstid := int(glong(a[1:]))
+		dst := c.image(a[1:])
+		if dst == nil {
+			return 0, errNoImage
+		}
+		r := grect(a[5:])
+		if !r.In(dst.R) || r.Empty() {
+			return 0, errWriteOutside
+		}
+		y, err := memdraw.Load(dst, r, a[m:], a[0] == 'Y')
+		if err != nil || y < 0 {
+			return 0, errors.New("bad writeimage call")
+		}
+		c.dstflush(dstid, dst, r)
+		return m + y, nil
+	}
+}
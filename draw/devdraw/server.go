@@ -0,0 +1,431 @@
+// Package devdraw is a draw server written in Go, standing in for the
+// devdraw program that drawfcall.New runs. It keeps the window in memory,
+// drawing on it with memdraw, and so needs no window system: programs
+// using it run headless.
+//
+//	s := devdraw.New()
+//	d, err := draw.InitConn(s.Dial(), nil, "", "label", "800x600")
+//
+// Mouse and keyboard input is given to the program with the server's
+// Mouse and Key methods. A Backend, if set, shows the window.
+//
+// Importing the package registers the server with drawfcall under the
+// name "go", so that draw.Init uses it when $DEVDRAW is "go".
+package devdraw
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"sync"
+
+	"bwsd.dev/plan9/draw"
+	"bwsd.dev/plan9/draw/drawfcall"
+	"bwsd.dev/plan9/draw/memdraw"
+)
+
+// memdrawMu serializes the use of memdraw, which keeps global state, by
+// all servers.
+var memdrawMu sync.Mutex
+
+const (
+	// defaultSize is the size of the window if Tinit does not give one.
+	defaultSize = "1024x768"
+
+	// dpi is the density the server reports for its window.
+	dpi = 100
+
+	// maxQueue is the most mouse events or keys the server queues for
+	// the client to read. Older ones are dropped.
+	maxQueue = 256
+)
+
+func init() {
+	drawfcall.Register("go", func() *drawfcall.Conn {
+		return New().Dial()
+	})
+}
+
+// A Backend shows the window of a Server, on a screen or elsewhere. The
+// server calls its methods one at a time.
+type Backend interface {
+	// Flush shows the rectangle r of the window, whose contents are
+	// in screen. Screen must not be used once Flush returns.
+	Flush(screen *memdraw.Image, r image.Rectangle)
+
+	// SetLabel sets the label of the window.
+	SetLabel(label string)
+
+	// SetCursor sets the image of the mouse cursor, or restores the
+	// arrow if c is nil. C2 is the cursor at twice the size, or nil.
+	SetCursor(c *drawfcall.Cursor, c2 *drawfcall.Cursor2)
+
+	// MoveTo moves the mouse cursor to p.
+	MoveTo(p image.Point)
+
+	// Top raises the window above the others.
+	Top()
+}
+
+// A Server is a draw server. It serves a single client at a time.
+type Server struct {
+	// Backend shows the window. If nil, the window is kept in memory
+	// only.
+	Backend Backend
+
+	mu      sync.Mutex
+	c       *client // nil until Tinit
+	size    image.Rectangle
+	snarf   []byte
+	serving bool
+
+	mouse     drawfcall.Mouse // where the mouse is
+	mouseq    []drawfcall.Mouse
+	resized   bool
+	mousetags []uint8
+	kbdq      []rune
+	kbdtags   []kbdread
+
+	out  [][]byte   // replies waiting to be written
+	outc *sync.Cond // signaled when out grows or serving stops
+}
+
+// A kbdread is a pending keyboard read.
+type kbdread struct {
+	tag uint8
+	typ uint8 // Trdkbd or Trdkbd4
+}
+
+// New returns a new server.
+func New() *Server {
+	s := new(Server)
+	s.outc = sync.NewCond(&s.mu)
+	return s
+}
+
+// Dial starts serving a new in-memory connection and returns the client's
+// end of it.
+func (s *Server) Dial() *drawfcall.Conn {
+	c1, c2 := net.Pipe()
+	go func() {
+		s.Serve(c2)
+		c2.Close()
+	}()
+	return drawfcall.NewConn(c1)
+}
+
+// Serve serves the draw protocol on rw until reading from it fails. It
+// returns nil if the client hangs up.
+func (s *Server) Serve(rw io.ReadWriter) error {
+	s.mu.Lock()
+	if s.serving {
+		s.mu.Unlock()
+		return errors.New("devdraw: already serving a client")
+	}
+	stop := new(bool)
+	s.serving = true
+	s.c = nil
+	s.mousetags = nil
+	s.kbdtags = nil
+	s.out = nil
+	s.mu.Unlock()
+	go s.writer(rw, stop)
+
+	defer func() {
+		s.mu.Lock()
+		*stop = true
+		s.serving = false
+		s.out = nil
+		s.outc.Broadcast()
+		s.mu.Unlock()
+	}()
+	for {
+		b, err := drawfcall.ReadMsg(rw)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		m := new(drawfcall.Msg)
+		if err := m.Unmarshal(b); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.send(s.handle(m))
+		s.mu.Unlock()
+	}
+}
+
+// send queues the replies rs to be written to the client. s.mu must be
+// held.
+func (s *Server) send(rs []*drawfcall.Msg) {
+	if !s.serving || len(rs) == 0 {
+		return
+	}
+	for _, r := range rs {
+		s.out = append(s.out, r.Marshal())
+	}
+	s.outc.Signal()
+}
+
+// writer writes the queued replies to w until stop is set. Writing apart
+// from Serve keeps the server reading requests while the client is busy
+// writing, as a client reading replies in the same goroutine that writes
+// requests would otherwise deadlock with it on an unbuffered connection.
+func (s *Server) writer(w io.Writer, stop *bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.out) == 0 && !*stop {
+			s.outc.Wait()
+		}
+		if *stop {
+			return
+		}
+		out := s.out
+		s.out = nil
+		s.mu.Unlock()
+		for _, b := range out {
+			w.Write(b)
+		}
+		s.mu.Lock()
+	}
+}
+
+// handle carries out the request m, returning the replies to send.
+func (s *Server) handle(m *drawfcall.Msg) []*drawfcall.Msg {
+	if s.c == nil && m.Type != drawfcall.Tinit {
+		return rerror(m, errors.New("not initialized"))
+	}
+	r := &drawfcall.Msg{Type: m.Type + 1, Tag: m.Tag}
+	switch m.Type {
+	default:
+		return rerror(m, fmt.Errorf("unknown message type %d", m.Type))
+
+	case drawfcall.Tinit:
+		if s.c != nil {
+			return rerror(m, errors.New("already initialized"))
+		}
+		if s.size.Empty() {
+			size := m.Winsize
+			if size == "" {
+				size = defaultSize
+			}
+			r, err := parseWinsize(size)
+			if err != nil {
+				return rerror(m, err)
+			}
+			s.size = r
+		}
+		s.setLabel(m.Label)
+		memdrawMu.Lock()
+		memdraw.Init()
+		screen, err := memdraw.AllocImage(s.size, draw.XRGB32)
+		memdrawMu.Unlock()
+		if err != nil {
+			return rerror(m, err)
+		}
+		s.c = newClient(screen, dpi, s.flush)
+
+	case drawfcall.Trdmouse:
+		s.mousetags = append(s.mousetags, m.Tag)
+		return s.matchMouse()
+
+	case drawfcall.Trdkbd, drawfcall.Trdkbd4:
+		s.kbdtags = append(s.kbdtags, kbdread{m.Tag, m.Type})
+		return s.matchKbd()
+
+	case drawfcall.Tmoveto:
+		s.mouse.Point = m.Mouse.Point
+		if s.Backend != nil {
+			s.Backend.MoveTo(m.Mouse.Point)
+		}
+
+	case drawfcall.Tbouncemouse:
+		rs := s.queueMouse(m.Mouse)
+		return append([]*drawfcall.Msg{r}, rs...)
+
+	case drawfcall.Tcursor, drawfcall.Tcursor2:
+		if s.Backend != nil {
+			switch {
+			case m.Arrow:
+				s.Backend.SetCursor(nil, nil)
+			case m.Type == drawfcall.Tcursor:
+				s.Backend.SetCursor(&m.Cursor, nil)
+			default:
+				s.Backend.SetCursor(&m.Cursor, &m.Cursor2)
+			}
+		}
+
+	case drawfcall.Ttop:
+		if s.Backend != nil {
+			s.Backend.Top()
+		}
+
+	case drawfcall.Tctxt:
+		// Nothing to do.
+
+	case drawfcall.Tlabel:
+		s.setLabel(m.Label)
+
+	case drawfcall.Trdsnarf:
+		r.Snarf = s.snarf
+
+	case drawfcall.Twrsnarf:
+		s.snarf = append([]byte(nil), m.Snarf...)
+
+	case drawfcall.Tresize:
+		rs := s.resize(m.Rect)
+		return append([]*drawfcall.Msg{r}, rs...)
+
+	case drawfcall.Trddraw:
+		memdrawMu.Lock()
+		b, err := s.c.read(m.Count)
+		memdrawMu.Unlock()
+		if err != nil {
+			return rerror(m, err)
+		}
+		r.Data = b
+
+	case drawfcall.Twrdraw:
+		if err := s.write(m.Data); err != nil {
+			return rerror(m, err)
+		}
+		r.Count = len(m.Data)
+	}
+	return []*drawfcall.Msg{r}
+}
+
+// write carries out the draw messages in b, turning a panic in memdraw,
+// as on a message it does not expect, into an error.
+func (s *Server) write(b []byte) (err error) {
+	memdrawMu.Lock()
+	defer memdrawMu.Unlock()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("draw failed: %v", e)
+		}
+	}()
+	return s.c.write(b)
+}
+
+func rerror(m *drawfcall.Msg, err error) []*drawfcall.Msg {
+	return []*drawfcall.Msg{{Type: drawfcall.Rerror, Tag: m.Tag, Error: err.Error()}}
+}
+
+// flush makes r of the window visible. It is called with memdrawMu held.
+func (s *Server) flush(r draw.Rectangle) {
+	if s.Backend != nil {
+		s.Backend.Flush(s.c.screen, r)
+	}
+}
+
+func (s *Server) setLabel(label string) {
+	if s.Backend != nil {
+		s.Backend.SetLabel(label)
+	}
+}
+
+// Mouse reports the state of the mouse to the client.
+func (s *Server) Mouse(m drawfcall.Mouse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send(s.queueMouse(m))
+}
+
+// Key reports a key typed to the client.
+func (s *Server) Key(r rune) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kbdq = append(s.kbdq, r)
+	if len(s.kbdq) > maxQueue {
+		s.kbdq = s.kbdq[1:]
+	}
+	s.send(s.matchKbd())
+}
+
+// Resize changes the size of the window to r, telling the client.
+func (s *Server) Resize(r image.Rectangle) error {
+	if r.Empty() {
+		return fmt.Errorf("devdraw: bad window size %v", r)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send(s.resize(r))
+	return nil
+}
+
+func (s *Server) resize(r image.Rectangle) []*drawfcall.Msg {
+	s.size = r
+	if s.c == nil {
+		return nil
+	}
+	memdrawMu.Lock()
+	screen, err := memdraw.AllocImage(r, draw.XRGB32)
+	if err == nil {
+		s.c.screen = screen
+		s.c.flushrect = draw.Rect(10000, 10000, -10000, -10000)
+	}
+	memdrawMu.Unlock()
+	if err != nil {
+		return nil
+	}
+	s.resized = true
+	return s.queueMouse(s.mouse)
+}
+
+func (s *Server) queueMouse(m drawfcall.Mouse) []*drawfcall.Msg {
+	s.mouse = m
+	// Merge moves with the buttons held the same.
+	if n := len(s.mouseq); n > 0 && s.mouseq[n-1].Buttons == m.Buttons {
+		s.mouseq[n-1] = m
+	} else {
+		s.mouseq = append(s.mouseq, m)
+		if len(s.mouseq) > maxQueue {
+			s.mouseq = s.mouseq[1:]
+		}
+	}
+	return s.matchMouse()
+}
+
+// matchMouse answers pending mouse reads with queued mouse events.
+func (s *Server) matchMouse() []*drawfcall.Msg {
+	var rs []*drawfcall.Msg
+	for len(s.mouseq) > 0 && len(s.mousetags) > 0 {
+		rs = append(rs, &drawfcall.Msg{
+			Type:    drawfcall.Rrdmouse,
+			Tag:     s.mousetags[0],
+			Mouse:   s.mouseq[0],
+			Resized: s.resized,
+		})
+		s.resized = false
+		s.mouseq = s.mouseq[1:]
+		s.mousetags = s.mousetags[1:]
+	}
+	return rs
+}
+
+// matchKbd answers pending keyboard reads with queued keys.
+func (s *Server) matchKbd() []*drawfcall.Msg {
+	var rs []*drawfcall.Msg
+	for len(s.kbdq) > 0 && len(s.kbdtags) > 0 {
+		k := s.kbdtags[0]
+		rs = append(rs, &drawfcall.Msg{Type: k.typ + 1, Tag: k.tag, Rune: s.kbdq[0]})
+		s.kbdq = s.kbdq[1:]
+		s.kbdtags = s.kbdtags[1:]
+	}
+	return rs
+}
+
+// parseWinsize parses a window size such as "1024x768", which may be
+// followed by a position, as in "1024x768@100,100", which is ignored.
+func parseWinsize(s string) (image.Rectangle, error) {
+	var dx, dy int
+	if n, _ := fmt.Sscanf(s, "%dx%d", &dx, &dy); n != 2 || dx <= 0 || dy <= 0 {
+		return image.Rectangle{}, fmt.Errorf("bad window size %q", s)
+	}
+	return image.Rect(0, 0, dx, dy), nil
+}
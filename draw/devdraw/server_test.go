@@ -0,0 +1,264 @@
+package devdraw_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"bwsd.dev/plan9/draw"
+	"bwsd.dev/plan9/draw/devdraw"
+	"bwsd.dev/plan9/draw/drawfcall"
+	"bwsd.dev/plan9/draw/memdraw"
+)
+
+// initDisplay connects a draw client to a new server.
+func initDisplay(t *testing.T) *draw.Display {
+	t.Helper()
+	d, err := draw.InitConn(devdraw.New().Dial(), nil, "", "test", "200x100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// dial connects to s and initializes the connection.
+func dial(t *testing.T, s *devdraw.Server, label string) *drawfcall.Conn {
+	t.Helper()
+	c := s.Dial()
+	t.Cleanup(func() { c.Close() })
+	if err := c.Init(label, "200x100"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// msg builds a draw message from a byte, such as 'd', followed by
+// little-endian 4-byte integers.
+func msg(op byte, args ...int) []byte {
+	b := []byte{op}
+	for _, a := range args {
+		b = binary.LittleEndian.AppendUint32(b, uint32(a))
+	}
+	return b
+}
+
+// screenRect returns the rectangle of the window, image 0, installing it
+// with 'J' first.
+func screenRect(t *testing.T, c *drawfcall.Conn) image.Rectangle {
+	t.Helper()
+	if _, err := c.WriteDraw(append(msg('J'), 'I')); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 12*12)
+	n, err := c.ReadDraw(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id, image0 int
+	var pix, repl string
+	var r image.Rectangle
+	if _, err := fmt.Sscan(string(buf[:n]), &id, &image0, &pix, &repl,
+		&r.Min.X, &r.Min.Y, &r.Max.X, &r.Max.Y); err != nil {
+		t.Fatalf("parsing %q: %v", buf[:n], err)
+	}
+	return r
+}
+
+// pixel returns the blue, green and red bytes of the pixel of i, an
+// XRGB32 image, at p.
+func pixel(t *testing.T, i *draw.Image, p draw.Point) []byte {
+	t.Helper()
+	buf := make([]byte, 4)
+	if _, err := i.Unload(draw.Rect(p.X, p.Y, p.X+1, p.Y+1), buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf[:3]
+}
+
+func TestDraw(t *testing.T) {
+	d := initDisplay(t)
+	defer d.Close()
+	screen := d.ScreenImage
+	if r := screen.R; r.Dx() != 200 || r.Dy() != 100 {
+		t.Fatalf("screen is %v, want 200x100", r)
+	}
+	red, err := d.AllocImage(draw.Rect(0, 0, 1, 1), screen.Pix, true, draw.Red)
+	if err != nil {
+		t.Fatal(err)
+	}
+	screen.Draw(draw.Rect(10, 10, 20, 20).Add(screen.R.Min), red, nil, draw.ZP)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if p := pixel(t, screen, screen.R.Min.Add(draw.Pt(15, 15))); !bytes.Equal(p, []byte{0, 0, 0xFF}) {
+		t.Errorf("inside drawn rectangle: % x, want red", p)
+	}
+	if p := pixel(t, screen, screen.R.Min.Add(draw.Pt(25, 15))); !bytes.Equal(p, []byte{0xFF, 0xFF, 0xFF}) {
+		t.Errorf("outside drawn rectangle: % x, want white", p)
+	}
+
+	r := draw.Rect(0, 0, 100, 30).Add(screen.R.Min)
+	before := make([]byte, 4*r.Dx()*r.Dy())
+	after := make([]byte, len(before))
+	screen.Unload(r, before)
+	screen.String(screen.R.Min.Add(draw.Pt(2, 2)), d.Black, draw.ZP, d.Font, "hello")
+	screen.Unload(r, after)
+	if bytes.Equal(before, after) {
+		t.Errorf("String left the screen unchanged")
+	}
+}
+
+func TestBadDraw(t *testing.T) {
+	c := dial(t, devdraw.New(), "test")
+	for _, b := range [][]byte{
+		msg('d', 0, 0, 0),                         // short
+		msg('d', 7, 7, 7, 0, 0, 1, 1, 0, 0, 0, 0), // no such images
+		{'?'},
+	} {
+		if _, err := c.WriteDraw(b); err == nil {
+			t.Errorf("WriteDraw(% x) succeeded", b)
+		}
+	}
+	if r := screenRect(t, c); r != image.Rect(0, 0, 200, 100) {
+		t.Errorf("screen after errors is %v", r)
+	}
+}
+
+func TestInput(t *testing.T) {
+	s := devdraw.New()
+	c := dial(t, s, "test")
+
+	s.Mouse(drawfcall.Mouse{Point: image.Pt(3, 4), Buttons: 1})
+	if m, resized, err := c.ReadMouse(); err != nil || m.Point != image.Pt(3, 4) || m.Buttons != 1 || resized {
+		t.Errorf("ReadMouse = %v, %v, %v", m, resized, err)
+	}
+	s.Key('x')
+	if r, err := c.ReadKbd(); err != nil || r != 'x' {
+		t.Errorf("ReadKbd = %q, %v", r, err)
+	}
+
+	if err := s.Resize(image.Rect(0, 0, 300, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if _, resized, err := c.ReadMouse(); err != nil || !resized {
+		t.Errorf("ReadMouse after Resize: resized %v, %v", resized, err)
+	}
+	if r := screenRect(t, c); r != image.Rect(0, 0, 300, 200) {
+		t.Errorf("screen after resize is %v, want 300x200", r)
+	}
+}
+
+func TestSnarf(t *testing.T) {
+	c := dial(t, devdraw.New(), "test")
+	if err := c.WriteSnarf([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, _, err := c.ReadSnarf(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("ReadSnarf = %q, %v", buf[:n], err)
+	}
+}
+
+// A recorder is a Backend recording what it is asked to do.
+type recorder struct {
+	label   string
+	flushed image.Rectangle
+	arrow   bool
+}
+
+func (b *recorder) Flush(screen *memdraw.Image, r image.Rectangle) {
+	b.flushed = b.flushed.Union(r)
+}
+
+func (b *recorder) SetLabel(label string) { b.label = label }
+
+func (b *recorder) SetCursor(c *drawfcall.Cursor, c2 *drawfcall.Cursor2) { b.arrow = c == nil }
+
+func (b *recorder) MoveTo(p image.Point) {}
+
+func (b *recorder) Top() {}
+
+func TestBackend(t *testing.T) {
+	s := devdraw.New()
+	b := new(recorder)
+	s.Backend = b
+	c := dial(t, s, "test")
+	if b.label != "test" {
+		t.Errorf("label %q, want test", b.label)
+	}
+
+	// Draw the screen onto itself, then flush.
+	screenRect(t, c)
+	r := image.Rect(10, 10, 20, 20)
+	if _, err := c.WriteDraw(append(msg('d', 0, 0, 0, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y, 0, 0, 0, 0), 'v')); err != nil {
+		t.Fatal(err)
+	}
+	if !r.In(b.flushed) {
+		t.Errorf("flushed %v, want to include %v", b.flushed, r)
+	}
+
+	if err := c.Label("new"); err != nil || b.label != "new" {
+		t.Errorf("Label: label %q, %v", b.label, err)
+	}
+	if err := c.Cursor(nil); err != nil || !b.arrow {
+		t.Errorf("Cursor(nil): arrow %v, %v", b.arrow, err)
+	}
+}
+
+func TestDEVDRAW(t *testing.T) {
+	t.Setenv("DEVDRAW", "go")
+	d, err := draw.Init(nil, "", "test", "50x50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if r := d.ScreenImage.R; r.Dx() != 50 || r.Dy() != 50 {
+		t.Errorf("screen is %v, want 50x50", r)
+	}
+}
+
+func TestScreenshot(t *testing.T) {
+	d := initDisplay(t)
+	defer d.Close()
+	screen := d.ScreenImage
+	red, err := d.AllocImage(draw.Rect(0, 0, 1, 1), draw.RGB24, true, draw.Red)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := draw.Rect(10, 10, 20, 20).Add(screen.R.Min)
+	screen.Draw(r, red, nil, draw.ZP)
+
+	m, err := d.Screenshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Rect != screen.R {
+		t.Errorf("screenshot of %v, want %v", m.Rect, screen.R)
+	}
+	if c := m.RGBAAt(r.Min.X, r.Min.Y); c != (color.RGBA{0xFF, 0, 0, 0xFF}) {
+		t.Errorf("inside drawn rectangle: %v, want red", c)
+	}
+	if c := m.RGBAAt(r.Max.X, r.Min.Y); c != (color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("outside drawn rectangle: %v, want white", c)
+	}
+
+	var buf bytes.Buffer
+	if err := screen.Encode(&buf, "png"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Bounds().Eq(m.Rect) || color.RGBAModel.Convert(p.At(r.Min.X, r.Min.Y)) != m.RGBAAt(r.Min.X, r.Min.Y) {
+		t.Errorf("decoded PNG differs from screenshot")
+	}
+	if err := screen.Encode(&buf, "gif"); err == nil {
+		t.Errorf("Encode to gif succeeded")
+	}
+}
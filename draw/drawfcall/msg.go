@@ -234,6 +234,9 @@ func ReadMsg(r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	n, _ := gbit32(size[:])
+	if n < 6 {
+		return nil, fmt.Errorf("short packet")
+	}
 	buf := make([]byte, n)
 	copy(buf, size)
 	_, err = io.ReadFull(r, buf[4:])
@@ -246,9 +249,37 @@ func ReadMsg(r io.Reader) ([]byte, error) {
 	return buf, nil
 }
 
+// errShort reports a message too short for its fields.
+var errShort = fmt.Errorf("short packet")
+
+// fixedSize gives the size of the fields of the messages that have only
+// fixed-size fields, after the size, tag and type.
+var fixedSize = map[uint8]int{
+	Rrdmouse:     4 + 4 + 4 + 4 + 1,
+	Tbouncemouse: 4 + 4 + 4,
+	Tmoveto:      4 + 4,
+	Tcursor:      4 + 4 + 32 + 32 + 1,
+	Tcursor2:     4 + 4 + 32 + 32 + 4 + 4 + 128 + 128 + 1,
+	Rrdkbd:       2,
+	Rrdkbd4:      4,
+	Trddraw:      4,
+	Rwrdraw:      4,
+	Tresize:      4 + 4 + 4 + 4,
+}
+
+// counted reports whether b begins with a 4-byte count followed by at
+// least that many bytes, as read by gstring and gbytes.
+func counted(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	n, b := gbit32(b)
+	return n <= len(b)
+}
+
 func (m *Msg) Unmarshal(b []byte) error {
 	if len(b) < 6 {
-		return fmt.Errorf("short packet")
+		return errShort
 	}
 
 	nn, b := gbit32(b)
@@ -258,6 +289,9 @@ func (m *Msg) Unmarshal(b []byte) error {
 
 	m.Tag, b = gbit8(b)
 	m.Type, b = gbit8(b)
+	if n, ok := fixedSize[m.Type]; ok && len(b) < n {
+		return errShort
+	}
 	switch m.Type {
 	default:
 		return fmt.Errorf("invalid type %d", int(m.Type))
@@ -278,6 +312,9 @@ func (m *Msg) Unmarshal(b []byte) error {
 		Rresize:
 		// nothing
 	case Rerror:
+		if !counted(b) {
+			return errShort
+		}
 		m.Error, b = gstring(b)
 	case Rrdmouse:
 		m.Mouse.X, b = gbit32(b)
@@ -328,21 +365,36 @@ func (m *Msg) Unmarshal(b []byte) error {
 		r, b = gbit32(b)
 		m.Rune = rune(r)
 	case Tlabel:
+		if !counted(b) {
+			return errShort
+		}
 		m.Label, b = gstring(b)
 	case Tctxt:
+		if !counted(b) {
+			return errShort
+		}
 		m.ID, b = gstring(b)
 	case Tinit:
+		if !counted(b) {
+			return errShort
+		}
 		m.Winsize, b = gstring(b)
+		if !counted(b) {
+			return errShort
+		}
 		m.Label, b = gstring(b)
 	case Rrdsnarf,
 		Twrsnarf:
+		if !counted(b) {
+			return errShort
+		}
 		m.Snarf, b = gbytes(b)
 	case Rrddraw,
 		Twrdraw:
-		var n int
-		n, b = gbit32(b)
-		m.Data = b[:n]
-		b = b[n:]
+		if !counted(b) {
+			return errShort
+		}
+		m.Data, b = gbytes(b)
 	case Trddraw,
 		Rwrdraw:
 		m.Count, b = gbit32(b)
@@ -0,0 +1,49 @@
+package drawfcall
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	tx := &Msg{Type: Tinit, Tag: 1, Winsize: "100x100", Label: "test"}
+	b := tx.Marshal()
+	var rx Msg
+	if err := rx.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if rx.Type != Tinit || rx.Tag != 1 || rx.Winsize != "100x100" || rx.Label != "test" {
+		t.Errorf("Unmarshal(Marshal(%v)) = %v", tx, &rx)
+	}
+
+	// Every shorter message, with its size fixed up, is an error.
+	for _, tx := range []*Msg{
+		tx,
+		{Type: Rerror, Error: "oops"},
+		{Type: Rrdmouse, Mouse: Mouse{Buttons: 1}, Resized: true},
+		{Type: Tcursor2, Arrow: true},
+		{Type: Rrdkbd4, Rune: 'x'},
+		{Type: Twrdraw, Data: []byte("draw")},
+		{Type: Tresize},
+	} {
+		b := tx.Marshal()
+		for n := 6; n < len(b); n++ {
+			short := append([]byte(nil), b[:n]...)
+			pbit32(short[:0], n)
+			if err := new(Msg).Unmarshal(short); err == nil {
+				t.Errorf("Unmarshal of %d-byte prefix of %v succeeded", n, tx)
+			}
+		}
+	}
+}
+
+func TestReadMsg(t *testing.T) {
+	for _, b := range [][]byte{
+		{0, 0, 0, 2},
+		{0, 0, 0, 10, 1, 2},
+	} {
+		if _, err := ReadMsg(bytes.NewReader(b)); err == nil {
+			t.Errorf("ReadMsg(% x) succeeded", b)
+		}
+	}
+}
@@ -22,8 +22,36 @@ type Conn struct {
 	tagmap  map[byte]chan []byte
 }
 
+var (
+	serversMu sync.Mutex
+	servers   = make(map[string]func() *Conn)
+)
+
+// Register makes a draw server running in the same process available to
+// New under name: when $DEVDRAW is name, New calls dial for a connection
+// to the server instead of running a devdraw program. Register is called
+// from the init function of the package implementing the server, such as
+// bwsd.dev/plan9/draw/devdraw, which registers itself as "go".
+func Register(name string, dial func() *Conn) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	if _, dup := servers[name]; dup {
+		panic("drawfcall: Register called twice for " + name)
+	}
+	servers[name] = dial
+}
+
+// New returns a connection to a new draw server: the one registered
+// under the name in $DEVDRAW, if any, or else the devdraw program,
+// which $DEVDRAW may name instead.
 func New() (*Conn, error) {
 	devdraw := os.Getenv("DEVDRAW")
+	serversMu.Lock()
+	dial := servers[devdraw]
+	serversMu.Unlock()
+	if dial != nil {
+		return dial(), nil
+	}
 	r1, w1, _ := os.Pipe()
 	r2, w2, _ := os.Pipe()
 	if devdraw == "" {
@@ -46,18 +74,26 @@ func New() (*Conn, error) {
 		return nil, fmt.Errorf("drawfcall.New: %v", err)
 	}
 
+	return newConn(r2, w1), nil
+}
+
+// NewConn returns a Conn speaking to a draw server over rw, such as one
+// end of a pipe to a server running in the same process.
+func NewConn(rw io.ReadWriteCloser) *Conn {
+	return newConn(rw, rw)
+}
+
+func newConn(rd io.ReadCloser, wr io.WriteCloser) *Conn {
 	c := &Conn{
-		rd:      r2,
-		wr:      w1,
+		rd:      rd,
+		wr:      wr,
 		freetag: make(map[byte]bool),
 		tagmap:  make(map[byte]chan []byte),
 	}
 	for i := 1; i <= 254; i++ {
 		c.freetag[byte(i)] = true
 	}
-	c.rd = r2
-	c.wr = w1
-	return c, nil
+	return c
 }
 
 func (c *Conn) RPC(tx, rx *Msg) error {
@@ -124,9 +160,12 @@ func (c *Conn) Close() error {
 	c.w.Lock()
 	err1 := c.wr.Close()
 	c.w.Unlock()
-	c.r.Lock()
-	err2 := c.rd.Close()
-	c.r.Unlock()
+	var err2 error
+	if io.Closer(c.rd) != io.Closer(c.wr) {
+		c.r.Lock()
+		err2 = c.rd.Close()
+		c.r.Unlock()
+	}
 	if err1 != nil {
 		return err1
 	}
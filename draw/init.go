@@ -172,6 +172,12 @@ func Init(errch chan<- error, font, label, size string) (d *Display, err error)
 	if err != nil {
 		return nil, err
 	}
+	return InitConn(c, errch, font, label, size)
+}
+
+// InitConn is like Init but uses c, an existing connection to a display
+// server, such as one running in the same process.
+func InitConn(c *drawfcall.Conn, errch chan<- error, font, label, size string) (d *Display, err error) {
 	d = &Display{
 		conn:    c,
 		errch:   errch,
@@ -0,0 +1,132 @@
+package draw
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+// RGBA returns a copy of the pixels of i in i.R, clipped to i.Clipr,
+// read from the server in bulk. Pixels of every format are converted to
+// 8-bit red, green, blue and alpha, like those of Color, which are
+// pre-multiplied by alpha as image.RGBA expects.
+//
+// RGBA is much faster than reading i, which satisfies image.Image, a
+// pixel at a time with At.
+func (i *Image) RGBA() (*image.RGBA, error) {
+	r := i.R.Intersect(i.Clipr)
+	if r.Empty() {
+		return image.NewRGBA(r), nil
+	}
+	data := make([]byte, BytesPerLine(r, i.Depth)*r.Dy())
+	if _, err := i.Unload(r, data); err != nil {
+		return nil, err
+	}
+	return unloadRGBA(r, i.Pix, data)
+}
+
+// Encode writes the pixels of i, as returned by RGBA, to w in the given
+// image format. The only format is "png".
+func (i *Image) Encode(w io.Writer, format string) error {
+	if format != "png" {
+		return fmt.Errorf("draw: unknown image format %q", format)
+	}
+	m, err := i.RGBA()
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, m)
+}
+
+// Screenshot returns a copy of the pixels of the display's window,
+// d.ScreenImage.
+func (d *Display) Screenshot() (*image.RGBA, error) {
+	d.mu.Lock()
+	screen := d.ScreenImage
+	d.mu.Unlock()
+	return screen.RGBA()
+}
+
+// A pixchan is a channel of a pixel format: its type (CRed etc.), its
+// width in bits and the shift of its lowest bit in a pixel.
+type pixchan struct {
+	typ, nbits, shift int
+}
+
+// unloadRGBA converts data, the pixels of r in format pix as Unload
+// returns them, to an image.RGBA.
+func unloadRGBA(r Rectangle, pix Pix, data []byte) (*image.RGBA, error) {
+	depth := pix.Depth()
+	if depth == 0 || depth > 32 || (depth < 8 && 8%depth != 0) || (depth > 8 && depth%8 != 0) {
+		return nil, fmt.Errorf("draw: unsupported pixel format %v", pix)
+	}
+	bpl := BytesPerLine(r, depth)
+	if len(data) < bpl*r.Dy() {
+		return nil, fmt.Errorf("draw: short pixel data for %v", r)
+	}
+	var chans []pixchan
+	shift := 0
+	for p := pix; p != 0; p >>= 8 {
+		c := pixchan{typ: int(p>>4) & 15, nbits: int(p) & 15, shift: shift}
+		shift += c.nbits
+		chans = append(chans, c)
+	}
+
+	// For pixels smaller than a byte, a scan line begins with the byte
+	// holding the pixel at r.Min.X, at its absolute position in the line.
+	// The first pixel in a byte is in its high bits.
+	bit0 := r.Min.X * depth
+	bit0 -= (bit0%8 + 8) % 8
+	mask := uint32(1)<<uint(depth) - 1
+
+	m := image.NewRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		line := data[y*bpl : (y+1)*bpl]
+		out := m.Pix[y*m.Stride:]
+		for x := 0; x < r.Dx(); x++ {
+			var v uint32
+			if depth < 8 {
+				bit := (r.Min.X+x)*depth - bit0
+				v = uint32(line[bit/8]>>uint(8-depth-bit%8)) & mask
+			} else {
+				// Larger pixels are little-endian.
+				b := line[x*depth/8:]
+				for k := depth/8 - 1; k >= 0; k-- {
+					v = v<<8 | uint32(b[k])
+				}
+			}
+			var c [4]uint8 // red, green, blue, alpha
+			c[3] = 0xFF
+			for _, ch := range chans {
+				val := v >> uint(ch.shift) & (1<<uint(ch.nbits) - 1)
+				switch ch.typ {
+				case CRed, CGreen, CBlue:
+					c[ch.typ] = widen(val, ch.nbits)
+				case CAlpha:
+					c[3] = widen(val, ch.nbits)
+				case CGrey:
+					g := widen(val, ch.nbits)
+					c[0], c[1], c[2] = g, g, g
+				case CMap:
+					cr, cg, cb := cmap2rgb(int(val))
+					c[0], c[1], c[2] = uint8(cr), uint8(cg), uint8(cb)
+				}
+			}
+			copy(out[4*x:4*x+4], c[:])
+		}
+	}
+	return m, nil
+}
+
+// widen widens the n-bit value v to 8 bits by replicating its bits.
+func widen(v uint32, n int) uint8 {
+	if n >= 8 {
+		return uint8(v >> uint(n-8))
+	}
+	x := v << uint(8-n)
+	for s := n; s < 8; s *= 2 {
+		x |= x >> uint(s)
+	}
+	return uint8(x)
+}
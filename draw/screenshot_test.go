@@ -0,0 +1,61 @@
+package draw
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestUnloadRGBA(t *testing.T) {
+	tests := []struct {
+		r    Rectangle
+		pix  Pix
+		data []byte
+		want []color.RGBA // in order, left to right, top to bottom
+	}{
+		// The scan line starts with the byte holding x=-3: bits 5, 6 and 7.
+		{Rect(-3, 0, 0, 1), GREY1, []byte{0x05},
+			[]color.RGBA{{0xFF, 0xFF, 0xFF, 0xFF}, {0, 0, 0, 0xFF}, {0xFF, 0xFF, 0xFF, 0xFF}}},
+		{Rect(1, 0, 3, 1), GREY2, []byte{0x24},
+			[]color.RGBA{{0xAA, 0xAA, 0xAA, 0xFF}, {0x55, 0x55, 0x55, 0xFF}}},
+		{Rect(0, 0, 1, 2), GREY4, []byte{0xD0, 0x30},
+			[]color.RGBA{{0xDD, 0xDD, 0xDD, 0xFF}, {0x33, 0x33, 0x33, 0xFF}}},
+		{Rect(0, 0, 1, 1), CMAP8, []byte{0xFF}, []color.RGBA{{0xFF, 0xFF, 0xFF, 0xFF}}},
+		{Rect(0, 0, 2, 1), RGB16, []byte{0x00, 0xF8, 0x1F, 0x00},
+			[]color.RGBA{{0xFF, 0, 0, 0xFF}, {0, 0, 0xFF, 0xFF}}},
+		{Rect(0, 0, 1, 1), RGB24, []byte{0x33, 0x22, 0x11}, []color.RGBA{{0x11, 0x22, 0x33, 0xFF}}},
+		{Rect(0, 0, 1, 1), RGBA32, []byte{0x80, 0x33, 0x22, 0x11}, []color.RGBA{{0x11, 0x22, 0x33, 0x80}}},
+		{Rect(0, 0, 1, 1), ARGB32, []byte{0x33, 0x22, 0x11, 0x80}, []color.RGBA{{0x11, 0x22, 0x33, 0x80}}},
+		{Rect(0, 0, 1, 1), XBGR32, []byte{0x11, 0x22, 0x33, 0x00}, []color.RGBA{{0x11, 0x22, 0x33, 0xFF}}},
+	}
+	for _, tt := range tests {
+		m, err := unloadRGBA(tt.r, tt.pix, tt.data)
+		if err != nil {
+			t.Errorf("%v %v: %v", tt.pix, tt.r, err)
+			continue
+		}
+		i := 0
+		for y := tt.r.Min.Y; y < tt.r.Max.Y; y++ {
+			for x := tt.r.Min.X; x < tt.r.Max.X; x++ {
+				if c := m.RGBAAt(x, y); c != tt.want[i] {
+					t.Errorf("%v %v: pixel %d,%d is %v, want %v", tt.pix, tt.r, x, y, c, tt.want[i])
+				}
+				i++
+			}
+		}
+	}
+}
+
+func TestRGBA(t *testing.T) {
+	for i, tt := range atTests {
+		m, err := tt.im.RGBA()
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		// The images are single pixels.
+		want := color.RGBA{tt.r, tt.g, tt.b, tt.a}
+		if c := m.RGBAAt(tt.im.R.Min.X, tt.im.R.Min.Y); m.Rect != tt.im.R || c != want {
+			t.Errorf("%d: RGBA is %x over %v, want %x over %v", i, c, m.Rect, want, tt.im.R)
+		}
+	}
+}
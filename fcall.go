@@ -3,6 +3,7 @@ package plan9
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
 /*
@@ -81,7 +82,7 @@ type Fcall struct {
 	Afid   uint32   // Tauth, Tattach
 	Uname  string   // Tauth, Tattach (user name)
 	Aname  string   // Tauth, Tattach (attach name)
-	Perm   uint32   // Tcreate (file permission mode)
+	Perm   uint32   // Tcreate (file permission mode); Tlcreate, Tmknod, Tmkdir
 	Name   string   // Tcreate
 	Mode   uint8    // Tcreate, Topen
 	Newfid uint32   // Twalk
@@ -96,9 +97,27 @@ type Fcall struct {
 	Stat []byte // Twstat, Rstat
 
 	// 9P2000.u extensions
-	Errno     uint32 // Rerror (error code)
-	Uid       uint32 // Tattach, Tauth
+	Errno     uint32 // Rerror (Unix error number), Rlerror
+	Uid       uint32 // Tattach, Tauth (numeric user id, n_uname; NOUID if none)
 	Extension string // Tcreate (special file description)
+
+	// 9P2000.L extensions. Messages naming a new file use Name for it and
+	// Perm for its Linux mode bits.
+	Flags    uint32 // Tlopen, Tlcreate (Linux open flags), Txattrcreate, Tunlinkat
+	Gid      uint32 // Tlcreate, Tsymlink, Tmknod, Tmkdir
+	Dfid     uint32 // Tmknod, Trename, Tlink, Tmkdir, Trenameat, Tunlinkat (directory fid)
+	Newdfid  uint32 // Trenameat
+	Newname  string // Trenameat
+	Target   string // Tsymlink, Rreadlink
+	Major    uint32 // Tmknod
+	Minor    uint32 // Tmknod
+	Mask     uint64 // Tgetattr (request mask)
+	Attr     Attr   // Rgetattr, Tsetattr
+	Statfs   Statfs // Rstatfs
+	Size     uint64 // Rxattrwalk, Txattrcreate
+	Datasync uint32 // Tfsync
+	Lock     Flock  // Tlock, Tgetlock, Rgetlock
+	Status   uint8  // Rlock
 }
 
 /*
@@ -115,13 +134,41 @@ zero byte. The NUL character is illegal in all text strings in 9P, and is
 therefore excluded from file names, user names, and so on.
 */
 
+// Bytes returns the 9P2000 encoding of f.
 func (f *Fcall) Bytes() ([]byte, error) {
-	b := pbit32(nil, 0) // length: fill in later
+	return f.BytesDialect(Dialect9P)
+}
+
+// BytesDialect returns the encoding of f in dialect d.
+//
+// 9P2000.u adds the numeric user id to Tauth and Tattach, an error number to
+// Rerror and an extension string to Tcreate. 9P2000.L shares the numeric user
+// id in Tauth and Tattach.
+func (f *Fcall) BytesDialect(d Dialect) ([]byte, error) {
+	b, err := f.AppendDialect(nil, d)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Append appends the 9P2000 encoding of f to b and returns the extended
+// buffer.
+func (f *Fcall) Append(b []byte) ([]byte, error) {
+	return f.AppendDialect(b, Dialect9P)
+}
+
+// AppendDialect appends the encoding of f in dialect d to b and returns the
+// extended buffer. If b has room for the message, AppendDialect allocates
+// nothing. On error, it returns b unchanged.
+func (f *Fcall) AppendDialect(b []byte, d Dialect) ([]byte, error) {
+	start := len(b)
+	b = pbit32(b, 0) // length: fill in later
 	b = pbit8(b, f.Type)
 	b = pbit16(b, f.Tag)
 	switch f.Type {
 	default:
-		return nil, ProtocolError("invalid type")
+		return b[:start], ProtocolError("invalid type")
 
 	case Tversion:
 		b = pbit32(b, f.Msize)
@@ -134,18 +181,24 @@ func (f *Fcall) Bytes() ([]byte, error) {
 		b = pbit32(b, f.Afid)
 		b = pstring(b, f.Uname)
 		b = pstring(b, f.Aname)
+		if d.numericIds() {
+			b = pbit32(b, f.Uid)
+		}
 
 	case Tattach:
 		b = pbit32(b, f.Fid)
 		b = pbit32(b, f.Afid)
 		b = pstring(b, f.Uname)
 		b = pstring(b, f.Aname)
+		if d.numericIds() {
+			b = pbit32(b, f.Uid)
+		}
 
 	case Twalk:
 		b = pbit32(b, f.Fid)
 		b = pbit32(b, f.Newfid)
 		if len(f.Wname) > MAXWELEM {
-			return nil, ProtocolError("too many names in walk")
+			return b[:start], ProtocolError("too many names in walk")
 		}
 		b = pbit16(b, uint16(len(f.Wname)))
 		for i := range f.Wname {
@@ -161,6 +214,9 @@ func (f *Fcall) Bytes() ([]byte, error) {
 		b = pstring(b, f.Name)
 		b = pbit32(b, uint32(f.Perm))
 		b = pbit8(b, f.Mode)
+		if d == Dialect9PU {
+			b = pstring(b, f.Extension)
+		}
 
 	case Tread:
 		b = pbit32(b, f.Fid)
@@ -187,6 +243,9 @@ func (f *Fcall) Bytes() ([]byte, error) {
 
 	case Rerror:
 		b = pstring(b, f.Ename)
+		if d == Dialect9PU {
+			b = pbit32(b, f.Errno)
+		}
 
 	case Rflush, Rclunk, Rremove, Rwstat:
 		// nothing
@@ -199,7 +258,7 @@ func (f *Fcall) Bytes() ([]byte, error) {
 
 	case Rwalk:
 		if len(f.Wqid) > MAXWELEM {
-			return nil, ProtocolError("too many qid in walk")
+			return b[:start], ProtocolError("too many qid in walk")
 		}
 		b = pbit16(b, uint16(len(f.Wqid)))
 		for i := range f.Wqid {
@@ -220,160 +279,468 @@ func (f *Fcall) Bytes() ([]byte, error) {
 	case Rstat:
 		b = pbit16(b, uint16(len(f.Stat)))
 		b = append(b, f.Stat...)
+
+	case Tstatfs, Treadlink:
+		b = pbit32(b, f.Fid)
+
+	case Tlopen:
+		b = pbit32(b, f.Fid)
+		b = pbit32(b, f.Flags)
+
+	case Tlcreate:
+		b = pbit32(b, f.Fid)
+		b = pstring(b, f.Name)
+		b = pbit32(b, f.Flags)
+		b = pbit32(b, f.Perm)
+		b = pbit32(b, f.Gid)
+
+	case Tsymlink:
+		b = pbit32(b, f.Fid)
+		b = pstring(b, f.Name)
+		b = pstring(b, f.Target)
+		b = pbit32(b, f.Gid)
+
+	case Tmknod:
+		b = pbit32(b, f.Dfid)
+		b = pstring(b, f.Name)
+		b = pbit32(b, f.Perm)
+		b = pbit32(b, f.Major)
+		b = pbit32(b, f.Minor)
+		b = pbit32(b, f.Gid)
+
+	case Trename:
+		b = pbit32(b, f.Fid)
+		b = pbit32(b, f.Dfid)
+		b = pstring(b, f.Name)
+
+	case Tgetattr:
+		b = pbit32(b, f.Fid)
+		b = pbit64(b, f.Mask)
+
+	case Tsetattr:
+		b = pbit32(b, f.Fid)
+		b = psetattr(b, &f.Attr)
+
+	case Txattrwalk:
+		b = pbit32(b, f.Fid)
+		b = pbit32(b, f.Newfid)
+		b = pstring(b, f.Name)
+
+	case Txattrcreate:
+		b = pbit32(b, f.Fid)
+		b = pstring(b, f.Name)
+		b = pbit64(b, f.Size)
+		b = pbit32(b, f.Flags)
+
+	case Treaddir:
+		b = pbit32(b, f.Fid)
+		b = pbit64(b, f.Offset)
+		b = pbit32(b, f.Count)
+
+	case Tfsync:
+		b = pbit32(b, f.Fid)
+		b = pbit32(b, f.Datasync)
+
+	case Tlock:
+		b = pbit32(b, f.Fid)
+		b = pflock(b, &f.Lock, true)
+
+	case Tgetlock:
+		b = pbit32(b, f.Fid)
+		b = pflock(b, &f.Lock, false)
+
+	case Tlink:
+		b = pbit32(b, f.Dfid)
+		b = pbit32(b, f.Fid)
+		b = pstring(b, f.Name)
+
+	case Tmkdir:
+		b = pbit32(b, f.Dfid)
+		b = pstring(b, f.Name)
+		b = pbit32(b, f.Perm)
+		b = pbit32(b, f.Gid)
+
+	case Trenameat:
+		b = pbit32(b, f.Dfid)
+		b = pstring(b, f.Name)
+		b = pbit32(b, f.Newdfid)
+		b = pstring(b, f.Newname)
+
+	case Tunlinkat:
+		b = pbit32(b, f.Dfid)
+		b = pstring(b, f.Name)
+		b = pbit32(b, f.Flags)
+
+	case Rlerror:
+		b = pbit32(b, f.Errno)
+
+	case Rstatfs:
+		b = pstatfs(b, &f.Statfs)
+
+	case Rlopen, Rlcreate:
+		b = pqid(b, f.Qid)
+		b = pbit32(b, f.Iounit)
+
+	case Rsymlink, Rmknod, Rmkdir:
+		b = pqid(b, f.Qid)
+
+	case Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
+		// nothing
+
+	case Rreadlink:
+		b = pstring(b, f.Target)
+
+	case Rgetattr:
+		b = pattr(b, &f.Attr)
+
+	case Rxattrwalk:
+		b = pbit64(b, f.Size)
+
+	case Rreaddir:
+		b = pbit32(b, uint32(len(f.Data)))
+		b = append(b, f.Data...)
+
+	case Rlock:
+		b = pbit8(b, f.Status)
+
+	case Rgetlock:
+		b = pflock(b, &f.Lock, false)
 	}
 
-	pbit32(b[0:0], uint32(len(b)))
+	pbit32(b[start:start], uint32(len(b)-start))
 	return b, nil
 }
 
+// UnmarshalFcall decodes the 9P2000 message in b.
 func UnmarshalFcall(b []byte) (f *Fcall, err error) {
-	defer func() {
-		if recover() != nil {
-			println("bad fcall at ", b)
-			f = nil
-			err = ProtocolError("malformed Fcall")
-		}
-	}()
+	return UnmarshalFcallDialect(b, Dialect9P)
+}
 
-	n, b := gbit32(b)
-	if len(b) != int(n)-4 {
-		panic(1)
+// UnmarshalFcallDialect decodes the message in b, which is encoded in
+// dialect d. See BytesDialect.
+//
+// In 9P2000.u and 9P2000.L, a Tauth or Tattach without the numeric user id
+// is accepted and given the id NOUID, as some clients omit it.
+func UnmarshalFcallDialect(b []byte, d Dialect) (f *Fcall, err error) {
+	f = new(Fcall)
+	if err := f.UnmarshalDialect(b, d); err != nil {
+		return nil, err
 	}
+	return f, nil
+}
 
-	f = new(Fcall)
-	f.Type, b = gbit8(b)
-	f.Tag, b = gbit16(b)
+// Unmarshal decodes the 9P2000 message in b into f.
+func (f *Fcall) Unmarshal(b []byte) error {
+	return f.UnmarshalDialect(b, Dialect9P)
+}
+
+// UnmarshalDialect decodes the message in b, which is encoded in dialect d,
+// into f, as UnmarshalFcallDialect does but without allocating an Fcall.
+// Data and Stat refer to b rather than to a copy, and the arrays already
+// in Wname and Wqid are reused, so that decoding a message without strings
+// allocates nothing.
+//
+// On error, the contents of f are undefined.
+func (f *Fcall) UnmarshalDialect(b []byte, d Dialect) error {
+	wname, wqid := f.Wname[:0], f.Wqid[:0]
+	*f = Fcall{}
+	u := unpacker{b: b}
+	n := u.bit32()
+	f.Type = u.bit8()
+	f.Tag = u.bit16()
+	switch {
+	case u.bad:
+		return &DecodeError{"Fcall", u.fail, errTruncated}
+	case uint64(n) != uint64(len(b)):
+		return &DecodeError{typeName(f.Type), 0, errLength}
+	}
 
 	switch f.Type {
 	default:
-		panic(1)
+		return &DecodeError{typeName(f.Type), 4, errType}
 
 	case Tversion:
-		f.Msize, b = gbit32(b)
-		f.Version, b = gstring(b)
+		f.Msize = u.bit32()
+		f.Version = u.string()
 
 	case Tflush:
-		f.Oldtag, b = gbit16(b)
+		f.Oldtag = u.bit16()
 
 	case Tauth:
-		f.Afid, b = gbit32(b)
-		f.Uname, b = gstring(b)
-		f.Aname, b = gstring(b)
+		f.Afid = u.bit32()
+		f.Uname = u.string()
+		f.Aname = u.string()
+		f.Uid = u.uid(d)
 
 	case Tattach:
-		f.Fid, b = gbit32(b)
-		f.Afid, b = gbit32(b)
-		f.Uname, b = gstring(b)
-		f.Aname, b = gstring(b)
+		f.Fid = u.bit32()
+		f.Afid = u.bit32()
+		f.Uname = u.string()
+		f.Aname = u.string()
+		f.Uid = u.uid(d)
 
 	case Twalk:
-		f.Fid, b = gbit32(b)
-		f.Newfid, b = gbit32(b)
-		var n uint16
-		n, b = gbit16(b)
+		f.Fid = u.bit32()
+		f.Newfid = u.bit32()
+		off := u.off
+		n := u.bit16()
 		if n > MAXWELEM {
-			panic(1)
+			return &DecodeError{typeName(f.Type), off, errWalk}
 		}
-		f.Wname = make([]string, n)
-		for i := range f.Wname {
-			f.Wname[i], b = gstring(b)
+		for i := 0; i < int(n); i++ {
+			wname = append(wname, u.string())
 		}
+		f.Wname = wname
 
 	case Topen:
-		f.Fid, b = gbit32(b)
-		f.Mode, b = gbit8(b)
+		f.Fid = u.bit32()
+		f.Mode = u.bit8()
 
 	case Tcreate:
-		f.Fid, b = gbit32(b)
-		f.Name, b = gstring(b)
-		f.Perm, b = gbit32(b)
-		f.Mode, b = gbit8(b)
+		f.Fid = u.bit32()
+		f.Name = u.string()
+		f.Perm = u.bit32()
+		f.Mode = u.bit8()
+		if d == Dialect9PU {
+			f.Extension = u.string()
+		}
 
 	case Tread:
-		f.Fid, b = gbit32(b)
-		f.Offset, b = gbit64(b)
-		f.Count, b = gbit32(b)
+		f.Fid = u.bit32()
+		f.Offset = u.bit64()
+		f.Count = u.bit32()
 
 	case Twrite:
-		f.Fid, b = gbit32(b)
-		f.Offset, b = gbit64(b)
-		n, b = gbit32(b)
-		if len(b) != int(n) {
-			panic(1)
-		}
-		f.Data = b
-		b = nil
+		f.Fid = u.bit32()
+		f.Offset = u.bit64()
+		f.Data = u.data(u.bit32())
 
 	case Tclunk, Tremove, Tstat:
-		f.Fid, b = gbit32(b)
+		f.Fid = u.bit32()
 
 	case Twstat:
-		f.Fid, b = gbit32(b)
-		var n uint16
-		n, b = gbit16(b)
-		if len(b) != int(n) {
-			panic(1)
-		}
-		f.Stat = b
-		b = nil
+		f.Fid = u.bit32()
+		f.Stat = u.data(uint32(u.bit16()))
 
 	case Rversion:
-		f.Msize, b = gbit32(b)
-		f.Version, b = gstring(b)
+		f.Msize = u.bit32()
+		f.Version = u.string()
 
 	case Rerror:
-		f.Ename, b = gstring(b)
+		f.Ename = u.string()
+		if d == Dialect9PU {
+			f.Errno = u.bit32()
+		}
 
 	case Rflush, Rclunk, Rremove, Rwstat:
 		// nothing
 
 	case Rauth:
-		f.Aqid, b = gqid(b)
+		f.Aqid = u.qid()
 
 	case Rattach:
-		f.Qid, b = gqid(b)
+		f.Qid = u.qid()
 
 	case Rwalk:
-		var n uint16
-		n, b = gbit16(b)
+		off := u.off
+		n := u.bit16()
 		if n > MAXWELEM {
-			panic(1)
+			return &DecodeError{typeName(f.Type), off, errWalk}
 		}
-		f.Wqid = make([]Qid, n)
-		for i := range f.Wqid {
-			f.Wqid[i], b = gqid(b)
+		for i := 0; i < int(n); i++ {
+			wqid = append(wqid, u.qid())
 		}
+		f.Wqid = wqid
 
 	case Ropen, Rcreate:
-		f.Qid, b = gqid(b)
-		f.Iounit, b = gbit32(b)
+		f.Qid = u.qid()
+		f.Iounit = u.bit32()
 
 	case Rread:
-		n, b = gbit32(b)
-		if len(b) != int(n) {
-			panic(1)
-		}
-		f.Data = b
-		b = nil
+		f.Data = u.data(u.bit32())
 
 	case Rwrite:
-		f.Count, b = gbit32(b)
+		f.Count = u.bit32()
 
 	case Rstat:
-		var n uint16
-		n, b = gbit16(b)
-		if len(b) != int(n) {
-			panic(1)
-		}
-		f.Stat = b
-		b = nil
+		f.Stat = u.data(uint32(u.bit16()))
+
+	case Tstatfs, Treadlink:
+		f.Fid = u.bit32()
+
+	case Tlopen:
+		f.Fid = u.bit32()
+		f.Flags = u.bit32()
+
+	case Tlcreate:
+		f.Fid = u.bit32()
+		f.Name = u.string()
+		f.Flags = u.bit32()
+		f.Perm = u.bit32()
+		f.Gid = u.bit32()
+
+	case Tsymlink:
+		f.Fid = u.bit32()
+		f.Name = u.string()
+		f.Target = u.string()
+		f.Gid = u.bit32()
+
+	case Tmknod:
+		f.Dfid = u.bit32()
+		f.Name = u.string()
+		f.Perm = u.bit32()
+		f.Major = u.bit32()
+		f.Minor = u.bit32()
+		f.Gid = u.bit32()
+
+	case Trename:
+		f.Fid = u.bit32()
+		f.Dfid = u.bit32()
+		f.Name = u.string()
+
+	case Tgetattr:
+		f.Fid = u.bit32()
+		f.Mask = u.bit64()
+
+	case Tsetattr:
+		f.Fid = u.bit32()
+		f.Attr = u.setattr()
+
+	case Txattrwalk:
+		f.Fid = u.bit32()
+		f.Newfid = u.bit32()
+		f.Name = u.string()
+
+	case Txattrcreate:
+		f.Fid = u.bit32()
+		f.Name = u.string()
+		f.Size = u.bit64()
+		f.Flags = u.bit32()
+
+	case Treaddir:
+		f.Fid = u.bit32()
+		f.Offset = u.bit64()
+		f.Count = u.bit32()
+
+	case Tfsync:
+		f.Fid = u.bit32()
+		f.Datasync = u.bit32()
+
+	case Tlock:
+		f.Fid = u.bit32()
+		f.Lock = u.flock(true)
+
+	case Tgetlock:
+		f.Fid = u.bit32()
+		f.Lock = u.flock(false)
+
+	case Tlink:
+		f.Dfid = u.bit32()
+		f.Fid = u.bit32()
+		f.Name = u.string()
+
+	case Tmkdir:
+		f.Dfid = u.bit32()
+		f.Name = u.string()
+		f.Perm = u.bit32()
+		f.Gid = u.bit32()
+
+	case Trenameat:
+		f.Dfid = u.bit32()
+		f.Name = u.string()
+		f.Newdfid = u.bit32()
+		f.Newname = u.string()
+
+	case Tunlinkat:
+		f.Dfid = u.bit32()
+		f.Name = u.string()
+		f.Flags = u.bit32()
+
+	case Rlerror:
+		f.Errno = u.bit32()
+
+	case Rstatfs:
+		f.Statfs = u.statfs()
+
+	case Rlopen, Rlcreate:
+		f.Qid = u.qid()
+		f.Iounit = u.bit32()
+
+	case Rsymlink, Rmknod, Rmkdir:
+		f.Qid = u.qid()
+
+	case Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
+		// nothing
+
+	case Rreadlink:
+		f.Target = u.string()
+
+	case Rgetattr:
+		f.Attr = u.attr()
+
+	case Rxattrwalk:
+		f.Size = u.bit64()
+
+	case Rreaddir:
+		f.Data = u.data(u.bit32())
+
+	case Rlock:
+		f.Status = u.bit8()
+
+	case Rgetlock:
+		f.Lock = u.flock(false)
 	}
 
-	if len(b) != 0 {
-		panic(1)
+	if off, err := u.check(); err != nil {
+		return &DecodeError{typeName(f.Type), off, err}
 	}
+	return nil
+}
 
-	return f, nil
+// The reasons a message cannot be decoded, as the Err of a DecodeError.
+var (
+	errTruncated = ProtocolError("message truncated")
+	errLength    = ProtocolError("size does not match length")
+	errType      = ProtocolError("unknown message type")
+	errWalk      = ProtocolError("too many elements in walk")
+	errTrailing  = ProtocolError("data after end of message")
+)
+
+// A DecodeError reports a message, stat or directory entry that could not
+// be decoded.
+type DecodeError struct {
+	What   string // "Tread", "Rerror", "Dir", "Dirent" and so on
+	Offset int    // offset of the field that could not be decoded
+	Err    error  // the reason, a ProtocolError
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("malformed %s at offset %d: %v", e.What, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// typeName returns the name of the message type t, such as "Tread".
+func typeName(t uint8) string {
+	s := (&Fcall{Type: t}).String()
+	if name, _, _ := strings.Cut(s, " "); name != "unknown" {
+		return name
+	}
+	return fmt.Sprintf("Fcall type %d", t)
+}
+
+// uid decodes the numeric user id at the end of a Tauth or Tattach message
+// in dialect d.
+func (u *unpacker) uid(d Dialect) uint32 {
+	switch {
+	case !d.numericIds():
+		return 0
+	case u.empty():
+		return NOUID
+	}
+	return u.bit32()
 }
 
 func (f *Fcall) String() string {
@@ -391,13 +758,16 @@ func (f *Fcall) String() string {
 		return fmt.Sprintf("Tauth tag %d afid %d uname %s aname %s",
 			f.Tag, f.Afid, f.Uname, f.Aname)
 	case Rauth:
-		return fmt.Sprintf("Rauth tag %d qid %v", f.Tag, f.Qid)
+		return fmt.Sprintf("Rauth tag %d qid %v", f.Tag, f.Aqid)
 	case Tattach:
 		return fmt.Sprintf("Tattach tag %d fid %d afid %d uname %s aname %s",
 			f.Tag, f.Fid, f.Afid, f.Uname, f.Aname)
 	case Rattach:
 		return fmt.Sprintf("Rattach tag %d qid %v", f.Tag, f.Qid)
 	case Rerror:
+		if f.Errno != 0 {
+			return fmt.Sprintf("Rerror tag %d ename %s errno %d", f.Tag, f.Ename, f.Errno)
+		}
 		return fmt.Sprintf("Rerror tag %d ename %s", f.Tag, f.Ename)
 	case Tflush:
 		return fmt.Sprintf("Tflush tag %d oldtag %d", f.Tag, f.Oldtag)
@@ -413,6 +783,10 @@ func (f *Fcall) String() string {
 	case Ropen:
 		return fmt.Sprintf("Ropen tag %d qid %v iouint %d", f.Tag, f.Qid, f.Iounit)
 	case Tcreate:
+		if f.Extension != "" {
+			return fmt.Sprintf("Tcreate tag %d fid %d name %s perm %v mode %d extension %q",
+				f.Tag, f.Fid, f.Name, f.Perm, f.Mode, f.Extension)
+		}
 		return fmt.Sprintf("Tcreate tag %d fid %d name %s perm %v mode %d",
 			f.Tag, f.Fid, f.Name, f.Perm, f.Mode)
 	case Rcreate:
@@ -440,25 +814,118 @@ func (f *Fcall) String() string {
 		return fmt.Sprintf("Tstat tag %d fid %d", f.Tag, f.Fid)
 	case Rstat:
 		d, err := UnmarshalDir(f.Stat)
-		if err == nil {
+		if err != nil {
 			return fmt.Sprintf("Rstat tag %d stat(%d bytes)",
 				f.Tag, len(f.Stat))
 		}
 		return fmt.Sprintf("Rstat tag %d stat %v", f.Tag, d)
 	case Twstat:
 		d, err := UnmarshalDir(f.Stat)
-		if err == nil {
+		if err != nil {
 			return fmt.Sprintf("Twstat tag %d fid %d stat(%d bytes)",
 				f.Tag, f.Fid, len(f.Stat))
 		}
 		return fmt.Sprintf("Twstat tag %d fid %d stat %v", f.Tag, f.Fid, d)
 	case Rwstat:
-		return fmt.Sprintf("FidRwstat tag %d", f.Tag)
+		return fmt.Sprintf("Rwstat tag %d", f.Tag)
+	case Rlerror:
+		return fmt.Sprintf("Rlerror tag %d ecode %d", f.Tag, f.Errno)
+	case Tstatfs:
+		return fmt.Sprintf("Tstatfs tag %d fid %d", f.Tag, f.Fid)
+	case Rstatfs:
+		s := &f.Statfs
+		return fmt.Sprintf("Rstatfs tag %d type %#x bsize %d blocks %d bfree %d bavail %d files %d ffree %d fsid %#x namelen %d",
+			f.Tag, s.Type, s.Bsize, s.Blocks, s.Bfree, s.Bavail, s.Files, s.Ffree, s.Fsid, s.Namelen)
+	case Tlopen:
+		return fmt.Sprintf("Tlopen tag %d fid %d flags %#o", f.Tag, f.Fid, f.Flags)
+	case Rlopen:
+		return fmt.Sprintf("Rlopen tag %d qid %v iounit %d", f.Tag, f.Qid, f.Iounit)
+	case Tlcreate:
+		return fmt.Sprintf("Tlcreate tag %d fid %d name %s flags %#o mode %#o gid %d",
+			f.Tag, f.Fid, f.Name, f.Flags, f.Perm, f.Gid)
+	case Rlcreate:
+		return fmt.Sprintf("Rlcreate tag %d qid %v iounit %d", f.Tag, f.Qid, f.Iounit)
+	case Tsymlink:
+		return fmt.Sprintf("Tsymlink tag %d fid %d name %s target %s gid %d",
+			f.Tag, f.Fid, f.Name, f.Target, f.Gid)
+	case Rsymlink:
+		return fmt.Sprintf("Rsymlink tag %d qid %v", f.Tag, f.Qid)
+	case Tmknod:
+		return fmt.Sprintf("Tmknod tag %d dfid %d name %s mode %#o major %d minor %d gid %d",
+			f.Tag, f.Dfid, f.Name, f.Perm, f.Major, f.Minor, f.Gid)
+	case Rmknod:
+		return fmt.Sprintf("Rmknod tag %d qid %v", f.Tag, f.Qid)
+	case Trename:
+		return fmt.Sprintf("Trename tag %d fid %d dfid %d name %s", f.Tag, f.Fid, f.Dfid, f.Name)
+	case Rrename:
+		return fmt.Sprintf("Rrename tag %d", f.Tag)
+	case Treadlink:
+		return fmt.Sprintf("Treadlink tag %d fid %d", f.Tag, f.Fid)
+	case Rreadlink:
+		return fmt.Sprintf("Rreadlink tag %d target %s", f.Tag, f.Target)
+	case Tgetattr:
+		return fmt.Sprintf("Tgetattr tag %d fid %d mask %#x", f.Tag, f.Fid, f.Mask)
+	case Rgetattr:
+		return fmt.Sprintf("Rgetattr tag %d %v", f.Tag, &f.Attr)
+	case Tsetattr:
+		a := &f.Attr
+		return fmt.Sprintf("Tsetattr tag %d fid %d valid %#x mode %#o uid %d gid %d size %d atime %d.%09d mtime %d.%09d",
+			f.Tag, f.Fid, a.Valid, a.Mode, a.Uid, a.Gid, a.Size, a.AtimeSec, a.AtimeNsec, a.MtimeSec, a.MtimeNsec)
+	case Rsetattr:
+		return fmt.Sprintf("Rsetattr tag %d", f.Tag)
+	case Txattrwalk:
+		return fmt.Sprintf("Txattrwalk tag %d fid %d newfid %d name %s", f.Tag, f.Fid, f.Newfid, f.Name)
+	case Rxattrwalk:
+		return fmt.Sprintf("Rxattrwalk tag %d size %d", f.Tag, f.Size)
+	case Txattrcreate:
+		return fmt.Sprintf("Txattrcreate tag %d fid %d name %s size %d flags %d",
+			f.Tag, f.Fid, f.Name, f.Size, f.Flags)
+	case Rxattrcreate:
+		return fmt.Sprintf("Rxattrcreate tag %d", f.Tag)
+	case Treaddir:
+		return fmt.Sprintf("Treaddir tag %d fid %d offset %d count %d", f.Tag, f.Fid, f.Offset, f.Count)
+	case Rreaddir:
+		return fmt.Sprintf("Rreaddir tag %d count %d", f.Tag, len(f.Data))
+	case Tfsync:
+		return fmt.Sprintf("Tfsync tag %d fid %d datasync %d", f.Tag, f.Fid, f.Datasync)
+	case Rfsync:
+		return fmt.Sprintf("Rfsync tag %d", f.Tag)
+	case Tlock:
+		return fmt.Sprintf("Tlock tag %d fid %d %v", f.Tag, f.Fid, &f.Lock)
+	case Rlock:
+		return fmt.Sprintf("Rlock tag %d status %d", f.Tag, f.Status)
+	case Tgetlock:
+		return fmt.Sprintf("Tgetlock tag %d fid %d %v", f.Tag, f.Fid, &f.Lock)
+	case Rgetlock:
+		return fmt.Sprintf("Rgetlock tag %d %v", f.Tag, &f.Lock)
+	case Tlink:
+		return fmt.Sprintf("Tlink tag %d dfid %d fid %d name %s", f.Tag, f.Dfid, f.Fid, f.Name)
+	case Rlink:
+		return fmt.Sprintf("Rlink tag %d", f.Tag)
+	case Tmkdir:
+		return fmt.Sprintf("Tmkdir tag %d dfid %d name %s mode %#o gid %d", f.Tag, f.Dfid, f.Name, f.Perm, f.Gid)
+	case Rmkdir:
+		return fmt.Sprintf("Rmkdir tag %d qid %v", f.Tag, f.Qid)
+	case Trenameat:
+		return fmt.Sprintf("Trenameat tag %d olddirfid %d oldname %s newdirfid %d newname %s",
+			f.Tag, f.Dfid, f.Name, f.Newdfid, f.Newname)
+	case Rrenameat:
+		return fmt.Sprintf("Rrenameat tag %d", f.Tag)
+	case Tunlinkat:
+		return fmt.Sprintf("Tunlinkat tag %d dirfid %d name %s flags %#x", f.Tag, f.Dfid, f.Name, f.Flags)
+	case Runlinkat:
+		return fmt.Sprintf("Runlinkat tag %d", f.Tag)
 	}
 	return fmt.Sprintf("unknown type %d", f.Type)
 }
 
+// ReadFcall reads a 9P2000 message from r.
 func ReadFcall(r io.Reader) (*Fcall, error) {
+	return ReadFcallDialect(r, Dialect9P)
+}
+
+// ReadFcallDialect reads a message encoded in dialect d from r.
+func ReadFcallDialect(r io.Reader, d Dialect) (*Fcall, error) {
 	// 128 bytes should be enough for most messages
 	buf := make([]byte, 128)
 	_, err := io.ReadFull(r, buf[0:4])
@@ -483,11 +950,17 @@ func ReadFcall(r io.Reader) (*Fcall, error) {
 	if err != nil {
 		return nil, err
 	}
-	return UnmarshalFcall(buf)
+	return UnmarshalFcallDialect(buf, d)
 }
 
+// WriteFcall writes the 9P2000 encoding of f to w.
 func WriteFcall(w io.Writer, f *Fcall) error {
-	b, err := f.Bytes()
+	return WriteFcallDialect(w, f, Dialect9P)
+}
+
+// WriteFcallDialect writes the encoding of f in dialect d to w.
+func WriteFcallDialect(w io.Writer, f *Fcall, d Dialect) error {
+	b, err := f.BytesDialect(d)
 	if err != nil {
 		return err
 	}
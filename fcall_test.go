@@ -0,0 +1,183 @@
+package plan9
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var dialectTests = []struct {
+	d Dialect
+	f Fcall
+	n int // encoded size
+}{
+	{Dialect9P, Fcall{Type: Tattach, Tag: 1, Fid: 2, Afid: NOFID, Uname: "glenda", Aname: ""}, 4 + 1 + 2 + 4 + 4 + 2 + 6 + 2},
+	{Dialect9PU, Fcall{Type: Tattach, Tag: 1, Fid: 2, Afid: NOFID, Uname: "glenda", Aname: "", Uid: 1000}, 4 + 1 + 2 + 4 + 4 + 2 + 6 + 2 + 4},
+	{Dialect9PL, Fcall{Type: Tauth, Tag: 1, Afid: 3, Uname: "glenda", Aname: "/", Uid: NOUID}, 4 + 1 + 2 + 4 + 2 + 6 + 2 + 1 + 4},
+	{Dialect9P, Fcall{Type: Rerror, Tag: 1, Ename: "no"}, 4 + 1 + 2 + 2 + 2},
+	{Dialect9PU, Fcall{Type: Rerror, Tag: 1, Ename: "no", Errno: 2}, 4 + 1 + 2 + 2 + 2 + 4},
+	{Dialect9PU, Fcall{Type: Tcreate, Tag: 1, Fid: 2, Name: "l", Perm: DMSYMLINK | 0777, Extension: "/tmp"}, 4 + 1 + 2 + 4 + 2 + 1 + 4 + 1 + 2 + 4},
+	{Dialect9PL, Fcall{Type: Tcreate, Tag: 1, Fid: 2, Name: "l", Perm: 0777}, 4 + 1 + 2 + 4 + 2 + 1 + 4 + 1},
+}
+
+func TestFcallDialect(t *testing.T) {
+	for _, tt := range dialectTests {
+		b, err := tt.f.BytesDialect(tt.d)
+		if err != nil {
+			t.Errorf("%v %v: %v", tt.d, &tt.f, err)
+			continue
+		}
+		if len(b) != tt.n {
+			t.Errorf("%v %v: encoded in %d bytes, want %d", tt.d, &tt.f, len(b), tt.n)
+		}
+		f, err := UnmarshalFcallDialect(b, tt.d)
+		if err != nil {
+			t.Errorf("%v %v: %v", tt.d, &tt.f, err)
+			continue
+		}
+		if !reflect.DeepEqual(f, &tt.f) {
+			t.Errorf("%v: round trip %v, got %v", tt.d, &tt.f, f)
+		}
+	}
+}
+
+func TestAttachWithoutUid(t *testing.T) {
+	f := &Fcall{Type: Tattach, Tag: 1, Fid: 2, Afid: NOFID, Uname: "glenda"}
+	b, err := f.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = UnmarshalFcallDialect(b, Dialect9PU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Uid != NOUID {
+		t.Errorf("uid = %d, want NOUID", f.Uid)
+	}
+}
+
+func TestDirDialect(t *testing.T) {
+	d := &Dir{
+		Qid:       Qid{Path: 1, Type: QTFILE},
+		Mode:      DMSYMLINK | 0777,
+		Name:      "l",
+		Uid:       "glenda",
+		Gid:       "glenda",
+		Muid:      "glenda",
+		Uidnum:    1000,
+		Gidnum:    100,
+		Muidnum:   1000,
+		Extension: "/tmp",
+	}
+	b, err := d.BytesDialect(Dialect9PU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, err := UnmarshalDirDialect(b, Dialect9PU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, d1) {
+		t.Errorf("round trip %v, got %v", d, d1)
+	}
+	if _, err := UnmarshalDir(b); err == nil {
+		t.Errorf("UnmarshalDir accepted 9P2000.u stat")
+	}
+
+	b, err = d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, err = UnmarshalDir(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.Uidnum != NOUID || d1.Extension != "" {
+		t.Errorf("9P2000 stat decoded as uid %d extension %q", d1.Uidnum, d1.Extension)
+	}
+}
+
+var dotlTests = []Fcall{
+	{Type: Rlerror, Tag: 1, Errno: 2},
+	{Type: Tstatfs, Tag: 1, Fid: 2},
+	{Type: Rstatfs, Tag: 1, Statfs: Statfs{Type: 0x01021997, Bsize: 4096, Blocks: 10, Bfree: 5, Bavail: 4, Files: 100, Ffree: 50, Fsid: 7, Namelen: 255}},
+	{Type: Tlopen, Tag: 1, Fid: 2, Flags: 0o2},
+	{Type: Rlopen, Tag: 1, Qid: Qid{Path: 3}, Iounit: 8192},
+	{Type: Tlcreate, Tag: 1, Fid: 2, Name: "f", Flags: 0o101, Perm: 0o644, Gid: 100},
+	{Type: Rlcreate, Tag: 1, Qid: Qid{Path: 3}, Iounit: 8192},
+	{Type: Tsymlink, Tag: 1, Fid: 2, Name: "l", Target: "../f", Gid: 100},
+	{Type: Rsymlink, Tag: 1, Qid: Qid{Path: 4}},
+	{Type: Tmknod, Tag: 1, Dfid: 2, Name: "null", Perm: 0o20666, Major: 1, Minor: 3, Gid: 0},
+	{Type: Rmknod, Tag: 1, Qid: Qid{Path: 5}},
+	{Type: Trename, Tag: 1, Fid: 2, Dfid: 3, Name: "g"},
+	{Type: Rrename, Tag: 1},
+	{Type: Treadlink, Tag: 1, Fid: 2},
+	{Type: Rreadlink, Tag: 1, Target: "../f"},
+	{Type: Tgetattr, Tag: 1, Fid: 2, Mask: GETATTRBASIC},
+	{Type: Rgetattr, Tag: 1, Attr: Attr{Valid: GETATTRBASIC, Qid: Qid{Path: 3}, Mode: 0o100644, Uid: 1000, Gid: 100, Nlink: 1, Size: 12, Blksize: 4096, Blocks: 8, MtimeSec: 1, MtimeNsec: 2, DataVersion: 9}},
+	{Type: Tsetattr, Tag: 1, Fid: 2, Attr: Attr{Valid: SETATTRSIZE | SETATTRMTIMESET, Size: 0, MtimeSec: 1, MtimeNsec: 2}},
+	{Type: Rsetattr, Tag: 1},
+	{Type: Txattrwalk, Tag: 1, Fid: 2, Newfid: 3, Name: "user.x"},
+	{Type: Rxattrwalk, Tag: 1, Size: 5},
+	{Type: Txattrcreate, Tag: 1, Fid: 2, Name: "user.x", Size: 5, Flags: 1},
+	{Type: Rxattrcreate, Tag: 1},
+	{Type: Treaddir, Tag: 1, Fid: 2, Offset: 10, Count: 8192},
+	{Type: Rreaddir, Tag: 1, Data: []byte{}},
+	{Type: Tfsync, Tag: 1, Fid: 2, Datasync: 1},
+	{Type: Rfsync, Tag: 1},
+	{Type: Tlock, Tag: 1, Fid: 2, Lock: Flock{Type: LOCKWRLCK, Flags: LOCKFLAGSBLOCK, Start: 0, Length: 10, ProcID: 42, ClientID: "host"}},
+	{Type: Rlock, Tag: 1, Status: LOCKBLOCKED},
+	{Type: Tgetlock, Tag: 1, Fid: 2, Lock: Flock{Type: LOCKRDLCK, Length: 10, ProcID: 42, ClientID: "host"}},
+	{Type: Rgetlock, Tag: 1, Lock: Flock{Type: LOCKUNLCK, ClientID: "host"}},
+	{Type: Tlink, Tag: 1, Dfid: 2, Fid: 3, Name: "h"},
+	{Type: Rlink, Tag: 1},
+	{Type: Tmkdir, Tag: 1, Dfid: 2, Name: "d", Perm: 0o755, Gid: 100},
+	{Type: Rmkdir, Tag: 1, Qid: Qid{Path: 6, Type: QTDIR}},
+	{Type: Trenameat, Tag: 1, Dfid: 2, Name: "a", Newdfid: 3, Newname: "b"},
+	{Type: Rrenameat, Tag: 1},
+	{Type: Tunlinkat, Tag: 1, Dfid: 2, Name: "d", Flags: ATREMOVEDIR},
+	{Type: Runlinkat, Tag: 1},
+}
+
+func TestFcallDotL(t *testing.T) {
+	for i := range dotlTests {
+		tx := &dotlTests[i]
+		b, err := tx.BytesDialect(Dialect9PL)
+		if err != nil {
+			t.Errorf("%v: %v", tx, err)
+			continue
+		}
+		rx, err := UnmarshalFcallDialect(b, Dialect9PL)
+		if err != nil {
+			t.Errorf("%v: %v", tx, err)
+			continue
+		}
+		if !reflect.DeepEqual(rx, tx) {
+			t.Errorf("round trip %v, got %v", tx, rx)
+		}
+		if s := tx.String(); strings.HasPrefix(s, "unknown") {
+			t.Errorf("no String for type %d", tx.Type)
+		}
+	}
+}
+
+func TestDirents(t *testing.T) {
+	dirs := []Dirent{
+		{Qid: Qid{Path: 1, Type: QTDIR}, Offset: 1, Type: 4, Name: "."},
+		{Qid: Qid{Path: 2}, Offset: 2, Type: 8, Name: "file"},
+	}
+	var b []byte
+	for i := range dirs {
+		b = AppendDirent(b, &dirs[i])
+	}
+	d, err := UnmarshalDirents(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, dirs) {
+		t.Errorf("round trip %v, got %v", dirs, d)
+	}
+	if _, err := UnmarshalDirents(b[:len(b)-1]); err == nil {
+		t.Errorf("truncated dirents accepted")
+	}
+}
@@ -0,0 +1,65 @@
+package plan9
+
+import (
+	"io/fs"
+	"time"
+)
+
+// Conversions between 9P and io/fs.
+
+var permModes = []struct {
+	bit  Perm
+	mode fs.FileMode
+}{
+	{DMDIR, fs.ModeDir},
+	{DMAPPEND, fs.ModeAppend},
+	{DMEXCL, fs.ModeExclusive},
+	{DMTMP, fs.ModeTemporary},
+	{DMAUTH, fs.ModeIrregular},
+	{DMSYMLINK, fs.ModeSymlink},
+	{DMDEVICE, fs.ModeDevice},
+	{DMNAMEDPIPE, fs.ModeNamedPipe},
+	{DMSOCKET, fs.ModeSocket},
+	{DMSETUID, fs.ModeSetuid},
+	{DMSETGID, fs.ModeSetgid},
+}
+
+// FileMode returns the fs.FileMode corresponding to p.
+// Bits with no io/fs equivalent, such as DMMOUNT, are dropped.
+func (p Perm) FileMode() fs.FileMode {
+	m := fs.FileMode(p & 0777)
+	for _, pm := range permModes {
+		if p&pm.bit != 0 {
+			m |= pm.mode
+		}
+	}
+	return m
+}
+
+// PermOf returns the Perm corresponding to the fs.FileMode m.
+// It is the inverse of Perm.FileMode.
+func PermOf(m fs.FileMode) Perm {
+	p := Perm(m.Perm())
+	for _, pm := range permModes {
+		if m&pm.mode != 0 {
+			p |= pm.bit
+		}
+	}
+	return p
+}
+
+// FileInfo returns an fs.FileInfo describing d. Its Sys method returns d.
+func (d *Dir) FileInfo() fs.FileInfo {
+	return dirInfo{d}
+}
+
+type dirInfo struct {
+	d *Dir
+}
+
+func (fi dirInfo) Name() string       { return fi.d.Name }
+func (fi dirInfo) Size() int64        { return int64(fi.d.Length) }
+func (fi dirInfo) Mode() fs.FileMode  { return Perm(fi.d.Mode).FileMode() }
+func (fi dirInfo) ModTime() time.Time { return time.Unix(int64(fi.d.Mtime), 0) }
+func (fi dirInfo) IsDir() bool        { return fi.d.Mode&DMDIR != 0 }
+func (fi dirInfo) Sys() interface{}   { return fi.d }
@@ -0,0 +1,323 @@
+// Package plan9test provides utilities for testing 9P clients and servers.
+//
+// A Server serves a srv.Handler, such as the Tree made by NewTree, over
+// in-memory connections. Between each client and the handler it passes the
+// messages through a proxy that can be told to misbehave: to delay or hold
+// back replies, to drop Rflush, to fail requests and to shorten reads.
+//
+//	tree := plan9test.NewTree(map[string]string{"index": "1 main.go\n"})
+//	s := plan9test.NewServer(tree)
+//	defer s.Close()
+//	fsys := s.Mount(t)
+//	s.Fail(plan9.Tread, "i/o error")
+//	...
+package plan9test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/srv"
+)
+
+// User is the user name Mount attaches as and NewTree gives its files.
+const User = "glenda"
+
+// A Server serves a Handler over in-memory connections, injecting faults.
+// The fault settings may be changed while connections are in use; each
+// applies to the replies and requests that pass after it is set.
+type Server struct {
+	Handler srv.Handler
+
+	// Msize is the largest message the server accepts. If zero,
+	// srv.DefaultMsize is used.
+	Msize uint32
+
+	mu        sync.Mutex
+	conns     map[*proxy]bool
+	delay     map[uint8]time.Duration // by request type
+	hold      map[uint8]chan struct{} // by request type; closed on release
+	fail      map[uint8]string        // by request type
+	dropFlush bool
+	readMax   uint32
+}
+
+// NewServer returns a Server for h.
+func NewServer(h srv.Handler) *Server {
+	return &Server{
+		Handler: h,
+		conns:   make(map[*proxy]bool),
+		delay:   make(map[uint8]time.Duration),
+		hold:    make(map[uint8]chan struct{}),
+		fail:    make(map[uint8]string),
+	}
+}
+
+// Pipe returns the client end of a new connection to the server, for
+// tests that speak 9P themselves.
+func (s *Server) Pipe() net.Conn {
+	c1, c2 := net.Pipe()
+	s1, s2 := net.Pipe()
+	p := &proxy{s: s, c: c1, srv: s1, pending: make(map[uint16]*plan9.Fcall), delayed: make(map[uint16]chan struct{})}
+	s.mu.Lock()
+	s.conns[p] = true
+	s.mu.Unlock()
+	go (&srv.Srv{Handler: s.Handler, Msize: s.Msize}).Serve(s2)
+	go p.requests()
+	go p.replies()
+	return c2
+}
+
+// Dial returns a new client connection to the server.
+func (s *Server) Dial() (*client.Conn, error) {
+	return client.NewConn(s.Pipe())
+}
+
+// Mount dials the server and attaches to it as User, failing the test on
+// error. The connection is closed when the test ends.
+func (s *Server) Mount(t testing.TB) *client.Fsys {
+	t.Helper()
+	conn, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := conn.Attach(nil, User, "")
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fsys.Close() })
+	return fsys
+}
+
+// Close closes all connections to the server and releases any held
+// replies.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.conns {
+		p.close()
+		delete(s.conns, p)
+	}
+	for typ, ch := range s.hold {
+		close(ch)
+		delete(s.hold, typ)
+	}
+}
+
+// Delay delays the replies to requests of type typ, such as plan9.Tread,
+// by d. A delay of zero removes it. Delayed replies overtake others, so
+// that they arrive out of order.
+func (s *Server) Delay(typ uint8, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d == 0 {
+		delete(s.delay, typ)
+		return
+	}
+	s.delay[typ] = d
+}
+
+// Hold holds back the replies to requests of type typ until release is
+// called, which sends them. A reply held back when its request is flushed
+// is never sent.
+func (s *Server) Hold(typ uint8) (release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.hold[typ]
+	if !ok {
+		ch = make(chan struct{})
+		s.hold[typ] = ch
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.hold[typ] == ch {
+				delete(s.hold, typ)
+				close(ch)
+			}
+		})
+	}
+}
+
+// Fail answers requests of type typ with an Rerror carrying ename instead
+// of passing them to the handler. An empty ename stops the failures.
+func (s *Server) Fail(typ uint8, ename string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ename == "" {
+		delete(s.fail, typ)
+		return
+	}
+	s.fail[typ] = ename
+}
+
+// DropFlush sets whether the server's Rflush replies are thrown away, as
+// though the server had forgotten them.
+func (s *Server) DropFlush(drop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropFlush = drop
+}
+
+// ShortReads limits the count of each Tread passed to the handler to n
+// bytes, so that reads return less than asked for. A limit of zero
+// removes it. Directory reads return nothing if n is smaller than a
+// directory entry.
+func (s *Server) ShortReads(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readMax = n
+}
+
+// A proxy passes the messages of one connection between the client, on c,
+// and the handler, on srv.
+type proxy struct {
+	s   *Server
+	c   net.Conn
+	srv net.Conn
+
+	w       sync.Mutex // guards writes on c
+	mu      sync.Mutex
+	dialect plan9.Dialect
+	pending map[uint16]*plan9.Fcall  // requests by tag
+	delayed map[uint16]chan struct{} // replies waiting to be sent, by tag; closed on flush
+}
+
+func (p *proxy) close() {
+	p.c.Close()
+	p.srv.Close()
+}
+
+// requests passes the client's requests to the handler.
+func (p *proxy) requests() {
+	defer p.close()
+	for {
+		p.mu.Lock()
+		d := p.dialect
+		p.mu.Unlock()
+		tx, err := plan9.ReadFcallDialect(p.c, d)
+		if err != nil {
+			return
+		}
+
+		p.s.mu.Lock()
+		ename, fail := p.s.fail[tx.Type]
+		if tx.Type == plan9.Tread && p.s.readMax != 0 && tx.Count > p.s.readMax {
+			tx.Count = p.s.readMax
+		}
+		p.s.mu.Unlock()
+		if fail {
+			p.send(&plan9.Fcall{Type: plan9.Rerror, Tag: tx.Tag, Ename: ename})
+			continue
+		}
+
+		p.mu.Lock()
+		p.pending[tx.Tag] = tx
+		p.mu.Unlock()
+		if err := plan9.WriteFcallDialect(p.srv, tx, d); err != nil {
+			return
+		}
+	}
+}
+
+// replies passes the handler's replies to the client.
+func (p *proxy) replies() {
+	defer p.close()
+	for {
+		p.mu.Lock()
+		d := p.dialect
+		p.mu.Unlock()
+		rx, err := plan9.ReadFcallDialect(p.srv, d)
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		tx := p.pending[rx.Tag]
+		delete(p.pending, rx.Tag)
+		if rx.Type == plan9.Rversion {
+			p.dialect = plan9.DialectOf(rx.Version)
+		}
+		if rx.Type == plan9.Rflush && tx != nil {
+			// A reply still waiting to be sent to the flushed
+			// request now never will be.
+			if ch, ok := p.delayed[tx.Oldtag]; ok {
+				close(ch)
+				delete(p.delayed, tx.Oldtag)
+			}
+		}
+		p.mu.Unlock()
+		if tx == nil {
+			p.send(rx)
+			continue
+		}
+
+		p.s.mu.Lock()
+		delay := p.s.delay[tx.Type]
+		hold := p.s.hold[tx.Type]
+		drop := p.s.dropFlush && rx.Type == plan9.Rflush
+		p.s.mu.Unlock()
+		switch {
+		case drop:
+		case delay == 0 && hold == nil:
+			p.send(rx)
+		default:
+			flushed := make(chan struct{})
+			p.mu.Lock()
+			p.delayed[rx.Tag] = flushed
+			p.mu.Unlock()
+			go p.sendLater(rx, delay, hold, flushed)
+		}
+	}
+}
+
+// send writes rx to the client.
+func (p *proxy) send(rx *plan9.Fcall) {
+	p.mu.Lock()
+	d := p.dialect
+	p.mu.Unlock()
+	p.w.Lock()
+	defer p.w.Unlock()
+	plan9.WriteFcallDialect(p.c, rx, d)
+}
+
+// sendLater writes rx to the client after the delay and once hold, if not
+// nil, is closed, unless flushed is closed first.
+func (p *proxy) sendLater(rx *plan9.Fcall, delay time.Duration, hold, flushed chan struct{}) {
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-flushed:
+			return
+		}
+	}
+	if hold != nil {
+		select {
+		case <-hold:
+		case <-flushed:
+			return
+		}
+	}
+	// Check and write under both locks, so that an Rflush for the
+	// request cannot be sent before the reply.
+	p.mu.Lock()
+	if p.delayed[rx.Tag] != flushed {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.delayed, rx.Tag)
+	p.w.Lock()
+	d := p.dialect
+	p.mu.Unlock()
+	plan9.WriteFcallDialect(p.c, rx, d)
+	p.w.Unlock()
+}
@@ -0,0 +1,210 @@
+package plan9test_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/plan9test"
+)
+
+func newServer(t *testing.T) *plan9test.Server {
+	s := plan9test.NewServer(plan9test.NewTree(map[string]string{
+		"hello":        "hello, world\n",
+		"lib/profile":  "bind -a $home/bin/rc /bin\n",
+		"lib/plumbing": "",
+		"tmp/scratch":  "",
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func readFile(fsys *client.Fsys, name string) (string, error) {
+	fid, err := fsys.Open(name, plan9.OREAD)
+	if err != nil {
+		return "", err
+	}
+	defer fid.Close()
+	b, err := io.ReadAll(fid)
+	return string(b), err
+}
+
+func TestTree(t *testing.T) {
+	fsys := newServer(t).Mount(t)
+	if s, err := readFile(fsys, "lib/profile"); err != nil || s != "bind -a $home/bin/rc /bin\n" {
+		t.Errorf("read lib/profile: %q, %v", s, err)
+	}
+	fid, err := fsys.Open("hello", plan9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid.WriteAt([]byte("HELLO"), 0)
+	fid.WriteAt([]byte("!"), 13)
+	fid.Close()
+	if s, err := readFile(fsys, "hello"); err != nil || s != "HELLO, world\n!" {
+		t.Errorf("read hello after writes: %q, %v", s, err)
+	}
+
+	dir, err := fsys.Open("lib", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	d, err := dir.Dirreadall()
+	if err != nil || len(d) != 2 || d[0].Name != "plumbing" || d[1].Name != "profile" {
+		t.Errorf("lib holds %v, %v", d, err)
+	}
+	if _, err := fsys.Stat("tmp/scratch"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFail(t *testing.T) {
+	s := newServer(t)
+	fsys := s.Mount(t)
+	s.Fail(plan9.Topen, "i/o error")
+	if _, err := fsys.Open("hello", plan9.OREAD); err == nil || err.Error() != "i/o error" {
+		t.Errorf("Open with failing Topen: %v", err)
+	}
+	s.Fail(plan9.Topen, "")
+	if _, err := readFile(fsys, "hello"); err != nil {
+		t.Errorf("Open after failures stopped: %v", err)
+	}
+}
+
+func TestShortReads(t *testing.T) {
+	s := newServer(t)
+	fsys := s.Mount(t)
+	s.ShortReads(3)
+	fid, err := fsys.Open("hello", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+	buf := make([]byte, 100)
+	if n, err := fid.Read(buf); n != 3 || err != nil {
+		t.Errorf("Read = %d, %v; want 3 bytes", n, err)
+	}
+	if n, err := fid.ReadFull(buf[:10]); n != 10 || err != nil || string(buf[:10]) != "lo, world\n" {
+		t.Errorf("ReadFull = %q, %v", buf[:n], err)
+	}
+}
+
+func TestMsize(t *testing.T) {
+	s := newServer(t)
+	s.Msize = 256
+	conn, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if m := conn.Msize(); m != 256 {
+		t.Errorf("msize %d, want 256", m)
+	}
+}
+
+func TestHold(t *testing.T) {
+	s := newServer(t)
+	fsys := s.Mount(t)
+	fid, err := fsys.Open("hello", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+	buf := make([]byte, 5)
+
+	// A held reply is never sent if the request is flushed.
+	release := s.Hold(plan9.Tread)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = fid.ReadAtContext(ctx, buf, 0)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("ReadAtContext of held reply: %v", err)
+	}
+	release()
+
+	release = s.Hold(plan9.Tread)
+	done := make(chan error)
+	go func() {
+		_, err := fid.ReadAt(buf, 0)
+		done <- err
+	}()
+	// Other requests go by.
+	if _, err := fsys.Stat("hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("read finished while held: %v", err)
+	default:
+	}
+	release()
+	if err := <-done; err != nil || string(buf) != "hello" {
+		t.Errorf("read after release: %q, %v", buf, err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	s := newServer(t)
+	fsys := s.Mount(t)
+	s.Delay(plan9.Tstat, 50*time.Millisecond)
+	done := make(chan bool)
+	go func() {
+		fsys.Stat("hello")
+		done <- true
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if _, err := readFile(fsys, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Errorf("delayed stat answered before later read")
+	default:
+	}
+	<-done
+}
+
+func TestDropFlush(t *testing.T) {
+	s := newServer(t)
+	s.DropFlush(true)
+	c := s.Pipe()
+	defer c.Close()
+	for _, tx := range []*plan9.Fcall{
+		{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: plan9.VERSION9P},
+		{Type: plan9.Tflush, Tag: 1, Oldtag: 2},
+		{Type: plan9.Tclunk, Tag: 3, Fid: 4},
+	} {
+		if err := plan9.WriteFcall(c, tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []uint8{plan9.Rversion, plan9.Rerror} {
+		rx, err := plan9.ReadFcall(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rx.Type != want {
+			t.Errorf("got %v, want type %d", rx, want)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newServer(t)
+	fsys := s.Mount(t)
+	s.Hold(plan9.Tstat)
+	done := make(chan error)
+	go func() {
+		_, err := fsys.Stat("hello")
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	s.Close()
+	if err := <-done; err == nil {
+		t.Errorf("Stat succeeded across Close")
+	}
+}
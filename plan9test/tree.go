@@ -0,0 +1,99 @@
+package plan9test
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/srv"
+)
+
+// NewTree returns a Tree holding the given files, keyed by slash-separated
+// path name, each a Data with the given contents. The directories leading
+// to them are made as needed. Everything belongs to User and may be read
+// and written by anyone.
+func NewTree(files map[string]string) *srv.Tree {
+	t := srv.NewTree(User, User, 0o777)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := t.Root
+		elem := strings.Split(strings.Trim(name, "/"), "/")
+		for _, e := range elem[:len(elem)-1] {
+			d := dir.Walk(e)
+			if d == nil {
+				var err error
+				d, err = dir.Create(e, User, 0o777|plan9.DMDIR, nil)
+				if err != nil {
+					panic("plan9test: " + name + ": " + err.Error())
+				}
+			}
+			dir = d
+		}
+		if _, err := dir.Create(elem[len(elem)-1], User, 0o666, NewData(files[name])); err != nil {
+			panic("plan9test: " + name + ": " + err.Error())
+		}
+	}
+	return t
+}
+
+// A Data is a srv.FileHandler holding the contents of a file in memory.
+// Reads and writes work as they would on a disk file, except that the file
+// is not truncated on open. As for most synthetic files, the length in the
+// file's Dir is zero.
+type Data struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+// NewData returns a Data holding s.
+func NewData(s string) *Data {
+	return &Data{b: []byte(s)}
+}
+
+// String returns the contents of d.
+func (d *Data) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return string(d.b)
+}
+
+// Set replaces the contents of d with s.
+func (d *Data) Set(s string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.b = []byte(s)
+}
+
+func (d *Data) Read(r *srv.Req) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	srv.ReadBytes(r, d.b)
+	// Copy, so that later writes do not change the reply.
+	r.Ofcall.Data = append([]byte(nil), r.Ofcall.Data...)
+	r.Respond(nil)
+}
+
+func (d *Data) Write(r *srv.Req) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	off := r.Ifcall.Offset
+	end := off + uint64(len(r.Ifcall.Data))
+	if end > uint64(len(d.b)) {
+		if end > maxData {
+			r.Respond(srv.Error("file too large"))
+			return
+		}
+		d.b = append(d.b, make([]byte, end-uint64(len(d.b)))...)
+	}
+	copy(d.b[off:], r.Ifcall.Data)
+	r.Ofcall.Count = uint32(len(r.Ifcall.Data))
+	r.Respond(nil)
+}
+
+// maxData is the largest a Data may grow.
+const maxData = 1 << 30
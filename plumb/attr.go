@@ -0,0 +1,140 @@
+package plumb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// An Attribute is a name=value pair attached to a Message.
+type Attribute struct {
+	Name  string // The name of the attribute ("addr").
+	Value string // The value of the attribute ("/long johns/")
+}
+
+// Attrs is an ordered list of attributes. A name may appear more than once;
+// Send and Recv preserve both the order and the repetitions, while Get and
+// Set deal with the first attribute of a given name. Set, Add and Delete
+// make a new list rather than change the old one, which may be shared with
+// a copy of the Message.
+type Attrs []Attribute
+
+// Get returns the value of the first attribute with the given name,
+// and whether there is one.
+func (a Attrs) Get(name string) (string, bool) {
+	for _, x := range a {
+		if x.Name == name {
+			return x.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets the value of the named attribute. It replaces the first
+// attribute with that name, removing any others, or else appends one.
+func (a *Attrs) Set(name, value string) {
+	var b Attrs
+	set := false
+	for _, x := range *a {
+		if x.Name == name {
+			if set {
+				continue
+			}
+			x.Value, set = value, true
+		}
+		b = append(b, x)
+	}
+	if !set {
+		b = append(b, Attribute{Name: name, Value: value})
+	}
+	*a = b
+}
+
+// Add appends an attribute, whether or not one with the same name exists.
+func (a *Attrs) Add(name, value string) {
+	n := len(*a)
+	*a = append((*a)[:n:n], Attribute{Name: name, Value: value})
+}
+
+// Delete removes all attributes with the given name.
+func (a *Attrs) Delete(name string) {
+	var b Attrs
+	for _, x := range *a {
+		if x.Name != name {
+			b = append(b, x)
+		}
+	}
+	*a = b
+}
+
+// Range calls f for each attribute in order, stopping if f returns false.
+func (a Attrs) Range(f func(name, value string) bool) {
+	for _, x := range a {
+		if !f(x.Name, x.Value) {
+			return
+		}
+	}
+}
+
+// String returns the attributes as they appear in an encoded message:
+// name=value pairs separated by spaces, with values quoted if necessary.
+func (a Attrs) String() string {
+	var b strings.Builder
+	for i, x := range a {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(x.Name)
+		b.WriteString("=")
+		b.WriteString(quoteAttribute(x.Value))
+	}
+	return b.String()
+}
+
+// Values of the action attribute understood by acme.
+const (
+	ActionShowFile = "showfile" // open the file named by the data
+	ActionShowData = "showdata" // show the data in a new window
+)
+
+// Addr returns the addr attribute, an address within the file named by the
+// data, in the form of an acme address ("/long johns/" or "#123").
+func (m *Message) Addr() string {
+	return m.LookupAttr("addr")
+}
+
+// SetAddr sets the addr attribute.
+func (m *Message) SetAddr(addr string) {
+	m.Attr.Set("addr", addr)
+}
+
+// Action returns the action attribute, such as ActionShowData,
+// which tells the receiver what to do with the message.
+func (m *Message) Action() string {
+	return m.LookupAttr("action")
+}
+
+// SetAction sets the action attribute.
+func (m *Message) SetAction(action string) {
+	m.Attr.Set("action", action)
+}
+
+// Click returns the click attribute: the offset, in characters, into the
+// data of the point the user selected. The plumber uses it to choose the
+// text around that point. Click reports false if there is no valid click
+// attribute.
+func (m *Message) Click() (int, bool) {
+	v, ok := m.Attr.Get("click")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// SetClick sets the click attribute.
+func (m *Message) SetClick(n int) {
+	m.Attr.Set("click", strconv.Itoa(n))
+}
@@ -0,0 +1,143 @@
+package plumb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAttrs(t *testing.T) {
+	var a Attrs
+	a.Add("addr", "1")
+	a.Add("action", "showdata")
+	a.Add("addr", "2")
+	if v, ok := a.Get("addr"); !ok || v != "1" {
+		t.Errorf("Get(addr) = %q, %v", v, ok)
+	}
+	if _, ok := a.Get("click"); ok {
+		t.Errorf("Get(click) found a value")
+	}
+
+	b := a
+	b.Set("addr", "3")
+	if want := (Attrs{{"addr", "3"}, {"action", "showdata"}}); !reflect.DeepEqual(b, want) {
+		t.Errorf("after Set: %v, want %v", b, want)
+	}
+	if want := (Attrs{{"addr", "1"}, {"action", "showdata"}, {"addr", "2"}}); !reflect.DeepEqual(a, want) {
+		t.Errorf("Set changed a copy: %v", a)
+	}
+	b.Set("click", "4")
+	b.Delete("action")
+	if want := (Attrs{{"addr", "3"}, {"click", "4"}}); !reflect.DeepEqual(b, want) {
+		t.Errorf("after Set and Delete: %v, want %v", b, want)
+	}
+
+	var names []string
+	a.Range(func(name, value string) bool {
+		names = append(names, name+"="+value)
+		return name != "action"
+	})
+	if want := []string{"addr=1", "action=showdata"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Range saw %v, want %v", names, want)
+	}
+	if s := (Attrs{{"addr", "/long johns/"}, {"x", ""}}).String(); s != "addr='/long johns/' x=" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestWellKnownAttrs(t *testing.T) {
+	m := new(Message)
+	if _, ok := m.Click(); ok {
+		t.Errorf("Click() found a click")
+	}
+	m.SetAddr("/main/")
+	m.SetAction(ActionShowData)
+	m.SetClick(12)
+	m.SetAddr("#5")
+	if m.Addr() != "#5" || m.Action() != "showdata" {
+		t.Errorf("addr %q, action %q", m.Addr(), m.Action())
+	}
+	if n, ok := m.Click(); !ok || n != 12 {
+		t.Errorf("Click() = %d, %v", n, ok)
+	}
+	if s := m.Attr.String(); s != "addr=#5 action=showdata click=12" {
+		t.Errorf("attributes %q", s)
+	}
+	m.Attr.Set("click", "x")
+	if _, ok := m.Click(); ok {
+		t.Errorf("Click() accepted a bad click")
+	}
+}
+
+func TestDuplicateAttributes(t *testing.T) {
+	m := &Message{Type: "text", Attr: Attrs{{"a", "1"}, {"b", "x y"}, {"a", "2"}}, Data: []byte("data")}
+	var buf bytes.Buffer
+	if err := m.Send(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\na=1 b='x y' a=2\n") {
+		t.Errorf("encoded %q", buf.String())
+	}
+	got := new(Message)
+	if err := got.Recv(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("received\n%+v\nwant\n%+v", got, m)
+	}
+}
+
+var validateTests = []struct {
+	m    Message
+	line int
+	want string
+}{
+	{Message{Src: "a\nb"}, 1, "plumb message line 1 (src): newline in field"},
+	{Message{Dir: "/tmp\n"}, 3, "plumb message line 3 (wdir): newline in field"},
+	{Message{Attr: Attrs{{"", "x"}}}, 5, `plumb message line 5 (attr): bad attribute syntax: name ""`},
+	{Message{Attr: Attrs{{"a", "1"}, {"b c", "x"}}}, 5, `plumb message line 5 (attr): bad attribute syntax: name "b c"`},
+	{Message{Attr: Attrs{{"a", "x\ny"}}}, 5, "plumb message line 5 (attr): newline in field: value of a"},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range validateTests {
+		err := tt.m.Validate()
+		var fe *FormatError
+		if !errors.As(err, &fe) || fe.Line != tt.line || err.Error() != tt.want {
+			t.Errorf("Validate(%+v) = %v, want %s", tt.m, err, tt.want)
+		}
+		if err := tt.m.Send(io.Discard); err == nil {
+			t.Errorf("Send(%+v) succeeded", tt.m)
+		}
+	}
+}
+
+var recvErrorTests = []struct {
+	in    string
+	field string
+	err   error
+}{
+	{"acme\nedit\n/tmp\ntext\naddr\n4\ndata", "attr", ErrAttribute},
+	{"acme\nedit\n/tmp\ntext\naddr=x''\n4\ndata", "attr", ErrQuote},
+	{"acme\nedit\n/tmp\ntext\naddr='x\n4\ndata", "attr", io.ErrUnexpectedEOF},
+	{"acme\nedit\n/tmp\ntext\n\nfour\ndata", "ndata", ErrCount},
+	{"acme\nedit\n/tmp\ntext\n\n-1\n", "ndata", ErrCount},
+	{"acme\nedit\n/tmp", "wdir", io.ErrUnexpectedEOF},
+	{"acme\nedit\n/tmp\ntext\n\n4\nda", "data", io.ErrUnexpectedEOF},
+}
+
+func TestRecvErrors(t *testing.T) {
+	for _, tt := range recvErrorTests {
+		err := new(Message).Recv(strings.NewReader(tt.in))
+		var fe *FormatError
+		if !errors.As(err, &fe) || fe.Field != tt.field || !errors.Is(err, tt.err) {
+			t.Errorf("Recv(%q) = %v, want %v in %s", tt.in, err, tt.err, tt.field)
+		}
+	}
+	if err := new(Message).Recv(strings.NewReader("")); err != io.EOF {
+		t.Errorf("Recv at EOF = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Plumber routes messages between programs according to a set of rules.
+//
+// Usage:
+//
+//	plumber [-p plumbing]
+//
+// The rules are read from the file plumbing, by default $HOME/lib/plumbing
+// or, if that does not exist, $PLAN9/plumb/initial.plumbing. Plumber posts
+// its files as the service plumb in the name space directory, from where
+// programs open them with plumb.Open.
+//
+// See plumber(4) and plumb(7).
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/plumb/plumber"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: plumber [-p plumbing]\n")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("plumber: ")
+
+	file := flag.String("p", "", "read rules from `file`")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+
+	rules, err := readRules(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := client.ListenService("plumb")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Clients attach as $USER; see client.Mount.
+	p := plumber.New(os.Getenv("USER"), rules)
+	log.Fatal(p.Serve(l))
+}
+
+func readRules(file string) (*plumber.Rules, error) {
+	if file != "" {
+		return plumber.ParseFile(file)
+	}
+	home, _ := os.UserHomeDir()
+	rules, err := plumber.ParseFile(filepath.Join(home, "lib", "plumbing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		return rules, err
+	}
+	root := os.Getenv("PLAN9")
+	if root == "" {
+		root = "/usr/local/plan9"
+	}
+	return plumber.ParseFile(filepath.Join(root, "plumb", "initial.plumbing"))
+}
@@ -0,0 +1,16 @@
+package plumb
+
+import (
+	"time"
+
+	"bwsd.dev/plan9/client"
+)
+
+func SetRetryDelay(d time.Duration) { retryDelay = d }
+
+// SendFid returns the send file Send keeps open.
+func SendFid() *client.Fid {
+	sendfid.Lock()
+	defer sendfid.Unlock()
+	return sendfid.fid
+}
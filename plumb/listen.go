@@ -0,0 +1,101 @@
+package plumb
+
+import (
+	"bufio"
+	"context"
+	"sync"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+)
+
+// retryDelay is how long Listen waits before trying again to reach the
+// plumber.
+var retryDelay = 2 * time.Second
+
+// Listen returns a channel on which it delivers the messages sent to the
+// named port, such as "edit". If the plumber is not running, or goes away,
+// Listen keeps trying to reconnect, so a program need not be restarted
+// with the plumber. The channel is closed once ctx is done.
+func Listen(ctx context.Context, port string) <-chan *Message {
+	c := make(chan *Message)
+	go listen(ctx, port, c)
+	return c
+}
+
+func listen(ctx context.Context, port string, c chan<- *Message) {
+	defer close(c)
+	for {
+		fid, err := Open(port, plan9.OREAD|plan9.OCEXEC)
+		if err == nil {
+			relay(ctx, fid, c)
+			fid.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// relay sends the messages read from fid on c, until the read fails.
+func relay(ctx context.Context, fid *client.Fid, c chan<- *Message) {
+	b := bufio.NewReader(&ctxReader{ctx, fid})
+	for {
+		m := new(Message)
+		if err := m.Recv(b); err != nil {
+			return
+		}
+		select {
+		case c <- m:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// A ctxReader reads from a fid until ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	fid *client.Fid
+}
+
+func (r *ctxReader) Read(b []byte) (int, error) {
+	return r.fid.ReadContext(r.ctx, b)
+}
+
+// sendfid is the send file used by Send.
+var sendfid struct {
+	sync.Mutex
+	fid *client.Fid
+}
+
+// Send sends m to the plumber. Unlike m.Send, it opens the plumber's send
+// file itself and keeps it open for later calls.
+func Send(m *Message) error {
+	// Checked here, so that a malformed message is not taken for a lost
+	// connection.
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	sendfid.Lock()
+	defer sendfid.Unlock()
+	for try := 0; ; try++ {
+		if sendfid.fid == nil {
+			fid, err := Open("send", plan9.OWRITE|plan9.OCEXEC)
+			if err != nil {
+				return err
+			}
+			sendfid.fid = fid
+		}
+		err := m.Send(sendfid.fid)
+		if !hungup(err) || try > 0 {
+			return err
+		}
+		// The plumber may have been restarted.
+		sendfid.fid.Close()
+		sendfid.fid = nil
+	}
+}
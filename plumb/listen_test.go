@@ -0,0 +1,140 @@
+package plumb_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/plumb"
+	"bwsd.dev/plan9/plumb/plumber"
+)
+
+// A plumberListener lets a test stop a plumber, hanging up on its clients.
+type plumberListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *plumberListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *plumberListener) Close() error {
+	err := l.Listener.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	return err
+}
+
+func startPlumber(t *testing.T) *plumberListener {
+	rules, err := plumber.Parse("test", []byte("type is text\nplumb to edit\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := client.ListenService("plumb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &plumberListener{Listener: l}
+	go plumber.New("glenda", rules).Serve(pl)
+	return pl
+}
+
+// send sends m, waiting for a listener to appear on its port.
+func send(t *testing.T, m *plumb.Message) {
+	t.Helper()
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = plumb.Send(m); err == nil {
+			return
+		}
+	}
+	t.Fatalf("send: %v", err)
+}
+
+func recv(t *testing.T, c <-chan *plumb.Message) *plumb.Message {
+	t.Helper()
+	select {
+	case m := <-c:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return nil
+}
+
+func TestListen(t *testing.T) {
+	t.Setenv("DISPLAY", ":0")
+	t.Setenv("NAMESPACE", filepath.Join(t.TempDir(), "ns"))
+	t.Setenv("USER", "glenda")
+	plumb.SetRetryDelay(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := plumb.Listen(ctx, "edit")
+
+	// Listen waits for the plumber to start.
+	time.Sleep(50 * time.Millisecond)
+	l := startPlumber(t)
+	send(t, &plumb.Message{Type: "text", Data: []byte("one")})
+	if m := recv(t, c); m.Dst != "edit" || string(m.Data) != "one" {
+		t.Errorf("received %+v", m)
+	}
+
+	// Send and Listen both reconnect to a new plumber.
+	l.Close()
+	l = startPlumber(t)
+	defer l.Close()
+	send(t, &plumb.Message{Type: "text", Data: []byte("two")})
+	if m := recv(t, c); string(m.Data) != "two" {
+		t.Errorf("received %+v", m)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-c:
+		if ok {
+			t.Errorf("received message after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+func TestSendInvalid(t *testing.T) {
+	t.Setenv("DISPLAY", ":0")
+	t.Setenv("NAMESPACE", filepath.Join(t.TempDir(), "ns"))
+	t.Setenv("USER", "glenda")
+	l := startPlumber(t)
+	defer l.Close()
+
+	// With no one listening, the plumber refuses the message, but Send
+	// has opened the send file.
+	plumb.Send(&plumb.Message{Type: "text", Data: []byte("one")})
+	fid := plumb.SendFid()
+	if fid == nil {
+		t.Fatal("send file not open")
+	}
+	var ferr *plumb.FormatError
+	if err := plumb.Send(&plumb.Message{Type: "text\n"}); !errors.As(err, &ferr) {
+		t.Errorf("Send of invalid message: %v, want FormatError", err)
+	}
+	if plumb.SendFid() != fid {
+		t.Errorf("send file reopened after invalid message")
+	}
+}
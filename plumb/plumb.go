@@ -15,72 +15,143 @@ import (
 
 // Message represents a message to or from the plumber.
 type Message struct {
-	Src  string     // The source of the message ("acme").
-	Dst  string     // The destination port of the message ("edit").
-	Dir  string     // The working directory in which to interpret the message.
-	Type string     // The type of the message ("text").
-	Attr *Attribute // The attributes; may be nil.
-	Data []byte     // The data; may be nil.
-}
-
-// Attribute represents a list of attributes for a single Message.
-type Attribute struct {
-	Name  string // The name of the attribute ("addr").
-	Value string // The value of the attribute ("/long johns/")
-	Next  *Attribute
+	Src  string // The source of the message ("acme").
+	Dst  string // The destination port of the message ("edit").
+	Dir  string // The working directory in which to interpret the message.
+	Type string // The type of the message ("text").
+	Attr Attrs  // The attributes; may be nil.
+	Data []byte // The data; may be nil.
 }
 
 var (
 	ErrAttribute = errors.New("bad attribute syntax")
 	ErrQuote     = errors.New("bad attribute quoting")
+	ErrNewline   = errors.New("newline in field")
+	ErrCount     = errors.New("bad data count")
 )
 
-var fsys *client.Fsys
-var fsysErr error
-var fsysOnce sync.Once
+// fields names the fields of an encoded message, one per line
+// except for the data.
+var fields = [...]string{"src", "dst", "wdir", "type", "attr", "ndata", "data"}
+
+// A FormatError reports a message that cannot be encoded or decoded.
+type FormatError struct {
+	Line  int    // line of the encoded message, from 1
+	Field string // src, dst, wdir, type, attr, ndata or data
+	Err   error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("plumb message line %d (%s): %v", e.Line, e.Field, e.Err)
+}
+
+func (e *FormatError) Unwrap() error { return e.Err }
+
+func formatError(line int, err error) error {
+	return &FormatError{Line: line, Field: fields[line-1], Err: err}
+}
+
+// plumbfs holds the connection to the plumber.
+var plumbfs struct {
+	sync.Mutex
+	fsys *client.Fsys
+}
+
+// mount returns the connection to the plumber, dialing it if there is none.
+// It reports whether the connection is a new one.
+func mount() (*client.Fsys, bool, error) {
+	plumbfs.Lock()
+	defer plumbfs.Unlock()
+	if plumbfs.fsys != nil {
+		return plumbfs.fsys, false, nil
+	}
+	fsys, err := client.MountService("plumb")
+	if err != nil {
+		return nil, false, err
+	}
+	plumbfs.fsys = fsys
+	return fsys, true, nil
+}
+
+// unmount drops fsys, which has failed, so that the next call to mount
+// dials the plumber again.
+func unmount(fsys *client.Fsys) {
+	plumbfs.Lock()
+	defer plumbfs.Unlock()
+	if plumbfs.fsys == fsys {
+		plumbfs.fsys = nil
+		fsys.Close()
+	}
+}
 
-func mountPlumb() {
-	fsys, fsysErr = client.MountService("plumb")
+// hungup reports whether err means the connection to the plumber failed,
+// rather than that the plumber refused a request.
+func hungup(err error) bool {
+	var e client.Error
+	return err != nil && !errors.As(err, &e)
 }
 
 // Open opens the plumbing file with the given name and open mode.
+// If the plumber has been restarted since the last call, Open connects to
+// the new one.
 func Open(name string, mode int) (*client.Fid, error) {
-	fsysOnce.Do(mountPlumb)
-	if fsysErr != nil {
-		return nil, fsysErr
+	fsys, fresh, err := mount()
+	if err != nil {
+		return nil, err
 	}
 	fid, err := fsys.Open(name, uint8(mode))
+	if hungup(err) && !fresh {
+		unmount(fsys)
+		if fsys, _, err = mount(); err != nil {
+			return nil, err
+		}
+		fid, err = fsys.Open(name, uint8(mode))
+	}
 	if err != nil {
 		return nil, err
 	}
 	return fid, nil
 }
 
+// Validate checks that m can be encoded: the header fields and attribute
+// values must not contain newlines, and attribute names must be non-empty
+// and free of white space, quotes and equals signs.
+func (m *Message) Validate() error {
+	for i, s := range []string{m.Src, m.Dst, m.Dir, m.Type} {
+		if strings.Contains(s, "\n") {
+			return formatError(i+1, ErrNewline)
+		}
+	}
+	for _, a := range m.Attr {
+		if a.Name == "" || strings.ContainsAny(a.Name, " \t\n'=") {
+			return formatError(5, fmt.Errorf("%w: name %q", ErrAttribute, a.Name))
+		}
+		if strings.Contains(a.Value, "\n") {
+			return formatError(5, fmt.Errorf("%w: value of %s", ErrNewline, a.Name))
+		}
+	}
+	return nil
+}
+
 // Send writes the message to the writer. The message will be sent with
-// a single call to Write.
+// a single call to Write. Send returns the error from Validate, without
+// writing anything, if the message cannot be encoded.
 func (m *Message) Send(w io.Writer) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "%s\n", m.Src)
 	fmt.Fprintf(&buf, "%s\n", m.Dst)
 	fmt.Fprintf(&buf, "%s\n", m.Dir)
 	fmt.Fprintf(&buf, "%s\n", m.Type)
-	m.Attr.send(&buf)
+	fmt.Fprintf(&buf, "%s\n", m.Attr)
 	fmt.Fprintf(&buf, "%d\n", len(m.Data))
 	buf.Write(m.Data)
 	_, err := w.Write(buf.Bytes())
 	return err
 }
 
-func (attr *Attribute) send(w io.Writer) {
-	for a := attr; a != nil; a = a.Next {
-		if a != attr {
-			fmt.Fprint(w, " ")
-		}
-		fmt.Fprintf(w, "%s=%s", a.Name, quoteAttribute(a.Value))
-	}
-	fmt.Fprintf(w, "\n")
-}
-
 const quote = '\''
 
 // quoteAttribute quotes the attribute value, if necessary, and returns the result.
@@ -103,30 +174,38 @@ func quoteAttribute(s string) string {
 
 // Recv reads a message from the reader and stores it in the Message.
 // Since encoded messages are properly delimited, Recv will not read
-// any data beyond the message itself.
+// any data beyond the message itself. Recv returns io.EOF if the reader
+// is at end of file, and a *FormatError for a malformed or truncated
+// message.
 func (m *Message) Recv(r io.ByteReader) error {
 	reader := newReader(r)
 	m.Src = reader.readLine()
+	if reader.err == io.EOF && reader.n == 0 {
+		return io.EOF
+	}
 	m.Dst = reader.readLine()
 	m.Dir = reader.readLine()
 	m.Type = reader.readLine()
 	m.Attr = reader.readAttr()
+	ndata := reader.readLine()
 	if reader.err != nil {
-		return reader.err
+		return reader.error()
 	}
-	n, err := strconv.Atoi(reader.readLine())
-	if err != nil {
-		return err
+	n, err := strconv.Atoi(ndata)
+	if err != nil || n < 0 {
+		return formatError(reader.line, fmt.Errorf("%w %q", ErrCount, ndata))
 	}
 	m.Data = make([]byte, n)
 	reader.read(m.Data)
-	return reader.err
+	return reader.error()
 }
 
 type reader struct {
 	r    io.ByteReader
 	buf  []byte
-	attr *Attribute
+	attr Attrs
+	line int // line being read
+	n    int // bytes read
 	err  error
 }
 
@@ -137,12 +216,39 @@ func newReader(r io.ByteReader) *reader {
 	}
 }
 
+// error returns the error that stopped r, if any, as a FormatError.
+func (r *reader) error() error {
+	switch r.err {
+	case nil:
+		return nil
+	case io.EOF:
+		return formatError(r.line, io.ErrUnexpectedEOF)
+	}
+	if _, ok := r.err.(*FormatError); ok {
+		return r.err
+	}
+	return formatError(r.line, r.err)
+}
+
+func (r *reader) readByte() byte {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	r.n++
+	return c
+}
+
 func (r *reader) readLine() string {
+	if r.err != nil {
+		return ""
+	}
+	r.line++
 	r.buf = r.buf[:0]
-	var c byte
-	for r.err == nil {
-		c, r.err = r.r.ReadByte()
-		if c == '\n' {
+	for {
+		c := r.readByte()
+		if r.err != nil || c == '\n' {
 			break
 		}
 		r.buf = append(r.buf, c)
@@ -151,29 +257,43 @@ func (r *reader) readLine() string {
 }
 
 func (r *reader) read(p []byte) {
-	rr, ok := r.r.(io.Reader)
-	if r.err == nil && ok {
-		_, r.err = io.ReadFull(rr, p)
+	if r.err != nil {
+		return
+	}
+	r.line++
+	if rr, ok := r.r.(io.Reader); ok {
+		var n int
+		n, r.err = io.ReadFull(rr, p)
+		r.n += n
 		return
 	}
 	for i := range p {
-		if r.err != nil {
+		if p[i] = r.readByte(); r.err != nil {
 			break
 		}
-		p[i], r.err = r.r.ReadByte()
 	}
 }
 
-func (r *reader) readAttr() *Attribute {
+func (r *reader) readAttr() Attrs {
+	if r.err != nil {
+		return nil
+	}
+	r.line++
 	r.buf = r.buf[:0]
 	var c byte
 	quoting := false
 Loop:
 	for r.err == nil {
-		c, r.err = r.r.ReadByte()
+		c = r.readByte()
+		if r.err != nil {
+			break
+		}
 		if quoting && c == quote {
 			r.buf = append(r.buf, c)
-			c, r.err = r.r.ReadByte()
+			c = r.readByte()
+			if r.err != nil {
+				break
+			}
 			if c != quote {
 				quoting = false
 			}
@@ -195,28 +315,22 @@ Loop:
 	if len(r.buf) > 0 && r.err == nil {
 		r.newAttr()
 	}
-	// Attributes are ordered so reverse the list.
-	var next, rattr *Attribute
-	for a := r.attr; a != nil; a = next {
-		next = a.Next
-		a.Next = rattr
-		rattr = a
-	}
-	return rattr
+	return r.attr
 }
 
 func (r *reader) newAttr() {
 	equals := bytes.IndexByte(r.buf, '=')
 	if equals < 0 {
-		r.err = ErrAttribute
+		r.err = formatError(r.line, fmt.Errorf("%w: %q", ErrAttribute, r.buf))
 		return
 	}
 	str := string(r.buf)
-	r.attr = &Attribute{
-		Name: str[:equals],
-		Next: r.attr,
+	value, err := unquoteAttribute(str[equals+1:])
+	if err != nil {
+		r.err = formatError(r.line, fmt.Errorf("%w: %s", err, str))
+		return
 	}
-	r.attr.Value, r.err = unquoteAttribute(str[equals+1:])
+	r.attr = append(r.attr, Attribute{Name: str[:equals], Value: value})
 }
 
 // unquoteAttribute unquotes the attribute value, if necessary, and returns the result.
@@ -245,12 +359,8 @@ func unquoteAttribute(s string) (string, error) {
 // LookupAttr returns the value associated with the named attribute.
 // If the attribute is missing, LookupAttr returns an empty string.
 // To distinguish an empty present attribute from a missing attribute,
-// walk the m.Attr list directly instead of using LookupAttr.
+// use m.Attr.Get.
 func (m *Message) LookupAttr(name string) string {
-	for a := m.Attr; a != nil; a = a.Next {
-		if a.Name == name {
-			return a.Value
-		}
-	}
-	return ""
+	v, _ := m.Attr.Get(name)
+	return v
 }
@@ -9,10 +9,10 @@ import (
 )
 
 func TestBasic(t *testing.T) {
-	attr := &Attribute{
+	attr := Attrs{{
 		Name:  "addr",
 		Value: "/root/",
-	}
+	}}
 	message := &Message{
 		Src:  "plumb",
 		Dst:  "edit",
@@ -71,13 +71,9 @@ func TestQuoting(t *testing.T) {
 
 func TestMultipleAttributes(t *testing.T) {
 	// Make up a list of attributes from the quoting tests.
-	var attr *Attribute
+	var attr Attrs
 	for i, test := range quoteTests {
-		attr = &Attribute{
-			Name:  fmt.Sprintf("attr%d", i),
-			Value: test.unquoted,
-			Next:  attr,
-		}
+		attr.Add(fmt.Sprintf("attr%d", i), test.unquoted)
 	}
 	message := &Message{
 		Src:  "plumb",
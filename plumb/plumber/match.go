@@ -0,0 +1,269 @@
+package plumber
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"bwsd.dev/plan9/plumb"
+)
+
+// A Match describes what to do with a message, according to the first rule
+// set that matched it.
+type Match struct {
+	Msg    *plumb.Message // the message, as rewritten by the rule set
+	Set    *Ruleset       // the rule set that matched
+	Port   string         // the port to deliver to, if any
+	Client []string       // command to start if no one has the port open
+	Start  []string       // command to start instead of delivering
+}
+
+// Match returns how the first rule set that matches m would deliver it,
+// or nil if none does. If m has a destination, only rule sets sending to
+// that port are considered. Match does not change m.
+func (rs *Rules) Match(m *plumb.Message) *Match {
+	for _, s := range rs.Sets {
+		if m.Dst != "" && s.Port != m.Dst {
+			continue
+		}
+		if mt := s.match(m); mt != nil {
+			return mt
+		}
+	}
+	return nil
+}
+
+func (s *Ruleset) match(m *plumb.Message) *Match {
+	e := newMatcher(m)
+	for _, r := range s.Pats {
+		if !e.pattern(r) {
+			return nil
+		}
+	}
+	mt := &Match{Msg: &e.msg, Set: s, Port: s.Port}
+	for _, a := range s.Acts {
+		switch a.Verb {
+		case "client":
+			mt.Client = e.argv(a)
+		case "start":
+			mt.Start = e.argv(a)
+		}
+	}
+	if s.Port != "" {
+		e.msg.Dst = s.Port
+	}
+	return mt
+}
+
+// A matcher holds the state of matching a message against a rule set.
+type matcher struct {
+	msg   plumb.Message // working copy of the message
+	match [10]string    // $0 to $9
+	file  string        // $file
+	dir   string        // $dir
+}
+
+func newMatcher(m *plumb.Message) *matcher {
+	return &matcher{msg: *m}
+}
+
+// pattern applies the pattern r, reporting whether it matched.
+// Rules that rewrite the message always match.
+func (e *matcher) pattern(r *Rule) bool {
+	switch r.Verb {
+	case "is":
+		return e.value(r) == e.expand(joinWords(r.args))
+	case "isfile", "isdir":
+		return e.isfile(r)
+	case "matches":
+		return e.matches(r)
+	case "set":
+		v := e.expand(joinWords(r.args))
+		switch r.Obj {
+		case "src":
+			e.msg.Src = v
+		case "dst":
+			e.msg.Dst = v
+		case "wdir":
+			e.msg.Dir = v
+		case "type":
+			e.msg.Type = v
+		case "data":
+			e.msg.Data = []byte(v)
+		}
+	case "add":
+		for _, w := range r.args {
+			name, value, _ := strings.Cut(e.expand(w), "=")
+			e.msg.Attr.Set(name, value)
+		}
+	case "delete":
+		for _, w := range r.args {
+			e.msg.Attr.Delete(e.expand(w))
+		}
+	}
+	return true
+}
+
+// value returns the text of the object of r.
+func (e *matcher) value(r *Rule) string {
+	switch r.Obj {
+	case "src":
+		return e.msg.Src
+	case "dst":
+		return e.msg.Dst
+	case "wdir":
+		return e.msg.Dir
+	case "type":
+		return e.msg.Type
+	case "attr":
+		return e.msg.Attr.String()
+	case "data":
+		return string(e.msg.Data)
+	case "arg":
+		return e.expand(joinWords(r.args))
+	}
+	return ""
+}
+
+// isfile checks that the object of r names a plain file or a directory,
+// recording its name in $file or $dir. Relative names are taken to be in
+// the message's working directory.
+func (e *matcher) isfile(r *Rule) bool {
+	name := e.value(r)
+	if name == "" {
+		return false
+	}
+	if !filepath.IsAbs(name) && e.msg.Dir != "" {
+		name = filepath.Join(e.msg.Dir, name)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	if r.Verb == "isdir" {
+		if !fi.IsDir() {
+			return false
+		}
+		e.dir = name
+		return true
+	}
+	if fi.IsDir() {
+		return false
+	}
+	e.file = name
+	return true
+}
+
+// matches matches the object of r against the regular expression.
+// The whole text must match, unless the object is data and the message
+// has a click attribute: then the match need only contain the character
+// at the click offset, and it replaces the data.
+func (e *matcher) matches(r *Rule) bool {
+	re := r.re
+	if re == nil {
+		var err error
+		if re, err = compile(e.expand(joinWords(r.args))); err != nil {
+			return false
+		}
+	}
+	text := e.value(r)
+	if r.Obj == "data" {
+		if click, ok := e.msg.Click(); ok {
+			return e.clickmatch(re, text, click)
+		}
+	}
+	loc := re.FindStringSubmatchIndex(text)
+	if loc == nil || loc[0] != 0 || loc[1] != len(text) {
+		return false
+	}
+	e.setmatch(text, loc)
+	return true
+}
+
+func (e *matcher) clickmatch(re *regexp.Regexp, text string, click int) bool {
+	// The click offset counts characters.
+	clickp := 0
+	for i := 0; i < click && clickp < len(text); i++ {
+		_, w := utf8.DecodeRuneInString(text[clickp:])
+		clickp += w
+	}
+	for s := 0; s <= clickp; s++ {
+		if s < len(text) && !utf8.RuneStart(text[s]) {
+			continue
+		}
+		loc := re.FindStringSubmatchIndex(text[s:])
+		if loc == nil || s+loc[0] > clickp {
+			break
+		}
+		if clickp <= s+loc[1] {
+			for i := range loc {
+				if loc[i] >= 0 {
+					loc[i] += s
+				}
+			}
+			e.setmatch(text, loc)
+			e.msg.Data = []byte(e.match[0])
+			e.msg.Attr.Delete("click")
+			return true
+		}
+	}
+	return false
+}
+
+func (e *matcher) setmatch(text string, loc []int) {
+	for i := range e.match {
+		e.match[i] = ""
+		if 2*i+1 < len(loc) && loc[2*i] >= 0 {
+			e.match[i] = text[loc[2*i]:loc[2*i+1]]
+		}
+	}
+}
+
+// argv expands the arguments of a plumb client or plumb start action.
+func (e *matcher) argv(r *Rule) []string {
+	var argv []string
+	for _, w := range r.args {
+		argv = append(argv, e.expand(w))
+	}
+	return argv
+}
+
+// expand expands the variables left in w.
+func (e *matcher) expand(w word) string {
+	var b strings.Builder
+	for _, s := range w {
+		if s.quoted {
+			b.WriteString(s.text)
+			continue
+		}
+		t := s.text
+		for {
+			i, name, ok := nextVar(t)
+			if !ok {
+				break
+			}
+			b.WriteString(t[:i])
+			b.WriteString(e.lookup(name))
+			t = t[i+1+len(name):]
+		}
+		b.WriteString(t)
+	}
+	return b.String()
+}
+
+func (e *matcher) lookup(name string) string {
+	if isDigit(name[0]) {
+		return e.match[name[0]-'0']
+	}
+	switch name {
+	case "file":
+		return e.file
+	case "dir":
+		return e.dir
+	case "src", "dst", "wdir", "type", "attr", "data":
+		return e.value(&Rule{Obj: name})
+	}
+	return ""
+}
@@ -0,0 +1,419 @@
+// Package plumber implements the plumber, which routes messages between
+// programs according to a set of rules.
+//
+// A Plumber serves a file system like that of plumber(4):
+//
+//	rules	the rules, in the language of plumb(7)
+//	send	messages written here are routed by the rules
+//	port	one file for each port named by a plumb to rule
+//
+// Reading the rules file returns the text of the rules. Writing it adds
+// rules, as each rule set is completed by a blank line and when the file is
+// closed; opening it with OTRUNC first discards the old rules. Each reader
+// of a port file receives a copy of each message delivered to the port.
+// Messages are read and written in the form used by plumb.Message's Send
+// and Recv methods.
+package plumber
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/plumb"
+	"bwsd.dev/plan9/srv"
+)
+
+// ErrNoMatch is returned by Send for a message that no rule set matches.
+var ErrNoMatch = errors.New("no matching plumb rule")
+
+// A Plumber routes messages using Rules.
+type Plumber struct {
+	// Exec runs the command of a plumb start or plumb client action.
+	// If Exec is nil, the command is started with os/exec and left to
+	// run on its own.
+	Exec func(argv []string) error
+
+	user string
+	fs   *fsys
+
+	mu    sync.Mutex
+	rules *Rules
+	ports map[string]*port
+}
+
+// A port holds the readers of a port file.
+type port struct {
+	readers []*reader
+	held    [][]byte // messages waiting for a client to open the port
+}
+
+// A reader is an open port file.
+type reader struct {
+	port *port
+	msgs [][]byte   // encoded messages not yet read; the first may be partly read
+	reqs []*srv.Req // reads waiting for a message
+}
+
+// New returns a Plumber routing messages by rules, whose files are owned
+// by user. If rules is nil, the Plumber starts with no rules.
+func New(user string, rules *Rules) *Plumber {
+	p := &Plumber{user: user, ports: make(map[string]*port)}
+	tree := srv.NewTree(user, user, 0o555)
+	tree.Root.Create("rules", user, 0o600, &rulesFile{p})
+	tree.Root.Create("send", user, 0o222, &sendFile{p})
+	p.fs = &fsys{Tree: tree, p: p}
+	if rules == nil {
+		rules = &Rules{}
+	}
+	p.SetRules(rules)
+	return p
+}
+
+// Rules returns the rules in use.
+func (p *Plumber) Rules() *Rules {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rules
+}
+
+// SetRules replaces the rules, creating a port file for each port they
+// name. Port files are never removed.
+func (p *Plumber) SetRules(rules *Rules) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+	for _, name := range rules.Ports() {
+		if p.ports[name] != nil {
+			continue
+		}
+		pt := new(port)
+		if _, err := p.fs.Root.Create(name, p.user, 0o444, &portFile{p, pt}); err != nil {
+			continue // a port called rules or send
+		}
+		p.ports[name] = pt
+	}
+}
+
+// addRules parses src and adds the rules in it to those in use.
+func (p *Plumber) addRules(line int, src []byte) error {
+	p.mu.Lock()
+	rules := p.rules.clone()
+	p.mu.Unlock()
+	if err := rules.parse("rules", line, src); err != nil {
+		return err
+	}
+	p.SetRules(rules)
+	return nil
+}
+
+// Send routes m according to the rules. A message that no rule set
+// matches is delivered unchanged if it has a destination port that
+// exists; otherwise Send returns ErrNoMatch.
+func (p *Plumber) Send(m *plumb.Message) error {
+	mt := p.Rules().Match(m)
+	if mt == nil {
+		if m.Dst != "" && p.deliver(m.Dst, m) {
+			return nil
+		}
+		return ErrNoMatch
+	}
+	if mt.Port != "" {
+		if p.deliver(mt.Port, mt.Msg) {
+			return nil
+		}
+		if mt.Client != nil {
+			p.hold(mt.Port, mt.Msg)
+			return p.exec(mt.Client)
+		}
+		if mt.Start == nil {
+			return fmt.Errorf("no one is listening on port %s", mt.Port)
+		}
+	}
+	return p.exec(mt.Start)
+}
+
+// deliver sends m to the readers of the named port, reporting whether
+// there were any.
+func (p *Plumber) deliver(name string, m *plumb.Message) bool {
+	b := encode(m)
+	p.mu.Lock()
+	pt := p.ports[name]
+	if pt == nil || len(pt.readers) == 0 {
+		p.mu.Unlock()
+		return false
+	}
+	var ready []*srv.Req
+	for _, rd := range pt.readers {
+		rd.msgs = append(rd.msgs, b)
+		ready = append(ready, rd.serve()...)
+	}
+	p.mu.Unlock()
+	respond(ready)
+	return true
+}
+
+// hold keeps m for the next reader of the named port,
+// usually a client started by a plumb client action.
+func (p *Plumber) hold(name string, m *plumb.Message) {
+	b := encode(m)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pt := p.ports[name]; pt != nil {
+		pt.held = append(pt.held, b)
+	}
+}
+
+func encode(m *plumb.Message) []byte {
+	var buf bytes.Buffer
+	m.Send(&buf)
+	return buf.Bytes()
+}
+
+func (p *Plumber) exec(argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("empty command")
+	}
+	if p.Exec != nil {
+		return p.Exec(argv)
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// serve answers the waiting reads that can be answered from rd.msgs,
+// returning them to be responded to once p.mu is released.
+// It is called with p.mu held.
+func (rd *reader) serve() []*srv.Req {
+	var ready []*srv.Req
+	for len(rd.reqs) > 0 && len(rd.msgs) > 0 {
+		r := rd.reqs[0]
+		rd.reqs = rd.reqs[1:]
+		b := rd.msgs[0]
+		n := len(b)
+		if n > int(r.Ifcall.Count) {
+			n = int(r.Ifcall.Count)
+		}
+		r.Ofcall.Data = b[:n]
+		if rd.msgs[0] = b[n:]; len(rd.msgs[0]) == 0 {
+			rd.msgs = rd.msgs[1:]
+		}
+		ready = append(ready, r)
+	}
+	return ready
+}
+
+func respond(reqs []*srv.Req) {
+	for _, r := range reqs {
+		r.Respond(nil)
+	}
+}
+
+// ServeConn serves the plumber's files on rwc, which it closes on return.
+// ServeConn returns nil when the client hangs up.
+func (p *Plumber) ServeConn(rwc io.ReadWriteCloser) error {
+	return srv.Serve(rwc, p.fs)
+}
+
+// Serve accepts client connections on l and serves each in its own
+// goroutine. It returns when l fails.
+func (p *Plumber) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.ServeConn(c)
+	}
+}
+
+// fsys is the srv.Handler for a Plumber's files. It adds to the Tree's
+// handling what it needs to track open port and rules files.
+type fsys struct {
+	*srv.Tree
+	p *Plumber
+}
+
+func (fs *fsys) Open(r *srv.Req) {
+	p := fs.p
+	switch h := r.Fid.File.Handler.(type) {
+	case *portFile:
+		if r.Ifcall.Mode&(3|plan9.OTRUNC) == plan9.OREAD {
+			rd := &reader{port: h.port}
+			p.mu.Lock()
+			h.port.readers = append(h.port.readers, rd)
+			rd.msgs, h.port.held = h.port.held, nil
+			p.mu.Unlock()
+			r.Fid.Aux = rd
+		}
+	case *rulesFile:
+		fs.Tree.Open(r)
+		if r.Fid.Omode >= 0 && r.Ifcall.Mode&plan9.OTRUNC != 0 {
+			p.SetRules(&Rules{})
+		}
+		return
+	}
+	fs.Tree.Open(r)
+}
+
+// Flush aborts a read waiting on a port.
+func (fs *fsys) Flush(r *srv.Req) {
+	old := r.Oldreq
+	found := false
+	if old != nil && old.Fid != nil {
+		if rd, ok := old.Fid.Aux.(*reader); ok {
+			fs.p.mu.Lock()
+			for i, q := range rd.reqs {
+				if q == old {
+					rd.reqs = append(rd.reqs[:i], rd.reqs[i+1:]...)
+					found = true
+					break
+				}
+			}
+			fs.p.mu.Unlock()
+		}
+	}
+	if found {
+		old.Respond(srv.Error("interrupted"))
+	}
+	r.Respond(nil)
+}
+
+// Clunk adds any rules left over from writes to the rules file,
+// reporting errors in them.
+func (fs *fsys) Clunk(r *srv.Req) {
+	var err error
+	if w, ok := r.Fid.Aux.(*rulesWriter); ok && len(w.buf) > 0 {
+		err = fs.p.addRules(w.line, w.buf)
+		w.buf = nil
+	}
+	r.Respond(err)
+}
+
+// DestroyFid closes a port file.
+func (fs *fsys) DestroyFid(f *srv.Fid) {
+	rd, ok := f.Aux.(*reader)
+	if !ok {
+		return
+	}
+	p := fs.p
+	p.mu.Lock()
+	pt := rd.port
+	for i, x := range pt.readers {
+		if x == rd {
+			pt.readers = append(pt.readers[:i], pt.readers[i+1:]...)
+			break
+		}
+	}
+	reqs := rd.reqs
+	rd.reqs = nil
+	p.mu.Unlock()
+	for _, r := range reqs {
+		r.Respond(srv.Error("port closed"))
+	}
+}
+
+// portFile serves a port file.
+type portFile struct {
+	p    *Plumber
+	port *port
+}
+
+func (f *portFile) Read(r *srv.Req) {
+	rd := r.Fid.Aux.(*reader)
+	f.p.mu.Lock()
+	rd.reqs = append(rd.reqs, r)
+	ready := rd.serve()
+	f.p.mu.Unlock()
+	respond(ready)
+}
+
+func (f *portFile) Write(r *srv.Req) {
+	r.Respond(srv.ErrPerm)
+}
+
+// sendFile serves the send file. A message may take several writes;
+// the fid's Aux holds the part received so far.
+type sendFile struct {
+	p *Plumber
+}
+
+func (f *sendFile) Read(r *srv.Req) {
+	r.Respond(srv.ErrPerm)
+}
+
+func (f *sendFile) Write(r *srv.Req) {
+	buf, _ := r.Fid.Aux.([]byte)
+	buf = append(buf, r.Ifcall.Data...)
+	var err error
+	for len(buf) > 0 {
+		m := new(plumb.Message)
+		br := bytes.NewReader(buf)
+		if rerr := m.Recv(br); rerr != nil {
+			if !errors.Is(rerr, io.ErrUnexpectedEOF) {
+				err = fmt.Errorf("bad message: %w", rerr)
+				buf = nil
+			}
+			break // otherwise wait for the rest
+		}
+		buf = buf[len(buf)-br.Len():]
+		if serr := f.p.Send(m); serr != nil {
+			err = serr
+		}
+	}
+	r.Fid.Aux = buf
+	if err != nil {
+		r.Respond(err)
+		return
+	}
+	r.Ofcall.Count = uint32(len(r.Ifcall.Data))
+	r.Respond(nil)
+}
+
+// rulesFile serves the rules file.
+type rulesFile struct {
+	p *Plumber
+}
+
+// A rulesWriter holds the text written to the rules file but not yet parsed.
+type rulesWriter struct {
+	buf  []byte
+	line int // lines parsed before buf
+}
+
+func (f *rulesFile) Read(r *srv.Req) {
+	srv.ReadString(r, f.p.Rules().String())
+	r.Respond(nil)
+}
+
+func (f *rulesFile) Write(r *srv.Req) {
+	w, _ := r.Fid.Aux.(*rulesWriter)
+	if w == nil {
+		w = new(rulesWriter)
+		r.Fid.Aux = w
+	}
+	w.buf = append(w.buf, r.Ifcall.Data...)
+	// Parse the complete rule sets, leaving the rest for later.
+	if i := bytes.LastIndex(w.buf, []byte("\n\n")); i >= 0 {
+		src := w.buf[:i+2]
+		w.buf = append([]byte(nil), w.buf[i+2:]...)
+		line := w.line
+		w.line += bytes.Count(src, []byte("\n"))
+		if err := f.p.addRules(line, src); err != nil {
+			w.buf = nil
+			r.Respond(err)
+			return
+		}
+	}
+	r.Ofcall.Count = uint32(len(r.Ifcall.Data))
+	r.Respond(nil)
+}
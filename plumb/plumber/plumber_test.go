@@ -0,0 +1,381 @@
+package plumber
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/plumb"
+)
+
+const testRules = `# a comment
+addrelem='((#?[0-9]+)|(/[A-Za-z0-9_\^]+/?)|[.$])'
+addr=:($addrelem([,;+\-]$addrelem)*)
+
+# existing files, possibly tagged by line number, go to the editor
+type is text
+data matches '([.a-zA-Z0-9_/\-]+)('$addr')?'
+arg isfile	$1
+data set	$file
+attr add	addr=$3
+plumb to edit
+plumb client acme
+
+# urls go to the browser
+type is text
+data matches 'https?://[a-zA-Z0-9_@\-]+([.:][a-zA-Z0-9_@\-]+)*/?[a-zA-Z0-9_?,%#~&/\-+=]*'
+plumb to web
+plumb start browser $0
+
+# man pages
+type is text
+data matches '([a-z]+)\(([1-8])\)'
+plumb start rc -c 'man '$2' '$1' | plumb -i -d edit -a ''action=showdata'''
+`
+
+func parse(t *testing.T, src string) *Rules {
+	t.Helper()
+	rules, err := Parse("test", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParse(t *testing.T) {
+	rules := parse(t, testRules)
+	if len(rules.Sets) != 3 {
+		t.Fatalf("got %d rule sets, want 3", len(rules.Sets))
+	}
+	if got, want := rules.Ports(), []string{"edit", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ports() = %v, want %v", got, want)
+	}
+	s := rules.Sets[0]
+	if s.Line != 6 || len(s.Pats) != 5 || len(s.Acts) != 2 || s.Port != "edit" {
+		t.Errorf("first rule set: line %d, %d patterns, %d actions, port %q", s.Line, len(s.Pats), len(s.Acts), s.Port)
+	}
+	if r := s.Pats[2]; r.Obj != "arg" || r.Verb != "isfile" || r.Arg != "$1" {
+		t.Errorf("third pattern = %s %s %s", r.Obj, r.Verb, r.Arg)
+	}
+	if rules.String() != testRules {
+		t.Errorf("String() does not return the source")
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "basic"), []byte("type is text\nplumb to edit\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "plumbing")
+	if err := os.WriteFile(main, []byte("include basic\n\ntype is image\nplumb to image\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseFile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rules.Ports(), []string{"edit", "image"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ports() = %v, want %v", got, want)
+	}
+	if f := rules.Sets[0].File; f != filepath.Join(dir, "basic") {
+		t.Errorf("included rule set read from %q", f)
+	}
+}
+
+// basicRules begins, like $PLAN9/plumb/basic, by declaring ports.
+const basicRules = `# declarations of ports without rules
+plumb to seemail
+plumb to showmail
+
+# go source goes to the editor
+type is text
+data matches '[a-zA-Z0-9_./\-]+\.go'
+plumb to edit
+`
+
+func TestParseDecls(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "basic")
+	if err := os.WriteFile(name, []byte(basicRules), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Sets) != 1 {
+		t.Fatalf("got %d rule sets, want 1", len(rules.Sets))
+	}
+	if got, want := rules.Ports(), []string{"seemail", "showmail", "edit"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ports() = %v, want %v", got, want)
+	}
+	m := &plumb.Message{Type: "text", Data: []byte("x.go")}
+	if mt := rules.Match(m); mt == nil || mt.Port != "edit" {
+		t.Errorf("Match(%s) = %+v, want port edit", m.Data, mt)
+	}
+	m = &plumb.Message{Type: "text", Data: []byte("x.c")}
+	if mt := rules.Match(m); mt != nil {
+		t.Errorf("%s matched rule set at line %d", m.Data, mt.Set.Line)
+	}
+}
+
+var parseErrorTests = []struct {
+	src string
+	err string
+}{
+	{"type is text\n", "test:1: rule set has no action"},
+	{"type is text\nplumb client acme\n", "test:1: rule set has no plumb to or plumb start"},
+	{"\n\ntype was text\nplumb to edit\n", "test:3: unknown verb \"was\" for type"},
+	{"colour is red\nplumb to edit\n", "test:1: unknown object \"colour\""},
+	{"data matches 'abc\nplumb to edit\n", "test:1: unterminated quote"},
+	{"data matches '(abc'\nplumb to edit\n", "test:1: bad regexp"},
+	{"type is text\nplumb to edit\nplumb to web\n", "test:3: rule set has more than one plumb to"},
+	{"plumb to edit\ntype is text\n", "test:2: pattern after action"},
+	{"plumb to edit\nplumb to web\nplumb start web\n", "test:3: rule set has more than one plumb to"},
+	{"attr add addr\nplumb to edit\n", "test:1: attr add: \"addr\" is not name=value"},
+	{"type is\nplumb to edit\n", "test:1: type is: missing argument"},
+	{"include\n", "test:1: usage: include file"},
+	{"include /nonexistent/rules\n", "test:1: cannot find include file"},
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range parseErrorTests {
+		_, err := Parse("test", []byte(tt.src))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) = %v, want %s", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	rules := parse(t, testRules)
+
+	m := &plumb.Message{Src: "acme", Dir: dir, Type: "text", Data: []byte("a.go:12")}
+	mt := rules.Match(m)
+	if mt == nil {
+		t.Fatalf("no match for %s", m.Data)
+	}
+	want := &plumb.Message{
+		Src:  "acme",
+		Dst:  "edit",
+		Dir:  dir,
+		Type: "text",
+		Attr: plumb.Attrs{{Name: "addr", Value: "12"}},
+		Data: []byte(filepath.Join(dir, "a.go")),
+	}
+	if !reflect.DeepEqual(mt.Msg, want) {
+		t.Errorf("rewritten message:\n%+v\nwant\n%+v", mt.Msg, want)
+	}
+	if mt.Port != "edit" || !reflect.DeepEqual(mt.Client, []string{"acme"}) || mt.Start != nil {
+		t.Errorf("match: port %q, client %q, start %q", mt.Port, mt.Client, mt.Start)
+	}
+	if string(m.Data) != "a.go:12" || m.Attr != nil {
+		t.Errorf("Match changed its argument")
+	}
+
+	// A click selects the text around it.
+	m = &plumb.Message{Dir: dir, Type: "text",
+		Attr: plumb.Attrs{{Name: "click", Value: "5"}},
+		Data: []byte("see https://9p.io/plan9 for details")}
+	mt = rules.Match(m)
+	if mt == nil || mt.Port != "web" || string(mt.Msg.Data) != "https://9p.io/plan9" || mt.Msg.Attr != nil {
+		t.Fatalf("click match = %+v", mt)
+	}
+	if want := []string{"browser", "https://9p.io/plan9"}; !reflect.DeepEqual(mt.Start, want) {
+		t.Errorf("start = %q, want %q", mt.Start, want)
+	}
+
+	m = &plumb.Message{Type: "text", Data: []byte("ls(1)")}
+	mt = rules.Match(m)
+	if mt == nil {
+		t.Fatalf("no match for %s", m.Data)
+	}
+	if want := []string{"rc", "-c", "man 1 ls | plumb -i -d edit -a 'action=showdata'"}; !reflect.DeepEqual(mt.Start, want) {
+		t.Errorf("start = %q, want %q", mt.Start, want)
+	}
+
+	for _, data := range []string{"b.go", "x a.go"} {
+		m = &plumb.Message{Dir: dir, Type: "text", Data: []byte(data)}
+		if mt := rules.Match(m); mt != nil {
+			t.Errorf("%q matched rule set at line %d", data, mt.Set.Line)
+		}
+	}
+	m = &plumb.Message{Dst: "web", Dir: dir, Type: "text", Data: []byte("a.go")}
+	if mt := rules.Match(m); mt != nil {
+		t.Errorf("message for web matched rule set at line %d", mt.Set.Line)
+	}
+}
+
+func mount(t *testing.T, p *Plumber) *client.Fsys {
+	c1, c2 := net.Pipe()
+	go p.ServeConn(c1)
+	conn, err := client.NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func send(t *testing.T, fsys *client.Fsys, m *plumb.Message) error {
+	t.Helper()
+	fid, err := fsys.Open("send", plan9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+	return m.Send(fid)
+}
+
+func TestPlumber(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	p := New("glenda", parse(t, testRules))
+	var started [][]string
+	p.Exec = func(argv []string) error {
+		started = append(started, argv)
+		return nil
+	}
+	fsys := mount(t, p)
+
+	// With no one reading edit, the message is held for the client.
+	m := &plumb.Message{Src: "acme", Dir: dir, Type: "text", Data: []byte("a.go:/main/")}
+	if err := send(t, fsys, m); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"acme"}}; !reflect.DeepEqual(started, want) {
+		t.Errorf("started %q, want %q", started, want)
+	}
+
+	edit, err := fsys.Open("edit", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edit.Close()
+	b := bufio.NewReader(edit)
+	for _, addr := range []string{"/main/", "7"} {
+		if addr == "7" {
+			m.Data = []byte("a.go:7")
+			if err := send(t, fsys, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := new(plumb.Message)
+		if err := got.Recv(b); err != nil {
+			t.Fatal(err)
+		}
+		if got.Dst != "edit" || string(got.Data) != filepath.Join(dir, "a.go") || got.Addr() != addr {
+			t.Errorf("received %+v", got)
+		}
+	}
+
+	err = send(t, fsys, &plumb.Message{Type: "text", Data: []byte("nothing to see")})
+	if err == nil || !strings.Contains(err.Error(), ErrNoMatch.Error()) {
+		t.Errorf("sending unmatched message: %v", err)
+	}
+	err = send(t, fsys, &plumb.Message{Type: "text", Data: []byte("https://9p.io/")})
+	if err != nil {
+		t.Errorf("sending to web: %v", err)
+	}
+	if want := []string{"browser", "https://9p.io/"}; len(started) != 2 || !reflect.DeepEqual(started[1], want) {
+		t.Errorf("started %q, want %q", started, want)
+	}
+}
+
+func TestRulesFile(t *testing.T) {
+	p := New("glenda", nil)
+	fsys := mount(t, p)
+
+	fid, err := fsys.Open("rules", plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second rule set is completed by the close.
+	text := "type is text\nplumb to one\n\ntype is image\nplumb to two\n"
+	for _, s := range strings.SplitAfter(text, "to") {
+		if _, err := fid.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := p.Rules().Ports(); !reflect.DeepEqual(got, []string{"one"}) {
+		t.Errorf("ports before close = %v", got)
+	}
+	if err := fid.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Rules().Ports(); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("ports after close = %v", got)
+	}
+
+	fid, err = fsys.Open("rules", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1000)
+	n, _ := fid.Read(buf)
+	if string(buf[:n]) != text {
+		t.Errorf("read rules %q, want %q", buf[:n], text)
+	}
+	fid.Close()
+	if _, err := fsys.Stat("two"); err != nil {
+		t.Errorf("no port file for new port: %v", err)
+	}
+
+	// Errors are reported by the write or close that completes the rule set.
+	fid, err = fsys.Open("rules", plan9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fid.Write([]byte("\n\ntype is text\n\n")); err == nil || err.Error() != "rules:3: rule set has no action" {
+		t.Errorf("write bad rules: %v", err)
+	}
+	if _, err := fid.Write([]byte("type is text\nplumb to\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fid.Close(); err == nil || err.Error() != "rules:6: plumb to: missing argument" {
+		t.Errorf("close after bad rules: %v", err)
+	}
+	if got := p.Rules().Ports(); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("ports after bad rules = %v", got)
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	p := New("glenda", parse(t, testRules))
+	p.Exec = func(argv []string) error { return nil }
+	fsys := mount(t, p)
+	fid, err := fsys.Open("send", plan9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+
+	// A truncated message waits for the rest; a malformed one fails at
+	// once and is discarded.
+	if _, err := fid.Write([]byte("acme\nweb\n/tmp\ntext\n")); err != nil {
+		t.Fatalf("writing first part: %v", err)
+	}
+	if _, err := fid.Write([]byte("\nfour\n")); err == nil || !strings.Contains(err.Error(), plumb.ErrCount.Error()) {
+		t.Errorf("writing bad count: %v", err)
+	}
+	m := &plumb.Message{Type: "text", Data: []byte("https://9p.io/")}
+	if err := m.Send(fid); err != nil {
+		t.Errorf("sending after bad message: %v", err)
+	}
+}
@@ -0,0 +1,552 @@
+package plumber
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Rules is a parsed set of plumbing rules, in the language of plumb(7).
+//
+// A rules file is a sequence of rule sets separated by blank lines. Each
+// rule set is a list of patterns, such as
+//
+//	type is text
+//	data matches '([a-z]+)\.go'
+//	arg isfile $1
+//
+// which must all succeed for the rule set to apply, followed by actions:
+//
+//	plumb to edit
+//	plumb start rc -c 'go doc '$1
+//
+// Lines of the form name=value set variables, which are expanded as $name
+// outside single quotes when the rules are read. The variables $0 to $9,
+// $file, $dir, $src, $dst, $wdir, $type, $attr and $data are instead
+// expanded as each message is matched. Lines of the form include file read
+// another rules file, which is looked for in the directory of the including
+// file and then in $PLAN9/plumb.
+//
+// A rule set made only of plumb to lines, as at the top of
+// $PLAN9/plumb/basic, declares ports without routing anything to them.
+type Rules struct {
+	Sets []*Ruleset
+
+	decls []string          // ports declared by plumb to lines alone
+	vars  map[string]string // variables set so far
+	text  []byte            // the source, less included files
+}
+
+// A Ruleset is a list of patterns and the actions taken if they all match.
+type Ruleset struct {
+	Pats []*Rule // patterns, in order
+	Acts []*Rule // actions: plumb to, plumb client and plumb start
+	Port string  // destination port, from plumb to
+	File string  // where the rule set was read
+	Line int
+}
+
+// A Rule is a single line of a Ruleset: an object, a verb and arguments.
+type Rule struct {
+	Obj  string // src, dst, wdir, type, attr, data, arg or plumb
+	Verb string // is, isdir, isfile, matches, set, add, delete, to, client or start
+	Arg  string // the arguments as written
+	Line int
+
+	args []word         // Arg, with variables other than the runtime ones expanded
+	re   *regexp.Regexp // for matches, if args are constant
+}
+
+// A SyntaxError reports a malformed rules file.
+type SyntaxError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// verbs lists the verbs allowed with each object.
+var verbs = map[string][]string{
+	"src":   {"is", "isdir", "isfile", "matches", "set"},
+	"dst":   {"is", "isdir", "isfile", "matches", "set"},
+	"wdir":  {"is", "isdir", "isfile", "matches", "set"},
+	"type":  {"is", "isdir", "isfile", "matches", "set"},
+	"data":  {"is", "isdir", "isfile", "matches", "set"},
+	"attr":  {"is", "matches", "add", "delete"},
+	"arg":   {"isdir", "isfile"},
+	"plumb": {"to", "client", "start"},
+}
+
+// runtimeVars are the variables expanded as messages are matched.
+var runtimeVars = map[string]bool{
+	"file": true, "dir": true,
+	"src": true, "dst": true, "wdir": true, "type": true, "attr": true, "data": true,
+}
+
+const maxInclude = 10 // depth of nested includes
+
+// Parse parses the rules in src, which was read from the named file.
+func Parse(name string, src []byte) (*Rules, error) {
+	rs := &Rules{vars: make(map[string]string)}
+	if err := rs.parse(name, 0, src); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// ParseFile reads and parses the named rules file.
+func ParseFile(name string) (*Rules, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(name, src)
+}
+
+// String returns the text from which the rules were parsed.
+func (rs *Rules) String() string {
+	return string(rs.text)
+}
+
+// Ports returns the names of the declared ports, followed by those of
+// the other ports named in plumb to actions, in the order they first
+// appear.
+func (rs *Rules) Ports() []string {
+	var ports []string
+	seen := make(map[string]bool)
+	for _, name := range rs.decls {
+		if !seen[name] {
+			seen[name] = true
+			ports = append(ports, name)
+		}
+	}
+	for _, s := range rs.Sets {
+		if s.Port != "" && !seen[s.Port] {
+			seen[s.Port] = true
+			ports = append(ports, s.Port)
+		}
+	}
+	return ports
+}
+
+// clone returns a copy of rs that can be extended without changing rs.
+func (rs *Rules) clone() *Rules {
+	n := &Rules{
+		Sets:  append([]*Ruleset(nil), rs.Sets...),
+		decls: append([]string(nil), rs.decls...),
+		vars:  make(map[string]string, len(rs.vars)),
+		text:  append([]byte(nil), rs.text...),
+	}
+	for k, v := range rs.vars {
+		n.vars[k] = v
+	}
+	return n
+}
+
+// parse adds the rules in src to rs. The text follows the given number of
+// lines already read from the named file.
+func (rs *Rules) parse(name string, line int, src []byte) error {
+	p := &parser{rules: rs, file: name, line: line}
+	if err := p.parse(src); err != nil {
+		return err
+	}
+	rs.text = append(rs.text, src...)
+	return nil
+}
+
+type parser struct {
+	rules *Rules
+	file  string
+	line  int
+	depth int
+	set   *Ruleset // rule set being read
+}
+
+func (p *parser) errorf(format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{File: p.file, Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+var assignment = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z_0-9]*)=`)
+
+func (p *parser) parse(src []byte) error {
+	for _, line := range strings.Split(string(src), "\n") {
+		p.line++
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if err := p.endSet(); err != nil {
+				return err
+			}
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+		if m := assignment.FindStringSubmatch(line); m != nil {
+			words, err := p.words(line[len(m[0]):])
+			if err != nil {
+				return err
+			}
+			var vals []string
+			for _, w := range words {
+				vals = append(vals, w.literal())
+			}
+			p.rules.vars[m[1]] = strings.Join(vals, " ")
+			continue
+		}
+		words, err := p.words(line)
+		if err != nil {
+			return err
+		}
+		if len(words) == 0 {
+			continue // a comment
+		}
+		if words[0].literal() == "include" {
+			if err := p.include(words[1:]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.rule(line, words); err != nil {
+			return err
+		}
+	}
+	return p.endSet()
+}
+
+func (p *parser) include(args []word) error {
+	if p.set != nil {
+		return p.errorf("include inside rule set")
+	}
+	if len(args) != 1 {
+		return p.errorf("usage: include file")
+	}
+	name := args[0].literal()
+	if p.depth >= maxInclude {
+		return p.errorf("include %s: too deeply nested", name)
+	}
+	var try []string
+	if filepath.IsAbs(name) {
+		try = []string{name}
+	} else {
+		try = []string{filepath.Join(filepath.Dir(p.file), name), filepath.Join(plan9Root(), "plumb", name)}
+	}
+	for _, file := range try {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		inc := &parser{rules: p.rules, file: file, depth: p.depth + 1}
+		return inc.parse(src)
+	}
+	return p.errorf("cannot find include file %s", name)
+}
+
+func plan9Root() string {
+	if root := os.Getenv("PLAN9"); root != "" {
+		return root
+	}
+	return "/usr/local/plan9"
+}
+
+// rule adds the rule on the given line to the current rule set.
+func (p *parser) rule(line string, words []word) error {
+	if len(words) < 2 {
+		return p.errorf("malformed rule %q", line)
+	}
+	obj, verb := words[0].literal(), words[1].literal()
+	vs, ok := verbs[obj]
+	if !ok {
+		return p.errorf("unknown object %q", obj)
+	}
+	if !contains(vs, verb) {
+		return p.errorf("unknown verb %q for %s", verb, obj)
+	}
+	arg := strings.TrimSpace(strings.TrimPrefix(line, obj))
+	arg = strings.TrimSpace(strings.TrimPrefix(arg, verb))
+	r := &Rule{Obj: obj, Verb: verb, Arg: arg, Line: p.line, args: words[2:]}
+	if len(r.args) == 0 && (obj == "arg" || verb != "isfile" && verb != "isdir") {
+		return p.errorf("%s %s: missing argument", obj, verb)
+	}
+	if p.set == nil {
+		p.set = &Ruleset{File: p.file, Line: p.line}
+	}
+	s := p.set
+	switch verb {
+	case "to":
+		if len(r.args) != 1 {
+			return p.errorf("plumb to: too many arguments")
+		}
+		if s.Port != "" && !isDecl(s) {
+			return p.errorf("rule set has more than one plumb to")
+		}
+		if !r.args[0].constant() {
+			return p.errorf("plumb to: port name must be constant")
+		}
+		if s.Port == "" {
+			s.Port = r.args[0].literal()
+		}
+		s.Acts = append(s.Acts, r)
+		return nil
+	case "client", "start":
+		if len(s.Acts) > 1 && isDecl(s) {
+			return p.errorf("rule set has more than one plumb to")
+		}
+		s.Acts = append(s.Acts, r)
+		return nil
+	case "add":
+		for _, w := range r.args {
+			if !strings.Contains(w.String(), "=") {
+				return p.errorf("attr add: %q is not name=value", w.String())
+			}
+		}
+	case "matches":
+		w := joinWords(r.args)
+		if w.constant() {
+			re, err := compile(w.literal())
+			if err != nil {
+				return p.errorf("bad regexp %q: %v", w.literal(), err)
+			}
+			r.re = re
+		}
+	}
+	if len(s.Acts) > 0 {
+		return p.errorf("pattern after action")
+	}
+	s.Pats = append(s.Pats, r)
+	return nil
+}
+
+// endSet finishes the current rule set, at a blank line or the end of the
+// input.
+func (p *parser) endSet() error {
+	s := p.set
+	if s == nil {
+		return nil
+	}
+	p.set = nil
+	var err *SyntaxError
+	switch {
+	case len(s.Acts) > 0 && isDecl(s):
+		for _, a := range s.Acts {
+			p.rules.decls = append(p.rules.decls, a.args[0].literal())
+		}
+		return nil
+	case len(s.Acts) == 0:
+		err = p.errorf("rule set has no action")
+	case s.Port == "" && !hasAct(s, "start"):
+		err = p.errorf("rule set has no plumb to or plumb start")
+	default:
+		p.rules.Sets = append(p.rules.Sets, s)
+		return nil
+	}
+	err.Line = s.Line
+	return err
+}
+
+// isDecl reports whether s has only plumb to lines, which declare ports.
+func isDecl(s *Ruleset) bool {
+	if len(s.Pats) > 0 {
+		return false
+	}
+	for _, a := range s.Acts {
+		if a.Verb != "to" {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAct(s *Ruleset, verb string) bool {
+	for _, a := range s.Acts {
+		if a.Verb == verb {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// compile compiles a plumbing regular expression. As in regexp(7), the
+// leftmost-longest match is preferred.
+func compile(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	re.Longest()
+	return re, nil
+}
+
+// A word is a word of a rule, as a sequence of quoted and unquoted text.
+// Variables are expanded only in the unquoted text.
+type word []segment
+
+type segment struct {
+	text   string
+	quoted bool
+}
+
+// String returns w in its original quoted form.
+func (w word) String() string {
+	var b strings.Builder
+	for _, s := range w {
+		if s.quoted {
+			b.WriteString("'" + strings.ReplaceAll(s.text, "'", "''") + "'")
+		} else {
+			b.WriteString(s.text)
+		}
+	}
+	return b.String()
+}
+
+// constant reports whether w contains no variables left to expand.
+func (w word) constant() bool {
+	for _, s := range w {
+		if !s.quoted && strings.Contains(s.text, "$") {
+			if _, _, ok := nextVar(s.text); ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// literal returns the text of w, without expanding anything.
+func (w word) literal() string {
+	var b strings.Builder
+	for _, s := range w {
+		b.WriteString(s.text)
+	}
+	return b.String()
+}
+
+// joinWords joins the words with single spaces, for patterns whose argument
+// is the rest of the line.
+func joinWords(ws []word) word {
+	var j word
+	for i, w := range ws {
+		if i > 0 {
+			j = append(j, segment{" ", true})
+		}
+		j = append(j, w...)
+	}
+	return j
+}
+
+// words splits a line into words, removing quotes and expanding the
+// variables set so far. Variables expanded at match time are left alone.
+func (p *parser) words(line string) ([]word, error) {
+	var words []word
+	var w word
+	inword := false
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inword {
+				words = append(words, w)
+				w, inword = nil, false
+			}
+			i++
+		case c == '#' && !inword:
+			i = len(line)
+		case c == '\'':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(line) {
+					return nil, p.errorf("unterminated quote")
+				}
+				if line[i] == '\'' {
+					if i+1 < len(line) && line[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(line[i])
+				i++
+			}
+			w = append(w, segment{b.String(), true})
+			inword = true
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t'", rune(line[j])) {
+				j++
+			}
+			w = append(w, p.expand(line[i:j])...)
+			i = j
+			inword = true
+		}
+	}
+	if inword {
+		words = append(words, w)
+	}
+	return words, nil
+}
+
+// expand expands the variables in unquoted text s. The values are quoted
+// so that they are not expanded again.
+func (p *parser) expand(s string) []segment {
+	var segs []segment
+	for {
+		i, name, ok := nextVar(s)
+		if !ok {
+			break
+		}
+		if isDigit(name[0]) || runtimeVars[name] {
+			segs = append(segs, segment{s[:i+1+len(name)], false})
+		} else {
+			v, ok := p.rules.vars[name]
+			if !ok {
+				v = os.Getenv(name)
+			}
+			segs = append(segs, segment{s[:i], false}, segment{v, true})
+		}
+		s = s[i+1+len(name):]
+	}
+	if s != "" {
+		segs = append(segs, segment{s, false})
+	}
+	return segs
+}
+
+// nextVar finds the next variable reference in s, returning the index of
+// its $ and its name. A $ not followed by a name stands for itself.
+func nextVar(s string) (int, string, bool) {
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] != '$' {
+			continue
+		}
+		if isDigit(s[i+1]) {
+			return i, s[i+1 : i+2], true
+		}
+		j := i + 1
+		for j < len(s) && (isDigit(s[j]) || isAlpha(s[j])) {
+			j++
+		}
+		if j > i+1 {
+			return i, s[i+1 : j], true
+		}
+	}
+	return 0, "", false
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func isAlpha(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' }
@@ -0,0 +1,438 @@
+package srv
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bwsd.dev/plan9"
+)
+
+// FS returns a Handler serving the files of fsys, read-only.
+func FS(fsys fs.FS) Handler {
+	return &fsHandler{fsys: fsys}
+}
+
+// DirFS returns a Handler serving the operating system directory tree
+// rooted at dir. Clients may create, write, remove and rename files, and
+// change their permissions, length and modification time, subject to the
+// permissions of the serving process; attach names and user names are
+// ignored.
+//
+// As with os.DirFS, symbolic links in the tree are followed, even out of
+// the tree.
+func DirFS(dir string) Handler {
+	return &fsHandler{fsys: os.DirFS(dir), root: dir, writable: true}
+}
+
+// An fsHandler is a Handler serving an fs.FS. If writable is set, the files
+// are those of the operating system directory root, and may be changed.
+type fsHandler struct {
+	fsys     fs.FS
+	root     string
+	writable bool
+}
+
+// An fsFid is the Aux of a Fid served by an fsHandler.
+type fsFid struct {
+	path   string      // fs.FS path name
+	file   fs.File     // open file, or nil
+	dirs   []plan9.Dir // directory entries, read at offset 0
+	offset int64       // offset for files that cannot seek
+	rclose bool        // remove on clunk
+}
+
+func (h *fsHandler) osPath(name string) string {
+	return filepath.Join(h.root, filepath.FromSlash(name))
+}
+
+func (h *fsHandler) stat(name string) (plan9.Dir, error) {
+	fi, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return plan9.Dir{}, fsError(err)
+	}
+	return fileDir(name, fi), nil
+}
+
+// fileDir returns the Dir for the file called name, described by fi.
+func fileDir(name string, fi fs.FileInfo) plan9.Dir {
+	mtime := fi.ModTime()
+	d := plan9.Dir{
+		Qid:     fileQid(name, fi),
+		Mode:    uint32(plan9.PermOf(fi.Mode())),
+		Atime:   uint32(mtime.Unix()),
+		Mtime:   uint32(mtime.Unix()),
+		Length:  uint64(fi.Size()),
+		Name:    fi.Name(),
+		Uid:     "none",
+		Gid:     "none",
+		Muid:    "none",
+		Uidnum:  plan9.NOUID,
+		Gidnum:  plan9.NOUID,
+		Muidnum: plan9.NOUID,
+	}
+	if name == "." {
+		d.Name = "/"
+	}
+	if fi.IsDir() {
+		d.Length = 0
+	}
+	if uid, gid, ok := fileOwner(fi); ok {
+		d.Uidnum, d.Gidnum, d.Muidnum = uid, gid, uid
+		d.Uid = userName(uid)
+		d.Gid = groupName(gid)
+		d.Muid = d.Uid
+	}
+	return d
+}
+
+// fileQid returns the qid of the file called name. The path is the file's
+// inode number where the system has one and a hash of its name otherwise;
+// the version changes with the modification time.
+func fileQid(name string, fi fs.FileInfo) plan9.Qid {
+	q := plan9.Qid{
+		Type: uint8(plan9.PermOf(fi.Mode()) >> 24),
+		Vers: uint32(fi.ModTime().UnixNano() / int64(time.Millisecond)),
+	}
+	if ino, ok := fileIno(fi); ok {
+		q.Path = ino
+	} else {
+		h := fnv.New64a()
+		io.WriteString(h, name)
+		q.Path = h.Sum64()
+	}
+	return q
+}
+
+// fsError converts an error from fs or os into one to send to the client.
+func fsError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ErrPerm
+	case errors.Is(err, fs.ErrExist):
+		return Error("file already exists")
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return Error(pe.Err.Error())
+	}
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return Error(le.Err.Error())
+	}
+	return err
+}
+
+// validName reports whether name may be a file name in a directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (h *fsHandler) Attach(r *Req) {
+	d, err := h.stat(".")
+	if err != nil {
+		r.Respond(err)
+		return
+	}
+	r.Fid.Aux = &fsFid{path: "."}
+	r.Ofcall.Qid = d.Qid
+	r.Respond(nil)
+}
+
+func (h *fsHandler) Walk(r *Req) {
+	p := r.Fid.Aux.(*fsFid).path
+	var err error
+	for _, name := range r.Ifcall.Wname {
+		if name == ".." {
+			p = path.Dir(p)
+		} else if validName(name) {
+			p = path.Join(p, name)
+		} else {
+			err = ErrNotFound
+			break
+		}
+		var d plan9.Dir
+		if d, err = h.stat(p); err != nil {
+			break
+		}
+		r.Ofcall.Wqid = append(r.Ofcall.Wqid, d.Qid)
+		if d.Qid.Type&plan9.QTDIR == 0 {
+			break
+		}
+	}
+	if len(r.Ofcall.Wqid) == len(r.Ifcall.Wname) {
+		r.Newfid.Aux = &fsFid{path: p}
+	} else if err == nil {
+		err = ErrNotDir
+	}
+	r.Respond(err)
+}
+
+// osFlags maps a 9P open mode to os.OpenFile flags.
+func osFlags(mode uint8) int {
+	var flag int
+	switch mode & 3 {
+	case plan9.OREAD, plan9.OEXEC:
+		flag = os.O_RDONLY
+	case plan9.OWRITE:
+		flag = os.O_WRONLY
+	case plan9.ORDWR:
+		flag = os.O_RDWR
+	}
+	if mode&plan9.OTRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	return flag
+}
+
+func (h *fsHandler) Open(r *Req) {
+	f := r.Fid.Aux.(*fsFid)
+	mode := r.Ifcall.Mode
+	r.Ofcall.Qid = r.Fid.Qid
+	if r.Fid.Qid.Type&plan9.QTDIR != 0 {
+		r.Respond(nil)
+		return
+	}
+	var err error
+	switch {
+	case h.writable:
+		f.file, err = os.OpenFile(h.osPath(f.path), osFlags(mode), 0)
+	case mode&3 == plan9.OWRITE || mode&3 == plan9.ORDWR || mode&(plan9.OTRUNC|plan9.ORCLOSE) != 0:
+		err = ErrPerm
+	default:
+		f.file, err = h.fsys.Open(f.path)
+	}
+	if err != nil {
+		r.Respond(fsError(err))
+		return
+	}
+	f.rclose = mode&plan9.ORCLOSE != 0
+	r.Respond(nil)
+}
+
+func (h *fsHandler) Create(r *Req) {
+	if !h.writable {
+		r.Respond(ErrPerm)
+		return
+	}
+	f := r.Fid.Aux.(*fsFid)
+	name := r.Ifcall.Name
+	if !validName(name) {
+		r.Respond(Error("bad file name"))
+		return
+	}
+	p := path.Join(f.path, name)
+	perm := r.Ifcall.Perm
+	var file fs.File
+	var err error
+	if perm&plan9.DMDIR != 0 {
+		if r.Ifcall.Mode&3 != plan9.OREAD {
+			r.Respond(ErrIsDir)
+			return
+		}
+		err = os.Mkdir(h.osPath(p), fs.FileMode(perm&0777))
+	} else {
+		// See open(5): creating an existing file fails.
+		flag := osFlags(r.Ifcall.Mode) | os.O_CREATE | os.O_EXCL
+		file, err = os.OpenFile(h.osPath(p), flag, fs.FileMode(perm&0777))
+	}
+	if err != nil {
+		r.Respond(fsError(err))
+		return
+	}
+	d, err := h.stat(p)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		r.Respond(err)
+		return
+	}
+	f.path = p
+	f.file = file
+	f.rclose = r.Ifcall.Mode&plan9.ORCLOSE != 0
+	r.Ofcall.Qid = d.Qid
+	r.Respond(nil)
+}
+
+func (h *fsHandler) Read(r *Req) {
+	f := r.Fid.Aux.(*fsFid)
+	if r.Fid.Qid.Type&plan9.QTDIR != 0 {
+		if r.Ifcall.Offset == 0 {
+			if err := h.readdir(f); err != nil {
+				r.Respond(err)
+				return
+			}
+		}
+		r.Respond(DirRead(r, func(i int) (*plan9.Dir, bool) {
+			if i >= len(f.dirs) {
+				return nil, false
+			}
+			return &f.dirs[i], true
+		}))
+		return
+	}
+
+	b := make([]byte, r.Ifcall.Count)
+	off := int64(r.Ifcall.Offset)
+	var n int
+	var err error
+	switch file := f.file.(type) {
+	case io.ReaderAt:
+		n, err = file.ReadAt(b, off)
+	case io.ReadSeeker:
+		if _, err = file.Seek(off, io.SeekStart); err == nil {
+			n, err = io.ReadFull(file, b)
+		}
+	default:
+		if off != f.offset {
+			r.Respond(ErrBadOffset)
+			return
+		}
+		n, err = io.ReadFull(file, b)
+		f.offset += int64(n)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		r.Respond(fsError(err))
+		return
+	}
+	r.Ofcall.Data = b[:n]
+	r.Respond(nil)
+}
+
+// readdir reads the directory f into f.dirs.
+func (h *fsHandler) readdir(f *fsFid) error {
+	ents, err := fs.ReadDir(h.fsys, f.path)
+	if err != nil {
+		return fsError(err)
+	}
+	f.dirs = f.dirs[:0]
+	for _, e := range ents {
+		fi, err := e.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			continue
+		}
+		f.dirs = append(f.dirs, fileDir(path.Join(f.path, e.Name()), fi))
+	}
+	return nil
+}
+
+func (h *fsHandler) Write(r *Req) {
+	f := r.Fid.Aux.(*fsFid)
+	w, ok := f.file.(io.WriterAt)
+	if !ok {
+		r.Respond(ErrPerm)
+		return
+	}
+	n, err := w.WriteAt(r.Ifcall.Data, int64(r.Ifcall.Offset))
+	if err != nil {
+		r.Respond(fsError(err))
+		return
+	}
+	r.Ofcall.Count = uint32(n)
+	r.Respond(nil)
+}
+
+func (h *fsHandler) Remove(r *Req) {
+	f := r.Fid.Aux.(*fsFid)
+	if !h.writable || f.path == "." {
+		r.Respond(ErrPerm)
+		return
+	}
+	f.close()
+	r.Respond(fsError(os.Remove(h.osPath(f.path))))
+}
+
+func (h *fsHandler) Stat(r *Req) {
+	d, err := h.stat(r.Fid.Aux.(*fsFid).path)
+	if err != nil {
+		r.Respond(err)
+		return
+	}
+	r.Dir = d
+	r.Respond(nil)
+}
+
+// Wstat changes the name, permissions, length and modification time of a
+// file. Each is checked before any is changed, and the name is changed
+// last, but the changes are not atomic.
+func (h *fsHandler) Wstat(r *Req) {
+	f := r.Fid.Aux.(*fsFid)
+	if !h.writable {
+		r.Respond(ErrPerm)
+		return
+	}
+	cur, err := h.stat(f.path)
+	if err != nil {
+		r.Respond(err)
+		return
+	}
+	d := &r.Dir
+	rename := d.Name != "" && d.Name != cur.Name
+	switch {
+	case rename && (f.path == "." || !validName(d.Name)):
+		err = Error("bad file name")
+	case d.Mode != ^uint32(0) && (d.Mode^cur.Mode)&plan9.DMDIR != 0:
+		err = Error("can't change directory bit")
+	case d.Length != ^uint64(0) && cur.Mode&plan9.DMDIR != 0 && d.Length != 0:
+		err = ErrIsDir
+	case d.Uid != "" && d.Uid != cur.Uid, d.Gid != "" && d.Gid != cur.Gid:
+		err = Error("can't change owner or group")
+	}
+	if err != nil {
+		r.Respond(err)
+		return
+	}
+
+	name := h.osPath(f.path)
+	if d.Mode != ^uint32(0) {
+		err = os.Chmod(name, plan9.Perm(d.Mode).FileMode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid))
+	}
+	if err == nil && d.Length != ^uint64(0) && cur.Mode&plan9.DMDIR == 0 {
+		err = os.Truncate(name, int64(d.Length))
+	}
+	if err == nil && d.Mtime != ^uint32(0) {
+		var atime time.Time
+		if d.Atime != ^uint32(0) {
+			atime = time.Unix(int64(d.Atime), 0)
+		}
+		err = os.Chtimes(name, atime, time.Unix(int64(d.Mtime), 0))
+	}
+	if err == nil && rename {
+		p := path.Join(path.Dir(f.path), d.Name)
+		if err = os.Rename(name, h.osPath(p)); err == nil {
+			f.path = p
+		}
+	}
+	r.Respond(fsError(err))
+}
+
+func (h *fsHandler) DestroyFid(fid *Fid) {
+	f, ok := fid.Aux.(*fsFid)
+	if !ok {
+		return
+	}
+	f.close()
+	if f.rclose && h.writable {
+		os.Remove(h.osPath(f.path))
+	}
+}
+
+func (f *fsFid) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
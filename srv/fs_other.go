@@ -0,0 +1,13 @@
+//go:build !unix
+
+package srv
+
+import "io/fs"
+
+func fileIno(fi fs.FileInfo) (uint64, bool) { return 0, false }
+
+func fileOwner(fi fs.FileInfo) (uid, gid uint32, ok bool) { return 0, 0, false }
+
+func userName(uid uint32) string { return "none" }
+
+func groupName(gid uint32) string { return "none" }
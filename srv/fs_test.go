@@ -0,0 +1,114 @@
+package srv_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/srv"
+)
+
+func TestFS(t *testing.T) {
+	mfs := fstest.MapFS{
+		"hello":      {Data: []byte("hello, world\n"), Mode: 0o444},
+		"sub/a":      {Data: []byte("a\n"), Mode: 0o644},
+		"sub/deep/b": {Data: []byte("b\n"), Mode: 0o600},
+	}
+	fsys := mount(t, srv.FS(mfs), "glenda")
+	if err := fstest.TestFS(fsys.FS(), "hello", "sub/a", "sub/deep/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Open("hello", plan9.OWRITE); err == nil {
+		t.Errorf("opened read-only file for writing")
+	}
+	if _, err := fsys.Create("new", plan9.OWRITE, 0o644); err == nil {
+		t.Errorf("created file in read-only tree")
+	}
+	if _, err := fsys.Stat("sub/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat missing: %v, want ErrNotExist", err)
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	fsys := mount(t, srv.DirFS(dir), "glenda")
+
+	fid, err := fsys.Create("f", plan9.ORDWR, 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fid.Write([]byte("hello, world\n")); err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+	if _, err := fsys.Create("f", plan9.OWRITE, 0o640); err == nil {
+		t.Errorf("created existing file")
+	}
+	if _, err := fsys.Create("d", plan9.OREAD, plan9.DMDIR|0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := fsys.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Length != 13 || d.Mode != 0o640 || d.Mtime != uint32(fi.ModTime().Unix()) {
+		t.Errorf("stat f = length %d mode %o mtime %d", d.Length, d.Mode, d.Mtime)
+	}
+
+	var wd plan9.Dir
+	wd.Null()
+	wd.Name = "g"
+	wd.Mode = 0o600
+	wd.Length = 5
+	if err := fsys.Wstat("f", &wd); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("g contains %q, want %q", b, "hello")
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "g")); err != nil || fi.Mode() != 0o600 {
+		t.Errorf("stat g = %v, %v; want mode 0600", fi, err)
+	}
+
+	wd.Null()
+	wd.Mode = plan9.DMDIR | 0o700
+	if err := fsys.Wstat("g", &wd); err == nil {
+		t.Errorf("made g a directory")
+	}
+
+	fid, err = fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := fid.Dirreadall()
+	fid.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 2 || dirs[0].Name != "d" || dirs[0].Qid.Type&plan9.QTDIR == 0 || dirs[1].Name != "g" {
+		t.Errorf("directory contains %v", dirs)
+	}
+
+	if err := fsys.Remove("g"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "g")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("g not removed: %v", err)
+	}
+	if _, err := fsys.Open("../../etc/passwd", plan9.OREAD); err == nil {
+		t.Errorf("walked out of the tree")
+	}
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package srv
+
+import (
+	"io/fs"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+func fileIno(fi fs.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
+
+func fileOwner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint32(st.Uid), uint32(st.Gid), true
+}
+
+// Names of users and groups, by id.
+var (
+	users  sync.Map
+	groups sync.Map
+)
+
+func userName(uid uint32) string {
+	if name, ok := users.Load(uid); ok {
+		return name.(string)
+	}
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	users.Store(uid, name)
+	return name
+}
+
+func groupName(gid uint32) string {
+	if name, ok := groups.Load(gid); ok {
+		return name.(string)
+	}
+	name := strconv.FormatUint(uint64(gid), 10)
+	if g, err := user.LookupGroupId(name); err == nil {
+		name = g.Name
+	}
+	groups.Store(gid, name)
+	return name
+}
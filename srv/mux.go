@@ -0,0 +1,523 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"bwsd.dev/plan9"
+)
+
+// A Mux serves many clients over a single 9P connection to a server, as
+// 9pserve(4) does. It answers each client's Tversion itself and rewrites
+// the tags and fids in the clients' requests so that they cannot collide.
+// When a client hangs up, the Mux flushes its outstanding requests and
+// clunks its fids.
+type Mux struct {
+	rwc     io.ReadWriteCloser // the server
+	dec     *plan9.Decoder     // reads from rwc
+	msize   uint32
+	version string
+	w       sync.Mutex // guards writes on rwc
+
+	// mu guards the rest, and the tables in each muxConn.
+	mu      sync.Mutex
+	reqs    map[uint16]*muxReq // outstanding requests, by server tag
+	nexttag uint16
+	freefid []uint32
+	nextfid uint32
+	conns   map[*muxConn]bool
+	err     error         // why the server connection failed
+	done    chan struct{} // closed when the server connection fails
+}
+
+// A muxConn is a client connection to a Mux.
+type muxConn struct {
+	m     *Mux
+	rwc   io.ReadWriteCloser
+	w     sync.Mutex // guards writes on rwc
+	msize uint32
+
+	// guarded by m.mu
+	fids map[uint32]*muxFid // by client fid
+	tags map[uint16]*muxReq // outstanding requests, by client tag
+}
+
+// A muxFid is a client's fid and the server fid standing for it.
+type muxFid struct {
+	sfid    uint32
+	pending bool // created by a request not yet answered
+}
+
+// A muxReq is a request forwarded to the server.
+type muxReq struct {
+	c      *muxConn // client, or nil for the Mux's own requests
+	tag    uint16   // client's tag
+	stag   uint16   // server tag
+	tx     *plan9.Fcall
+	fid    uint32  // client fid created by the request, or NOFID
+	newfid *muxFid // server fid created by the request
+	clunk  uint32  // server fid clunked by the request, or NOFID
+	oldreq *muxReq // Tflush: the request being flushed
+}
+
+var (
+	errOutOfTags = Error("out of tags")
+	errOutOfFids = Error("out of fids")
+	errNoVersion = Error("version not negotiated")
+)
+
+// NewMux starts a Mux serving clients over rwc, a connection to a 9P2000
+// server. It negotiates the version and message size with the server
+// before returning.
+func NewMux(rwc io.ReadWriteCloser) (*Mux, error) {
+	tx := &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: DefaultMsize, Version: plan9.VERSION9P}
+	if err := plan9.WriteFcall(rwc, tx); err != nil {
+		return nil, err
+	}
+	dec := plan9.NewDecoder(rwc)
+	dec.Msize = DefaultMsize
+	rx := new(plan9.Fcall)
+	if err := dec.Decode(rx); err != nil {
+		return nil, err
+	}
+	switch {
+	case rx.Type == plan9.Rerror:
+		return nil, errors.New(rx.Ename)
+	case rx.Type != plan9.Rversion || rx.Tag != plan9.NOTAG:
+		return nil, plan9.ProtocolError(fmt.Sprintf("bad reply to Tversion: %v", rx))
+	case rx.Version != plan9.VERSION9P:
+		return nil, fmt.Errorf("server speaks %q, not %s", rx.Version, plan9.VERSION9P)
+	case rx.Msize <= plan9.IOHDRSZ || rx.Msize > DefaultMsize:
+		return nil, plan9.ProtocolError(fmt.Sprintf("bad msize %d in Rversion", rx.Msize))
+	}
+	dec.Msize = rx.Msize
+	m := &Mux{
+		rwc:     rwc,
+		dec:     dec,
+		msize:   rx.Msize,
+		version: rx.Version,
+		reqs:    make(map[uint16]*muxReq),
+		nextfid: 1,
+		conns:   make(map[*muxConn]bool),
+		done:    make(chan struct{}),
+	}
+	go m.reader()
+	return m, nil
+}
+
+// Close closes the connection to the server and all client connections.
+func (m *Mux) Close() error {
+	return m.rwc.Close()
+}
+
+// Serve accepts client connections on l and serves each in its own
+// goroutine. It returns when l fails or the server connection does,
+// closing l.
+func (m *Mux) Serve(l net.Listener) error {
+	defer l.Close()
+	go func() {
+		<-m.done
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return m.err
+			default:
+				return err
+			}
+		}
+		go m.ServeConn(c)
+	}
+}
+
+// ServeConn serves a single client on rwc, which it closes on return.
+// ServeConn returns nil when the client hangs up.
+func (m *Mux) ServeConn(rwc io.ReadWriteCloser) error {
+	c := &muxConn{
+		m:    m,
+		rwc:  rwc,
+		fids: make(map[uint32]*muxFid),
+		tags: make(map[uint16]*muxReq),
+	}
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		rwc.Close()
+		return m.err
+	}
+	m.conns[c] = true
+	m.mu.Unlock()
+	defer c.hangup()
+	// Each request has been sent on, or answered, before the next is
+	// read, so f can share the decoder's buffer.
+	dec := plan9.NewDecoder(rwc)
+	for {
+		m.mu.Lock()
+		if dec.Msize = c.msize; dec.Msize == 0 {
+			dec.Msize = m.msize
+		}
+		m.mu.Unlock()
+		f := new(plan9.Fcall)
+		if err := dec.Decode(f); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if f.Type == plan9.Tversion {
+			c.version(f)
+			continue
+		}
+		if err := c.forward(f); err != nil {
+			c.write(&plan9.Fcall{Type: plan9.Rerror, Tag: f.Tag, Ename: err.Error()})
+		}
+	}
+}
+
+// version answers a Tversion, starting a new session.
+func (c *muxConn) version(f *plan9.Fcall) {
+	c.reset()
+	rx := &plan9.Fcall{Type: plan9.Rversion, Tag: f.Tag, Msize: f.Msize, Version: "unknown"}
+	if rx.Msize > c.m.msize {
+		rx.Msize = c.m.msize
+	}
+	if strings.HasPrefix(f.Version, c.m.version) {
+		rx.Version = c.m.version
+		c.m.mu.Lock()
+		c.msize = rx.Msize
+		c.m.mu.Unlock()
+	}
+	c.write(rx)
+}
+
+// hangup cleans up after the client has gone.
+func (c *muxConn) hangup() {
+	c.m.mu.Lock()
+	delete(c.m.conns, c)
+	c.m.mu.Unlock()
+	c.reset()
+	c.rwc.Close()
+}
+
+// reset flushes the client's outstanding requests and clunks its fids.
+func (c *muxConn) reset() {
+	m := c.m
+	var send []*muxReq
+	m.mu.Lock()
+	for _, r := range c.tags {
+		switch r.tx.Type {
+		case plan9.Tflush, plan9.Tclunk, plan9.Tremove:
+			// Nothing to gain by flushing these.
+		default:
+			tx := &plan9.Fcall{Type: plan9.Tflush, Oldtag: r.stag}
+			if fr, err := m.newreq(nil, tx); err == nil {
+				fr.oldreq = r
+				send = append(send, fr)
+			}
+		}
+		// Drop the reply.
+		r.c = nil
+	}
+	for _, f := range c.fids {
+		if f.pending {
+			// Dealt with when the request creating it is answered.
+			continue
+		}
+		tx := &plan9.Fcall{Type: plan9.Tclunk, Fid: f.sfid}
+		if cr, err := m.newreq(nil, tx); err == nil {
+			cr.clunk = f.sfid
+			send = append(send, cr)
+		}
+	}
+	c.fids = make(map[uint32]*muxFid)
+	c.tags = make(map[uint16]*muxReq)
+	c.msize = 0
+	m.mu.Unlock()
+	for _, r := range send {
+		m.send(r.tx)
+	}
+}
+
+func (c *muxConn) write(f *plan9.Fcall) {
+	c.w.Lock()
+	defer c.w.Unlock()
+	if err := plan9.WriteFcall(c.rwc, f); err != nil {
+		// The read loop will notice the broken connection.
+		c.rwc.Close()
+	}
+}
+
+// forward rewrites the client's request f and sends it to the server.
+func (c *muxConn) forward(f *plan9.Fcall) error {
+	m := c.m
+	m.mu.Lock()
+	if c.msize == 0 {
+		m.mu.Unlock()
+		return errNoVersion
+	}
+	if _, ok := c.tags[f.Tag]; ok {
+		m.mu.Unlock()
+		return ErrDupTag
+	}
+	tag := f.Tag
+	r, err := c.translate(f)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	if r == nil {
+		// Answered without asking the server.
+		m.mu.Unlock()
+		c.write(&plan9.Fcall{Type: f.Type + 1, Tag: tag})
+		return nil
+	}
+	m.mu.Unlock()
+	m.send(r.tx)
+	return nil
+}
+
+// translate rewrites the fids and tag in f for the server, recording the
+// request, and returns it. It is called with m.mu held.
+func (c *muxConn) translate(f *plan9.Fcall) (*muxReq, error) {
+	m := c.m
+	lookup := func(fid uint32) (uint32, error) {
+		if mf, ok := c.fids[fid]; ok && !mf.pending {
+			return mf.sfid, nil
+		}
+		return 0, ErrUnknownFid
+	}
+	var err error
+	var oldreq *muxReq
+	var newfid, clunk uint32 = plan9.NOFID, plan9.NOFID
+	switch f.Type {
+	default:
+		return nil, ErrBadFcall
+
+	case plan9.Tauth:
+		newfid = f.Afid
+
+	case plan9.Tattach:
+		if f.Afid != plan9.NOFID {
+			if f.Afid, err = lookup(f.Afid); err != nil {
+				return nil, err
+			}
+		}
+		newfid = f.Fid
+
+	case plan9.Twalk:
+		if newfid = f.Newfid; newfid == f.Fid {
+			newfid = plan9.NOFID
+		}
+		if f.Fid, err = lookup(f.Fid); err != nil {
+			return nil, err
+		}
+		if newfid == plan9.NOFID {
+			f.Newfid = f.Fid
+		}
+
+	case plan9.Tclunk, plan9.Tremove:
+		cfid := f.Fid
+		if f.Fid, err = lookup(f.Fid); err != nil {
+			return nil, err
+		}
+		// The client may not use the fid again, whatever the reply.
+		delete(c.fids, cfid)
+		clunk = f.Fid
+
+	case plan9.Topen, plan9.Tcreate, plan9.Tread, plan9.Twrite, plan9.Tstat, plan9.Twstat:
+		if f.Fid, err = lookup(f.Fid); err != nil {
+			return nil, err
+		}
+
+	case plan9.Tflush:
+		if oldreq = c.tags[f.Oldtag]; oldreq == nil {
+			// Nothing to flush.
+			return nil, nil
+		}
+		f.Oldtag = oldreq.stag
+	}
+
+	var mf *muxFid
+	if newfid != plan9.NOFID {
+		if _, ok := c.fids[newfid]; ok {
+			return nil, ErrDupFid
+		}
+		sfid, err := m.newfid()
+		if err != nil {
+			return nil, err
+		}
+		mf = &muxFid{sfid: sfid, pending: true}
+		switch f.Type {
+		case plan9.Tauth:
+			f.Afid = sfid
+		case plan9.Tattach:
+			f.Fid = sfid
+		case plan9.Twalk:
+			f.Newfid = sfid
+		}
+	}
+
+	tag := f.Tag
+	r, err := m.newreq(c, f)
+	if err != nil {
+		if mf != nil {
+			m.putfid(mf.sfid)
+		}
+		return nil, err
+	}
+	r.tag = tag
+	r.fid = newfid
+	r.newfid = mf
+	r.clunk = clunk
+	r.oldreq = oldreq
+	if mf != nil {
+		c.fids[newfid] = mf
+	}
+	c.tags[tag] = r
+	return r, nil
+}
+
+// newreq allocates a server tag for tx, on behalf of client c.
+// It is called with m.mu held.
+func (m *Mux) newreq(c *muxConn, tx *plan9.Fcall) (*muxReq, error) {
+	for i := 0; i < int(plan9.NOTAG); i++ {
+		tag := m.nexttag
+		if m.nexttag++; m.nexttag == plan9.NOTAG {
+			m.nexttag = 0
+		}
+		if _, ok := m.reqs[tag]; !ok {
+			tx.Tag = tag
+			r := &muxReq{c: c, stag: tag, tx: tx, fid: plan9.NOFID, clunk: plan9.NOFID}
+			m.reqs[tag] = r
+			return r, nil
+		}
+	}
+	return nil, errOutOfTags
+}
+
+// newfid allocates a server fid. It is called with m.mu held.
+func (m *Mux) newfid() (uint32, error) {
+	if n := len(m.freefid); n > 0 {
+		fid := m.freefid[n-1]
+		m.freefid = m.freefid[:n-1]
+		return fid, nil
+	}
+	if m.nextfid == plan9.NOFID {
+		return 0, errOutOfFids
+	}
+	fid := m.nextfid
+	m.nextfid++
+	return fid, nil
+}
+
+// putfid frees a server fid. It is called with m.mu held.
+func (m *Mux) putfid(fid uint32) {
+	m.freefid = append(m.freefid, fid)
+}
+
+// send writes f to the server.
+func (m *Mux) send(f *plan9.Fcall) {
+	m.w.Lock()
+	defer m.w.Unlock()
+	if err := plan9.WriteFcall(m.rwc, f); err != nil {
+		// The reader will notice the broken connection.
+		m.rwc.Close()
+	}
+}
+
+// reader reads replies from the server and passes them on to the clients.
+func (m *Mux) reader() {
+	for {
+		// rx is passed on before the next read reuses its buffer.
+		rx := new(plan9.Fcall)
+		if err := m.dec.Decode(rx); err != nil {
+			m.hangup(err)
+			return
+		}
+		m.mu.Lock()
+		r := m.reqs[rx.Tag]
+		if r == nil {
+			m.mu.Unlock()
+			continue
+		}
+		send := m.finish(r, rx, false)
+		c := r.c
+		m.mu.Unlock()
+		for _, f := range send {
+			m.send(f)
+		}
+		if c != nil {
+			rx.Tag = r.tag
+			c.write(rx)
+		}
+	}
+}
+
+// finish retires the request r, answered by rx or, if flushed is set,
+// flushed, updating the fid tables to match. It returns any requests to
+// be sent to the server as a result. It is called with m.mu held.
+func (m *Mux) finish(r *muxReq, rx *plan9.Fcall, flushed bool) []*plan9.Fcall {
+	var send []*plan9.Fcall
+	delete(m.reqs, r.stag)
+	c := r.c
+	if c != nil && c.tags[r.tag] == r {
+		delete(c.tags, r.tag)
+	}
+
+	if mf := r.newfid; mf != nil {
+		failed := flushed || rx.Type == plan9.Rerror ||
+			r.tx.Type == plan9.Twalk && len(rx.Wqid) < len(r.tx.Wname)
+		if c != nil && c.fids[r.fid] == mf {
+			if failed {
+				delete(c.fids, r.fid)
+			} else {
+				mf.pending = false
+			}
+		}
+		switch {
+		case failed:
+			m.putfid(mf.sfid)
+		case c == nil:
+			// The client hung up before the fid was made.
+			tx := &plan9.Fcall{Type: plan9.Tclunk, Fid: mf.sfid}
+			if cr, err := m.newreq(nil, tx); err == nil {
+				cr.clunk = mf.sfid
+				send = append(send, tx)
+			}
+		}
+	}
+	if r.clunk != plan9.NOFID && !flushed {
+		// Tclunk and Tremove clunk the fid even if they fail.
+		// A flushed one may or may not have; don't reuse the fid.
+		m.putfid(r.clunk)
+	}
+	if old := r.oldreq; old != nil && !flushed && m.reqs[old.stag] == old {
+		// Flushed before it was answered.
+		send = append(send, m.finish(old, nil, true)...)
+	}
+	return send
+}
+
+// hangup shuts down the Mux after the server connection fails.
+func (m *Mux) hangup(err error) {
+	m.mu.Lock()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	m.err = err
+	conns := m.conns
+	m.conns = make(map[*muxConn]bool)
+	m.mu.Unlock()
+	close(m.done)
+	m.rwc.Close()
+	for c := range conns {
+		c.rwc.Close()
+	}
+}
@@ -0,0 +1,173 @@
+package srv_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/srv"
+)
+
+// fidTree is a srv.Tree that reports destroyed fids.
+type fidTree struct {
+	*srv.Tree
+	destroyed chan uint32
+}
+
+func (t *fidTree) DestroyFid(f *srv.Fid) { t.destroyed <- f.Fid }
+
+func newMux(t *testing.T, h srv.Handler) *srv.Mux {
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, h)
+	m, err := srv.NewMux(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func muxMount(t *testing.T, m *srv.Mux) (*client.Conn, *client.Fsys) {
+	c1, c2 := net.Pipe()
+	go m.ServeConn(c1)
+	conn, err := client.NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, fsys
+}
+
+func TestMux(t *testing.T) {
+	m := newMux(t, newTree(t))
+	_, fsys1 := muxMount(t, m)
+	_, fsys2 := muxMount(t, m)
+
+	// Both clients use the same fid numbers.
+	fid1, err := fsys1.Open("hello", plan9.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid1.Close()
+	fid2, err := fsys2.Open("hello", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid2.Close()
+	if _, err := fid1.WriteAt([]byte("HELLO"), 0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 13)
+	if _, err := fid2.ReadAt(buf, 0); err != nil || string(buf) != "HELLO, world\n" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	if _, err := fsys2.Open("sub/missing", plan9.OREAD); err == nil {
+		t.Errorf("opened missing file")
+	}
+	if _, err := fsys1.Stat("sub/secret"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMuxProtocol(t *testing.T) {
+	m := newMux(t, newTree(t))
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go m.ServeConn(c1)
+
+	rx := rpc(t, c2, &plan9.Fcall{Type: plan9.Tattach, Tag: 1, Fid: 1, Afid: plan9.NOFID, Uname: "glenda"})
+	if rx.Type != plan9.Rerror {
+		t.Fatalf("attach before version: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 1 << 20, Version: "9P2000.u"})
+	if rx.Type != plan9.Rversion || rx.Version != "9P2000" || rx.Msize != srv.DefaultMsize {
+		t.Fatalf("version: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tattach, Tag: 7, Fid: 100, Afid: plan9.NOFID, Uname: "glenda"})
+	if rx.Type != plan9.Rattach || rx.Tag != 7 {
+		t.Fatalf("attach: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Twalk, Tag: 7, Fid: 100, Newfid: 100})
+	if rx.Type != plan9.Rwalk {
+		t.Fatalf("walk in place: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Twalk, Tag: 7, Fid: 100, Newfid: 101, Wname: []string{"sub", "missing"}})
+	if rx.Type != plan9.Rwalk || len(rx.Wqid) != 1 {
+		t.Fatalf("partial walk: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tstat, Tag: 7, Fid: 101})
+	if rx.Type != plan9.Rerror || rx.Ename != string(srv.ErrUnknownFid) {
+		t.Fatalf("stat after partial walk: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Twalk, Tag: 7, Fid: 100, Newfid: 100, Wname: []string{"hello"}})
+	if rx.Type != plan9.Rwalk || len(rx.Wqid) != 1 {
+		t.Fatalf("walk: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tattach, Tag: 7, Fid: 100, Afid: plan9.NOFID, Uname: "glenda"})
+	if rx.Type != plan9.Rerror || rx.Ename != string(srv.ErrDupFid) {
+		t.Fatalf("attach to busy fid: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tflush, Tag: 8, Oldtag: 99})
+	if rx.Type != plan9.Rflush || rx.Tag != 8 {
+		t.Fatalf("flush: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tclunk, Tag: 7, Fid: 100})
+	if rx.Type != plan9.Rclunk {
+		t.Fatalf("clunk: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tclunk, Tag: 7, Fid: 100})
+	if rx.Type != plan9.Rerror {
+		t.Fatalf("second clunk: %v", rx)
+	}
+}
+
+func TestMuxOversized(t *testing.T) {
+	m := newMux(t, newTree(t))
+	var perr plan9.ProtocolError
+	if err := oversized(t, m.ServeConn, 1024); !errors.As(err, &perr) {
+		t.Errorf("ServeConn returned %v, want ProtocolError", err)
+	}
+}
+
+func TestMuxHangup(t *testing.T) {
+	b := &blocker{reqs: make(chan *srv.Req, 1)}
+	tree := &fidTree{Tree: newTree(t), destroyed: make(chan uint32, 10)}
+	tree.Root.Create("block", "glenda", 0o444, b)
+	m := newMux(t, tree)
+	conn1, fsys1 := muxMount(t, m)
+	_, fsys2 := muxMount(t, m)
+
+	if _, err := fsys1.Open("hello", plan9.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys1.Open("block", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fid.Read(make([]byte, 10))
+	old := <-b.reqs
+
+	conn1.Close()
+	timeout := time.After(10 * time.Second)
+	seen := make(map[uint32]bool)
+	for len(seen) < 3 {
+		select {
+		case fid := <-tree.destroyed:
+			seen[fid] = true
+		case <-timeout:
+			t.Fatalf("fids not clunked after hangup; saw %v", seen)
+		}
+	}
+	old.Respond(nil)
+
+	if _, err := fsys2.Stat("hello"); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package srv
+
+import (
+	"bwsd.dev/plan9"
+)
+
+// A Fid is a server's view of a client fid.
+type Fid struct {
+	Fid   uint32
+	Qid   plan9.Qid
+	Omode int    // open mode, or -1 if the fid is not open
+	Uid   string // user name given in the attach
+
+	File *File       // the file in a Tree, if any
+	Aux  interface{} // for use by the Handler
+
+	diroffset uint64 // offset the next directory read must use
+	dirindex  int    // index of the next directory entry
+	c         *conn
+}
+
+// A Req is an outstanding 9P request.
+type Req struct {
+	Ifcall plan9.Fcall // the request
+	Ofcall plan9.Fcall // the reply, filled in by the Handler
+
+	Fid    *Fid      // the fid named in Ifcall, if any
+	Afid   *Fid      // Tauth, Tattach
+	Newfid *Fid      // Twalk; same as Fid for an in-place walk
+	Oldreq *Req      // Tflush
+	Dir    plan9.Dir // Tstat (reply), Twstat (request)
+
+	Aux interface{} // for use by the Handler
+
+	c         *conn
+	responded bool
+	flushed   bool   // Rflush sent (or session ended); drop the reply
+	flush     []*Req // flushes waiting for this request to be answered
+}
+
+// Msize returns the maximum message size negotiated for r's session.
+func (r *Req) Msize() uint32 {
+	r.c.mu.Lock()
+	defer r.c.mu.Unlock()
+	return r.c.msize
+}
+
+// Respond sends the reply to r, or an Rerror if err is non-nil.
+// It must be called exactly once for each request.
+func (r *Req) Respond(err error) {
+	c := r.c
+	f := &r.Ofcall
+	f.Tag = r.Ifcall.Tag
+
+	var del []*Fid // fids to hand to the FidDestroyer
+	c.mu.Lock()
+	if r.responded {
+		c.mu.Unlock()
+		panic("srv: Respond called twice")
+	}
+	r.responded = true
+	if r.flushed && err == nil {
+		// The client has forgotten about r; so must we.
+		err = Error("flushed")
+	}
+
+	// Finish the request, updating the fid table to match the reply.
+	switch r.Ifcall.Type {
+	case plan9.Tauth:
+		if err != nil {
+			del = c.dropfid(del, r.Afid)
+			break
+		}
+		r.Afid.Qid = f.Aqid
+
+	case plan9.Tattach:
+		if err != nil {
+			del = c.dropfid(del, r.Fid)
+			break
+		}
+		r.Fid.Qid = f.Qid
+
+	case plan9.Twalk:
+		if err == nil && len(r.Ifcall.Wname) > 0 && len(f.Wqid) == 0 {
+			err = ErrNotFound
+		}
+		if err != nil && len(f.Wqid) > 0 {
+			// Report the partial walk; see walk(5).
+			err = nil
+		}
+		if err != nil || len(f.Wqid) < len(r.Ifcall.Wname) {
+			if r.Newfid != r.Fid {
+				del = c.dropfid(del, r.Newfid)
+			}
+			break
+		}
+		if n := len(f.Wqid); n > 0 {
+			r.Newfid.Qid = f.Wqid[n-1]
+		}
+
+	case plan9.Topen, plan9.Tcreate:
+		if err != nil {
+			break
+		}
+		r.Fid.Omode = int(r.Ifcall.Mode)
+		r.Fid.Qid = f.Qid
+		r.Fid.diroffset = 0
+		r.Fid.dirindex = 0
+
+	case plan9.Tread:
+		if err != nil {
+			break
+		}
+		f.Count = uint32(len(f.Data))
+		if r.Fid.Qid.Type&plan9.QTDIR != 0 {
+			r.Fid.diroffset = r.Ifcall.Offset + uint64(f.Count)
+		}
+
+	case plan9.Tclunk, plan9.Tremove:
+		if r.Fid != nil {
+			del = append(del, r.Fid)
+		}
+
+	case plan9.Tstat:
+		if err != nil || len(f.Stat) > 0 {
+			break
+		}
+		f.Stat, err = r.Dir.Bytes()
+		if err == nil && len(f.Stat) > int(c.msize-plan9.IOHDRSZ) {
+			err = Error("stat too long")
+		}
+
+	case plan9.Tflush:
+		// The old request must not be answered after the Rflush.
+		if old := r.Oldreq; old != nil && !old.responded && !old.flushed {
+			old.flushed = true
+			if c.reqs[old.Ifcall.Tag] == old {
+				delete(c.reqs, old.Ifcall.Tag)
+			}
+		}
+	}
+
+	if err != nil {
+		*f = plan9.Fcall{Type: plan9.Rerror, Tag: r.Ifcall.Tag, Ename: err.Error()}
+	} else {
+		f.Type = r.Ifcall.Type + 1
+	}
+
+	flushed := r.flushed
+	if !flushed && c.reqs[r.Ifcall.Tag] == r {
+		delete(c.reqs, r.Ifcall.Tag)
+	}
+	flush := r.flush
+	r.flush = nil
+	c.mu.Unlock()
+
+	for _, fid := range del {
+		c.destroy(fid)
+	}
+	if !flushed {
+		c.write(f)
+	}
+	for _, fr := range flush {
+		fr.Respond(nil)
+	}
+}
+
+// dropfid removes f from the fid table, if it is still there, and appends it
+// to del. It is called with c.mu held.
+func (c *conn) dropfid(del []*Fid, f *Fid) []*Fid {
+	if f == nil || c.fids[f.Fid] != f {
+		return del
+	}
+	delete(c.fids, f.Fid)
+	return append(del, f)
+}
+
+// DirRead fills r.Ofcall.Data with as many directory entries as fit in
+// r.Ifcall.Count, continuing from the entries returned by earlier reads of
+// r.Fid. The entries are produced by gen, which is called with successive
+// indices starting at zero until it returns false.
+//
+// DirRead does not respond to r; a Handler typically calls
+//
+//	r.Respond(srv.DirRead(r, gen))
+func DirRead(r *Req, gen func(i int) (*plan9.Dir, bool)) error {
+	fid := r.Fid
+	switch r.Ifcall.Offset {
+	case 0:
+		fid.dirindex = 0
+	case fid.diroffset:
+	default:
+		return ErrBadOffset
+	}
+	b := make([]byte, 0, r.Ifcall.Count)
+	for {
+		d, ok := gen(fid.dirindex)
+		if !ok {
+			break
+		}
+		buf, err := d.Bytes()
+		if err != nil {
+			return err
+		}
+		if len(b)+len(buf) > int(r.Ifcall.Count) {
+			break
+		}
+		b = append(b, buf...)
+		fid.dirindex++
+	}
+	r.Ofcall.Data = b
+	return nil
+}
+
+// ReadBytes fills r.Ofcall.Data with the part of b selected by the offset and
+// count of the read request r.
+func ReadBytes(r *Req, b []byte) {
+	off := r.Ifcall.Offset
+	if off >= uint64(len(b)) {
+		r.Ofcall.Data = nil
+		return
+	}
+	b = b[off:]
+	if uint64(len(b)) > uint64(r.Ifcall.Count) {
+		b = b[:r.Ifcall.Count]
+	}
+	r.Ofcall.Data = b
+}
+
+// ReadString is like ReadBytes but reads from s.
+func ReadString(r *Req, s string) {
+	ReadBytes(r, []byte(s))
+}
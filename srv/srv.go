@@ -0,0 +1,475 @@
+// Package srv helps programs serve file trees over 9P2000.
+//
+// A Srv reads T-messages from a connection, maintains the fid and tag tables,
+// negotiates the message size and dispatches each request to a Handler.
+// Handlers answer requests by calling Req.Respond, possibly later and from
+// another goroutine, so that a blocking read need not stall the connection.
+//
+// See: 9p(2)
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"bwsd.dev/plan9"
+)
+
+// DefaultMsize is the maximum message size offered by a Srv whose Msize is
+// zero.
+const DefaultMsize = 8192 + plan9.IOHDRSZ
+
+// Error is the type of the errors reported by this package. Its text is sent
+// to the client verbatim in an Rerror message.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+var (
+	ErrBadFcall   = Error("bad fcall type")
+	ErrDupFid     = Error("duplicate fid")
+	ErrDupTag     = Error("duplicate tag")
+	ErrUnknownFid = Error("unknown fid")
+	ErrNotFound   = Error("file does not exist")
+	ErrPerm       = Error("permission denied")
+	ErrIsDir      = Error("is a directory")
+	ErrNotDir     = Error("not a directory")
+	ErrOpen       = Error("file already open")
+	ErrNotOpen    = Error("file not open")
+	ErrWalkOpen   = Error("walk of open file")
+	ErrNoAuth     = Error("authentication not required")
+	ErrBadOffset  = Error("bad offset in directory read")
+	ErrBadStat    = Error("bad stat")
+)
+
+// A Handler serves the requests of a 9P session.
+//
+// The Srv calls the methods of a Handler one at a time, in the order the
+// requests arrive on a connection. Each method must eventually call
+// r.Respond exactly once; a method that has to wait for something should
+// arrange to respond from another goroutine and return.
+//
+// The Srv validates fids and open modes before calling the Handler, and
+// updates its fid table once the Handler responds: the qid of a walked,
+// opened or created fid is taken from the reply.
+type Handler interface {
+	Attach(r *Req)
+	Walk(r *Req)
+	Open(r *Req)
+	Create(r *Req)
+	Read(r *Req)
+	Write(r *Req)
+	Remove(r *Req)
+	Stat(r *Req)
+	Wstat(r *Req)
+}
+
+// An Auther is a Handler that supports authentication. Without one, Tauth is
+// answered with ErrNoAuth. The auth fid, r.Afid, is open for reading and
+// writing, and the Handler's Read and Write see the conversation on it;
+// they can recognize it by the QTAUTH bit in its qid.
+type Auther interface {
+	Auth(r *Req)
+}
+
+// A Flusher is a Handler that can abort requests. Flush is called with the
+// Tflush request in r and the request to abort in r.Oldreq. Once r is
+// responded to, any later response to r.Oldreq is discarded.
+//
+// Without a Flusher, the Srv answers a Tflush as soon as the old request
+// has been responded to.
+type Flusher interface {
+	Flush(r *Req)
+}
+
+// A Clunker is a Handler that wants to see Tclunk requests. Without one, the
+// Srv answers a Tclunk immediately. Either way, the fid has already been
+// removed from the fid table when Clunk is called.
+type Clunker interface {
+	Clunk(r *Req)
+}
+
+// A FidDestroyer is a Handler that is told when a fid leaves the fid table:
+// after it is clunked or removed, when a walk to a new fid fails, or when the
+// session ends with the fid still in use.
+type FidDestroyer interface {
+	DestroyFid(f *Fid)
+}
+
+// Srv serves 9P sessions using a Handler.
+type Srv struct {
+	Handler Handler
+
+	// Msize is the maximum message size the server accepts.
+	// If zero, DefaultMsize is used.
+	Msize uint32
+
+	// Chatty causes every message to be printed on standard error.
+	Chatty bool
+}
+
+func (s *Srv) msize() uint32 {
+	if s.Msize == 0 {
+		return DefaultMsize
+	}
+	return s.Msize
+}
+
+// Serve serves a single 9P session on rwc, which it closes on return.
+// Serve returns nil when the client hangs up.
+func (s *Srv) Serve(rwc io.ReadWriteCloser) error {
+	c := &conn{
+		srv:   s,
+		rwc:   rwc,
+		msize: s.msize(),
+		fids:  make(map[uint32]*Fid),
+		reqs:  make(map[uint16]*Req),
+	}
+	defer c.hangup()
+	dec := plan9.NewDecoder(rwc)
+	for {
+		c.mu.Lock()
+		dec.Msize = c.msize
+		c.mu.Unlock()
+		f := new(plan9.Fcall)
+		if err := dec.Decode(f); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Requests are answered concurrently, so they cannot share the
+		// decoder's buffer.
+		f.Data = bytes.Clone(f.Data)
+		f.Stat = bytes.Clone(f.Stat)
+		if s.Chatty {
+			fmt.Fprintf(os.Stderr, "-> %v\n", f)
+		}
+		c.dispatch(f)
+	}
+}
+
+// Serve serves a single 9P session on rwc using h.
+func Serve(rwc io.ReadWriteCloser, h Handler) error {
+	s := &Srv{Handler: h}
+	return s.Serve(rwc)
+}
+
+type conn struct {
+	srv   *Srv
+	rwc   io.ReadWriteCloser
+	msize uint32
+	w     sync.Mutex // guards writes on rwc
+
+	// mu guards the fid and tag tables
+	// and the bookkeeping in each Req.
+	mu   sync.Mutex
+	fids map[uint32]*Fid
+	reqs map[uint16]*Req
+}
+
+func (c *conn) write(f *plan9.Fcall) {
+	if c.srv.Chatty {
+		fmt.Fprintf(os.Stderr, "<- %v\n", f)
+	}
+	c.w.Lock()
+	defer c.w.Unlock()
+	if err := plan9.WriteFcall(c.rwc, f); err != nil {
+		// The read loop will notice the broken connection.
+		c.rwc.Close()
+	}
+}
+
+func (c *conn) lookfid(fid uint32) *Fid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fids[fid]
+}
+
+func (c *conn) newfid(fid uint32) (*Fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fid == plan9.NOFID {
+		return nil, ErrUnknownFid
+	}
+	if _, ok := c.fids[fid]; ok {
+		return nil, ErrDupFid
+	}
+	f := &Fid{Fid: fid, Omode: -1, c: c}
+	c.fids[fid] = f
+	return f, nil
+}
+
+func (c *conn) destroy(f *Fid) {
+	if d, ok := c.srv.Handler.(FidDestroyer); ok {
+		d.DestroyFid(f)
+	}
+}
+
+// reset aborts all outstanding requests and clunks all fids.
+// It is called when a new session starts and when the connection closes.
+func (c *conn) reset(keep *Req) {
+	c.mu.Lock()
+	for tag, r := range c.reqs {
+		if r != keep {
+			r.flushed = true
+			delete(c.reqs, tag)
+		}
+	}
+	fids := c.fids
+	c.fids = make(map[uint32]*Fid)
+	c.mu.Unlock()
+	for _, f := range fids {
+		c.destroy(f)
+	}
+}
+
+func (c *conn) hangup() {
+	c.reset(nil)
+	c.rwc.Close()
+}
+
+func (c *conn) dispatch(f *plan9.Fcall) {
+	r := &Req{Ifcall: *f, c: c}
+	c.mu.Lock()
+	if _, ok := c.reqs[f.Tag]; ok {
+		c.mu.Unlock()
+		c.write(&plan9.Fcall{Type: plan9.Rerror, Tag: f.Tag, Ename: string(ErrDupTag)})
+		return
+	}
+	c.reqs[f.Tag] = r
+	c.mu.Unlock()
+
+	h := c.srv.Handler
+	switch f.Type {
+	default:
+		r.Respond(ErrBadFcall)
+
+	case plan9.Tversion:
+		c.version(r)
+
+	case plan9.Tauth:
+		a, ok := h.(Auther)
+		if !ok {
+			r.Respond(ErrNoAuth)
+			return
+		}
+		var err error
+		if r.Afid, err = c.newfid(f.Afid); err != nil {
+			r.Respond(err)
+			return
+		}
+		r.Afid.Uid = f.Uname
+		r.Afid.Qid.Type = plan9.QTAUTH
+		r.Afid.Omode = plan9.ORDWR // auth fids are read and written unopened
+		a.Auth(r)
+
+	case plan9.Tattach:
+		if f.Afid != plan9.NOFID {
+			if r.Afid = c.lookfid(f.Afid); r.Afid == nil {
+				r.Respond(ErrUnknownFid)
+				return
+			}
+		}
+		var err error
+		if r.Fid, err = c.newfid(f.Fid); err != nil {
+			r.Respond(err)
+			return
+		}
+		r.Fid.Uid = f.Uname
+		h.Attach(r)
+
+	case plan9.Tflush:
+		c.mu.Lock()
+		r.Oldreq = c.reqs[f.Oldtag]
+		c.mu.Unlock()
+		if r.Oldreq == nil || r.Oldreq == r {
+			r.Oldreq = nil
+			r.Respond(nil)
+			return
+		}
+		if fl, ok := h.(Flusher); ok {
+			fl.Flush(r)
+			return
+		}
+		c.mu.Lock()
+		if old := r.Oldreq; !old.responded {
+			old.flush = append(old.flush, r)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+		r.Respond(nil)
+
+	case plan9.Twalk:
+		if r.Fid = c.lookfid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		if r.Fid.Omode != -1 {
+			r.Respond(ErrWalkOpen)
+			return
+		}
+		if len(f.Wname) > 0 && r.Fid.Qid.Type&plan9.QTDIR == 0 {
+			r.Respond(ErrNotDir)
+			return
+		}
+		if f.Newfid == f.Fid {
+			r.Newfid = r.Fid
+		} else {
+			var err error
+			if r.Newfid, err = c.newfid(f.Newfid); err != nil {
+				r.Respond(err)
+				return
+			}
+			r.Newfid.Uid = r.Fid.Uid
+			r.Newfid.Qid = r.Fid.Qid
+			r.Newfid.File = r.Fid.File
+		}
+		h.Walk(r)
+
+	case plan9.Topen:
+		if r.Fid = c.lookfid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		if r.Fid.Omode != -1 {
+			r.Respond(ErrOpen)
+			return
+		}
+		if r.Fid.Qid.Type&plan9.QTDIR != 0 && f.Mode&^plan9.ORCLOSE != plan9.OREAD {
+			r.Respond(ErrIsDir)
+			return
+		}
+		r.Ofcall.Qid = r.Fid.Qid
+		h.Open(r)
+
+	case plan9.Tcreate:
+		if r.Fid = c.lookfid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		if r.Fid.Omode != -1 {
+			r.Respond(ErrOpen)
+			return
+		}
+		if r.Fid.Qid.Type&plan9.QTDIR == 0 {
+			r.Respond(Error("create in non-directory"))
+			return
+		}
+		h.Create(r)
+
+	case plan9.Tread:
+		if r.Fid = c.lookfid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		if r.Fid.Omode == -1 {
+			r.Respond(ErrNotOpen)
+			return
+		}
+		if r.Fid.Omode&3 == plan9.OWRITE {
+			r.Respond(ErrPerm)
+			return
+		}
+		if max := r.Msize() - plan9.IOHDRSZ; r.Ifcall.Count > max {
+			r.Ifcall.Count = max
+		}
+		h.Read(r)
+
+	case plan9.Twrite:
+		if r.Fid = c.lookfid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		if r.Fid.Omode == -1 {
+			r.Respond(ErrNotOpen)
+			return
+		}
+		if m := r.Fid.Omode & 3; m != plan9.OWRITE && m != plan9.ORDWR {
+			r.Respond(ErrPerm)
+			return
+		}
+		if max := r.Msize() - plan9.IOHDRSZ; uint32(len(r.Ifcall.Data)) > max {
+			r.Ifcall.Data = r.Ifcall.Data[:max]
+		}
+		h.Write(r)
+
+	case plan9.Tclunk:
+		if r.Fid = c.removefid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		if cl, ok := h.(Clunker); ok {
+			cl.Clunk(r)
+			return
+		}
+		r.Respond(nil)
+
+	case plan9.Tremove:
+		if r.Fid = c.removefid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		h.Remove(r)
+
+	case plan9.Tstat:
+		if r.Fid = c.lookfid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		h.Stat(r)
+
+	case plan9.Twstat:
+		if r.Fid = c.lookfid(f.Fid); r.Fid == nil {
+			r.Respond(ErrUnknownFid)
+			return
+		}
+		d, err := plan9.UnmarshalDir(f.Stat)
+		if err != nil {
+			r.Respond(ErrBadStat)
+			return
+		}
+		r.Dir = *d
+		h.Wstat(r)
+	}
+}
+
+// removefid removes fid from the fid table and returns it.
+// The Handler is told once the request removing it is responded to.
+func (c *conn) removefid(fid uint32) *Fid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.fids[fid]
+	delete(c.fids, fid)
+	return f
+}
+
+// version answers a Tversion, starting a new session.
+//
+// See: version(5)
+func (c *conn) version(r *Req) {
+	f := &r.Ifcall
+	if f.Msize < 256 {
+		r.Respond(Error("version: message size too small"))
+		return
+	}
+	c.reset(r)
+	msize := c.srv.msize()
+	if f.Msize < msize {
+		msize = f.Msize
+	}
+	c.mu.Lock()
+	c.msize = msize
+	c.mu.Unlock()
+	r.Ofcall.Msize = msize
+	r.Ofcall.Version = "unknown"
+	if strings.HasPrefix(f.Version, plan9.VERSION9P) {
+		r.Ofcall.Version = plan9.VERSION9P
+	}
+	r.Respond(nil)
+}
@@ -0,0 +1,246 @@
+package srv_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/srv"
+)
+
+// text is a FileHandler serving an in-memory file.
+type text struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+func (t *text) Read(r *srv.Req) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	srv.ReadBytes(r, t.b)
+	r.Respond(nil)
+}
+
+func (t *text) Write(r *srv.Req) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	off := int(r.Ifcall.Offset)
+	for len(t.b) < off+len(r.Ifcall.Data) {
+		t.b = append(t.b, 0)
+	}
+	copy(t.b[off:], r.Ifcall.Data)
+	r.Ofcall.Count = uint32(len(r.Ifcall.Data))
+	r.Respond(nil)
+}
+
+func newTree(t *testing.T) *srv.Tree {
+	tree := srv.NewTree("glenda", "glenda", 0o555)
+	if _, err := tree.Root.Create("hello", "glenda", 0o666, &text{b: []byte("hello, world\n")}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := tree.Root.Create("sub", "glenda", 0o555|plan9.DMDIR, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Create("secret", "glenda", 0o600, &text{}); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func mount(t *testing.T, h srv.Handler, user string) *client.Fsys {
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, h)
+	conn, err := client.NewConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := conn.Attach(nil, user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return fsys
+}
+
+func TestTree(t *testing.T) {
+	fsys := mount(t, newTree(t), "glenda")
+
+	fid, err := fsys.Open("hello", plan9.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fid.WriteAt([]byte("HELLO"), 0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := fid.ReadAt(buf[:13], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "HELLO, world\n" {
+		t.Errorf("read %q", got)
+	}
+	fid.Close()
+
+	d, err := fsys.Stat("sub/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "secret" || d.Mode != 0o600 {
+		t.Errorf("stat sub/secret = %v", d)
+	}
+	if _, err := fsys.Stat("sub/../hello"); err != nil {
+		t.Errorf("stat sub/../hello: %v", err)
+	}
+	if _, err := fsys.Stat("nonexistent"); err == nil {
+		t.Errorf("stat nonexistent succeeded")
+	}
+
+	fid, err = fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := fid.Dirreadall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "hello" || names[1] != "sub" {
+		t.Errorf("dirread / = %v", names)
+	}
+	fid.Close()
+
+	if _, err := fsys.Open("/", plan9.OWRITE); err == nil {
+		t.Errorf("opened directory for writing")
+	}
+}
+
+func TestTreePerm(t *testing.T) {
+	fsys := mount(t, newTree(t), "other")
+	if _, err := fsys.Open("sub/secret", plan9.OREAD); err == nil {
+		t.Errorf("other opened sub/secret")
+	}
+	if _, err := fsys.Open("hello", plan9.OREAD); err != nil {
+		t.Errorf("open hello: %v", err)
+	}
+}
+
+// blocker is a FileHandler whose reads never finish on their own.
+type blocker struct {
+	reqs chan *srv.Req
+}
+
+func (b *blocker) Read(r *srv.Req)  { b.reqs <- r }
+func (b *blocker) Write(r *srv.Req) { r.Respond(srv.ErrPerm) }
+
+func rpc(t *testing.T, c net.Conn, tx *plan9.Fcall) *plan9.Fcall {
+	t.Helper()
+	if err := plan9.WriteFcall(c, tx); err != nil {
+		t.Fatal(err)
+	}
+	rx, err := plan9.ReadFcall(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rx
+}
+
+func TestFlush(t *testing.T) {
+	b := &blocker{reqs: make(chan *srv.Req, 1)}
+	tree := srv.NewTree("glenda", "glenda", 0o555)
+	tree.Root.Create("block", "glenda", 0o444, b)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go srv.Serve(c1, tree)
+
+	rx := rpc(t, c2, &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 1 << 20, Version: "9P2000.x"})
+	if rx.Type != plan9.Rversion || rx.Version != "9P2000" || rx.Msize != srv.DefaultMsize {
+		t.Fatalf("version: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Tattach, Tag: 1, Fid: 1, Afid: plan9.NOFID, Uname: "glenda"})
+	if rx.Type != plan9.Rattach {
+		t.Fatalf("attach: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Twalk, Tag: 1, Fid: 1, Newfid: 2, Wname: []string{"block"}})
+	if rx.Type != plan9.Rwalk || len(rx.Wqid) != 1 {
+		t.Fatalf("walk: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Topen, Tag: 1, Fid: 2, Mode: plan9.OREAD})
+	if rx.Type != plan9.Ropen {
+		t.Fatalf("open: %v", rx)
+	}
+	rx = rpc(t, c2, &plan9.Fcall{Type: plan9.Twalk, Tag: 1, Fid: 1, Newfid: 2})
+	if rx.Type != plan9.Rerror || rx.Ename != string(srv.ErrDupFid) {
+		t.Fatalf("walk to busy fid: %v", rx)
+	}
+
+	if err := plan9.WriteFcall(c2, &plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 2, Count: 10}); err != nil {
+		t.Fatal(err)
+	}
+	old := <-b.reqs
+
+	// Without a Flusher, the Rflush waits for the old request.
+	if err := plan9.WriteFcall(c2, &plan9.Fcall{Type: plan9.Tflush, Tag: 3, Oldtag: 2}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		old.Ofcall.Data = []byte("late")
+		old.Respond(nil)
+	}()
+	rx, err := plan9.ReadFcall(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rx.Type != plan9.Rread || rx.Tag != 2 || string(rx.Data) != "late" {
+		t.Fatalf("read: %v", rx)
+	}
+	rx, err = plan9.ReadFcall(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rx.Type != plan9.Rflush || rx.Tag != 3 {
+		t.Fatalf("flush: %v", rx)
+	}
+}
+
+// oversized sends a Twrite larger than msize, after a Tversion for msize,
+// to a server whose Serve method is serve, and returns serve's error.
+func oversized(t *testing.T, serve func(io.ReadWriteCloser) error, msize uint32) error {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- serve(c1) }()
+	rx := rpc(t, c2, &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: "9P2000"})
+	if rx.Type != plan9.Rversion || rx.Msize != msize {
+		t.Fatalf("version: %v", rx)
+	}
+	go plan9.WriteFcall(c2, &plan9.Fcall{Type: plan9.Twrite, Tag: 1, Fid: 1, Data: make([]byte, msize)})
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("oversized message not rejected")
+	}
+	return nil
+}
+
+func TestOversized(t *testing.T) {
+	s := &srv.Srv{Handler: newTree(t)}
+	var perr plan9.ProtocolError
+	if err := oversized(t, s.Serve, 1024); !errors.As(err, &perr) {
+		t.Errorf("Serve returned %v, want ProtocolError", err)
+	}
+}
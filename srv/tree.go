@@ -0,0 +1,248 @@
+package srv
+
+import (
+	"sync"
+	"time"
+
+	"bwsd.dev/plan9"
+)
+
+// A FileHandler serves the contents of a plain File in a Tree.
+// Its methods follow the rules for Handler methods.
+type FileHandler interface {
+	Read(r *Req)
+	Write(r *Req)
+}
+
+// A Tree is a Handler serving a synthetic hierarchy of Files.
+//
+// The Tree answers walks, stats and directory reads itself and passes reads
+// and writes of plain files to their FileHandlers. Clients cannot create,
+// remove or change files; the program serving the Tree does that with
+// File.Create and File.Remove.
+type Tree struct {
+	Root *File
+
+	mu   sync.RWMutex // guards the structure of the tree
+	path uint64       // last qid path handed out
+}
+
+// A File is a file or directory in a Tree.
+type File struct {
+	plan9.Dir
+	Handler FileHandler // nil for directories
+	Aux     interface{}
+
+	tree   *Tree
+	parent *File
+	child  []*File
+}
+
+// NewTree returns a Tree whose root directory has the given owner, group and
+// permissions.
+func NewTree(uid, gid string, perm uint32) *Tree {
+	t := new(Tree)
+	t.Root = t.newFile("/", uid, gid, perm|plan9.DMDIR, nil)
+	t.Root.parent = t.Root
+	return t
+}
+
+func (t *Tree) newFile(name, uid, gid string, perm uint32, h FileHandler) *File {
+	now := uint32(time.Now().Unix())
+	t.path++
+	f := &File{
+		Dir: plan9.Dir{
+			Qid:   plan9.Qid{Path: t.path, Type: uint8(perm >> 24)},
+			Mode:  perm,
+			Atime: now,
+			Mtime: now,
+			Name:  name,
+			Uid:   uid,
+			Gid:   gid,
+			Muid:  uid,
+		},
+		Handler: h,
+		tree:    t,
+	}
+	return f
+}
+
+// Create adds a new file named name to the directory f. Files with the DMDIR
+// bit set in perm are directories; all others are served by h.
+func (f *File) Create(name, uid string, perm uint32, h FileHandler) (*File, error) {
+	t := f.tree
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f.Mode&plan9.DMDIR == 0 {
+		return nil, ErrNotDir
+	}
+	if f.parent == nil {
+		return nil, ErrNotFound
+	}
+	for _, c := range f.child {
+		if c.Name == name {
+			return nil, Error("file already exists")
+		}
+	}
+	nf := t.newFile(name, uid, f.Gid, perm, h)
+	nf.parent = f
+	f.child = append(f.child, nf)
+	return nf, nil
+}
+
+// Remove removes f from its directory. Directories must be empty.
+func (f *File) Remove() error {
+	t := f.tree
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := f.parent
+	if p == nil || p == f {
+		return ErrPerm
+	}
+	if len(f.child) > 0 {
+		return Error("directory not empty")
+	}
+	for i, c := range p.child {
+		if c == f {
+			p.child = append(p.child[:i], p.child[i+1:]...)
+			break
+		}
+	}
+	f.parent = nil
+	return nil
+}
+
+// Walk returns the file called name in directory f, or nil.
+func (f *File) Walk(name string) *File {
+	f.tree.mu.RLock()
+	defer f.tree.mu.RUnlock()
+	return f.walk(name)
+}
+
+func (f *File) walk(name string) *File {
+	if name == ".." {
+		return f.parent
+	}
+	for _, c := range f.child {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// hasPerm reports whether user uid may access f in the given way,
+// one of plan9.AREAD, plan9.AWRITE and plan9.AEXEC or a combination.
+func (f *File) hasPerm(uid string, a uint32) bool {
+	m := f.Mode & 7 // other
+	if uid == f.Uid {
+		m |= (f.Mode >> 6) & 7
+	}
+	if uid == f.Gid {
+		m |= (f.Mode >> 3) & 7
+	}
+	return m&a == a
+}
+
+var openPerm = [4]uint32{
+	plan9.OREAD:  plan9.AREAD,
+	plan9.OWRITE: plan9.AWRITE,
+	plan9.ORDWR:  plan9.AREAD | plan9.AWRITE,
+	plan9.OEXEC:  plan9.AEXEC,
+}
+
+func (t *Tree) Attach(r *Req) {
+	r.Fid.File = t.Root
+	r.Ofcall.Qid = t.Root.Qid
+	r.Respond(nil)
+}
+
+func (t *Tree) Walk(r *Req) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f := r.Fid.File
+	var err error
+	for _, name := range r.Ifcall.Wname {
+		if f.Mode&plan9.DMDIR == 0 {
+			err = ErrNotDir
+			break
+		}
+		if !f.hasPerm(r.Fid.Uid, plan9.AEXEC) {
+			err = ErrPerm
+			break
+		}
+		nf := f.walk(name)
+		if nf == nil {
+			err = ErrNotFound
+			break
+		}
+		f = nf
+		r.Ofcall.Wqid = append(r.Ofcall.Wqid, f.Qid)
+	}
+	if len(r.Ofcall.Wqid) == len(r.Ifcall.Wname) {
+		r.Newfid.File = f
+	}
+	r.Respond(err)
+}
+
+func (t *Tree) Open(r *Req) {
+	f := r.Fid.File
+	p := openPerm[r.Ifcall.Mode&3]
+	if r.Ifcall.Mode&plan9.OTRUNC != 0 {
+		p |= plan9.AWRITE
+	}
+	if !f.hasPerm(r.Fid.Uid, p) {
+		r.Respond(ErrPerm)
+		return
+	}
+	r.Respond(nil)
+}
+
+func (t *Tree) Create(r *Req) {
+	r.Respond(ErrPerm)
+}
+
+func (t *Tree) Read(r *Req) {
+	f := r.Fid.File
+	if f.Mode&plan9.DMDIR == 0 {
+		if f.Handler == nil {
+			r.Respond(ErrPerm)
+			return
+		}
+		f.Handler.Read(r)
+		return
+	}
+	t.mu.RLock()
+	child := append([]*File(nil), f.child...)
+	t.mu.RUnlock()
+	r.Respond(DirRead(r, func(i int) (*plan9.Dir, bool) {
+		if i >= len(child) {
+			return nil, false
+		}
+		return &child[i].Dir, true
+	}))
+}
+
+func (t *Tree) Write(r *Req) {
+	f := r.Fid.File
+	if f.Handler == nil {
+		r.Respond(ErrPerm)
+		return
+	}
+	f.Handler.Write(r)
+}
+
+func (t *Tree) Remove(r *Req) {
+	r.Respond(ErrPerm)
+}
+
+func (t *Tree) Stat(r *Req) {
+	t.mu.RLock()
+	r.Dir = r.Fid.File.Dir
+	t.mu.RUnlock()
+	r.Respond(nil)
+}
+
+func (t *Tree) Wstat(r *Req) {
+	r.Respond(ErrPerm)
+}
@@ -0,0 +1,237 @@
+// Package trace records the 9P messages passing over a connection.
+//
+// New wraps the transport of a client or a server. Every message written
+// to or read from the transport is decoded and written to a log, each reply
+// with the time since its request. The arrows in a text trace point the way
+// the messages go between client and server, whichever side is traced:
+//
+//	06:35:35.123456 -> Tread tag 1 fid 2 offset 0 count 8192
+//	06:35:35.123987 <- Rread tag 1 count 5 "hello" 531µs
+//
+// A JSON trace has an object per line. Replies have their latency in
+// nanoseconds, and messages that cannot be decoded have an error instead
+// of a tag and fcall:
+//
+//	{"time":"2026-10-17T06:35:35.123987Z","size":16,"type":"Rread","tag":1,"fcall":"Rread tag 1 count 5 \"hello\"","latency_ns":531000}
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"bwsd.dev/plan9"
+)
+
+// A Format is a way of writing a trace.
+type Format int
+
+const (
+	Text Format = iota // a line of text per message, as printed by Fcall.String
+	JSON               // a JSON object per line
+)
+
+// maxMsg is the largest message the trace will decode. A bigger size
+// means the stream is not 9P, or has lost its framing.
+const maxMsg = 1 << 24
+
+// Options control a trace.
+type Options struct {
+	Format Format
+
+	// Name, if not empty, is written with each message, to tell apart
+	// the connections in a shared trace.
+	Name string
+}
+
+// New returns a transport that behaves like rwc, writing a trace of the
+// messages passing through it to w. Errors writing the trace are ignored.
+// Traces of different connections may share w as long as its Write method
+// writes each line whole; the trace makes one call for each.
+func New(rwc io.ReadWriteCloser, w io.Writer, opts *Options) io.ReadWriteCloser {
+	t := &tracer{w: w, pending: make(map[uint16]request)}
+	if opts != nil {
+		t.format = opts.Format
+		t.name = opts.Name
+	}
+	return &conn{rwc: rwc, t: t}
+}
+
+// A conn is a traced transport.
+type conn struct {
+	rwc     io.ReadWriteCloser
+	t       *tracer
+	in, out stream // messages read, written
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.rwc.Read(b)
+	if n > 0 {
+		c.t.feed(&c.in, b[:n])
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.rwc.Write(b)
+	if n > 0 {
+		c.t.feed(&c.out, b[:n])
+	}
+	return n, err
+}
+
+func (c *conn) Close() error {
+	return c.rwc.Close()
+}
+
+// A stream reassembles the messages going one way.
+type stream struct {
+	buf    []byte // start of an incomplete message
+	broken bool   // framing lost; stop decoding
+}
+
+// A request is a T-message awaiting its reply.
+type request struct {
+	f    *plan9.Fcall
+	time time.Time
+}
+
+// A tracer decodes the messages of a connection and writes the trace.
+type tracer struct {
+	w      io.Writer
+	format Format
+	name   string
+
+	mu      sync.Mutex
+	dialect plan9.Dialect
+	pending map[uint16]request // by tag
+}
+
+// feed adds b to the stream s, tracing the messages it completes.
+func (t *tracer) feed(s *stream, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s.broken {
+		return
+	}
+	s.buf = append(s.buf, b...)
+	for len(s.buf) >= 4 {
+		n := int(s.buf[0]) | int(s.buf[1])<<8 | int(s.buf[2])<<16 | int(s.buf[3])<<24
+		if n < 7 || n > maxMsg {
+			s.broken = true
+			s.buf = nil
+			t.write(&event{time: time.Now(), size: n, err: fmt.Errorf("bad message size %d; trace stopped", n)})
+			return
+		}
+		if len(s.buf) < n {
+			break
+		}
+		t.message(s.buf[:n])
+		s.buf = s.buf[n:]
+	}
+	if len(s.buf) == 0 {
+		s.buf = nil // don't pin a large message
+	}
+}
+
+// message traces the message b.
+func (t *tracer) message(b []byte) {
+	e := &event{time: time.Now(), size: len(b)}
+	f, err := plan9.UnmarshalFcallDialect(b, t.dialect)
+	if err != nil {
+		e.err = err
+		e.typ = b[4]
+		t.write(e)
+		return
+	}
+	e.f = f
+	if f.Type%2 == 0 { // T-message
+		t.pending[f.Tag] = request{f, e.time}
+		t.write(e)
+		return
+	}
+	if r, ok := t.pending[f.Tag]; ok {
+		delete(t.pending, f.Tag)
+		e.req = r.f
+		e.latency = e.time.Sub(r.time)
+		if f.Type == plan9.Rflush && r.f.Type == plan9.Tflush {
+			// The flushed request gets no reply, or has had it.
+			delete(t.pending, r.f.Oldtag)
+		}
+	}
+	if f.Type == plan9.Rversion {
+		t.dialect = plan9.DialectOf(f.Version)
+		// A new session abandons all requests.
+		t.pending = make(map[uint16]request)
+	}
+	t.write(e)
+}
+
+// An event is a traced message.
+type event struct {
+	time    time.Time
+	size    int
+	typ     uint8        // message type, if f is nil
+	f       *plan9.Fcall // nil if the message could not be decoded
+	err     error        // why not
+	req     *plan9.Fcall // for a reply, its request, if seen
+	latency time.Duration
+}
+
+// A jsonEvent is an event as it appears in a JSON trace.
+type jsonEvent struct {
+	Time    time.Time `json:"time"`
+	Conn    string    `json:"conn,omitempty"`
+	Size    int       `json:"size"`
+	Type    string    `json:"type,omitempty"`  // "Tread", "Rerror" and so on
+	Tag     *uint16   `json:"tag,omitempty"`   // absent if the message could not be decoded
+	Fcall   string    `json:"fcall,omitempty"` // the message, as printed by Fcall.String
+	Latency int64     `json:"latency_ns,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (t *tracer) write(e *event) {
+	var line []byte
+	switch t.format {
+	case JSON:
+		j := jsonEvent{Time: e.time, Conn: t.name, Size: e.size, Latency: int64(e.latency)}
+		if e.f != nil {
+			j.Fcall = e.f.String()
+			j.Type, _, _ = strings.Cut(j.Fcall, " ")
+			j.Tag = &e.f.Tag
+		} else if e.typ != 0 {
+			j.Type = fmt.Sprintf("type %d", e.typ)
+		}
+		if e.err != nil {
+			j.Error = e.err.Error()
+		}
+		line, _ = json.Marshal(&j)
+		line = append(line, '\n')
+	default:
+		var b strings.Builder
+		b.WriteString(e.time.Format("15:04:05.000000 "))
+		if t.name != "" {
+			b.WriteString(t.name)
+			b.WriteString(" ")
+		}
+		switch {
+		case e.f == nil && e.typ == 0:
+			fmt.Fprintf(&b, "!! %v", e.err)
+		case e.f == nil:
+			fmt.Fprintf(&b, "!! type %d size %d: %v", e.typ, e.size, e.err)
+		case e.f.Type%2 == 0:
+			fmt.Fprintf(&b, "-> %v", e.f)
+		default:
+			fmt.Fprintf(&b, "<- %v", e.f)
+			if e.req != nil {
+				fmt.Fprintf(&b, " %v", e.latency)
+			}
+		}
+		b.WriteString("\n")
+		line = []byte(b.String())
+	}
+	t.w.Write(line)
+}
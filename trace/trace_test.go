@@ -0,0 +1,187 @@
+package trace_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"bwsd.dev/plan9"
+	"bwsd.dev/plan9/client"
+	"bwsd.dev/plan9/srv"
+	"bwsd.dev/plan9/trace"
+)
+
+type helloFile struct{}
+
+func (helloFile) Read(r *srv.Req) {
+	srv.ReadString(r, "hello")
+	r.Respond(nil)
+}
+
+func (helloFile) Write(r *srv.Req) { r.Respond(srv.ErrPerm) }
+
+// syncBuffer is a bytes.Buffer safe for the trace's concurrent writes.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// session runs a short client session over a traced connection.
+func session(t *testing.T, opts *trace.Options) string {
+	tree := srv.NewTree("glenda", "glenda", 0o555)
+	tree.Root.Create("hello", "glenda", 0o444, helloFile{})
+	c1, c2 := net.Pipe()
+	go srv.Serve(c1, tree)
+	var log syncBuffer
+	conn, err := client.NewConn(trace.New(c2, &log, opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Open("hello", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := fid.ReadAt(buf[:5], 0); err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+	if _, err := fsys.Open("missing", plan9.OREAD); err == nil {
+		t.Fatal("opened missing file")
+	}
+	conn.Close()
+	return log.String()
+}
+
+func TestText(t *testing.T) {
+	out := session(t, nil)
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			t.Fatalf("bad line %q", line)
+		}
+		msgs = append(msgs, f[1]+" "+f[2])
+		if f[1] == "<-" && !strings.HasSuffix(f[len(f)-1], "s") {
+			t.Errorf("reply without latency: %q", line)
+		}
+	}
+	want := []string{
+		"-> Tversion", "<- Rversion",
+		"-> Tattach", "<- Rattach",
+		"-> Twalk", "<- Rwalk",
+		"-> Topen", "<- Ropen",
+		"-> Tread", "<- Rread",
+		"-> Tclunk", "<- Rclunk",
+		"-> Twalk", "<- Rerror",
+	}
+	if strings.Join(msgs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("trace:\n%s\nwant messages:\n%s", out, strings.Join(want, "\n"))
+	}
+	if !strings.Contains(out, "<- Rread tag ") || !strings.Contains(out, `"hello"`) {
+		t.Errorf("trace lacks data read:\n%s", out)
+	}
+}
+
+type jsonEvent struct {
+	Conn    string
+	Size    int
+	Type    string
+	Tag     *uint16
+	Fcall   string
+	Latency int64 `json:"latency_ns"`
+	Error   string
+}
+
+func TestJSON(t *testing.T) {
+	out := session(t, &trace.Options{Format: trace.JSON, Name: "c1"})
+	sc := bufio.NewScanner(strings.NewReader(out))
+	pending := make(map[uint16]string)
+	n := 0
+	for sc.Scan() {
+		var e jsonEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%v: %s", err, sc.Text())
+		}
+		n++
+		if e.Conn != "c1" || e.Tag == nil || e.Size < 7 || !strings.HasPrefix(e.Fcall, e.Type+" ") {
+			t.Errorf("bad event %s", sc.Text())
+			continue
+		}
+		if e.Type[0] == 'T' {
+			pending[*e.Tag] = e.Type
+			continue
+		}
+		req, ok := pending[*e.Tag]
+		if !ok {
+			t.Errorf("reply without request: %s", sc.Text())
+		}
+		if e.Type != "Rerror" && e.Type[1:] != req[1:] {
+			t.Errorf("%s answered by %s", req, e.Type)
+		}
+		if e.Latency <= 0 {
+			t.Errorf("no latency: %s", sc.Text())
+		}
+		delete(pending, *e.Tag)
+	}
+	if n != 14 || len(pending) != 0 {
+		t.Errorf("%d events, %d unanswered:\n%s", n, len(pending), out)
+	}
+}
+
+// bufRWC is a transport reading from r and writing to a buffer.
+type bufRWC struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (b *bufRWC) Read(p []byte) (int, error)  { return b.r.Read(p) }
+func (b *bufRWC) Write(p []byte) (int, error) { return b.w.Write(p) }
+func (b *bufRWC) Close() error                { return nil }
+
+func TestFraming(t *testing.T) {
+	tx := &plan9.Fcall{Type: plan9.Tread, Tag: 3, Fid: 1, Offset: 10, Count: 20}
+	rx := &plan9.Fcall{Type: plan9.Rread, Tag: 3, Data: []byte("data")}
+	tb, _ := tx.Bytes()
+	rb, _ := rx.Bytes()
+
+	var log bytes.Buffer
+	c := trace.New(&bufRWC{r: bytes.NewReader(rb)}, &log, nil)
+	// A byte at a time.
+	for i := range tb {
+		c.Write(tb[i : i+1])
+	}
+	io.Copy(io.Discard, iotest.OneByteReader(c))
+	if got := log.String(); !strings.Contains(got, "-> "+tx.String()) || !strings.Contains(got, "<- "+rx.String()) {
+		t.Errorf("trace:\n%s", got)
+	}
+
+	log.Reset()
+	c = trace.New(&bufRWC{r: strings.NewReader("\xff\xff\xff\xffjunk")}, &log, nil)
+	io.Copy(io.Discard, c)
+	if got := log.String(); !strings.Contains(got, "bad message size") {
+		t.Errorf("trace of junk:\n%s", got)
+	}
+}